@@ -0,0 +1,43 @@
+// Command htfs-chaos-proxy sits between htfs (or anything else) and a real
+// URL, and injects latency, throttling, connection resets, and server
+// errors at configurable rates, to reproduce field conditions against
+// production CDNs:
+//
+//	htfs-chaos-proxy -target https://cdn.example.org -latency 200ms -reset-rate 0.05
+//
+// Requests to the proxy are forwarded to the target, with the same path,
+// query, and headers (Range included). Absolute-form requests, as sent to
+// an HTTP proxy, are forwarded to the URL they name, so the proxy can also
+// be used as HTTP_PROXY for cleartext URLs.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+)
+
+func main() {
+	settings := Settings{}
+	listen := flag.String("listen", "127.0.0.1:8080", "address to listen on")
+	flag.StringVar(&settings.Target, "target", "", "base URL requests are forwarded to, like https://cdn.example.org")
+	flag.DurationVar(&settings.Latency, "latency", 0, "delay before forwarding each request")
+	flag.DurationVar(&settings.Jitter, "jitter", 0, "random extra delay, up to that much")
+	flag.Int64Var(&settings.BytesPerSecond, "throttle", 0, "bandwidth limit per response, in bytes per second (0 for none)")
+	flag.Float64Var(&settings.ResetRate, "reset-rate", 0, "fraction of responses whose connection is reset partway through the body")
+	flag.Float64Var(&settings.ErrorRate, "error-rate", 0, "fraction of requests answered with a 5xx instead of being forwarded")
+	flag.Int64Var(&settings.Seed, "seed", 0, "random seed, for reproducible runs (0 picks one)")
+	flag.Parse()
+
+	if settings.Seed == 0 {
+		settings.Seed = time.Now().UnixNano()
+	}
+	proxy, err := NewProxy(settings)
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+
+	log.Printf("Listening on %s (seed %d)", *listen, settings.Seed)
+	log.Fatal(http.ListenAndServe(*listen, proxy))
+}
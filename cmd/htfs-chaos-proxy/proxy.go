@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Settings controls which faults a Proxy injects, and how often
+type Settings struct {
+	// Target is the base URL requests are forwarded to. It can be empty
+	// if all requests are absolute-form, like with HTTP_PROXY.
+	Target string
+	// Latency is added before forwarding each request, plus up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// BytesPerSecond limits each response body, zero means no limit
+	BytesPerSecond int64
+	// ResetRate is the fraction of responses, from 0 to 1, whose
+	// connection is reset at a random point in the body
+	ResetRate float64
+	// ErrorRate is the fraction of requests, from 0 to 1, answered
+	// with a 500, 502, or 503 instead of being forwarded
+	ErrorRate float64
+	// Seed makes fault decisions reproducible
+	Seed int64
+	// Client forwards requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// Stats counts what a Proxy did
+type Stats struct {
+	Requests int64
+	Errors   int64
+	Resets   int64
+	Bytes    int64
+}
+
+// Proxy is an http.Handler that forwards requests and injects faults
+type Proxy struct {
+	settings Settings
+	target   *url.URL
+
+	randMutex sync.Mutex
+	rand      *rand.Rand
+
+	stats Stats
+}
+
+var _ http.Handler = (*Proxy)(nil)
+
+// NewProxy returns a Proxy for settings
+func NewProxy(settings Settings) (*Proxy, error) {
+	p := &Proxy{
+		settings: settings,
+		rand:     rand.New(rand.NewSource(settings.Seed)),
+	}
+	if settings.Target != "" {
+		target, err := url.Parse(settings.Target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing target")
+		}
+		if target.Scheme != "http" && target.Scheme != "https" {
+			return nil, errors.Errorf("unsupported target scheme %q", target.Scheme)
+		}
+		p.target = target
+	}
+	if p.settings.Client == nil {
+		p.settings.Client = http.DefaultClient
+	}
+	return p, nil
+}
+
+// Stats returns what the proxy did so far
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		Requests: atomic.LoadInt64(&p.stats.Requests),
+		Errors:   atomic.LoadInt64(&p.stats.Errors),
+		Resets:   atomic.LoadInt64(&p.stats.Resets),
+		Bytes:    atomic.LoadInt64(&p.stats.Bytes),
+	}
+}
+
+func (p *Proxy) float64() float64 {
+	p.randMutex.Lock()
+	defer p.randMutex.Unlock()
+	return p.rand.Float64()
+}
+
+// upstreamURL returns where req should be forwarded to
+func (p *Proxy) upstreamURL(req *http.Request) (*url.URL, error) {
+	if req.URL.IsAbs() {
+		return req.URL, nil
+	}
+	if p.target == nil {
+		return nil, errors.Errorf("no target, and %s isn't an absolute URL", req.URL)
+	}
+	u := *p.target
+	u.Path = strings.TrimSuffix(p.target.Path, "/") + req.URL.Path
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	return &u, nil
+}
+
+// hopHeaders aren't forwarded, see RFC 7230, section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := atomic.AddInt64(&p.stats.Requests, 1)
+
+	delay := p.settings.Latency
+	if p.settings.Jitter > 0 {
+		delay += time.Duration(p.float64() * float64(p.settings.Jitter))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if p.float64() < p.settings.ErrorRate {
+		atomic.AddInt64(&p.stats.Errors, 1)
+		codes := []int{500, 502, 503}
+		code := codes[int(p.float64()*float64(len(codes)))%len(codes)]
+		log.Printf("[%d] %s %s: injecting HTTP %d", id, req.Method, req.URL, code)
+		http.Error(w, fmt.Sprintf("injected by htfs-chaos-proxy (request %d)", id), code)
+		return
+	}
+
+	u, err := p.upstreamURL(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upReq, err := http.NewRequest(req.Method, u.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upReq = upReq.WithContext(req.Context())
+	for key, values := range req.Header {
+		upReq.Header[key] = values
+	}
+	for _, key := range hopHeaders {
+		upReq.Header.Del(key)
+	}
+
+	res, err := p.settings.Client.Do(upReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	for key, values := range res.Header {
+		w.Header()[key] = values
+	}
+	for _, key := range hopHeaders {
+		w.Header().Del(key)
+	}
+	w.WriteHeader(res.StatusCode)
+
+	resetAfter := int64(-1)
+	if p.float64() < p.settings.ResetRate {
+		// somewhere in the body if we know its length, early on otherwise
+		length := res.ContentLength
+		if length <= 0 {
+			length = 64 * 1024
+		}
+		resetAfter = int64(p.float64() * float64(length))
+	}
+
+	written, err := p.copyBody(w, res.Body, resetAfter)
+	atomic.AddInt64(&p.stats.Bytes, written)
+	if err == errReset {
+		atomic.AddInt64(&p.stats.Resets, 1)
+		log.Printf("[%d] %s %s: resetting after %d bytes", id, req.Method, req.URL, written)
+		reset(w)
+	}
+}
+
+var errReset = errors.New("reset")
+
+// copyBody copies body to w, throttled, and stops with errReset
+// after resetAfter bytes if it's not negative.
+func (p *Proxy) copyBody(w http.ResponseWriter, body io.Reader, resetAfter int64) (int64, error) {
+	chunkSize := int64(32 * 1024)
+	if bps := p.settings.BytesPerSecond; bps > 0 && bps/10 < chunkSize {
+		// about ten writes a second
+		chunkSize = bps/10 + 1
+	}
+	buf := make([]byte, chunkSize)
+	flusher, _ := w.(http.Flusher)
+
+	var written int64
+	start := time.Now()
+	for {
+		chunk := buf
+		if resetAfter >= 0 && resetAfter-written < int64(len(chunk)) {
+			chunk = chunk[:resetAfter-written]
+		}
+		n, err := body.Read(chunk)
+		if n > 0 {
+			if _, werr := w.Write(chunk[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if resetAfter >= 0 && written >= resetAfter {
+			return written, errReset
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+
+		if bps := p.settings.BytesPerSecond; bps > 0 {
+			expected := time.Duration(float64(written) / float64(bps) * float64(time.Second))
+			if elapsed := time.Since(start); elapsed < expected {
+				time.Sleep(expected - elapsed)
+			}
+		}
+	}
+}
+
+// reset closes the client's connection abruptly, with a TCP RST
+// when possible, like a flaky middlebox would.
+func reset(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		// HTTP/2: the best we can do is abort the stream
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
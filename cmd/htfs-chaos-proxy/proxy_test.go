@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Proxy(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("chaos "), 100000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewProxy(Settings{
+		Target:    upstream.URL + "/files",
+		ResetRate: 0.3,
+		ErrorRate: 0.3,
+		Seed:      42,
+	})
+	assert.NoError(err)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	// htfs gets through it all, with retries
+	f, err := htfs.Open(func() (string, error) { return server.URL + "/data.bin", nil },
+		func(res *http.Response, body []byte) bool { return false },
+		&htfs.Settings{
+			RetrySettings: &retrycontext.Settings{MaxTries: 20, NoSleep: true},
+		})
+	assert.NoError(err)
+	read, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.True(bytes.Equal(data, read))
+	assert.NoError(f.Close())
+
+	stats := proxy.Stats()
+	assert.True(stats.Errors > 0, "injected errors")
+	assert.True(stats.Resets > 0, "injected resets")
+}
+
+func Test_ProxyThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 20*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewProxy(Settings{
+		Target:         upstream.URL,
+		BytesPerSecond: 100 * 1024,
+		Latency:        50 * time.Millisecond,
+	})
+	assert.NoError(err)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	start := time.Now()
+	res, err := http.Get(server.URL)
+	assert.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.Len(body, len(data))
+	// 50ms of latency, and 200ms worth of bytes
+	assert.True(time.Since(start) >= 200*time.Millisecond, "took %s", time.Since(start))
+}
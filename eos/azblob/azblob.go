@@ -0,0 +1,326 @@
+// Package azblob implements the 'azblob://account/container/blob' scheme
+// for eos, reading Azure blobs with ranged Get Blob requests.
+//
+// Requests are authorized with a SAS token, either given or generated
+// on demand from the account key. Reads of the live blob are pinned to
+// the ETag of the first response, so a blob overwritten mid-read fails
+// with 412 instead of mixing contents; snapshots are immutable anyway.
+package azblob
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+)
+
+// DefaultExpiry is how long generated SAS tokens are valid for.
+// They're renewed transparently when they expire.
+const DefaultExpiry = 15 * time.Minute
+
+// sasVersion is the storage service version generated SAS tokens use,
+// and requests ask for. It's the first one with blob versions.
+const sasVersion = "2019-12-12"
+
+// Handler is an eos handler for the 'azblob' scheme
+type Handler struct {
+	// Key is the base64-encoded storage account key used to generate
+	// SAS tokens. Defaults to $AZURE_STORAGE_KEY.
+	Key string
+
+	// SASToken is a pre-generated SAS token, used as-is when Key is
+	// empty. Defaults to $AZURE_STORAGE_SAS_TOKEN. If neither is set,
+	// requests are anonymous, which works for public containers.
+	SASToken string
+
+	// Endpoint, if set, is the base URL of the account, like
+	// "http://127.0.0.1:10000/devstoreaccount1". Defaults to
+	// $AZURE_STORAGE_BLOB_ENDPOINT, then https://<account>.blob.core.windows.net
+	Endpoint string
+
+	// Expiry is how long generated SAS tokens are valid for, see DefaultExpiry
+	Expiry time.Duration
+
+	// now is overridden by tests
+	now func() time.Time
+}
+
+// NewHandler returns a Handler configured from the environment
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Scheme is part of the eos.Handler interface
+func (h *Handler) Scheme() string {
+	return "azblob"
+}
+
+type blobRef struct {
+	account   string
+	container string
+	blob      string
+	snapshot  string
+	versionID string
+}
+
+func parseURL(u *url.URL) (blobRef, error) {
+	tokens := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if u.Host == "" || len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return blobRef{}, errors.Errorf("azblob: invalid URL %q, expected azblob://account/container/blob", u.String())
+	}
+	q := u.Query()
+	return blobRef{
+		account:   u.Host,
+		container: tokens[0],
+		blob:      tokens[1],
+		snapshot:  q.Get("snapshot"),
+		versionID: q.Get("versionid"),
+	}, nil
+}
+
+// MakeResource is part of the eos.Handler interface. 'snapshot' and
+// 'versionid' query parameters select an immutable blob snapshot or
+// version.
+func (h *Handler) MakeResource(u *url.URL) (htfs.GetURLFunc, htfs.NeedsRenewalFunc, error) {
+	ref, err := parseURL(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	getURL := func() (string, error) {
+		return h.blobURL(ref), nil
+	}
+	return getURL, h.needsRenewal, nil
+}
+
+// ConfigureSettings is part of the eos.SettingsConfigurer interface:
+// it pins reads of live blobs to the ETag they had on first access.
+func (h *Handler) ConfigureSettings(u *url.URL, s *htfs.Settings) error {
+	ref, err := parseURL(u)
+	if err != nil {
+		return err
+	}
+
+	header := make(http.Header)
+	for k, v := range s.Header {
+		header[k] = v
+	}
+	if header.Get("x-ms-version") == "" {
+		header.Set("x-ms-version", sasVersion)
+	}
+	s.Header = header
+
+	if ref.snapshot != "" || ref.versionID != "" {
+		return nil
+	}
+
+	base := s.Client
+	if base == nil {
+		base = http.DefaultClient
+	}
+	client := *base
+	client.Transport = &etagTransport{base: base.Transport}
+	s.Client = &client
+	return nil
+}
+
+// needsRenewal returns true when a generated SAS token has expired
+func (h *Handler) needsRenewal(res *http.Response, body []byte) bool {
+	if h.key() == "" || res.StatusCode != 403 {
+		return false
+	}
+	return bytes.Contains(body, []byte("<Code>AuthenticationFailed</Code>"))
+}
+
+func (h *Handler) key() string {
+	if h.Key != "" {
+		return h.Key
+	}
+	return os.Getenv("AZURE_STORAGE_KEY")
+}
+
+func (h *Handler) sasToken() string {
+	if h.SASToken != "" {
+		return strings.TrimPrefix(h.SASToken, "?")
+	}
+	return strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+}
+
+func (h *Handler) endpoint(account string) string {
+	for _, e := range []string{h.Endpoint, os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT")} {
+		if e != "" {
+			return strings.TrimSuffix(e, "/")
+		}
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net", account)
+}
+
+func (h *Handler) blobURL(ref blobRef) string {
+	blobPath := url.PathEscape(ref.container) + "/" + strings.Replace(url.PathEscape(ref.blob), "%2F", "/", -1)
+	res := h.endpoint(ref.account) + "/" + blobPath
+
+	var params []string
+	if ref.snapshot != "" {
+		params = append(params, "snapshot="+url.QueryEscape(ref.snapshot))
+	}
+	if ref.versionID != "" {
+		params = append(params, "versionid="+url.QueryEscape(ref.versionID))
+	}
+	if key := h.key(); key != "" {
+		params = append(params, h.signSAS(key, ref))
+	} else if sas := h.sasToken(); sas != "" {
+		params = append(params, sas)
+	}
+
+	if len(params) > 0 {
+		res += "?" + strings.Join(params, "&")
+	}
+	return res
+}
+
+// signSAS returns a read-only service SAS for a blob, see
+// https://docs.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (h *Handler) signSAS(key string, ref blobRef) string {
+	now := time.Now
+	if h.now != nil {
+		now = h.now
+	}
+	expiry := h.Expiry
+	if expiry <= 0 {
+		expiry = DefaultExpiry
+	}
+	t := now().UTC()
+	// allow for some clock skew
+	start := t.Add(-5 * time.Minute).Format(time.RFC3339)
+	end := t.Add(expiry).Format(time.RFC3339)
+
+	// signedSnapshotTime holds version IDs too
+	resource, snapshotTime := "b", ""
+	if ref.snapshot != "" {
+		resource, snapshotTime = "bs", ref.snapshot
+	} else if ref.versionID != "" {
+		resource, snapshotTime = "bv", ref.versionID
+	}
+
+	stringToSign := strings.Join([]string{
+		"r",   // signedPermissions
+		start, // signedStart
+		end,   // signedExpiry
+		"/blob/" + ref.account + "/" + ref.container + "/" + ref.blob,
+		"", // signedIdentifier
+		"", // signedIP
+		"", // signedProtocol
+		sasVersion,
+		resource,
+		snapshotTime,
+		"", "", "", "", "", // response header overrides
+	}, "\n")
+
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		// let the service reject it rather than failing early
+		decodedKey = []byte(key)
+	}
+	mac := hmac.New(sha256.New, decodedKey)
+	mac.Write([]byte(stringToSign))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	q := url.Values{
+		"sv":  {sasVersion},
+		"sr":  {resource},
+		"sp":  {"r"},
+		"st":  {start},
+		"se":  {end},
+		"sig": {sig},
+	}
+	return q.Encode()
+}
+
+// etagTransport sends If-Match with the ETag of the first successful
+// response, so that later ranges come from the same blob.
+type etagTransport struct {
+	base http.RoundTripper
+
+	mu   sync.Mutex
+	etag string
+}
+
+func (et *etagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := et.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	et.mu.Lock()
+	etag := et.etag
+	et.mu.Unlock()
+
+	if etag != "" {
+		// RoundTrippers must not modify the request
+		req2 := new(http.Request)
+		*req2 = *req
+		req2.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			req2.Header[k] = v
+		}
+		req2.Header.Set("If-Match", etag)
+		req = req2
+	}
+
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if etag == "" && res.StatusCode/100 == 2 {
+		et.mu.Lock()
+		if et.etag == "" {
+			et.etag = res.Header.Get("ETag")
+		}
+		et.mu.Unlock()
+	}
+	return res, nil
+}
+
+// Properties are the blob properties returned with Get Blob responses
+type Properties struct {
+	ETag         string
+	BlobType     string
+	VersionID    string
+	SnapshotTime string
+	// Metadata holds x-ms-meta-* headers, keyed by lower-case name
+	Metadata map[string]string
+}
+
+// GetProperties extracts blob properties from an opened file's
+// response headers
+func GetProperties(f *htfs.File) Properties {
+	return parseProperties(f.GetHeader())
+}
+
+func parseProperties(header http.Header) Properties {
+	props := Properties{
+		ETag:         header.Get("ETag"),
+		BlobType:     header.Get("x-ms-blob-type"),
+		VersionID:    header.Get("x-ms-version-id"),
+		SnapshotTime: header.Get("x-ms-snapshot"),
+		Metadata:     make(map[string]string),
+	}
+	const prefix = "x-ms-meta-"
+	for k, v := range header {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, prefix) && len(v) > 0 {
+			props.Metadata[strings.TrimPrefix(lower, prefix)] = v[0]
+		}
+	}
+	return props
+}
@@ -0,0 +1,154 @@
+package azblob
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OpenPinned(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	data := bytes.Repeat([]byte("version one "), 1000)
+	etag := `"0x1"`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Equal("/devstoreaccount1/builds/some/blob.bin", r.URL.Path)
+		assert.Equal(sasVersion, r.Header.Get("x-ms-version"))
+		assert.Equal("sv=1&sig=abc", r.URL.RawQuery)
+
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			w.WriteHeader(412)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("x-ms-blob-type", "BlockBlob")
+		w.Header().Set("x-ms-meta-Channel", "windows-64")
+		http.ServeContent(w, r, "blob.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	h := &Handler{
+		SASToken: "?sv=1&sig=abc",
+		Endpoint: server.URL + "/devstoreaccount1",
+	}
+	u, err := url.Parse("azblob://devstoreaccount1/builds/some/blob.bin")
+	assert.NoError(err)
+	getURL, needsRenewal, err := h.MakeResource(u)
+	assert.NoError(err)
+	settings := &htfs.Settings{NoReadAhead: true}
+	assert.NoError(h.ConfigureSettings(u, settings))
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	props := GetProperties(f)
+	assert.Equal(`"0x1"`, props.ETag)
+	assert.Equal("BlockBlob", props.BlobType)
+	assert.Equal(map[string]string{"channel": "windows-64"}, props.Metadata)
+
+	buf := make([]byte, 100)
+	_, err = f.ReadAt(buf, 120)
+	assert.NoError(err)
+	assert.Equal(data[120:220], buf)
+
+	// the blob is overwritten, we don't read the new one
+	mu.Lock()
+	data = bytes.Repeat([]byte("version two "), 1000)
+	etag = `"0x2"`
+	mu.Unlock()
+	_, err = f.ReadAt(buf, 2400)
+	assert.Error(err)
+}
+
+func Test_SignSAS(t *testing.T) {
+	assert := assert.New(t)
+
+	key := base64.StdEncoding.EncodeToString([]byte("not a real account key"))
+	h := &Handler{
+		Key: key,
+		now: func() time.Time {
+			return time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+		},
+	}
+
+	u, err := url.Parse("azblob://myaccount/builds/dir/blob.bin?snapshot=2020-02-29T10:00:00.0000000Z")
+	assert.NoError(err)
+	getURL, needsRenewal, err := h.MakeResource(u)
+	assert.NoError(err)
+
+	signed, err := getURL()
+	assert.NoError(err)
+	su, err := url.Parse(signed)
+	assert.NoError(err)
+	assert.Equal("myaccount.blob.core.windows.net", su.Host)
+	assert.Equal("/builds/dir/blob.bin", su.Path)
+
+	q := su.Query()
+	assert.Equal("2020-02-29T10:00:00.0000000Z", q.Get("snapshot"))
+	assert.Equal("bs", q.Get("sr"))
+	assert.Equal("r", q.Get("sp"))
+	assert.Equal("2020-03-01T11:55:00Z", q.Get("st"))
+	assert.Equal("2020-03-01T12:15:00Z", q.Get("se"))
+
+	stringToSign := strings.Join([]string{
+		"r", "2020-03-01T11:55:00Z", "2020-03-01T12:15:00Z",
+		"/blob/myaccount/builds/dir/blob.bin",
+		"", "", "", sasVersion, "bs", "2020-02-29T10:00:00.0000000Z",
+		"", "", "", "", "",
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte("not a real account key"))
+	mac.Write([]byte(stringToSign))
+	assert.Equal(base64.StdEncoding.EncodeToString(mac.Sum(nil)), q.Get("sig"))
+
+	u, err = url.Parse("azblob://myaccount/builds/dir/blob.bin?versionid=2020-02-29T11:00:00.0000000Z")
+	assert.NoError(err)
+	getURL, _, err = h.MakeResource(u)
+	assert.NoError(err)
+	signed, err = getURL()
+	assert.NoError(err)
+	su, err = url.Parse(signed)
+	assert.NoError(err)
+	q = su.Query()
+	assert.Equal("2020-02-29T11:00:00.0000000Z", q.Get("versionid"))
+	assert.Equal("bv", q.Get("sr"))
+	assert.Equal(sasVersion, q.Get("sv"))
+
+	stringToSign = strings.Join([]string{
+		"r", "2020-03-01T11:55:00Z", "2020-03-01T12:15:00Z",
+		"/blob/myaccount/builds/dir/blob.bin",
+		"", "", "", sasVersion, "bv", "2020-02-29T11:00:00.0000000Z",
+		"", "", "", "", "",
+	}, "\n")
+	mac = hmac.New(sha256.New, []byte("not a real account key"))
+	mac.Write([]byte(stringToSign))
+	assert.Equal(base64.StdEncoding.EncodeToString(mac.Sum(nil)), q.Get("sig"))
+
+	expired := []byte("<Error><Code>AuthenticationFailed</Code><AuthenticationErrorDetail>Signed expiry time has to be after signed start time</AuthenticationErrorDetail></Error>")
+	assert.True(needsRenewal(&http.Response{StatusCode: 403}, expired))
+	assert.False(needsRenewal(&http.Response{StatusCode: 404}, expired))
+
+	for _, bad := range []string{"azblob://myaccount/builds", "azblob:///builds/blob", "azblob://myaccount//blob"} {
+		u, err := url.Parse(bad)
+		assert.NoError(err)
+		_, _, err = h.MakeResource(u)
+		assert.Error(err, fmt.Sprintf("%s should be rejected", bad))
+	}
+}
@@ -11,7 +11,12 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/itchio/httpkit/eos/azblob"
+	"github.com/itchio/httpkit/eos/gs"
+	"github.com/itchio/httpkit/eos/ipfs"
 	"github.com/itchio/httpkit/eos/option"
+	"github.com/itchio/httpkit/eos/s3"
+	"github.com/itchio/httpkit/eos/sftp"
 	"github.com/itchio/httpkit/htfs"
 	"github.com/itchio/httpkit/retrycontext"
 	"github.com/pkg/errors"
@@ -34,8 +39,22 @@ type Handler interface {
 	MakeResource(u *url.URL) (htfs.GetURLFunc, htfs.NeedsRenewalFunc, error)
 }
 
+// SettingsConfigurer can be implemented by handlers that need to adjust
+// how their resources are fetched, e.g. to authenticate requests.
+type SettingsConfigurer interface {
+	ConfigureSettings(u *url.URL, s *htfs.Settings) error
+}
+
 var handlers = make(map[string]Handler)
 
+// builtinHandlers are used for schemes no handler was registered for
+var builtinHandlers = map[string]Handler{
+	"azblob": azblob.NewHandler(),
+	"gs":     gs.NewHandler(),
+	"ipfs":   ipfs.NewHandler(),
+	"s3":     s3.NewHandler(),
+}
+
 func RegisterHandler(h Handler) error {
 	scheme := h.Scheme()
 
@@ -132,7 +151,7 @@ func realOpen(name string, opts ...option.Option) (File, error) {
 	}
 
 	switch u.Scheme {
-	case "http", "https":
+	case "http", "https", "data":
 		res := &simpleHTTPResource{name}
 		hf, err := htfs.Open(res.GetURL, res.NeedsRenewal, htfsSettings())
 
@@ -141,8 +160,23 @@ func realOpen(name string, opts ...option.Option) (File, error) {
 		}
 
 		return hf, nil
+	case "sftp":
+		sf, err := sftp.Open(u, &sftp.Settings{
+			RetrySettings: &retrycontext.Settings{
+				MaxTries: settings.MaxTries,
+				Consumer: settings.Consumer,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return sf, nil
 	default:
 		handler := handlers[u.Scheme]
+		if handler == nil {
+			handler = builtinHandlers[u.Scheme]
+		}
 		if handler == nil {
 			return os.Open(name)
 		}
@@ -152,7 +186,15 @@ func realOpen(name string, opts ...option.Option) (File, error) {
 			return nil, errors.WithStack(err)
 		}
 
-		hf, err := htfs.Open(getURL, needsRenewal, htfsSettings())
+		hs := htfsSettings()
+		if sc, ok := handler.(SettingsConfigurer); ok {
+			err = sc.ConfigureSettings(u, hs)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+
+		hf, err := htfs.Open(getURL, needsRenewal, hs)
 
 		if err != nil {
 			return nil, err
@@ -0,0 +1,221 @@
+// Package gs implements the 'gs://bucket/object' scheme for eos, reading
+// Google Cloud Storage objects through the JSON API with OAuth2 bearer
+// tokens. Reads are pinned to a single object generation, so that an
+// object overwritten mid-read fails loudly instead of mixing contents.
+package gs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+)
+
+// DefaultEndpoint is the Cloud Storage API endpoint
+const DefaultEndpoint = "https://storage.googleapis.com"
+
+// metadataClient is used for object metadata requests
+var metadataClient = &http.Client{Timeout: 30 * time.Second}
+
+// Handler is an eos handler for the 'gs' scheme
+type Handler struct {
+	// Tokens provides OAuth2 access tokens. Defaults to DefaultTokens().
+	Tokens TokenSource
+
+	// Endpoint is the base URL of the API. Defaults to
+	// $STORAGE_EMULATOR_HOST, then DefaultEndpoint.
+	Endpoint string
+}
+
+// NewHandler returns a Handler configured from the environment
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Scheme is part of the eos.Handler interface
+func (h *Handler) Scheme() string {
+	return "gs"
+}
+
+// MakeResource is part of the eos.Handler interface. The URL's host is
+// the bucket, and its path the object name. A generation can be pinned
+// with a fragment ('gs://bucket/object#1234', like gsutil) or a
+// 'generation' query parameter; otherwise the live generation is
+// looked up on first use and pinned from then on.
+func (h *Handler) MakeResource(u *url.URL) (htfs.GetURLFunc, htfs.NeedsRenewalFunc, error) {
+	bucket := u.Host
+	object := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, nil, errors.Errorf("gs: invalid URL %q, expected gs://bucket/object", u.String())
+	}
+
+	generation := u.Fragment
+	if generation == "" {
+		generation = u.Query().Get("generation")
+	}
+	if generation != "" {
+		if _, err := strconv.ParseInt(generation, 10, 64); err != nil {
+			return nil, nil, errors.Errorf("gs: invalid generation %q", generation)
+		}
+	}
+
+	r := &resource{
+		h:          h,
+		objectURL:  h.endpoint() + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object),
+		generation: generation,
+	}
+	return r.GetURL, r.NeedsRenewal, nil
+}
+
+// ConfigureSettings is part of the eos.SettingsConfigurer interface:
+// it makes requests to the endpoint carry a bearer token.
+func (h *Handler) ConfigureSettings(u *url.URL, s *htfs.Settings) error {
+	endpoint, err := url.Parse(h.endpoint())
+	if err != nil {
+		return errors.Wrap(err, "gs: invalid endpoint")
+	}
+
+	base := s.Client
+	if base == nil {
+		base = http.DefaultClient
+	}
+	client := *base
+	client.Transport = &authTransport{
+		base:   base.Transport,
+		host:   endpoint.Host,
+		tokens: h.tokens(),
+	}
+	s.Client = &client
+	return nil
+}
+
+func (h *Handler) tokens() TokenSource {
+	if h.Tokens != nil {
+		return h.Tokens
+	}
+	return DefaultTokens()
+}
+
+func (h *Handler) endpoint() string {
+	if h.Endpoint != "" {
+		return strings.TrimSuffix(h.Endpoint, "/")
+	}
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		return strings.TrimSuffix(emulator, "/")
+	}
+	return DefaultEndpoint
+}
+
+type resource struct {
+	h         *Handler
+	objectURL string
+
+	mu         sync.Mutex
+	generation string
+}
+
+// GetURL returns the media URL of the pinned generation
+func (r *resource) GetURL() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.generation == "" {
+		generation, err := r.fetchGeneration()
+		if err != nil {
+			return "", err
+		}
+		r.generation = generation
+	}
+	return r.objectURL + "?alt=media&generation=" + r.generation, nil
+}
+
+func (r *resource) fetchGeneration() (string, error) {
+	req, err := http.NewRequest("GET", r.objectURL+"?fields=generation", nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	token, err := r.h.tokens().Token()
+	if err != nil {
+		return "", errors.Wrap(err, "gs: while getting token")
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	res, err := metadataClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "gs: while getting object metadata")
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "gs: while getting object metadata")
+	}
+	if res.StatusCode != 200 {
+		return "", errors.Errorf("gs: while getting object metadata: HTTP %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var meta struct {
+		Generation string `json:"generation"`
+	}
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return "", errors.Wrap(err, "gs: while parsing object metadata")
+	}
+	if meta.Generation == "" {
+		return "", errors.New("gs: object metadata has no generation")
+	}
+	return meta.Generation, nil
+}
+
+// NeedsRenewal returns true when the token was rejected, after making
+// sure the next request gets a fresh one.
+func (r *resource) NeedsRenewal(res *http.Response, body []byte) bool {
+	if res.StatusCode != 401 {
+		return false
+	}
+	if inv, ok := r.h.tokens().(interface{ Invalidate() }); ok {
+		inv.Invalidate()
+	}
+	return true
+}
+
+// authTransport adds a bearer token to requests bound for host
+type authTransport struct {
+	base   http.RoundTripper
+	host   string
+	tokens TokenSource
+}
+
+func (at *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := at.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if req.URL.Host != at.host {
+		return base.RoundTrip(req)
+	}
+
+	token, err := at.tokens.Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "gs: while getting token")
+	}
+	// RoundTrippers must not modify the request
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		req2.Header[k] = v
+	}
+	req2.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	return base.RoundTrip(req2)
+}
@@ -0,0 +1,214 @@
+package gs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGCS serves a single object, that can be overwritten
+type fakeGCS struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	data       []byte
+	generation int64
+	token      string
+}
+
+func newFakeGCS(data []byte) *fakeGCS {
+	fg := &fakeGCS{data: data, generation: 1000, token: "token-1"}
+	fg.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fg.mu.Lock()
+		defer fg.mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer "+fg.token {
+			w.WriteHeader(401)
+			return
+		}
+		if r.URL.EscapedPath() != "/storage/v1/b/bucket/o/some%2Fobject" {
+			w.WriteHeader(404)
+			return
+		}
+
+		q := r.URL.Query()
+		if q.Get("alt") != "media" {
+			fmt.Fprintf(w, `{"generation":"%d"}`, fg.generation)
+			return
+		}
+		if q.Get("generation") != fmt.Sprintf("%d", fg.generation) {
+			w.WriteHeader(404)
+			return
+		}
+		http.ServeContent(w, r, "object", time.Time{}, bytes.NewReader(fg.data))
+	}))
+	return fg
+}
+
+func (fg *fakeGCS) set(f func()) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	f()
+}
+
+func Test_OpenPinned(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("generation one "), 1000)
+	fg := newFakeGCS(data)
+	defer fg.Close()
+
+	fetches := 0
+	tokens := &Chain{Sources: []TokenSource{TokenFunc(func() (Token, error) {
+		fetches++
+		return Token{AccessToken: fmt.Sprintf("token-%d", fetches), Expiry: time.Now().Add(time.Hour)}, nil
+	})}}
+	h := &Handler{Tokens: tokens, Endpoint: fg.URL}
+
+	u, err := url.Parse("gs://bucket/some/object")
+	assert.NoError(err)
+	getURL, needsRenewal, err := h.MakeResource(u)
+	assert.NoError(err)
+	settings := &htfs.Settings{NoReadAhead: true}
+	assert.NoError(h.ConfigureSettings(u, settings))
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	buf := make([]byte, 100)
+	_, err = f.ReadAt(buf, 150)
+	assert.NoError(err)
+	assert.Equal(data[150:250], buf)
+
+	// the server rotates tokens, ours gets refreshed
+	fg.set(func() { fg.token = "token-2" })
+	_, err = f.ReadAt(buf, 1500)
+	assert.NoError(err)
+	assert.Equal(data[1500:1600], buf)
+	assert.Equal(2, fetches)
+
+	// the object is overwritten, we don't read the new one
+	fg.set(func() {
+		fg.data = bytes.Repeat([]byte("generation two "), 1000)
+		fg.generation++
+	})
+	_, err = f.ReadAt(buf, 3000)
+	assert.Error(err)
+
+	// unless asked to
+	u, err = url.Parse("gs://bucket/some/object#1001")
+	assert.NoError(err)
+	getURL, _, err = h.MakeResource(u)
+	assert.NoError(err)
+	pinned, err := getURL()
+	assert.NoError(err)
+	assert.True(strings.HasSuffix(pinned, "generation=1001"))
+
+	u, err = url.Parse("gs://bucket/some/object#latest")
+	assert.NoError(err)
+	_, _, err = h.MakeResource(u)
+	assert.Error(err)
+}
+
+func Test_ApplicationCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(err)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(r.ParseForm())
+		switch r.Form.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:jwt-bearer":
+			parts := strings.Split(r.Form.Get("assertion"), ".")
+			assert.Len(parts, 3)
+			sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+			assert.NoError(err)
+			sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			assert.NoError(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig))
+
+			claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+			assert.NoError(err)
+			var claims map[string]interface{}
+			assert.NoError(json.Unmarshal(claimsJSON, &claims))
+			assert.Equal("robot@example.iam.gserviceaccount.com", claims["iss"])
+			assert.Equal(Scope, claims["scope"])
+			fmt.Fprint(w, `{"access_token":"sa-token","expires_in":3600}`)
+		case "refresh_token":
+			assert.Equal("refresh", r.Form.Get("refresh_token"))
+			fmt.Fprint(w, `{"access_token":"user-token","expires_in":3600}`)
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gs-creds")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+	write := func(cf credentialsFile) {
+		contents, err := json.Marshal(map[string]string{
+			"type":          cf.Type,
+			"client_email":  cf.ClientEmail,
+			"private_key":   cf.PrivateKey,
+			"token_uri":     server.URL,
+			"client_id":     cf.ClientID,
+			"client_secret": cf.ClientSecret,
+			"refresh_token": cf.RefreshToken,
+		})
+		assert.NoError(err)
+		path := filepath.Join(dir, cf.Type+".json")
+		assert.NoError(ioutil.WriteFile(path, contents, 0644))
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+	}
+
+	write(credentialsFile{
+		Type:        "service_account",
+		ClientEmail: "robot@example.iam.gserviceaccount.com",
+		PrivateKey:  string(pemKey),
+	})
+	token, err := ApplicationCredentialsToken()
+	assert.NoError(err)
+	assert.Equal("sa-token", token.AccessToken)
+	assert.True(token.Expiry.After(time.Now().Add(time.Minute)))
+
+	write(credentialsFile{
+		Type:         "authorized_user",
+		ClientID:     "id",
+		ClientSecret: "secret",
+		RefreshToken: "refresh",
+	})
+	token, err = ApplicationCredentialsToken()
+	assert.NoError(err)
+	assert.Equal("user-token", token.AccessToken)
+
+	write(credentialsFile{Type: "external_account"})
+	_, err = ApplicationCredentialsToken()
+	assert.Error(err)
+}
@@ -0,0 +1,311 @@
+package gs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Scope is the OAuth2 scope tokens are requested for
+const Scope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// A Token is an OAuth2 access token
+type Token struct {
+	AccessToken string
+	// Expiry is zero for tokens whose lifetime is unknown
+	Expiry time.Time
+}
+
+// A TokenSource returns access tokens, refreshing them as needed.
+// It must be safe for concurrent use.
+type TokenSource interface {
+	Token() (Token, error)
+}
+
+// TokenFunc adapts a function to the TokenSource interface
+type TokenFunc func() (Token, error)
+
+// Token is part of the TokenSource interface
+func (tf TokenFunc) Token() (Token, error) {
+	return tf()
+}
+
+// StaticToken returns a source that always returns accessToken
+func StaticToken(accessToken string) TokenSource {
+	return TokenFunc(func() (Token, error) {
+		return Token{AccessToken: accessToken}, nil
+	})
+}
+
+// expiryWindow is how long before their expiry tokens are refreshed
+const expiryWindow = 2 * time.Minute
+
+// tokenClient is used for requests to token endpoints
+var tokenClient = &http.Client{Timeout: 10 * time.Second}
+
+// Chain tries sources in order, and caches the first token obtained
+// until it's about to expire, or is invalidated.
+type Chain struct {
+	Sources []TokenSource
+
+	mu     sync.Mutex
+	cached *Token
+}
+
+var _ TokenSource = (*Chain)(nil)
+
+var defaultChain = &Chain{
+	Sources: []TokenSource{
+		TokenFunc(EnvToken),
+		TokenFunc(ApplicationCredentialsToken),
+		TokenFunc(MetadataToken),
+	},
+}
+
+// DefaultTokens returns the standard chain: $GOOGLE_OAUTH_ACCESS_TOKEN,
+// application default credentials (service account or gcloud user
+// credentials), then the GCE metadata server.
+func DefaultTokens() TokenSource {
+	return defaultChain
+}
+
+// Token is part of the TokenSource interface
+func (c *Chain) Token() (Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached != nil {
+		exp := c.cached.Expiry
+		if exp.IsZero() || time.Now().Add(expiryWindow).Before(exp) {
+			return *c.cached, nil
+		}
+		c.cached = nil
+	}
+
+	var errs []string
+	for _, s := range c.Sources {
+		token, err := s.Token()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		c.cached = &token
+		return token, nil
+	}
+	return Token{}, errors.Errorf("no Google credentials found (%s)", strings.Join(errs, "; "))
+}
+
+// Invalidate forgets the cached token, for when it was rejected
+func (c *Chain) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cached = nil
+}
+
+// EnvToken reads $GOOGLE_OAUTH_ACCESS_TOKEN
+func EnvToken() (Token, error) {
+	accessToken := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if accessToken == "" {
+		return Token{}, errors.New("env: GOOGLE_OAUTH_ACCESS_TOKEN not set")
+	}
+	return Token{AccessToken: accessToken}, nil
+}
+
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// ApplicationCredentialsToken exchanges the credentials in
+// $GOOGLE_APPLICATION_CREDENTIALS, or gcloud's well-known
+// application_default_credentials.json, for an access token.
+func ApplicationCredentialsToken() (Token, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		configDir := os.Getenv("CLOUDSDK_CONFIG")
+		if configDir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return Token{}, errors.Wrap(err, "application credentials")
+			}
+			configDir = filepath.Join(home, ".config", "gcloud")
+		}
+		path = filepath.Join(configDir, "application_default_credentials.json")
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "application credentials")
+	}
+	var cf credentialsFile
+	if err := json.Unmarshal(contents, &cf); err != nil {
+		return Token{}, errors.Wrapf(err, "application credentials: parsing %s", path)
+	}
+
+	var form url.Values
+	tokenURI := cf.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	switch cf.Type {
+	case "service_account":
+		assertion, err := signJWT(cf, tokenURI, time.Now())
+		if err != nil {
+			return Token{}, errors.Wrap(err, "application credentials")
+		}
+		form = url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+	case "authorized_user":
+		form = url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {cf.ClientID},
+			"client_secret": {cf.ClientSecret},
+			"refresh_token": {cf.RefreshToken},
+		}
+	default:
+		return Token{}, errors.Errorf("application credentials: unsupported type %q in %s", cf.Type, path)
+	}
+
+	req, err := http.NewRequest("POST", tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Token{}, errors.Wrap(err, "application credentials")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	token, err := fetchToken(req)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "application credentials")
+	}
+	return token, nil
+}
+
+// signJWT returns a self-signed assertion for the service account
+// token exchange, see https://developers.google.com/identity/protocols/oauth2/service-account
+func signJWT(cf credentialsFile, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(cf.PrivateKey))
+	if block == nil {
+		return "", errors.New("no PEM block in private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", errors.Wrap(err, "while parsing private key")
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private key is not an RSA key")
+	}
+
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": cf.PrivateKeyID,
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   cf.ClientEmail,
+		"scope": Scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	enc := base64.RawURLEncoding
+	payload := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return payload + "." + enc.EncodeToString(sig), nil
+}
+
+// metadataHost is the GCE metadata server
+var metadataHost = "http://metadata.google.internal"
+
+// MetadataToken fetches the default service account's token from the
+// GCE metadata server
+func MetadataToken() (Token, error) {
+	host := metadataHost
+	if env := os.Getenv("GCE_METADATA_HOST"); env != "" {
+		host = "http://" + env
+	}
+
+	req, err := http.NewRequest("GET", host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "metadata")
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	token, err := fetchToken(req)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "metadata")
+	}
+	return token, nil
+}
+
+func fetchToken(req *http.Request) (Token, error) {
+	res, err := tokenClient.Do(req)
+	if err != nil {
+		return Token{}, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return Token{}, errors.WithStack(err)
+	}
+	if res.StatusCode != 200 {
+		return Token{}, errors.Errorf("HTTP %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Token{}, errors.WithStack(err)
+	}
+	if payload.AccessToken == "" {
+		return Token{}, errors.New("no access token in response")
+	}
+
+	token := Token{AccessToken: payload.AccessToken}
+	if payload.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(payload.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
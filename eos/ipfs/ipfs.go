@@ -0,0 +1,271 @@
+// Package ipfs implements the 'ipfs://CID/path' scheme for eos, by
+// reading content through HTTP gateways. Requests fail over to the next
+// gateway on network errors, server errors, or responses whose ranges
+// don't match what was asked for.
+package ipfs
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+)
+
+// DefaultGateways are used when neither Handler.Gateways nor
+// $IPFS_GATEWAYS are set
+var DefaultGateways = []string{
+	"https://ipfs.io",
+	"https://dweb.link",
+	"https://cloudflare-ipfs.com",
+}
+
+// Handler is an eos handler for the 'ipfs' scheme
+type Handler struct {
+	// Gateways are the base URLs of the gateways to use, in order of
+	// preference, like "https://ipfs.io", or "https://example.org/gw"
+	// for one that serves "/gw/ipfs/CID". Defaults to the comma-separated
+	// $IPFS_GATEWAYS, then DefaultGateways.
+	Gateways []string
+}
+
+// NewHandler returns a Handler configured from the environment
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Scheme is part of the eos.Handler interface
+func (h *Handler) Scheme() string {
+	return "ipfs"
+}
+
+func (h *Handler) gateways() []string {
+	gateways := h.Gateways
+	if len(gateways) == 0 {
+		if env := os.Getenv("IPFS_GATEWAYS"); env != "" {
+			gateways = strings.Split(env, ",")
+		} else {
+			gateways = DefaultGateways
+		}
+	}
+
+	var res []string
+	for _, g := range gateways {
+		if g = strings.TrimSuffix(strings.TrimSpace(g), "/"); g != "" {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+func contentPath(u *url.URL) (string, error) {
+	if u.Host == "" {
+		return "", errors.Errorf("ipfs: invalid URL %q, expected ipfs://CID/path", u.String())
+	}
+	return "/ipfs/" + u.Host + u.EscapedPath(), nil
+}
+
+// MakeResource is part of the eos.Handler interface. The URL points to
+// the first gateway, ConfigureSettings takes care of failing over.
+func (h *Handler) MakeResource(u *url.URL) (htfs.GetURLFunc, htfs.NeedsRenewalFunc, error) {
+	path, err := contentPath(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	gateways := h.gateways()
+	if len(gateways) == 0 {
+		return nil, nil, errors.New("ipfs: no gateways configured")
+	}
+
+	getURL := func() (string, error) {
+		return gateways[0] + path, nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+	return getURL, needsRenewal, nil
+}
+
+// ConfigureSettings is part of the eos.SettingsConfigurer interface:
+// it makes requests fail over between gateways.
+func (h *Handler) ConfigureSettings(u *url.URL, s *htfs.Settings) error {
+	gateways := h.gateways()
+	var parsed []*url.URL
+	for _, g := range gateways {
+		gu, err := url.Parse(g)
+		if err != nil {
+			return errors.Wrapf(err, "ipfs: invalid gateway %q", g)
+		}
+		parsed = append(parsed, gu)
+	}
+
+	base := s.Client
+	if base == nil {
+		base = http.DefaultClient
+	}
+	client := *base
+	client.Transport = &gatewayTransport{
+		base:     base.Transport,
+		gateways: parsed,
+	}
+	s.Client = &client
+	return nil
+}
+
+// gatewayTransport sends requests to the last gateway that worked,
+// trying the others in turn when it doesn't.
+type gatewayTransport struct {
+	base     http.RoundTripper
+	gateways []*url.URL
+
+	mu      sync.Mutex
+	current int
+}
+
+func (gt *gatewayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := gt.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	content, ok := gt.contentPath(req.URL)
+	if !ok || req.Body != nil {
+		return base.RoundTrip(req)
+	}
+
+	gt.mu.Lock()
+	start := gt.current
+	gt.mu.Unlock()
+
+	n := len(gt.gateways)
+	var lastErr error
+	for attempt := 0; attempt < n; attempt++ {
+		index := (start + attempt) % n
+		gateway := gt.gateways[index]
+
+		// RoundTrippers must not modify the request
+		req2 := new(http.Request)
+		*req2 = *req
+		u := *req.URL
+		u.Scheme = gateway.Scheme
+		u.Host = gateway.Host
+		u.RawPath = gateway.EscapedPath() + content
+		path, err := url.PathUnescape(u.RawPath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		u.Path = path
+		req2.URL = &u
+		req2.Host = ""
+
+		res, err := base.RoundTrip(req2)
+		last := attempt == n-1
+		if err == nil {
+			err = checkResponse(req2, res)
+			// let htfs see the last gateway's error status, but
+			// never a bad range
+			if err == nil || (last && isServerFailure(res)) {
+				gt.mu.Lock()
+				gt.current = index
+				gt.mu.Unlock()
+				return res, nil
+			}
+			res.Body.Close()
+		}
+		lastErr = err
+
+		if req.Context().Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// contentPath returns the escaped "/ipfs/CID/path" part of u, past the
+// path of the gateway it's on, if any, and false if it's not IPFS content.
+func (gt *gatewayTransport) contentPath(u *url.URL) (string, bool) {
+	p := u.EscapedPath()
+	for _, gateway := range gt.gateways {
+		prefix := gateway.EscapedPath()
+		if gateway.Host == u.Host && strings.HasPrefix(p, prefix+"/ipfs/") {
+			return p[len(prefix):], true
+		}
+	}
+	if strings.HasPrefix(p, "/ipfs/") {
+		return p, true
+	}
+	return "", false
+}
+
+// checkResponse returns an error if a gateway failed, or served
+// a range other than the one requested.
+func checkResponse(req *http.Request, res *http.Response) error {
+	if isServerFailure(res) {
+		return errors.Errorf("ipfs: gateway %s returned HTTP %d", req.URL.Host, res.StatusCode)
+	}
+
+	if res.StatusCode != 206 || strings.HasPrefix(res.Header.Get("content-type"), "multipart/") {
+		return nil
+	}
+	start, end, ok := parseRange(req.Header.Get("range"))
+	if !ok {
+		return nil
+	}
+
+	var gotStart, gotEnd, total int64
+	_, err := fmt.Sscanf(res.Header.Get("content-range"), "bytes %d-%d/", &gotStart, &gotEnd)
+	if err != nil {
+		return errors.Errorf("ipfs: gateway %s sent invalid Content-Range %q", req.URL.Host, res.Header.Get("content-range"))
+	}
+	if tokens := strings.SplitN(res.Header.Get("content-range"), "/", 2); len(tokens) == 2 {
+		total, _ = strconv.ParseInt(tokens[1], 10, 64)
+	}
+
+	wantEnd := end
+	if wantEnd < 0 || (total > 0 && wantEnd >= total) {
+		if total > 0 {
+			wantEnd = total - 1
+		} else {
+			wantEnd = gotEnd
+		}
+	}
+	if gotStart != start || gotEnd != wantEnd {
+		return errors.Errorf("ipfs: gateway %s sent bytes %d-%d, asked for %d-%d", req.URL.Host, gotStart, gotEnd, start, wantEnd)
+	}
+	if res.ContentLength >= 0 && res.ContentLength != gotEnd-gotStart+1 {
+		return errors.Errorf("ipfs: gateway %s sent %d bytes for range %d-%d", req.URL.Host, res.ContentLength, gotStart, gotEnd)
+	}
+	return nil
+}
+
+func isServerFailure(res *http.Response) bool {
+	return res.StatusCode >= 500 || res.StatusCode == 429
+}
+
+// parseRange parses a single 'bytes=start-end' range. end is -1 when open.
+func parseRange(header string) (int64, int64, bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	tokens := strings.SplitN(spec, "-", 2)
+	if len(tokens) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if tokens[1] == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,148 @@
+package ipfs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_GatewayFailover(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("content-addressed "), 2000)
+	const path = "/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi/builds/game.zip"
+
+	// went away
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	// serves the wrong bytes for ranges
+	var sloppyHits int64
+	sloppy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&sloppyHits, 1)
+		if r.Header.Get("range") == "" {
+			http.ServeContent(w, r, "game.zip", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		w.Header().Set("content-range", fmt.Sprintf("bytes 0-99/%d", len(data)))
+		w.WriteHeader(206)
+		w.Write(data[:100])
+	}))
+	defer sloppy.Close()
+
+	var goodHits int64
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&goodHits, 1)
+		assert.Equal(path, r.URL.Path)
+		http.ServeContent(w, r, "game.zip", time.Time{}, bytes.NewReader(data))
+	}))
+	defer good.Close()
+
+	h := &Handler{Gateways: []string{down.URL, sloppy.URL + "/", good.URL}}
+	u, err := url.Parse("ipfs://bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi/builds/game.zip")
+	assert.NoError(err)
+	getURL, needsRenewal, err := h.MakeResource(u)
+	assert.NoError(err)
+	settings := &htfs.Settings{
+		NoReadAhead:   true,
+		RetrySettings: &retrycontext.Settings{MaxTries: 2, NoSleep: true},
+	}
+	assert.NoError(h.ConfigureSettings(u, settings))
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	stats, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(data), stats.Size())
+
+	buf := make([]byte, 500)
+	_, err = f.ReadAt(buf, 10000)
+	assert.NoError(err)
+	assert.Equal(data[10000:10500], buf)
+
+	// the good gateway is remembered
+	sloppyBefore := atomic.LoadInt64(&sloppyHits)
+	goodBefore := atomic.LoadInt64(&goodHits)
+	_, err = f.ReadAt(buf, 20000)
+	assert.NoError(err)
+	assert.Equal(data[20000:20500], buf)
+	assert.Equal(sloppyBefore, atomic.LoadInt64(&sloppyHits))
+	assert.Equal(goodBefore+1, atomic.LoadInt64(&goodHits))
+
+	u, err = url.Parse("ipfs:///nope")
+	assert.NoError(err)
+	_, _, err = h.MakeResource(u)
+	assert.Error(err)
+}
+
+func Test_GatewayPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("behind a prefix "), 2000)
+	const path = "/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi/builds/game%20v2.zip"
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	var hits int64
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		assert.Equal("/gateways/dweb"+path, r.URL.EscapedPath())
+		http.ServeContent(w, r, "game.zip", time.Time{}, bytes.NewReader(data))
+	}))
+	defer good.Close()
+
+	h := &Handler{Gateways: []string{down.URL + "/gw/", good.URL + "/gateways/dweb"}}
+	u, err := url.Parse("ipfs://bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi/builds/game%20v2.zip")
+	assert.NoError(err)
+	getURL, needsRenewal, err := h.MakeResource(u)
+	assert.NoError(err)
+	first, err := getURL()
+	assert.NoError(err)
+	assert.Equal(down.URL+"/gw"+path, first)
+
+	settings := &htfs.Settings{
+		NoReadAhead:   true,
+		RetrySettings: &retrycontext.Settings{MaxTries: 2, NoSleep: true},
+	}
+	assert.NoError(h.ConfigureSettings(u, settings))
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	buf := make([]byte, 500)
+	_, err = f.ReadAt(buf, 10000)
+	assert.NoError(err)
+	assert.Equal(data[10000:10500], buf)
+	assert.True(atomic.LoadInt64(&hits) > 0)
+}
+
+func Test_ParseRange(t *testing.T) {
+	assert := assert.New(t)
+
+	start, end, ok := parseRange("bytes=100-199")
+	assert.True(ok)
+	assert.EqualValues(100, start)
+	assert.EqualValues(199, end)
+
+	start, end, ok = parseRange("bytes=100-")
+	assert.True(ok)
+	assert.EqualValues(100, start)
+	assert.EqualValues(-1, end)
+
+	_, _, ok = parseRange("bytes=0-1,5-6")
+	assert.False(ok)
+	_, _, ok = parseRange("")
+	assert.False(ok)
+}
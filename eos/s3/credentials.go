@@ -0,0 +1,307 @@
+package s3
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Credentials are an AWS access key, and, for temporary credentials,
+// a session token and expiration time.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expiration is zero for credentials that don't expire
+	Expiration time.Time
+}
+
+// A CredentialsProvider returns credentials, refreshing them as needed.
+// It must be safe for concurrent use.
+type CredentialsProvider interface {
+	Retrieve() (Credentials, error)
+}
+
+// CredentialsFunc adapts a function to the CredentialsProvider interface
+type CredentialsFunc func() (Credentials, error)
+
+// Retrieve is part of the CredentialsProvider interface
+func (cf CredentialsFunc) Retrieve() (Credentials, error) {
+	return cf()
+}
+
+// StaticCredentials returns a provider that always returns creds
+func StaticCredentials(creds Credentials) CredentialsProvider {
+	return CredentialsFunc(func() (Credentials, error) {
+		return creds, nil
+	})
+}
+
+// expiryWindow is how long before their expiration temporary credentials
+// are refreshed, so that signed URLs don't outlive them by much.
+const expiryWindow = 5 * time.Minute
+
+// metadataTimeout bounds requests to the ECS and EC2 metadata services,
+// which are unreachable outside of AWS.
+const metadataTimeout = 2 * time.Second
+
+// Chain tries providers in order, and caches the first credentials
+// obtained until they're about to expire.
+type Chain struct {
+	Providers []CredentialsProvider
+
+	mu     sync.Mutex
+	cached *Credentials
+}
+
+var _ CredentialsProvider = (*Chain)(nil)
+
+var defaultChain = &Chain{
+	Providers: []CredentialsProvider{
+		CredentialsFunc(EnvCredentials),
+		CredentialsFunc(SharedCredentials),
+		CredentialsFunc(ContainerCredentials),
+		CredentialsFunc(InstanceCredentials),
+	},
+}
+
+// DefaultCredentials returns the standard chain: environment variables,
+// the shared credentials file, the ECS container endpoint, then the EC2
+// instance metadata service.
+func DefaultCredentials() CredentialsProvider {
+	return defaultChain
+}
+
+// Retrieve is part of the CredentialsProvider interface
+func (c *Chain) Retrieve() (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached != nil {
+		exp := c.cached.Expiration
+		if exp.IsZero() || time.Now().Add(expiryWindow).Before(exp) {
+			return *c.cached, nil
+		}
+		c.cached = nil
+	}
+
+	var errs []string
+	for _, p := range c.Providers {
+		creds, err := p.Retrieve()
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		c.cached = &creds
+		return creds, nil
+	}
+	return Credentials{}, errors.Errorf("no AWS credentials found (%s)", strings.Join(errs, "; "))
+}
+
+// EnvCredentials reads $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY,
+// and $AWS_SESSION_TOKEN
+func EnvCredentials() (Credentials, error) {
+	creds := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, errors.New("env: AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY not set")
+	}
+	return creds, nil
+}
+
+// SharedCredentials reads the $AWS_PROFILE (or 'default') profile of
+// $AWS_SHARED_CREDENTIALS_FILE (or ~/.aws/credentials)
+func SharedCredentials() (Credentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, errors.Wrap(err, "shared file")
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "shared file")
+	}
+	defer f.Close()
+
+	var creds Credentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		tokens := strings.SplitN(line, "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(tokens[1])
+		switch strings.ToLower(strings.TrimSpace(tokens[0])) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, errors.Wrap(err, "shared file")
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, errors.Errorf("shared file: no credentials for profile %q in %s", profile, path)
+	}
+	return creds, nil
+}
+
+// containerHost is the ECS task metadata endpoint
+var containerHost = "http://169.254.170.2"
+
+// ContainerCredentials fetches an ECS task role's credentials, when
+// $AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or $AWS_CONTAINER_CREDENTIALS_FULL_URI is set
+func ContainerCredentials() (Credentials, error) {
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		url = containerHost + rel
+	}
+	if url == "" {
+		return Credentials{}, errors.New("container: not running in ECS")
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "container")
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	creds, err := fetchJSONCredentials(req)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "container")
+	}
+	return creds, nil
+}
+
+// instanceHost is the EC2 instance metadata service
+var instanceHost = "http://169.254.169.254"
+
+// InstanceCredentials fetches an EC2 instance profile's credentials,
+// using IMDSv2
+func InstanceCredentials() (Credentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return Credentials{}, errors.New("instance: metadata service disabled")
+	}
+
+	client := &http.Client{Timeout: metadataTimeout}
+
+	req, err := http.NewRequest("PUT", instanceHost+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "instance")
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := fetchString(client, req)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "instance: while getting token")
+	}
+
+	const credsPath = "/latest/meta-data/iam/security-credentials/"
+	req, err = http.NewRequest("GET", instanceHost+credsPath, nil)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "instance")
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	role, err := fetchString(client, req)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "instance: while getting role")
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+
+	req, err = http.NewRequest("GET", instanceHost+credsPath+role, nil)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "instance")
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	creds, err := fetchJSONCredentials(req)
+	if err != nil {
+		return Credentials{}, errors.Wrap(err, "instance")
+	}
+	return creds, nil
+}
+
+func fetchString(client *http.Client, req *http.Request) (string, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if res.StatusCode != 200 {
+		return "", errors.Errorf("HTTP %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+func fetchJSONCredentials(req *http.Request) (Credentials, error) {
+	body, err := fetchString(&http.Client{Timeout: metadataTimeout}, req)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var payload struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+		Expiration      string `json:"Expiration"`
+	}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return Credentials{}, errors.WithStack(err)
+	}
+	if payload.AccessKeyID == "" {
+		return Credentials{}, errors.New("no credentials in response")
+	}
+
+	creds := Credentials{
+		AccessKeyID:     payload.AccessKeyID,
+		SecretAccessKey: payload.SecretAccessKey,
+		SessionToken:    payload.Token,
+	}
+	if payload.Expiration != "" {
+		creds.Expiration, err = time.Parse(time.RFC3339, payload.Expiration)
+		if err != nil {
+			return Credentials{}, errors.WithStack(err)
+		}
+	}
+	return creds, nil
+}
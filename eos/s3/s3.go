@@ -0,0 +1,241 @@
+// Package s3 implements the 's3://bucket/key' scheme for eos, by signing
+// short-lived GetObject URLs on demand (AWS Signature Version 4), so that
+// htfs can renew them whenever they expire, instead of callers having to
+// hand out pre-signed URLs that may expire mid-download.
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+)
+
+// DefaultExpiry is how long signed URLs are valid for. They're
+// renewed transparently when they expire.
+const DefaultExpiry = 15 * time.Minute
+
+// Handler is an eos handler for the 's3' scheme
+type Handler struct {
+	// Credentials provides AWS credentials. Defaults to DefaultCredentials().
+	Credentials CredentialsProvider
+
+	// Region is the region buckets are in. Defaults to $AWS_REGION,
+	// $AWS_DEFAULT_REGION, then "us-east-1". It can be overridden
+	// per URL with a 'region' query parameter.
+	Region string
+
+	// Endpoint, if set, is the base URL of an S3-compatible service,
+	// like "http://localhost:9000". Buckets are then addressed
+	// path-style. Defaults to $AWS_ENDPOINT_URL_S3, or $AWS_ENDPOINT_URL.
+	Endpoint string
+
+	// Expiry is how long signed URLs are valid for, see DefaultExpiry
+	Expiry time.Duration
+
+	// now is overridden by tests
+	now func() time.Time
+}
+
+// NewHandler returns a Handler configured from the environment
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// Scheme is part of the eos.Handler interface
+func (h *Handler) Scheme() string {
+	return "s3"
+}
+
+// MakeResource is part of the eos.Handler interface. The URL's host is
+// the bucket, and its path the key. 'versionId' and 'region' query
+// parameters are honored.
+func (h *Handler) MakeResource(u *url.URL) (htfs.GetURLFunc, htfs.NeedsRenewalFunc, error) {
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, nil, errors.Errorf("s3: invalid URL %q, expected s3://bucket/key", u.String())
+	}
+
+	query := u.Query()
+	region := query.Get("region")
+	if region == "" {
+		region = h.region()
+	}
+
+	getURL := func() (string, error) {
+		creds, err := h.credentials().Retrieve()
+		if err != nil {
+			return "", errors.Wrap(err, "s3: while getting credentials")
+		}
+		return h.presign(creds, region, bucket, key, query.Get("versionId")), nil
+	}
+	return getURL, needsRenewal, nil
+}
+
+// needsRenewal returns true for expired signatures and session tokens
+func needsRenewal(res *http.Response, body []byte) bool {
+	if res.StatusCode != 400 && res.StatusCode != 403 {
+		return false
+	}
+	return bytes.Contains(body, []byte("Request has expired")) ||
+		bytes.Contains(body, []byte("<Code>ExpiredToken</Code>"))
+}
+
+func (h *Handler) credentials() CredentialsProvider {
+	if h.Credentials != nil {
+		return h.Credentials
+	}
+	return DefaultCredentials()
+}
+
+func (h *Handler) region() string {
+	for _, r := range []string{h.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+func (h *Handler) endpoint() string {
+	for _, e := range []string{h.Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")} {
+		if e != "" {
+			return strings.TrimSuffix(e, "/")
+		}
+	}
+	return ""
+}
+
+// objectURL returns the scheme, host, and path of an object
+func (h *Handler) objectURL(region string, bucket string, key string) (scheme string, host string, path string) {
+	if endpoint := h.endpoint(); endpoint != "" {
+		scheme, host = "https", endpoint
+		if tokens := strings.SplitN(endpoint, "://", 2); len(tokens) == 2 {
+			scheme, host = tokens[0], tokens[1]
+		}
+		return scheme, host, "/" + bucket + "/" + key
+	}
+
+	domain := "s3.amazonaws.com"
+	if region != "us-east-1" {
+		domain = fmt.Sprintf("s3.%s.amazonaws.com", region)
+	}
+	if strings.Contains(bucket, ".") {
+		// virtual-hosted style doesn't work with TLS for those
+		return "https", domain, "/" + bucket + "/" + key
+	}
+	return "https", bucket + "." + domain, "/" + key
+}
+
+// presign returns a GetObject URL signed with query parameters, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func (h *Handler) presign(creds Credentials, region string, bucket string, key string, versionID string) string {
+	now := time.Now
+	if h.now != nil {
+		now = h.now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	expiry := h.Expiry
+	if expiry <= 0 {
+		expiry = DefaultExpiry
+	}
+
+	scheme, host, path := h.objectURL(region, bucket, key)
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+
+	params := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    creds.AccessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       fmt.Sprintf("%d", int64(expiry/time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if creds.SessionToken != "" {
+		params["X-Amz-Security-Token"] = creds.SessionToken
+	}
+	if versionID != "" {
+		params["versionId"] = versionID
+	}
+	query := canonicalQuery(params)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		uriEncode(path, false),
+		query,
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", scheme, host, uriEncode(path, false), query, signature)
+}
+
+func canonicalQuery(params map[string]string) string {
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(params[k], true))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes everything but unreserved characters, and
+// slashes unless encodeSlash is set, as SigV4 expects.
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,371 @@
+// Package sftp implements the 'sftp://user@host:port/path' scheme for eos.
+// Files are read with SFTP's random-access reads, over connections
+// established like timeout clients do, and reads that fail because of
+// network trouble reconnect and retry like htfs does.
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultPort is used when the URL doesn't specify one
+const DefaultPort = "22"
+
+// Settings configures how an SFTP file is accessed
+type Settings struct {
+	// RetrySettings are used to reconnect when reads fail. Everything
+	// is tried at least once, whatever MaxTries says.
+	RetrySettings *retrycontext.Settings
+
+	// Timeouts are enforced on the SSH connection. Connect and DNS bound
+	// establishing it, and Idle detects stalls. Defaults to
+	// timeout.DefaultTimeouts().
+	Timeouts *timeout.Timeouts
+
+	// Auth are the methods tried to log in. Defaults to the URL's
+	// password if any, then keys from $SSH_AUTH_SOCK, then unencrypted
+	// keys in ~/.ssh.
+	Auth []ssh.AuthMethod
+
+	// HostKeyCallback verifies the server's host key. Defaults to
+	// checking ~/.ssh/known_hosts.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Log, if set, receives messages about reconnections
+	Log func(msg string)
+}
+
+// File is a remote file accessed over SFTP. ReadAt is safe for
+// concurrent use, Read and Seek share an offset like *os.File's.
+type File struct {
+	path     string
+	addr     string
+	config   *ssh.ClientConfig
+	timeouts timeout.Timeouts
+	retry    retrycontext.Settings
+	log      func(msg string)
+
+	mu     sync.Mutex
+	conn   *conn
+	closed bool
+
+	info os.FileInfo
+
+	offsetMutex sync.Mutex
+	offset      int64
+}
+
+// conn is an SSH connection, its SFTP session, and the open file
+type conn struct {
+	ssh  *ssh.Client
+	sftp *pkgsftp.Client
+	file *pkgsftp.File
+}
+
+func (c *conn) close() {
+	c.file.Close()
+	// closing the SSH connection first keeps sftp.Client.Close from
+	// waiting on the server
+	c.ssh.Close()
+	c.sftp.Close()
+}
+
+var _ io.ReaderAt = (*File)(nil)
+var _ io.ReadSeeker = (*File)(nil)
+
+// Open connects to the server in u, and opens the file at u's path.
+// settings may be nil.
+func Open(u *url.URL, settings *Settings) (*File, error) {
+	if settings == nil {
+		settings = &Settings{}
+	}
+	if u.Host == "" || u.Path == "" {
+		return nil, errors.Errorf("sftp: invalid URL %q, expected sftp://user@host/path", u.String())
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	auth := settings.Auth
+	if auth == nil {
+		auth = defaultAuth(u)
+	}
+
+	hostKeyCallback := settings.HostKeyCallback
+	if hostKeyCallback == nil {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "sftp: while looking for known_hosts")
+		}
+		hostKeyCallback, err = knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+		if err != nil {
+			return nil, errors.Wrap(err, "sftp: while reading known_hosts")
+		}
+	}
+
+	f := &File{
+		path: u.Path,
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+		timeouts: timeout.DefaultTimeouts(),
+		retry: retrycontext.Settings{
+			MaxTries: 15,
+		},
+		log: settings.Log,
+	}
+	if settings.Timeouts != nil {
+		f.timeouts = *settings.Timeouts
+	}
+	if settings.RetrySettings != nil {
+		f.retry = *settings.RetrySettings
+	}
+
+	rc := f.newRetryContext()
+	for rc.ShouldTry() {
+		c, err := f.borrowConn()
+		if err == nil {
+			f.info, err = c.file.Stat()
+		}
+		if err != nil {
+			if rc.IsRetriable(err) {
+				f.dropConn(c)
+				rc.Retry(err)
+				continue
+			}
+			f.Close()
+			return nil, errors.Wrapf(err, "sftp: while opening %s", f.path)
+		}
+		return f, nil
+	}
+	f.Close()
+	return nil, errors.Wrapf(rc.LastError, "sftp: while opening %s, too many errors", f.path)
+}
+
+func defaultAuth(u *url.URL) []ssh.AuthMethod {
+	var auth []ssh.AuthMethod
+	if password, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			agentConn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, err
+			}
+			defer agentConn.Close()
+			return agent.NewClient(agentConn).Signers()
+		}))
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		var signers []ssh.Signer
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			key, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			signer, err := ssh.ParsePrivateKey(key)
+			if err != nil {
+				// probably encrypted
+				continue
+			}
+			signers = append(signers, signer)
+		}
+		if len(signers) > 0 {
+			auth = append(auth, ssh.PublicKeys(signers...))
+		}
+	}
+	return auth
+}
+
+func (f *File) newRetryContext() *retrycontext.Context {
+	settings := f.retry
+	if settings.MaxTries < 1 {
+		settings.MaxTries = 1
+	}
+	if settings.IsRetriable == nil {
+		settings.IsRetriable = isRetriable
+	}
+	return retrycontext.New(settings)
+}
+
+// isRetriable returns true for errors a new connection might fix
+func isRetriable(err error) bool {
+	if se, ok := errors.Cause(err).(*pkgsftp.StatusError); ok {
+		switch se.Code {
+		case 6, 7: // SSH_FX_NO_CONNECTION, SSH_FX_CONNECTION_LOST
+			return true
+		}
+		return false
+	}
+	return neterr.IsNetworkError(err)
+}
+
+func (f *File) logf(format string, args ...interface{}) {
+	if f.log != nil {
+		f.log(fmt.Sprintf(format, args...))
+	}
+}
+
+// borrowConn returns the current connection, establishing one if needed
+func (f *File) borrowConn() (*conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, errors.New("sftp: file closed")
+	}
+	if f.conn != nil {
+		return f.conn, nil
+	}
+
+	netConn, err := timeout.DialContext(context.Background(), f.timeouts, "tcp", f.addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, f.addr, f.config)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+
+	sftpClient, err := pkgsftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	file, err := sftpClient.Open(f.path)
+	if err != nil {
+		sshClient.Close()
+		sftpClient.Close()
+		return nil, err
+	}
+
+	f.conn = &conn{ssh: sshClient, sftp: sftpClient, file: file}
+	return f.conn, nil
+}
+
+// dropConn closes c, if it's still the current connection
+func (f *File) dropConn(c *conn) {
+	if c == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conn == c {
+		f.conn = nil
+		c.close()
+	}
+}
+
+// ReadAt reads len(buf) bytes at offset, reconnecting as needed
+func (f *File) ReadAt(buf []byte, offset int64) (int, error) {
+	total := 0
+	rc := f.newRetryContext()
+	for rc.ShouldTry() {
+		c, err := f.borrowConn()
+		if err == nil {
+			var n int
+			n, err = c.file.ReadAt(buf[total:], offset+int64(total))
+			total += n
+			if err == io.EOF && offset+int64(total) < f.info.Size() {
+				// the file didn't shrink, the connection went away
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err != nil && err != io.EOF {
+			if rc.IsRetriable(err) {
+				f.logf("[%9d-%9d] (ReadAt) reconnecting on %v", offset, offset+int64(len(buf)), err)
+				f.dropConn(c)
+				rc.Retry(err)
+				continue
+			}
+			return total, errors.WithStack(err)
+		}
+		return total, err
+	}
+	return total, errors.Wrap(rc.LastError, "sftp: too many errors")
+}
+
+// Read reads from the current offset
+func (f *File) Read(buf []byte) (int, error) {
+	f.offsetMutex.Lock()
+	defer f.offsetMutex.Unlock()
+
+	n, err := f.ReadAt(buf, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek moves the current offset, and never fails on valid whence values
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.offsetMutex.Lock()
+	defer f.offsetMutex.Unlock()
+
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekEnd:
+		newOffset = f.info.Size() + offset
+	case io.SeekCurrent:
+		newOffset = f.offset + offset
+	default:
+		return f.offset, errors.Errorf("sftp: invalid whence value %d", whence)
+	}
+	if newOffset < 0 {
+		newOffset = 0
+	}
+	f.offset = newOffset
+	return newOffset, nil
+}
+
+// Stat returns the information the server gave when the file was opened
+func (f *File) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// Close closes the connection. Subsequent reads fail.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.conn != nil {
+		f.conn.close()
+		f.conn = nil
+	}
+	return nil
+}
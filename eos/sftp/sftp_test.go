@@ -0,0 +1,195 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/pkg/errors"
+	pkgsftp "github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer serves the local filesystem over SFTP
+type testServer struct {
+	listener net.Listener
+	hostKey  ssh.PublicKey
+
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "builds" && string(pass) == "hunter2" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{listener: listener, hostKey: signer.PublicKey()}
+
+	go func() {
+		for {
+			nc, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			ts.mu.Lock()
+			ts.conns = append(ts.conns, nc)
+			ts.dials++
+			ts.mu.Unlock()
+			go ts.serve(nc, config)
+		}
+	}()
+	return ts
+}
+
+func (ts *testServer) serve(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := pkgsftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					server.Serve()
+					return
+				}
+			}
+		}()
+	}
+}
+
+// dropAll closes every connection, like a flaky network would
+func (ts *testServer) dropAll() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, nc := range ts.conns {
+		nc.Close()
+	}
+	ts.conns = nil
+}
+
+func (ts *testServer) numDials() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.dials
+}
+
+func Test_Open(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := newTestServer(t)
+	defer ts.listener.Close()
+
+	dir, err := ioutil.TempDir("", "sftp-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 256*1024+17)
+	rand.Read(data)
+	path := filepath.Join(dir, "build.zip")
+	assert.NoError(ioutil.WriteFile(path, data, 0644))
+
+	u, err := url.Parse("sftp://builds:hunter2@" + ts.listener.Addr().String() + filepath.ToSlash(path))
+	assert.NoError(err)
+	settings := &Settings{
+		RetrySettings:   &retrycontext.Settings{MaxTries: 3, NoSleep: true},
+		HostKeyCallback: ssh.FixedHostKey(ts.hostKey),
+	}
+
+	f, err := Open(u, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	stats, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(data), stats.Size())
+
+	buf := make([]byte, 1000)
+	_, err = f.ReadAt(buf, 1234)
+	assert.NoError(err)
+	assert.Equal(data[1234:2234], buf)
+
+	// reconnects transparently
+	ts.dropAll()
+	_, err = f.ReadAt(buf, 100000)
+	assert.NoError(err)
+	assert.Equal(data[100000:101000], buf)
+	assert.Equal(2, ts.numDials())
+
+	_, err = f.Seek(-10, io.SeekEnd)
+	assert.NoError(err)
+	n, err := f.Read(buf)
+	assert.Equal(io.EOF, err)
+	assert.Equal(10, n)
+	assert.Equal(data[len(data)-10:], buf[:n])
+
+	// status errors aren't retried
+	missing, err := url.Parse("sftp://builds:hunter2@" + ts.listener.Addr().String() + filepath.ToSlash(filepath.Join(dir, "missing.zip")))
+	assert.NoError(err)
+	_, err = Open(missing, settings)
+	assert.Error(err)
+	assert.Equal(3, ts.numDials())
+
+	wrongHost := *settings
+	wrongHost.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return errors.New("unknown host key")
+	}
+	_, err = Open(u, &wrongHost)
+	assert.Error(err)
+
+	noTries := *settings
+	noTries.RetrySettings = &retrycontext.Settings{}
+	f2, err := Open(u, &noTries)
+	if assert.NoError(err) {
+		_, err = f2.ReadAt(buf, 1234)
+		assert.NoError(err)
+		assert.Equal(data[1234:2234], buf)
+		assert.NoError(f2.Close())
+	}
+}
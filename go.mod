@@ -8,12 +8,14 @@ require (
 	github.com/getlantern/idletiming v0.0.0-20200228204104-10036786eac5
 	github.com/itchio/headway v0.0.0-20191015112415-46f64dd4d524
 	github.com/itchio/randsource v0.0.0-20190703104731-3f6d22f91927
+	github.com/klauspost/compress v1.10.3
 	github.com/kr/text v0.2.0 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/pkg/errors v0.9.1
-	github.com/stretchr/testify v1.5.1
+	github.com/pkg/sftp v1.12.0
+	github.com/stretchr/testify v1.6.1
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
 	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
 )
@@ -0,0 +1,125 @@
+package htfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is filled in as an HTTP request progresses, and written
+// to the File's access log once it's done. All its methods do nothing on
+// a nil entry, which is what Files without an access log get.
+type accessLogEntry struct {
+	file  *File
+	start time.Time
+	once  sync.Once
+
+	Time       string  `json:"time"`
+	Op         string  `json:"op"`
+	Method     string  `json:"method"`
+	Host       string  `json:"host"`
+	Range      string  `json:"range,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	TTFBMs     float64 `json:"ttfbMs"`
+	DurationMs float64 `json:"durationMs"`
+	Attempt    int     `json:"attempt"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (f *File) newAccessLogEntry(req *http.Request, rr rangeRequest) *accessLogEntry {
+	if f.accessLog == nil {
+		return nil
+	}
+
+	now := f.clock.Now()
+	return &accessLogEntry{
+		file:    f,
+		start:   now,
+		Time:    now.UTC().Format(time.RFC3339Nano),
+		Op:      rr.op,
+		Method:  rr.method,
+		Host:    req.URL.Host,
+		Range:   rr.byteRange,
+		Attempt: rr.attempt,
+	}
+}
+
+func (e *accessLogEntry) gotResponse(status int) {
+	if e == nil {
+		return
+	}
+	e.Status = status
+	e.TTFBMs = durationMs(since(e.file.clock, e.start))
+}
+
+// finish writes the entry to the access log. Only the first call counts.
+func (e *accessLogEntry) finish(status int, bytes int64, err error) {
+	if e == nil {
+		return
+	}
+
+	e.once.Do(func() {
+		e.Status = status
+		e.Bytes = bytes
+		e.DurationMs = durationMs(since(e.file.clock, e.start))
+		if err != nil {
+			e.Error = err.Error()
+		}
+		e.file.writeAccessLog(e)
+	})
+}
+
+// wrapBody makes the entry be written when body is closed,
+// along with how many bytes were read from it.
+func (e *accessLogEntry) wrapBody(body io.ReadCloser, status int) io.ReadCloser {
+	if e == nil {
+		return body
+	}
+	return &accessLogBody{ReadCloser: body, entry: e, status: status}
+}
+
+type accessLogBody struct {
+	io.ReadCloser
+
+	entry  *accessLogEntry
+	status int
+	n      int64
+}
+
+func (alb *accessLogBody) Read(buf []byte) (int, error) {
+	n, err := alb.ReadCloser.Read(buf)
+	alb.n += int64(n)
+	return n, err
+}
+
+func (alb *accessLogBody) Close() error {
+	alb.entry.finish(alb.status, alb.n, nil)
+	return alb.ReadCloser.Close()
+}
+
+func (f *File) writeAccessLog(e *accessLogEntry) {
+	var line []byte
+	if f.accessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s %s %s %s %q %d %d ttfb=%.1fms duration=%.1fms attempt=%d",
+			e.Time, e.Op, e.Method, e.Host, e.Range, e.Status, e.Bytes, e.TTFBMs, e.DurationMs, e.Attempt))
+		if e.Error != "" {
+			line = append(line, fmt.Sprintf(" error=%q", e.Error)...)
+		}
+		line = append(line, '\n')
+	}
+
+	f.accessLogMutex.Lock()
+	defer f.accessLogMutex.Unlock()
+	f.accessLog.Write(line)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,104 @@
+package htfs
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultAutoTuneWindow is how long the conn tuner measures aggregate
+// throughput before deciding whether to grow or shrink the pool.
+const defaultAutoTuneWindow = 2 * time.Second
+
+// an improvement smaller than this (relative) is considered noise
+const autoTuneThreshold = 0.05
+
+// connTuner implements a simple hill-climbing strategy over the number
+// of connections a File keeps around: as long as adding connections
+// improves aggregate throughput, keep adding them. As soon as they stop
+// helping, back off.
+type connTuner struct {
+	mu sync.Mutex
+
+	min     int
+	max     int
+	current int
+	window  time.Duration
+
+	windowStart    time.Time
+	windowBytes    int64
+	lastThroughput float64
+	direction      int
+}
+
+func newConnTuner(min int, max int) *connTuner {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	return &connTuner{
+		min:       min,
+		max:       max,
+		current:   min,
+		window:    defaultAutoTuneWindow,
+		direction: 1,
+	}
+}
+
+// record accounts for n bytes delivered at time now, and returns the
+// new target number of connections, along with whether it changed.
+func (ct *connTuner) record(n int64, now time.Time) (int, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.windowStart.IsZero() {
+		ct.windowStart = now
+	}
+	ct.windowBytes += n
+
+	elapsed := now.Sub(ct.windowStart)
+	if elapsed < ct.window {
+		return ct.current, false
+	}
+
+	throughput := float64(ct.windowBytes) / elapsed.Seconds()
+	ct.windowStart = now
+	ct.windowBytes = 0
+
+	if ct.lastThroughput > 0 {
+		gain := (throughput - ct.lastThroughput) / ct.lastThroughput
+		if gain < -autoTuneThreshold {
+			// last move hurt, go the other way
+			ct.direction = -ct.direction
+		} else if gain < autoTuneThreshold {
+			// last move didn't help, prefer fewer connections
+			ct.direction = -1
+		}
+	}
+	ct.lastThroughput = throughput
+
+	next := ct.current + ct.direction
+	if next < ct.min {
+		next = ct.min
+	}
+	if next > ct.max {
+		next = ct.max
+	}
+
+	changed := next != ct.current
+	if !changed {
+		// we hit one of the bounds, explore in the other direction next time
+		ct.direction = -ct.direction
+	}
+	ct.current = next
+	return ct.current, changed
+}
+
+func (ct *connTuner) target() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	return ct.current
+}
@@ -0,0 +1,39 @@
+package htfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ConnTuner(t *testing.T) {
+	assert := assert.New(t)
+
+	ct := newConnTuner(2, 4)
+	assert.EqualValues(2, ct.target())
+
+	now := time.Now()
+	ct.record(0, now)
+	step := func(bytes int64) int {
+		now = now.Add(ct.window)
+		target, _ := ct.record(bytes, now)
+		return target
+	}
+
+	// first window: no reference, grow
+	assert.EqualValues(3, step(1000))
+	// throughput improved: keep growing
+	assert.EqualValues(4, step(2000))
+	// improved, but we're at the upper bound
+	assert.EqualValues(4, step(3000))
+	// flat: more connections stopped helping, shrink
+	assert.EqualValues(3, step(3000))
+	// much worse: go the other way
+	assert.EqualValues(4, step(1000))
+
+	// never go below the lower bound
+	for i := 0; i < 10; i++ {
+		assert.True(step(1000) >= 2)
+	}
+}
@@ -0,0 +1,61 @@
+package htfs
+
+import "sync"
+
+// A RetryBudget caps the number of retries done across all connections of
+// a File, or of every File it's shared with (for a process-wide budget).
+// Each retry spends a token, and each successful request earns back a
+// fraction of one, so that while a remote is hard-down, connections fail
+// fast once the budget is spent instead of each running a full backoff
+// schedule, but occasional errors on a healthy remote are always retried.
+type RetryBudget struct {
+	mu          sync.Mutex
+	maxTokens   float64
+	tokens      float64
+	refillRatio float64
+}
+
+// NewRetryBudget returns a budget that allows maxTokens retries in a row,
+// and adds refillRatio tokens back every time a request succeeds.
+func NewRetryBudget(maxTokens int, refillRatio float64) *RetryBudget {
+	return &RetryBudget{
+		maxTokens:   float64(maxTokens),
+		tokens:      float64(maxTokens),
+		refillRatio: refillRatio,
+	}
+}
+
+// Tokens returns the number of retries currently left in the budget
+func (rb *RetryBudget) Tokens() float64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.tokens
+}
+
+// withdraw spends a token, and returns false if there were none left.
+// A nil budget never runs out.
+func (rb *RetryBudget) withdraw() bool {
+	if rb == nil {
+		return true
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.tokens < 1 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// deposit records a successful request
+func (rb *RetryBudget) deposit() {
+	if rb == nil {
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.tokens += rb.refillRatio
+	if rb.tokens > rb.maxTokens {
+		rb.tokens = rb.maxTokens
+	}
+}
@@ -0,0 +1,683 @@
+package htfs
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	goerrors "errors"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCacheBlockSize is the granularity at which a Cache stores data,
+// unless CacheSettings.BlockSize says otherwise.
+const defaultCacheBlockSize int64 = 256 * 1024
+
+// CacheSettings configures a Cache
+type CacheSettings struct {
+	// MaxBytes is the total size of the blocks the Cache holds before
+	// it starts evicting some, according to Policy. Zero means no limit.
+	MaxBytes int64
+
+	// Policy determines which blocks are evicted first. Defaults to EvictLRU.
+	Policy EvictionPolicy
+
+	// Dir makes the Cache store blocks as files in that directory, so they
+	// survive the process. When empty, blocks are kept in memory.
+	Dir string
+
+	// BlockSize is the granularity at which data is cached.
+	// Defaults to 256KB.
+	BlockSize int64
+
+	// Mmap makes a Cache with a Dir serve blocks from memory mappings of
+	// their files instead of reading them, leaving residency to the OS page
+	// cache. It helps with workloads that read the same blocks many times,
+	// like verifying large files. Ignored on platforms without mmap.
+	Mmap bool
+
+	// Compress makes a Cache with a Dir compress blocks with zstd, unless
+	// a sample of them shows they're already compressed, trading CPU time
+	// for capacity: MaxBytes then applies to compressed sizes. Compressed
+	// blocks are kept apart from uncompressed ones, and Mmap is ignored.
+	Compress bool
+
+	// EncryptionKey makes a Cache with a Dir encrypt blocks with AES-GCM,
+	// so that they can't be read, or tampered with undetected, without the
+	// key. It must be 16, 24, or 32 bytes long. Blocks encrypted with other
+	// keys are kept apart, and Mmap is ignored. The validators kept along
+	// blocks (see Cache) are not encrypted: they're just response headers.
+	EncryptionKey []byte
+}
+
+// A Cache holds blocks of remote files, in memory or on disk. It can be
+// shared by any number of Files (see Settings.Cache), in which case its
+// size limit applies to all of them combined. Each File can also be
+// held to its own quota, see Settings.CacheQuota.
+type Cache struct {
+	mu sync.Mutex
+
+	blockSize int64
+	maxBytes  int64
+	store     cacheStore
+	evictor   evictor
+
+	size       int64
+	entries    map[string]*cacheEntry
+	ownerSizes map[string]int64
+	validators map[string]*cacheValidators
+	// pinned counts pins on block keys, see File.Pin
+	pinned map[string]int
+
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	key   string
+	owner string
+	size  int64
+}
+
+// CacheStats describes how well a Cache is doing
+type CacheStats struct {
+	Hits         int64
+	Misses       int64
+	Evictions    int64
+	EvictedBytes int64
+	// Corrupted counts blocks that failed checksum verification,
+	// and were discarded.
+	Corrupted int64
+	// Invalidated counts blocks that were discarded because
+	// the remote file changed since they were fetched.
+	Invalidated int64
+	// Pinned is the number of blocks in the cache that
+	// can't be evicted, see File.Pin
+	Pinned int64
+
+	// Size is the total size of the blocks in the cache,
+	// as stored (compressed, see CacheSettings.Compress)
+	Size int64
+	// Blocks is the number of blocks in the cache
+	Blocks int64
+}
+
+// HitRate returns the fraction of lookups that were served from the cache
+func (cs CacheStats) HitRate() float64 {
+	total := cs.Hits + cs.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.Hits) / float64(total)
+}
+
+// cacheStore is where a Cache keeps block contents. Implementations
+// must be safe for concurrent use.
+type cacheStore interface {
+	get(key string) ([]byte, error)
+	// put returns how many bytes the block takes up in the store
+	put(key string, data []byte) (int64, error)
+	remove(key string) error
+	putValidators(key string, v *cacheValidators) error
+}
+
+// NewCache returns a new Cache. If settings.Dir is set, blocks already
+// present in it are picked up, and count against settings.MaxBytes.
+// Files opening a remote file the Cache already holds blocks of first
+// check, with a conditional request, that it hasn't changed since.
+func NewCache(settings CacheSettings) (*Cache, error) {
+	if settings.Dir == "" {
+		return newCache(settings, &memoryStore{blocks: make(map[string][]byte)}), nil
+	}
+
+	c := newCache(settings, nil)
+	ds, existing, err := openDiskStore(settings, c.blockSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "htfs.NewCache")
+	}
+	c.store = ds
+	if settings.Mmap && mmapSupported && !settings.Compress && ds.aead == nil {
+		c.store = newMmapStore(ds)
+	}
+	c.validators, err = ds.loadValidators()
+	if err != nil {
+		return nil, errors.Wrapf(err, "htfs.NewCache")
+	}
+	for _, e := range existing {
+		c.entries[e.key] = e
+		c.ownerSizes[e.owner] += e.size
+		c.size += e.size
+		c.evictor.added(e.key)
+	}
+	c.evict("", 0)
+
+	return c, nil
+}
+
+func newCache(settings CacheSettings, store cacheStore) *Cache {
+	c := &Cache{
+		blockSize:  settings.BlockSize,
+		maxBytes:   settings.MaxBytes,
+		store:      store,
+		entries:    make(map[string]*cacheEntry),
+		pinned:     make(map[string]int),
+		ownerSizes: make(map[string]int64),
+		validators: make(map[string]*cacheValidators),
+	}
+	if c.blockSize <= 0 {
+		c.blockSize = defaultCacheBlockSize
+	}
+
+	// ARC needs to know how many blocks fit in the cache
+	capacity := 0
+	if c.maxBytes > 0 {
+		capacity = int(c.maxBytes / c.blockSize)
+	}
+	c.evictor = newEvictor(settings.Policy, capacity)
+	return c
+}
+
+// newMemoryCache returns an in-memory Cache, only bounded by budget, and
+// its store, to close once it's no longer used. A zero blockSize means
+// defaultCacheBlockSize.
+func newMemoryCache(blockSize int64, budget *MemoryBudget) (*Cache, *memoryStore) {
+	store := &memoryStore{blocks: make(map[string][]byte), budget: budget}
+	return newCache(CacheSettings{BlockSize: blockSize}, store), store
+}
+
+// BlockSize returns the granularity at which the Cache stores data
+func (c *Cache) BlockSize() int64 {
+	return c.blockSize
+}
+
+// Size returns the total size of the blocks currently held by the Cache
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// Stats returns a snapshot of the Cache's counters
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.size
+	stats.Blocks = int64(len(c.entries))
+	for key := range c.pinned {
+		if _, ok := c.entries[key]; ok {
+			stats.Pinned++
+		}
+	}
+	return stats
+}
+
+func (c *Cache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[key]
+	return ok
+}
+
+func (c *Cache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	_, ok := c.entries[key]
+	if ok {
+		c.evictor.accessed(key)
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.countMiss()
+		return nil, false
+	}
+
+	data, err := c.store.get(key)
+	if err != nil {
+		// evicted in the meantime, unreadable, or corrupt: either way,
+		// the block is dropped and will be fetched again.
+		if err == errCorruptBlock {
+			c.mu.Lock()
+			c.stats.Corrupted++
+			c.mu.Unlock()
+		}
+		c.forget(key)
+		c.countMiss()
+		return nil, false
+	}
+
+	c.mu.Lock()
+	c.stats.Hits++
+	c.mu.Unlock()
+	return data, true
+}
+
+func (c *Cache) countMiss() {
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+}
+
+// put stores a block on behalf of owner, which may hold
+// at most quota bytes in the cache (zero means no limit).
+func (c *Cache) put(owner string, quota int64, key string, data []byte) error {
+	size, err := c.store.put(key, data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.size += size - e.size
+		c.ownerSizes[e.owner] += size - e.size
+		e.size = size
+		c.evictor.accessed(key)
+	} else {
+		c.entries[key] = &cacheEntry{key: key, owner: owner, size: size}
+		c.size += size
+		c.ownerSizes[owner] += size
+		c.evictor.added(key)
+	}
+
+	c.evict(owner, quota)
+	return nil
+}
+
+func (c *Cache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// evict drops blocks until owner fits in its quota, and the cache
+// fits in its budget, except for pinned ones. Must be called with c.mu held.
+func (c *Cache) evict(owner string, quota int64) {
+	if quota > 0 && c.ownerSizes[owner] > quota {
+		c.evictor.walk(func(key string) bool {
+			e := c.entries[key]
+			if e.owner == owner && c.pinned[key] == 0 {
+				c.evictEntry(e)
+			}
+			return c.ownerSizes[owner] > quota
+		})
+	}
+
+	if c.maxBytes > 0 && c.size > c.maxBytes {
+		c.evictor.walk(func(key string) bool {
+			if c.pinned[key] == 0 {
+				c.evictEntry(c.entries[key])
+			}
+			return c.size > c.maxBytes
+		})
+	}
+}
+
+func (c *Cache) evictEntry(e *cacheEntry) {
+	c.stats.Evictions++
+	c.stats.EvictedBytes += e.size
+	c.remove(e)
+}
+
+func (c *Cache) remove(e *cacheEntry) {
+	c.evictor.removed(e.key)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	c.ownerSizes[e.owner] -= e.size
+	if c.ownerSizes[e.owner] <= 0 {
+		delete(c.ownerSizes, e.owner)
+	}
+	// if this fails, the block will just be unreachable
+	c.store.remove(e.key)
+}
+
+// cacheFileKey identifies a version of a remote file within a
+// Cache, as fetched with credentials, see credentialsKey.
+func cacheFileKey(urlStr string, credentials string, size int64, etag string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s", urlStr, size, etag)
+	if credentials != "" {
+		fmt.Fprintf(h, "\x00%s", credentials)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// CacheKeyWithoutQuery is a Settings.CacheKey for servers whose query
+// strings only hold signatures, tokens, and the like: it returns the URL
+// without its query string and fragment, so that all URLs for the same
+// path share cached blocks.
+func CacheKeyWithoutQuery(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return urlStr
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	return u.String()
+}
+
+// credentialsKey hashes the headers sent with every request (see
+// Settings.Header), like Authorization or Cookie, for cache keys: Files
+// opened with different ones for the same URL may get different bytes,
+// and must not serve each other's. It's empty without any, so that
+// those keys stay what they were.
+func credentialsKey(header http.Header) string {
+	if len(header) == 0 {
+		return ""
+	}
+
+	var lines []string
+	for name, values := range header {
+		lines = append(lines, http.CanonicalHeaderKey(name)+"\x00"+strings.Join(values, "\x00"))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		fmt.Fprintf(h, "%s\x00\x00", line)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// fileBlocks is a File's view of a Cache
+type fileBlocks struct {
+	cache     *Cache
+	fileKey   string
+	quota     int64
+	blockSize int64
+}
+
+func newFileBlocks(cache *Cache, quota int64) *fileBlocks {
+	return &fileBlocks{
+		cache:     cache,
+		quota:     quota,
+		blockSize: cache.blockSize,
+	}
+}
+
+func (fb *fileBlocks) key(index int64) string {
+	return fmt.Sprintf("%s-%d", fb.fileKey, index)
+}
+
+// ownerFromKey returns the file key a block key was made from
+func ownerFromKey(key string) string {
+	if i := strings.LastIndex(key, "-"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+func (fb *fileBlocks) get(index int64) ([]byte, bool) {
+	return fb.cache.get(fb.key(index))
+}
+
+func (fb *fileBlocks) has(index int64) bool {
+	return fb.cache.has(fb.key(index))
+}
+
+func (fb *fileBlocks) put(index int64, data []byte) error {
+	return fb.cache.put(fb.fileKey, fb.quota, fb.key(index), data)
+}
+
+// memoryStore keeps blocks in memory
+type memoryStore struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	// budget, if set, is charged for the blocks, until they're removed
+	// or the store is closed. Blocks that don't fit aren't stored.
+	budget *MemoryBudget
+	closed bool
+}
+
+func (ms *memoryStore) get(key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	data, ok := ms.blocks[key]
+	if !ok {
+		return nil, errors.Errorf("block %s not found", key)
+	}
+	return data, nil
+}
+
+func (ms *memoryStore) put(key string, data []byte) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.budget != nil {
+		if ms.closed {
+			return 0, errors.Errorf("block %s: store is closed", key)
+		}
+		old, size := int64(len(ms.blocks[key])), int64(len(data))
+		if size > old && !ms.budget.reserve(size-old) {
+			return 0, errors.Errorf("block %s doesn't fit in memory budget", key)
+		}
+		if size < old {
+			ms.budget.release(old - size)
+		}
+	}
+	ms.blocks[key] = data
+	return int64(len(data)), nil
+}
+
+func (ms *memoryStore) remove(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if data, ok := ms.blocks[key]; ok && ms.budget != nil && len(data) > 0 {
+		ms.budget.release(int64(len(data)))
+	}
+	delete(ms.blocks, key)
+	return nil
+}
+
+// close drops all blocks, giving back what they held of the budget
+func (ms *memoryStore) close() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var size int64
+	for _, data := range ms.blocks {
+		size += int64(len(data))
+	}
+	if ms.budget != nil && size > 0 {
+		ms.budget.release(size)
+	}
+	ms.blocks = make(map[string][]byte)
+	ms.closed = true
+}
+
+// diskStore keeps one file per block in a directory. Blocks are grouped
+// in a subdirectory per block size, so caches with different settings
+// can share a directory without mixing up their blocks.
+type diskStore struct {
+	dir string
+	// compress is set for CacheSettings.Compress, blocks then have
+	// their encoding after their checksum, see compressBlock.
+	compress bool
+	// aead is set for CacheSettings.EncryptionKey, blocks
+	// are then sealed with it, see sealBlock.
+	aead cipher.AEAD
+}
+
+const diskStoreSuffix = ".blk"
+
+// every block on disk starts with a checksum of its contents, so
+// corruption is never mistaken for remote file content.
+const blockChecksumSize = 4
+
+var blockChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorruptBlock is returned by cacheStore.get when a block
+// doesn't match its checksum
+var errCorruptBlock = goerrors.New("cached block is corrupt")
+
+func openDiskStore(settings CacheSettings, blockSize int64) (*diskStore, []*cacheEntry, error) {
+	subdir := fmt.Sprintf("bs%d", blockSize)
+	if settings.Compress {
+		subdir += "-zstd"
+	}
+	ds := &diskStore{
+		compress: settings.Compress,
+	}
+	if settings.EncryptionKey != nil {
+		var err error
+		ds.aead, err = newBlockCipher(settings.EncryptionKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		subdir += "-aes" + keyFingerprint(settings.EncryptionKey)
+	}
+	ds.dir = filepath.Join(settings.Dir, subdir)
+
+	err := os.MkdirAll(ds.dir, 0755)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	infos, err := ioutil.ReadDir(ds.dir)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// oldest first, so the most recently written end up at the front
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	var existing []*cacheEntry
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, diskStoreSuffix) {
+			continue
+		}
+		key := strings.TrimSuffix(name, diskStoreSuffix)
+		existing = append(existing, &cacheEntry{
+			key:   key,
+			owner: ownerFromKey(key),
+			size:  info.Size() - ds.overhead(),
+		})
+	}
+	return ds, existing, nil
+}
+
+func (ds *diskStore) path(key string) string {
+	return filepath.Join(ds.dir, key+diskStoreSuffix)
+}
+
+// headerSize is the number of bytes stored before a block's contents
+func (ds *diskStore) headerSize() int64 {
+	if ds.compress {
+		return blockChecksumSize + 1
+	}
+	return blockChecksumSize
+}
+
+// overhead is the number of bytes a block's file has besides its contents
+func (ds *diskStore) overhead() int64 {
+	if ds.aead != nil {
+		return ds.headerSize() + int64(ds.aead.NonceSize()+ds.aead.Overhead())
+	}
+	return ds.headerSize()
+}
+
+func (ds *diskStore) get(key string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(ds.path(key))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ds.aead != nil {
+		contents, err = openBlock(ds.aead, key, contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if int64(len(contents)) < ds.headerSize() {
+		return nil, errCorruptBlock
+	}
+	data := contents[ds.headerSize():]
+	if ds.compress {
+		data, err = decompressBlock(contents[blockChecksumSize], data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the checksum is of the block itself, not of how it's stored
+	if binary.LittleEndian.Uint32(contents) != crc32.Checksum(data, blockChecksumTable) {
+		return nil, errCorruptBlock
+	}
+	return data, nil
+}
+
+func (ds *diskStore) put(key string, data []byte) (int64, error) {
+	header := make([]byte, ds.headerSize())
+	binary.LittleEndian.PutUint32(header, crc32.Checksum(data, blockChecksumTable))
+	stored := data
+	if ds.compress {
+		var err error
+		header[blockChecksumSize], stored, err = compressBlock(data)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	contents := append(header, stored...)
+	if ds.aead != nil {
+		var err error
+		contents, err = sealBlock(ds.aead, key, contents)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// write then rename, so readers never see a partial block
+	tmp, err := ioutil.TempFile(ds.dir, key+".tmp")
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	_, err = tmp.Write(contents)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, errors.WithStack(err)
+	}
+
+	err = os.Rename(tmp.Name(), ds.path(key))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, errors.WithStack(err)
+	}
+	return int64(len(stored)), nil
+}
+
+func (ds *diskStore) remove(key string) error {
+	err := os.Remove(ds.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package htfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CacheEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(CacheSettings{MaxBytes: 300, BlockSize: 100})
+	assert.NoError(err)
+
+	block := make([]byte, 100)
+	assert.NoError(c.put("", 0, "a", block))
+	assert.NoError(c.put("", 0, "b", block))
+	assert.NoError(c.put("", 0, "c", block))
+	assert.EqualValues(300, c.Size())
+
+	// touch "a", so "b" is the least recently used
+	_, ok := c.get("a")
+	assert.True(ok)
+
+	assert.NoError(c.put("", 0, "d", block))
+	assert.EqualValues(300, c.Size())
+	assert.True(c.has("a"))
+	assert.False(c.has("b"))
+	assert.True(c.has("c"))
+	assert.True(c.has("d"))
+
+	// replacing a block doesn't count it twice
+	assert.NoError(c.put("", 0, "d", make([]byte, 50)))
+	assert.EqualValues(250, c.Size())
+}
+
+func Test_CacheDisk(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(CacheSettings{Dir: dir, BlockSize: 16})
+	assert.NoError(err)
+	assert.NoError(c.put("", 0, "first", []byte("hello")))
+	assert.NoError(c.put("", 0, "second", []byte("world!")))
+
+	// a new Cache picks up what's on disk
+	c, err = NewCache(CacheSettings{Dir: dir, BlockSize: 16})
+	assert.NoError(err)
+	assert.EqualValues(11, c.Size())
+	data, ok := c.get("second")
+	assert.True(ok)
+	assert.Equal([]byte("world!"), data)
+
+	// ...but only blocks of the same size
+	other, err := NewCache(CacheSettings{Dir: dir, BlockSize: 32})
+	assert.NoError(err)
+	assert.EqualValues(0, other.Size())
+
+	// and it respects its budget
+	c, err = NewCache(CacheSettings{Dir: dir, BlockSize: 16, MaxBytes: 8})
+	assert.NoError(err)
+	assert.EqualValues(6, c.Size())
+	assert.False(c.has("first"))
+	assert.True(c.has("second"))
+}
+
+func Test_CacheLFU(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(CacheSettings{MaxBytes: 300, BlockSize: 100, Policy: EvictLFU})
+	assert.NoError(err)
+
+	block := make([]byte, 100)
+	assert.NoError(c.put("", 0, "hot", block))
+	for i := 0; i < 3; i++ {
+		c.get("hot")
+	}
+	assert.NoError(c.put("", 0, "warm", block))
+	c.get("warm")
+	assert.NoError(c.put("", 0, "cold", block))
+
+	// a new block pushes out the least frequently used one,
+	// even though "hot" is the least recently used
+	assert.NoError(c.put("", 0, "new", block))
+	assert.True(c.has("hot"))
+	assert.True(c.has("warm"))
+	assert.False(c.has("cold"))
+	assert.True(c.has("new"))
+}
+
+func Test_CacheARCResistsScans(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(CacheSettings{MaxBytes: 400, BlockSize: 100, Policy: EvictARC})
+	assert.NoError(err)
+
+	block := make([]byte, 100)
+	for _, key := range []string{"index", "header"} {
+		assert.NoError(c.put("", 0, key, block))
+		c.get(key)
+	}
+
+	// a long one-off scan doesn't flush the blocks that are used repeatedly
+	for i := 0; i < 20; i++ {
+		assert.NoError(c.put("", 0, fmt.Sprintf("scan-%d", i), block))
+	}
+	assert.True(c.has("index"))
+	assert.True(c.has("header"))
+	assert.EqualValues(400, c.Size())
+}
+
+func Test_CacheQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(CacheSettings{MaxBytes: 1000, BlockSize: 100})
+	assert.NoError(err)
+
+	block := make([]byte, 100)
+	assert.NoError(c.put("small", 0, "small-0", block))
+	for i := 0; i < 5; i++ {
+		assert.NoError(c.put("greedy", 200, fmt.Sprintf("greedy-%d", i), block))
+	}
+
+	// the greedy file only evicted its own blocks
+	assert.EqualValues(300, c.Size())
+	assert.True(c.has("small-0"))
+	assert.True(c.has("greedy-4"))
+	assert.True(c.has("greedy-3"))
+	assert.False(c.has("greedy-2"))
+
+	stats := c.Stats()
+	assert.EqualValues(3, stats.Evictions)
+	assert.EqualValues(300, stats.EvictedBytes)
+	assert.EqualValues(3, stats.Blocks)
+}
+
+func Test_CachePin(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU, EvictARC} {
+		t.Run(policy.String(), func(t *testing.T) {
+			assert := assert.New(t)
+
+			c, err := NewCache(CacheSettings{MaxBytes: 300, BlockSize: 100, Policy: policy})
+			assert.NoError(err)
+
+			block := make([]byte, 100)
+			c.pin([]string{"index"})
+			assert.NoError(c.put("", 0, "index", block))
+			for i := 0; i < 10; i++ {
+				assert.NoError(c.put("", 0, fmt.Sprintf("stream-%d", i), block))
+			}
+
+			// streaming churned through everything else
+			assert.True(c.has("index"))
+			assert.False(c.has("stream-7"))
+			assert.True(c.has("stream-9"))
+			assert.EqualValues(300, c.Size())
+			assert.EqualValues(1, c.Stats().Pinned)
+
+			// pins are counted
+			c.pin([]string{"index"})
+			c.unpin([]string{"index"})
+			assert.NoError(c.put("", 0, "stream-10", block))
+			assert.True(c.has("index"))
+
+			c.unpin([]string{"index"})
+			assert.EqualValues(0, c.Stats().Pinned)
+			assert.NoError(c.put("", 0, "stream-11", block))
+			assert.NoError(c.put("", 0, "stream-12", block))
+			assert.False(c.has("index"))
+		})
+	}
+}
+
+func Test_CacheStats(t *testing.T) {
+	assert := assert.New(t)
+
+	c, _ := newMemoryCache(0, nil)
+	assert.NoError(c.put("", 0, "a", []byte("a")))
+	c.get("a")
+	c.get("a")
+	c.get("a")
+	c.get("b")
+
+	stats := c.Stats()
+	assert.EqualValues(3, stats.Hits)
+	assert.EqualValues(1, stats.Misses)
+	assert.InDelta(0.75, stats.HitRate(), 0.001)
+}
+
+func Test_CacheCorruption(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(CacheSettings{Dir: dir, BlockSize: 16})
+	assert.NoError(err)
+	assert.NoError(c.put("", 0, "block", []byte("remote contents")))
+
+	// flip a bit behind the cache's back
+	ds := c.store.(*diskStore)
+	contents, err := ioutil.ReadFile(ds.path("block"))
+	assert.NoError(err)
+	contents[len(contents)-1] ^= 0x01
+	assert.NoError(ioutil.WriteFile(ds.path("block"), contents, 0644))
+
+	_, ok := c.get("block")
+	assert.False(ok, "corrupt block is not served")
+	assert.False(c.has("block"), "corrupt block is discarded")
+	assert.EqualValues(1, c.Stats().Corrupted)
+	assert.EqualValues(0, c.Size())
+}
+
+func Test_CacheCompress(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	const blockSize = 64 * 1024
+	compressible := bytes.Repeat([]byte("remote contents "), blockSize/16)
+	incompressible := make([]byte, blockSize)
+	rand.New(rand.NewSource(0xfeed)).Read(incompressible)
+
+	c, err := NewCache(CacheSettings{Dir: dir, BlockSize: blockSize, Compress: true})
+	assert.NoError(err)
+	assert.NoError(c.put("", 0, "text", compressible))
+	assert.True(c.Size() < blockSize/10, "compressible block shrinks")
+	assert.NoError(c.put("", 0, "noise", incompressible))
+	assert.True(c.Size() > blockSize, "incompressible block is stored as-is")
+
+	ds := c.store.(*diskStore)
+	contents, err := ioutil.ReadFile(ds.path("noise"))
+	assert.NoError(err)
+	assert.EqualValues(blockEncodingRaw, contents[blockChecksumSize])
+
+	// compressed blocks survive the Cache, and only show up in compressed ones
+	c, err = NewCache(CacheSettings{Dir: dir, BlockSize: blockSize, Compress: true})
+	assert.NoError(err)
+	for key, want := range map[string][]byte{"text": compressible, "noise": incompressible} {
+		data, ok := c.get(key)
+		assert.True(ok)
+		assert.Equal(want, data)
+	}
+	plain, err := NewCache(CacheSettings{Dir: dir, BlockSize: blockSize})
+	assert.NoError(err)
+	assert.EqualValues(0, plain.Size())
+
+	// corruption of the compressed stream is caught too
+	contents, err = ioutil.ReadFile(ds.path("text"))
+	assert.NoError(err)
+	contents[len(contents)/2] ^= 0x01
+	assert.NoError(ioutil.WriteFile(ds.path("text"), contents, 0644))
+	_, ok := c.get("text")
+	assert.False(ok)
+	assert.EqualValues(1, c.Stats().Corrupted)
+}
+
+func Test_CacheEncryption(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{0x42}, 32)
+	secret := bytes.Repeat([]byte("proprietary build "), 64)
+
+	_, err = NewCache(CacheSettings{Dir: dir, EncryptionKey: []byte("too short")})
+	assert.Error(err)
+
+	c, err := NewCache(CacheSettings{Dir: dir, BlockSize: 4096, EncryptionKey: key, Compress: true})
+	assert.NoError(err)
+	assert.NoError(c.put("", 0, "a", secret))
+	assert.NoError(c.put("", 0, "b", []byte("other block")))
+	size := c.Size()
+	assert.True(size < int64(len(secret)), "blocks are still compressed")
+
+	ds := c.store.(*diskStore)
+	contents, err := ioutil.ReadFile(ds.path("a"))
+	assert.NoError(err)
+	assert.False(bytes.Contains(contents, []byte("proprietary")), "contents aren't readable at rest")
+
+	// the same key reads them back, other keys don't see them
+	c, err = NewCache(CacheSettings{Dir: dir, BlockSize: 4096, EncryptionKey: key, Compress: true})
+	assert.NoError(err)
+	assert.EqualValues(size, c.Size())
+	data, ok := c.get("a")
+	assert.True(ok)
+	assert.Equal(secret, data)
+
+	other, err := NewCache(CacheSettings{Dir: dir, BlockSize: 4096, EncryptionKey: bytes.Repeat([]byte{0x43}, 32), Compress: true})
+	assert.NoError(err)
+	assert.EqualValues(0, other.Size())
+
+	// blocks can't be moved around, or tampered with
+	assert.NoError(ioutil.WriteFile(ds.path("b"), contents, 0644))
+	_, ok = c.get("b")
+	assert.False(ok)
+	contents[len(contents)/2] ^= 0x01
+	assert.NoError(ioutil.WriteFile(ds.path("a"), contents, 0644))
+	_, ok = c.get("a")
+	assert.False(ok)
+	assert.EqualValues(2, c.Stats().Corrupted)
+}
+
+func Test_CacheMmap(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-cache")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(CacheSettings{Dir: dir, BlockSize: 16, Mmap: true})
+	assert.NoError(err)
+	ms, ok := c.store.(*mmapStore)
+	if !assert.True(ok) {
+		return
+	}
+
+	assert.NoError(c.put("", 0, "block", []byte("remote contents")))
+	for i := 0; i < 2; i++ {
+		data, ok := c.get("block")
+		assert.True(ok)
+		assert.Equal([]byte("remote contents"), data)
+	}
+	assert.Len(ms.mappings, 1)
+
+	// replacing a block drops its mapping
+	assert.NoError(c.put("", 0, "block", []byte("new contents")))
+	assert.Len(ms.mappings, 0)
+	data, ok := c.get("block")
+	assert.True(ok)
+	assert.Equal([]byte("new contents"), data)
+
+	// corruption is caught when mapping
+	assert.NoError(c.put("", 0, "other", []byte("other contents")))
+	contents, err := ioutil.ReadFile(ms.path("other"))
+	assert.NoError(err)
+	contents[len(contents)-1] ^= 0x01
+	assert.NoError(ioutil.WriteFile(ms.path("other"), contents, 0644))
+	_, ok = c.get("other")
+	assert.False(ok)
+	assert.EqualValues(1, c.Stats().Corrupted)
+
+	c.forget("block")
+	assert.Len(ms.mappings, 0)
+}
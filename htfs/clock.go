@@ -0,0 +1,155 @@
+package htfs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells time and schedules work for a File: stale connection
+// reaping, retry backoff, timeouts, hedging, and stats all go through
+// it. See Settings.Clock.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed,
+	// unless the returned Timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a pending call scheduled with Clock.AfterFunc
+type Timer interface {
+	// Stop prevents the call from happening, and returns
+	// false if it already happened or was stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock Files use by default
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// since is time.Since, according to c
+func since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// sleep waits for d according to c, or until ctx is done
+func sleep(c Clock, ctx context.Context, d time.Duration) {
+	done := make(chan struct{})
+	timer := c.AfterFunc(d, func() { close(done) })
+	defer timer.Stop()
+
+	var ctxDone <-chan struct{}
+	if ctx != nil {
+		ctxDone = ctx.Done()
+	}
+	select {
+	case <-done:
+	case <-ctxDone:
+	}
+}
+
+// ManualClock is a Clock whose time only moves when Advance is
+// called, for deterministic tests of timing-related behavior.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+var _ Clock = (*ManualClock)(nil)
+
+// NewManualClock returns a ManualClock set to start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now is part of the Clock interface
+func (mc *ManualClock) Now() time.Time {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.now
+}
+
+// AfterFunc is part of the Clock interface
+func (mc *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mt := &manualTimer{clock: mc, at: mc.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return mt
+	}
+	mc.timers = append(mc.timers, mt)
+	return mt
+}
+
+// Advance moves the clock forward by d, and calls the functions of
+// timers that are due, in order. Each runs in its own goroutine, as
+// Clock.AfterFunc says, but Advance waits for it to return before
+// calling the next one, and before returning itself.
+func (mc *ManualClock) Advance(d time.Duration) {
+	mc.mu.Lock()
+	mc.now = mc.now.Add(d)
+	var due []*manualTimer
+	var pending []*manualTimer
+	for _, mt := range mc.timers {
+		if !mt.at.After(mc.now) {
+			due = append(due, mt)
+		} else {
+			pending = append(pending, mt)
+		}
+	}
+	mc.timers = pending
+	mc.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].at.Before(due[j].at)
+	})
+	for _, mt := range due {
+		done := make(chan struct{})
+		go func(f func()) {
+			defer close(done)
+			f()
+		}(mt.f)
+		<-done
+	}
+}
+
+// Pending returns the number of timers that haven't fired or been stopped
+// yet, so tests can wait for code under test to schedule something.
+func (mc *ManualClock) Pending() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.timers)
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	at    time.Time
+	f     func()
+}
+
+func (mt *manualTimer) Stop() bool {
+	mc := mt.clock
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for i, other := range mc.timers {
+		if other == mt {
+			mc.timers = append(mc.timers[:i], mc.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
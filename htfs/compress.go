@@ -0,0 +1,92 @@
+package htfs
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Blocks of a Cache with CacheSettings.Compress have a byte after their
+// checksum telling how the rest is encoded.
+const (
+	blockEncodingRaw  byte = 0
+	blockEncodingZstd byte = 1
+)
+
+// compressSampleSize is how much of a block is compressed first,
+// to tell whether compressing all of it is worth it.
+const compressSampleSize = 16 * 1024
+
+// incompressibleRatio is how much of its size a sample has to keep for the
+// block to be stored as-is: archives, media, and most game builds are
+// already compressed, and would only cost CPU time.
+const incompressibleRatio = 0.9
+
+var zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+// zstdCodecs returns an encoder and a decoder, shared by all Caches.
+// Both are safe for concurrent use.
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder, error) {
+	zc := &zstdCodec
+	zc.once.Do(func() {
+		zc.encoder, zc.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if zc.err != nil {
+			return
+		}
+		zc.decoder, zc.err = zstd.NewReader(nil)
+	})
+	return zc.encoder, zc.decoder, errors.WithStack(zc.err)
+}
+
+// compressBlock returns the encoding a block is stored with, and the
+// bytes stored for it: compressed, unless that wouldn't save much.
+func compressBlock(data []byte) (byte, []byte, error) {
+	encoder, _, err := zstdCodecs()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sample := data
+	if len(sample) > compressSampleSize {
+		sample = sample[:compressSampleSize]
+	}
+	if !shrinksEnough(len(sample), len(encoder.EncodeAll(sample, nil))) {
+		return blockEncodingRaw, data, nil
+	}
+
+	compressed := encoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if !shrinksEnough(len(data), len(compressed)) {
+		return blockEncodingRaw, data, nil
+	}
+	return blockEncodingZstd, compressed, nil
+}
+
+func shrinksEnough(size int, compressedSize int) bool {
+	return float64(compressedSize) < float64(size)*incompressibleRatio
+}
+
+// decompressBlock undoes compressBlock
+func decompressBlock(encoding byte, stored []byte) ([]byte, error) {
+	switch encoding {
+	case blockEncodingRaw:
+		return stored, nil
+	case blockEncodingZstd:
+		_, decoder, err := zstdCodecs()
+		if err != nil {
+			return nil, err
+		}
+		data, err := decoder.DecodeAll(stored, nil)
+		if err != nil {
+			return nil, errCorruptBlock
+		}
+		return data, nil
+	default:
+		return nil, errCorruptBlock
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"time"
 
 	"github.com/itchio/httpkit/htfs/backtracker"
@@ -14,14 +14,28 @@ import (
 )
 
 type conn struct {
+	// these are read when dumping stats, possibly while the
+	// conn is in use. First, so they're 64-bit aligned.
+	retries    int64
+	renewals   int64
+	reconnects int64
+
 	backtracker.Backtracker
 
-	file       *File
-	id         string
-	touchedAt  time.Time
-	body       io.ReadCloser
-	reader     *bufio.Reader
-	currentURL string
+	file      *File
+	id        string
+	touchedAt time.Time
+	body      io.ReadCloser
+	reader    *bufio.Reader
+
+	downloaded  *countingBody
+	startOffset int64
+
+	// window is the length of the next range requested, for RampUp,
+	// zero for open-ended ranges. rangeEnd is where the current
+	// one ends, zero if it doesn't.
+	window   int64
+	rangeEnd int64
 
 	header        http.Header
 	requestURL    *url.URL
@@ -30,7 +44,7 @@ type conn struct {
 }
 
 func (c *conn) Stale() bool {
-	return time.Since(c.touchedAt) > c.file.ConnStaleThreshold
+	return since(c.file.clock, c.touchedAt) > c.file.ConnStaleThreshold
 }
 
 // *not* thread-safe, File handles the locking
@@ -38,6 +52,8 @@ func (c *conn) Connect(offset int64) error {
 	hf := c.file
 
 	if c.body != nil {
+		atomic.AddInt64(&c.reconnects, 1)
+		c.countAborted()
 		err := c.body.Close()
 		if err != nil {
 			return errors.Wrapf(err, "in conn.Connect, while closing previous body")
@@ -47,120 +63,101 @@ func (c *conn) Connect(offset int64) error {
 		c.reader = nil
 	}
 
-	retryCtx := hf.newRetryContext()
-	renewalTries := 0
-
-	hf.currentURL = hf.getCurrentURL()
-	for retryCtx.ShouldTry() {
-		startTime := time.Now()
-		err := c.tryConnect(offset)
+	startTime := hf.clock.Now()
+	err := hf.withRetries(offset, "Connect", func(attempt int) error {
+		err := c.tryConnect(offset, attempt)
 		if err != nil {
-			if _, ok := err.(*needsRenewalError); ok {
-				renewalTries++
-				if renewalTries >= maxRenewals {
-					return errors.Wrapf(ErrTooManyRenewals, "in conn.Connect, exceeded maxRenewals")
-				}
-				hf.log("[%9d-%9d] (Connect) renewing on %v", offset, offset, err)
-
-				err = c.renewURLWithRetries(offset)
-				if err != nil {
-					// if we reach this point, we've failed to generate
-					// a download URL a bunch of times in a row
-					return errors.Wrapf(err, "in conn.Connect (failed to generate URLs a few times)")
-				}
-				continue
-			} else if hf.shouldRetry(err) {
-				hf.log("[%9d-%9d] (Connect) retrying %v", offset, offset, err)
-				retryCtx.Retry(err)
-				continue
-			} else {
-				return errors.Wrapf(err, "in conn.Connect, non-retriable error")
-			}
+			c.countFailure(err)
 		}
-
-		totalConnDuration := time.Since(startTime)
-		hf.log("[%9d-%9d] (Connect) %s", offset, offset, totalConnDuration)
-		hf.stats.connections++
-		hf.stats.connectionWait += totalConnDuration
-		return nil
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "in conn.Connect")
 	}
 
-	return errors.Wrapf(retryCtx.LastError, "in conn.Connect, exhausted retry context")
-}
-
-func (c *conn) renewURLWithRetries(offset int64) error {
-	hf := c.file
-	renewRetryCtx := hf.newRetryContext()
-
-	for renewRetryCtx.ShouldTry() {
-		var err error
-		hf.stats.renews++
-		c.currentURL, err = hf.renewURL()
-		if err != nil {
-			if hf.shouldRetry(err) {
-				hf.log("[%9d-%9d] (Connect) retrying %v", offset, offset, err)
-				renewRetryCtx.Retry(err)
-				continue
-			} else {
-				hf.log("[%9d-%9d] (Connect) bailing on %v", offset, offset, err)
-				return errors.Wrapf(err, "in conn.renewURLWithRetries, non-retriable error")
-			}
-		}
-
-		return nil
-	}
-	return errors.Wrapf(renewRetryCtx.LastError, "in conn.renewURLWithRetries, exhausted retry context")
+	totalConnDuration := since(hf.clock, startTime)
+	hf.log("[%9d-%9d] (Connect) %s", offset, offset, totalConnDuration)
+	atomic.AddInt64(&hf.stats.connections, 1)
+	hf.stats.connectionWait += totalConnDuration
+	hf.notifyConn(hf.connHooks.opened, c)
+	return nil
 }
 
-func (c *conn) tryConnect(offset int64) error {
+func (c *conn) tryConnect(offset int64, attempt int) error {
 	hf := c.file
 
-	req, err := http.NewRequest("GET", hf.currentURL, nil)
+	byteRange, rangeStart, rangeEnd := c.byteRange(offset)
+	res, err := hf.doHedgedRangeRequest(rangeRequest{
+		op:        "Connect",
+		method:    "GET",
+		byteRange: byteRange,
+		offset:    rangeStart,
+		attempt:   attempt,
+		conn:      c.id,
+		close:     hf.maxBytesPerConn > 0,
+	})
 	if err != nil {
-		return errors.Wrapf(err, "in conn.tryConnect, while creating new GET request")
+		return errors.Wrapf(err, "in conn.tryConnect")
 	}
-
-	byteRange := fmt.Sprintf("bytes=%d-", offset)
-	req.Header.Set("Range", byteRange)
-
-	res, err := hf.client.Do(req)
+	err = c.attach(res, rangeStart, rangeEnd)
 	if err != nil {
-		return errors.Wrapf(err, "in conn.tryConnect, while doing GET request")
+		return err
 	}
 
-	if res.StatusCode == 200 && offset > 0 {
-		defer res.Body.Close()
-		se := &ServerError{
-			Host:       req.Host,
-			Message:    "HTTP Range header not supported",
-			Code:       ServerErrorCodeNoRangeSupport,
-			StatusCode: res.StatusCode,
+	if skip := offset - rangeStart; skip > 0 {
+		// the start of a chunk, see Settings.ChunkSize
+		err = c.Discard(skip)
+		if err != nil {
+			return errors.Wrapf(err, "in conn.tryConnect, while skipping to %d", offset)
 		}
-		return errors.Wrapf(se, "in conn.tryConnect, got HTTP 200 for non-zero offset")
+		atomic.AddInt64(&hf.transfer.discarded, skip)
 	}
+	return nil
+}
 
-	if res.StatusCode/100 != 2 {
-		defer res.Body.Close()
+// attach makes the conn read from res, the response to a request for
+// bytes from offset up to rangeEnd (zero if open-ended).
+func (c *conn) attach(res *http.Response, offset int64, rangeEnd int64) error {
+	hf := c.file
 
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			body = []byte("could not read error body")
+	if res.StatusCode == 206 {
+		// serving bytes from elsewhere would silently corrupt reads
+		start, end, _, err := parseContentRange(res.Header.Get("content-range"))
+		if err == nil && start != offset {
+			res.Body.Close()
+			se := &ServerError{
+				Host:       res.Request.URL.Host,
+				Message:    fmt.Sprintf("asked for bytes from %d, got bytes from %d", offset, start),
+				StatusCode: res.StatusCode,
+			}
+			return errors.Wrapf(se, "in conn.attach")
 		}
-
-		if hf.needsRenewal(res, body) {
-			return &needsRenewalError{url: hf.currentURL}
+		if err != nil || end+1 != rangeEnd {
+			// the server gave us less than asked for, so
+			// wherever that ends is the end of the file
+			rangeEnd = 0
 		}
+	} else {
+		// all of it, regardless of range
+		rangeEnd = 0
+	}
 
-		se := &ServerError{
-			Host:       req.Host,
-			Message:    fmt.Sprintf("HTTP %d: %v", res.StatusCode, string(body)),
-			StatusCode: res.StatusCode,
+	c.downloaded = hf.countDownload(res.Body)
+	c.startOffset = offset
+
+	var body io.Reader = c.downloaded
+	if hf.backing != nil {
+		body = &backingReader{
+			ReadCloser: c.downloaded,
+			file:       hf,
+			backing:    hf.backing,
+			offset:     offset,
 		}
-		return errors.Wrapf(se, "in conn.tryConnect, got HTTP non-2XX")
 	}
 
-	c.Backtracker = backtracker.New(offset, res.Body, maxDiscard)
+	c.Backtracker = backtracker.New(offset, body, maxDiscard)
 	c.body = res.Body
+	c.rangeEnd = rangeEnd
 	c.header = res.Header
 	c.requestURL = res.Request.URL
 	c.statusCode = res.StatusCode
@@ -169,8 +166,77 @@ func (c *conn) tryConnect(offset int64) error {
 	return nil
 }
 
+// shouldRotate returns true if the conn received Settings.MaxBytesPerConn
+// bytes from its current response, and isn't backtracking: reading from
+// position continues where that response is.
+func (c *conn) shouldRotate(position int64) bool {
+	max := c.file.maxBytesPerConn
+	return max > 0 && c.downloaded != nil && c.downloaded.n >= max && c.Offset() == position
+}
+
+// rotate reconnects the conn where it is, see Settings.MaxBytesPerConn
+func (c *conn) rotate() error {
+	hf := c.file
+
+	offset := c.Offset()
+	hf.log2("[%9d-%9d] (Rotate) %s after %d bytes", offset, offset, c.id, c.downloaded.n)
+	atomic.AddInt64(&hf.stats.rotations, 1)
+	return c.Connect(offset)
+}
+
+// countFailure accounts for a failed attempt at connecting,
+// which withRetries is about to renew or retry.
+func (c *conn) countFailure(err error) {
+	if _, ok := errors.Cause(err).(*needsRenewalError); ok {
+		atomic.AddInt64(&c.renewals, 1)
+	} else if c.file.isRetriable(err) {
+		atomic.AddInt64(&c.retries, 1)
+	}
+}
+
+// connReport is what the stats dump says about a connection
+type connReport struct {
+	id         string
+	host       string
+	retries    int64
+	renewals   int64
+	reconnects int64
+}
+
+func (c *conn) report() connReport {
+	cr := connReport{
+		id:         c.id,
+		retries:    atomic.LoadInt64(&c.retries),
+		renewals:   atomic.LoadInt64(&c.renewals),
+		reconnects: atomic.LoadInt64(&c.reconnects),
+	}
+	if c.requestURL != nil {
+		cr.host = c.requestURL.Host
+	}
+	return cr
+}
+
+func (cr connReport) String() string {
+	return fmt.Sprintf("conn %s (%s): %d reconnects, %d retries, %d renewals", cr.id, cr.host, cr.reconnects, cr.retries, cr.renewals)
+}
+
+// countAborted accounts for bytes that were received but never read,
+// when a connection is about to be closed.
+func (c *conn) countAborted() {
+	if c.downloaded == nil {
+		return
+	}
+
+	consumed := c.Offset() - c.startOffset
+	if left := c.downloaded.n - consumed; left > 0 {
+		atomic.AddInt64(&c.file.transfer.aborted, left)
+	}
+	c.downloaded = nil
+}
+
 func (c *conn) Close() error {
 	if c.body != nil {
+		c.countAborted()
 		err := c.body.Close()
 		c.body = nil
 
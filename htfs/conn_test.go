@@ -0,0 +1,64 @@
+package htfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ConnReports(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := bytes.Repeat([]byte("flaky route "), 50000)
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&requests, 1) {
+		case 2:
+			w.WriteHeader(503)
+		case 3:
+			// hang up halfway through
+			var start int
+			fmt.Sscanf(r.Header.Get("range"), "bytes=%d-", &start)
+			w.Header().Set("content-range", fmt.Sprintf("bytes %d-%d/%d", start, len(fakeData)-1, len(fakeData)))
+			w.Header().Set("content-length", strconv.Itoa(len(fakeData)-start))
+			w.WriteHeader(206)
+			w.Write(fakeData[start : start+1000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		default:
+			http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+		}
+	}))
+	defer server.Close()
+
+	f, err := Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, &Settings{
+			RetrySettings: &retrycontext.Settings{MaxTries: 3, NoSleep: true},
+			ProbeStrategy: ProbeSingleByte,
+			MaxConns:      1,
+			DumpStats:     true,
+		})
+	assert.NoError(err)
+
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(fakeData, data)
+	assert.NoError(f.Close())
+
+	if assert.Len(f.stats.connReports, 1) {
+		cr := f.stats.connReports[0]
+		assert.EqualValues(2, cr.retries, "503, then the reset")
+		assert.EqualValues(1, cr.reconnects)
+		assert.EqualValues(0, cr.renewals)
+		assert.Contains(cr.String(), server.Listener.Addr().String())
+	}
+}
@@ -0,0 +1,62 @@
+package htfs
+
+import (
+	"time"
+)
+
+// ConnInfo describes something that happened to one of a File's
+// connections, see Settings.OnConnOpened and the others.
+type ConnInfo struct {
+	// ID identifies the connection, like in logs and ReadError.ConnID
+	ID string
+	// Offset is the position in the remote file the connection is at
+	Offset int64
+	// Stalled is how long a read has been blocked, for OnConnStalled
+	Stalled time.Duration
+}
+
+// connHooks are the connection callbacks from Settings
+type connHooks struct {
+	opened  func(info ConnInfo)
+	reused  func(info ConnInfo)
+	closed  func(info ConnInfo)
+	stalled func(info ConnInfo)
+}
+
+// defaultConnStallNotice is how long a read has to block before
+// OnConnStalled is called, when there's no StallTimeout
+const defaultConnStallNotice = 10 * time.Second
+
+func (c *conn) info() ConnInfo {
+	ci := ConnInfo{ID: c.id}
+	if c.Backtracker != nil {
+		ci.Offset = c.Offset()
+	}
+	return ci
+}
+
+func (f *File) notifyConn(hook func(info ConnInfo), c *conn) {
+	if hook == nil {
+		return
+	}
+	hook(c.info())
+}
+
+// watchStall calls OnConnStalled if the read being done on c
+// takes too long, until the returned function is called.
+func (f *File) watchStall(c *conn) (stop func()) {
+	if f.connHooks.stalled == nil {
+		return func() {}
+	}
+
+	d := f.stallTimeout
+	if d <= 0 {
+		d = defaultConnStallNotice
+	}
+	info := c.info()
+	timer := f.clock.AfterFunc(d, func() {
+		info.Stalled = d
+		f.connHooks.stalled(info)
+	})
+	return func() { timer.Stop() }
+}
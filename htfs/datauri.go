@@ -0,0 +1,94 @@
+package htfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// inlineData serves data: URIs from memory
+type inlineData struct {
+	*bytes.Reader
+}
+
+func (id *inlineData) Close() error {
+	return nil
+}
+
+// parseDataURI decodes a data: URI, see RFC 2397. It returns the
+// media type and the data.
+func parseDataURI(uri string) (string, []byte, error) {
+	rest := strings.TrimPrefix(uri, "data:")
+	comma := strings.IndexByte(rest, ',')
+	if comma < 0 {
+		return "", nil, errors.New("missing comma")
+	}
+	params, payload := rest[:comma], rest[comma+1:]
+
+	isBase64 := false
+	if strings.HasSuffix(strings.ToLower(params), ";base64") {
+		isBase64 = true
+		params = params[:len(params)-len(";base64")]
+	}
+
+	mediaType := "text/plain;charset=US-ASCII"
+	if params != "" {
+		if strings.HasPrefix(params, ";") {
+			// parameters without a type, like 'data:;charset=utf-8,'
+			params = "text/plain" + params
+		}
+		mt, ps, err := mime.ParseMediaType(params)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "parsing media type")
+		}
+		mediaType = mime.FormatMediaType(mt, ps)
+	}
+
+	decoded, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "percent-decoding")
+	}
+	if !isBase64 {
+		return mediaType, []byte(decoded), nil
+	}
+
+	// be lenient with whitespace and missing padding
+	decoded = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, decoded)
+	data, err := base64.StdEncoding.DecodeString(decoded)
+	if err != nil {
+		data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(decoded, "="))
+		if err != nil {
+			return "", nil, errors.Wrap(err, "base64-decoding")
+		}
+	}
+	return mediaType, data, nil
+}
+
+// openDataURI serves the File from memory, in lieu of probing a remote one
+func (f *File) openDataURI(uri string) error {
+	mediaType, data, err := parseDataURI(uri)
+	if err != nil {
+		return errors.Wrapf(err, "htfs.Open (parsing data URI)")
+	}
+
+	f.local = &inlineData{bytes.NewReader(data)}
+	f.size = int64(len(data))
+	f.name = "data"
+	f.header = http.Header{
+		"Content-Type":   {mediaType},
+		"Content-Length": {strconv.FormatInt(f.size, 10)},
+	}
+	return nil
+}
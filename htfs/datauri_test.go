@@ -0,0 +1,34 @@
+package htfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseDataURI(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		uri       string
+		mediaType string
+		data      string
+	}{
+		{"data:,A%20brief%20note", "text/plain;charset=US-ASCII", "A brief note"},
+		{"data:text/plain;charset=utf-8;base64,aMOpbGxv", "text/plain; charset=utf-8", "héllo"},
+		{"data:application/json,{\"a\":1}", "application/json", `{"a":1}`},
+		{"data:;base64,aGk", "text/plain;charset=US-ASCII", "hi"},
+		{"data:;charset=utf-8,hi", "text/plain; charset=utf-8", "hi"},
+		{"data:application/octet-stream;base64,AAEC%0AAw==", "application/octet-stream", "\x00\x01\x02\x03"},
+	} {
+		mediaType, data, err := parseDataURI(tc.uri)
+		assert.NoError(err, tc.uri)
+		assert.Equal(tc.mediaType, mediaType, tc.uri)
+		assert.Equal(tc.data, string(data), tc.uri)
+	}
+
+	for _, bad := range []string{"data:text/plain", "data:;base64,!!!", "data:,%zz"} {
+		_, _, err := parseDataURI(bad)
+		assert.Error(err, bad)
+	}
+}
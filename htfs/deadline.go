@@ -0,0 +1,97 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A TimeoutError is returned when a server took too long to send response
+// headers, or stalled in the middle of a response body. It's retried like
+// network errors are.
+type TimeoutError struct {
+	// Phase is either "response header" or "body stall"
+	Phase    string
+	Duration time.Duration
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout (%s)", te.Phase, te.Duration)
+}
+
+// Timeout is part of the net.Error interface
+func (te *TimeoutError) Timeout() bool { return true }
+
+// Temporary is part of the net.Error interface
+func (te *TimeoutError) Temporary() bool { return true }
+
+// requestTimer cancels a request when one of its phases takes too long,
+// and remembers which one did, so we can return a *TimeoutError instead
+// of a generic "context canceled".
+type requestTimer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	clock  Clock
+
+	mu    sync.Mutex
+	fired *TimeoutError
+}
+
+func newRequestTimer(parent context.Context, clock Clock) *requestTimer {
+	ctx, cancel := context.WithCancel(parent)
+	return &requestTimer{ctx: ctx, cancel: cancel, clock: clock}
+}
+
+// arm cancels the request if stop isn't called within d.
+// A zero or negative d means no limit.
+func (rt *requestTimer) arm(phase string, d time.Duration) (stop func()) {
+	if d <= 0 {
+		return func() {}
+	}
+
+	timer := rt.clock.AfterFunc(d, func() {
+		rt.mu.Lock()
+		rt.fired = &TimeoutError{Phase: phase, Duration: d}
+		rt.mu.Unlock()
+		rt.cancel()
+	})
+	return func() { timer.Stop() }
+}
+
+// err returns a *TimeoutError if one of the request's
+// phases timed out, and err otherwise
+func (rt *requestTimer) err(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.fired != nil {
+		return rt.fired
+	}
+	return err
+}
+
+// stallBody fails reads that block for longer than timeout,
+// and releases the request's context when closed.
+type stallBody struct {
+	io.ReadCloser
+	timer   *requestTimer
+	timeout time.Duration
+}
+
+func (sb *stallBody) Read(buf []byte) (int, error) {
+	stop := sb.timer.arm("body stall", sb.timeout)
+	n, err := sb.ReadCloser.Read(buf)
+	stop()
+	return n, sb.timer.err(err)
+}
+
+func (sb *stallBody) Close() error {
+	err := sb.ReadCloser.Close()
+	sb.timer.cancel()
+	return err
+}
@@ -0,0 +1,148 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// eagerConn is a first data request, from the start of the file, sent
+// while the initial request is in flight. See Settings.EagerConnect.
+type eagerConn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// id is the ID of the conn it becomes, if all goes well
+	id       string
+	rangeEnd int64
+
+	done chan struct{}
+	res  *http.Response
+	err  error
+}
+
+func (f *File) startEagerConnect() *eagerConn {
+	ctx, cancel := context.WithCancel(f.ctx)
+	ec := &eagerConn{
+		ctx:    ctx,
+		cancel: cancel,
+		id:     fmt.Sprintf("reader-%d", generateID()),
+		done:   make(chan struct{}),
+	}
+
+	byteRange := "bytes=0-"
+	if f.rampUp != nil {
+		ec.rangeEnd = f.rampUp.Initial
+	}
+	if f.maxRangeSpan > 0 && (ec.rangeEnd == 0 || ec.rangeEnd > f.maxRangeSpan) {
+		ec.rangeEnd = f.maxRangeSpan
+	}
+	if f.chunkSize > 0 {
+		ec.rangeEnd = f.chunkSize
+	}
+	if ec.rangeEnd > 0 {
+		byteRange = fmt.Sprintf("bytes=0-%d", ec.rangeEnd-1)
+	}
+
+	f.goLabeled("EagerConnect", ec.id, func() {
+		defer close(ec.done)
+		// the size isn't known yet, it's checked once it is
+		ec.res, ec.err = f.doRangeRequest(rangeRequest{
+			op:        "EagerConnect",
+			method:    "GET",
+			byteRange: byteRange,
+			attempt:   1,
+			probe:     true,
+			ctx:       ctx,
+		})
+	})
+	return ec
+}
+
+// finishEagerConnect waits for the eager request, and adds it to the
+// pool of connections if the File opened fine and the response agrees
+// with the initial one. It's not retried: if anything's off, it's as if
+// it never happened.
+func (f *File) finishEagerConnect(ec *eagerConn, opened bool) {
+	if !opened {
+		ec.cancel()
+	}
+	<-ec.done
+
+	if ec.err != nil || !opened {
+		if ec.res != nil {
+			ec.res.Body.Close()
+		}
+		if opened {
+			f.log("(EagerConnect) giving up: %v", ec.err)
+		}
+		ec.cancel()
+		return
+	}
+
+	err := f.checkEagerResponse(ec.res)
+	if err == nil && ec.rangeEnd > 0 && f.sizeUnknown() {
+		// it may end right where the file does, and we
+		// wouldn't know whether to ask for more
+		err = errors.Errorf("bounded range for a file of unknown size")
+	}
+	if err != nil {
+		f.log("(EagerConnect) discarding response: %v", err)
+		ec.res.Body.Close()
+		ec.cancel()
+		return
+	}
+
+	c := &conn{
+		file:      f,
+		id:        ec.id,
+		touchedAt: f.clock.Now(),
+	}
+	if f.rampUp != nil && f.chunkSize <= 0 && ec.rangeEnd > 0 && ec.rangeEnd < f.size {
+		c.window = f.rampUp.Initial
+	}
+	err = c.attach(ec.res, 0, ec.rangeEnd)
+	if err != nil {
+		f.log("(EagerConnect) discarding response: %v", err)
+		ec.cancel()
+		return
+	}
+
+	f.log("[%9d-%9d] (EagerConnect) pooled %s", 0, 0, c.id)
+	atomic.AddInt64(&f.stats.connections, 1)
+	f.notifyConn(f.connHooks.opened, c)
+	f.returnConn(c)
+}
+
+// checkEagerResponse returns an error if res seems to be
+// for another version of the file than the initial request
+func (f *File) checkEagerResponse(res *http.Response) error {
+	host := res.Request.URL.Host
+	switch res.StatusCode {
+	case 206:
+		_, _, total, err := parseContentRange(res.Header.Get("content-range"))
+		if err != nil {
+			return err
+		}
+		err = f.checkTotal(host, total)
+		if err != nil {
+			return err
+		}
+	case 200:
+		if res.ContentLength >= 0 {
+			err := f.checkTotal(host, res.ContentLength)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("got HTTP %d", res.StatusCode)
+	}
+
+	if etag := f.headerValue("etag"); etag != "" && res.Header.Get("etag") != etag {
+		return errors.Errorf("etag %q, expected %q", res.Header.Get("etag"), etag)
+	}
+	return nil
+}
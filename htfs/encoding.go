@@ -0,0 +1,150 @@
+package htfs
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// An AcceptEncoding determines which content-encodings a File
+// asks servers for.
+type AcceptEncoding int
+
+const (
+	// AcceptEncodingIdentity sends "Accept-Encoding: identity" with every
+	// request, since compressed ranges make offsets meaningless. This is
+	// the default.
+	AcceptEncodingIdentity AcceptEncoding = iota
+	// AcceptEncodingGzipMetadata sends "Accept-Encoding: gzip" with
+	// requests that have no Range header, like ProbeHead's, and
+	// "identity" with the others.
+	AcceptEncodingGzipMetadata
+	// AcceptEncodingTransport leaves Accept-Encoding to the Client's
+	// Transport. http.Transport sends none for HEAD and range requests,
+	// and asks for gzip otherwise, which it transparently decodes. Range
+	// responses that were decoded are only used when
+	// Settings.DecodeContentEncoding is set, like those File decodes itself.
+	AcceptEncodingTransport
+)
+
+func (ae AcceptEncoding) String() string {
+	switch ae {
+	case AcceptEncodingIdentity:
+		return "identity"
+	case AcceptEncodingGzipMetadata:
+		return "gzip-metadata"
+	case AcceptEncodingTransport:
+		return "transport"
+	default:
+		return "unknown"
+	}
+}
+
+// setAcceptEncoding sets the Accept-Encoding header of req, if
+// it's up to us, see Settings.AcceptEncoding
+func (f *File) setAcceptEncoding(req *http.Request) {
+	switch f.acceptEncoding {
+	case AcceptEncodingTransport:
+		return
+	case AcceptEncodingGzipMetadata:
+		if req.Header.Get("Range") == "" {
+			req.Header.Set("Accept-Encoding", "gzip")
+			return
+		}
+	}
+	// compressed responses to range requests make offsets meaningless
+	req.Header.Set("Accept-Encoding", "identity")
+}
+
+// checkContentEncoding makes sure we can use the body of res as-is: if the
+// server compressed it anyway, it is either transparently decoded (when
+// Settings.DecodeContentEncoding is set), or a *ContentEncodingError is returned.
+func (f *File) checkContentEncoding(req *http.Request, res *http.Response) error {
+	if req.Method == "HEAD" {
+		return nil
+	}
+
+	if res.Uncompressed && req.Header.Get("Range") != "" {
+		// the Transport decoded it already, see AcceptEncodingTransport
+		if !f.decodeContentEncoding {
+			return &ContentEncodingError{
+				Host:     req.Host,
+				Encoding: "gzip",
+			}
+		}
+		f.log2("(Encoding) using gzip response decoded by the transport from %s", req.Host)
+		return nil
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+
+	if !f.decodeContentEncoding {
+		return &ContentEncodingError{
+			Host:     req.Host,
+			Encoding: encoding,
+		}
+	}
+
+	body, err := decodingReader(encoding, res.Body)
+	if err != nil {
+		return errors.Wrapf(err, "while decoding %s response", encoding)
+	}
+
+	f.log2("(Encoding) decoding %s response from %s", encoding, req.Host)
+	res.Body = body
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	return nil
+}
+
+func decodingReader(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &decodedBody{Reader: gr, decoder: gr, body: body}, nil
+	case "deflate":
+		// that's the zlib format, some servers send raw DEFLATE anyway
+		br := bufio.NewReader(body)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return &decodedBody{Reader: zr, decoder: zr, body: body}, nil
+		}
+		fr := flate.NewReader(br)
+		return &decodedBody{Reader: fr, decoder: fr, body: body}, nil
+	default:
+		return nil, &ContentEncodingError{Encoding: encoding}
+	}
+}
+
+// isZlibHeader returns true if header, the first two bytes of
+// a stream, are a zlib header for DEFLATE data, see RFC 1950
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (db *decodedBody) Close() error {
+	db.decoder.Close()
+	return db.body.Close()
+}
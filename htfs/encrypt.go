@@ -0,0 +1,60 @@
+package htfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// newBlockCipher returns what blocks are sealed with, for
+// CacheSettings.EncryptionKey. The key must be 16, 24, or 32 bytes.
+func newBlockCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid cache encryption key")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead, nil
+}
+
+// keyFingerprint tells keys apart without giving them away, so that
+// blocks sealed with different keys are kept in different directories.
+func keyFingerprint(key []byte) string {
+	h := sha256.New()
+	h.Write([]byte("htfs cache key\x00"))
+	h.Write(key)
+	return hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+// sealBlock encrypts what's stored for the block with the given key.
+// The key is authenticated too, so that blocks can't be swapped around.
+func sealBlock(aead cipher.AEAD, key string, contents []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(contents)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead.Seal(nonce, nonce, contents, []byte(key)), nil
+}
+
+// openBlock undoes sealBlock. Blocks that were tampered with, sealed
+// with another key, or stored under another key, are corrupt.
+func openBlock(aead cipher.AEAD, key string, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errCorruptBlock
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	contents, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, errCorruptBlock
+	}
+	return contents, nil
+}
@@ -1,6 +1,15 @@
 package htfs
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 type needsRenewalError struct {
 	url string
@@ -37,3 +46,217 @@ type ServerError struct {
 func (se *ServerError) Error() string {
 	return fmt.Sprintf("%s: %s", se.Host, se.Message)
 }
+
+// ContentEncodingError is returned when a server applies a content-encoding
+// (like gzip) to a ranged response, even though we asked for the identity
+// encoding. Offsets into such a response wouldn't match offsets into the
+// remote file, so we refuse to use it unless Settings.DecodeContentEncoding
+// is set.
+type ContentEncodingError struct {
+	Host     string
+	Encoding string
+}
+
+func (cee *ContentEncodingError) Error() string {
+	return fmt.Sprintf("%s: unexpected content-encoding %q for range request", cee.Host, cee.Encoding)
+}
+
+// SizeMismatchError is returned when a server answers a range request
+// with a Content-Range whose total size isn't the one the File was opened
+// with. The range is probably from another version of the remote file, so
+// it isn't retried.
+type SizeMismatchError struct {
+	Host     string
+	Expected int64
+	Actual   int64
+}
+
+func (sme *SizeMismatchError) Error() string {
+	return fmt.Sprintf("%s: content-range reports a size of %d bytes, expected %d", sme.Host, sme.Actual, sme.Expected)
+}
+
+// RangeNotSatisfiableError is returned when a server answers a range
+// request with HTTP 416 before the end of the remote file, usually because
+// the file shrank. At the end of the file, reads return io.EOF instead.
+type RangeNotSatisfiableError struct {
+	Host   string
+	Offset int64
+	// Size is what the server reported in Content-Range,
+	// or UnknownSize if it didn't say.
+	Size int64
+
+	// for the initial request, see File.probe
+	header     http.Header
+	requestURL *url.URL
+}
+
+func (rnse *RangeNotSatisfiableError) Error() string {
+	if rnse.Size == UnknownSize {
+		return fmt.Sprintf("%s: range from offset %d not satisfiable", rnse.Host, rnse.Offset)
+	}
+	return fmt.Sprintf("%s: range from offset %d not satisfiable, file is %d bytes", rnse.Host, rnse.Offset, rnse.Size)
+}
+
+// unsatisfiedRangeSize parses the Content-Range of a 416
+// response ("bytes */size"), if any
+func unsatisfiedRangeSize(value string) int64 {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "bytes */") {
+		return UnknownSize
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(value, "bytes */"), 10, 64)
+	if err != nil || size < 0 {
+		return UnknownSize
+	}
+	return size
+}
+
+// rangeEOF turns a *RangeNotSatisfiableError for a range that starts at
+// or past the end of the remote file into io.EOF, which it means there.
+// That's the size the File was opened with if it's known, otherwise the
+// one the server reported.
+func (f *File) rangeEOF(err error) error {
+	rnse, ok := errors.Cause(err).(*RangeNotSatisfiableError)
+	if !ok {
+		return err
+	}
+
+	end := rnse.Size
+	if f.knownSize() {
+		end = f.size
+	}
+	if end == UnknownSize || rnse.Offset < end {
+		return err
+	}
+	if f.sizeUnknown() {
+		f.observeEnd(end)
+	}
+	return io.EOF
+}
+
+// A ReadError is returned by ReadAt, Read and Seek when they fail,
+// with as much context as is known about the request that failed.
+// Use errors.Cause to get to the underlying error.
+type ReadError struct {
+	// Op is the method that failed: "ReadAt", "Read" or "Seek"
+	Op     string
+	Offset int64
+	Length int64
+
+	// ConnID identifies the connection the read was done on, if any
+	ConnID string
+	// Attempt is the number of attempts made at the last request, if any
+	Attempt int
+	// StatusCode is the HTTP status the server last answered with, if any
+	StatusCode int
+
+	Err error
+}
+
+func (re *ReadError) Error() string {
+	var details []string
+	if re.ConnID != "" {
+		details = append(details, "conn "+re.ConnID)
+	}
+	if re.Attempt > 0 {
+		details = append(details, fmt.Sprintf("attempt %d", re.Attempt))
+	}
+	if re.StatusCode != 0 {
+		details = append(details, fmt.Sprintf("HTTP %d", re.StatusCode))
+	}
+
+	msg := fmt.Sprintf("htfs: %s of %d bytes at offset %d", re.Op, re.Length, re.Offset)
+	if len(details) > 0 {
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+	return msg + ": " + re.Err.Error()
+}
+
+// Cause returns the underlying error, for github.com/pkg/errors
+func (re *ReadError) Cause() error {
+	return re.Err
+}
+
+// attemptError records how many attempts were made before giving up
+type attemptError struct {
+	attempt int
+	err     error
+}
+
+func (ae *attemptError) Error() string {
+	return ae.err.Error()
+}
+
+func (ae *attemptError) Cause() error {
+	return ae.err
+}
+
+func withAttempt(attempt int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &attemptError{attempt: attempt, err: err}
+}
+
+// connError records which connection an error happened on
+type connError struct {
+	connID string
+	err    error
+}
+
+func (ce *connError) Error() string {
+	return ce.err.Error()
+}
+
+func (ce *connError) Cause() error {
+	return ce.err
+}
+
+// newReadError wraps err with the context found along its chain of causes.
+// io.EOF and nil are returned as-is, since callers compare against them.
+func newReadError(op string, offset int64, length int, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+
+	re := &ReadError{
+		Op:     op,
+		Offset: offset,
+		Length: int64(length),
+		Err:    err,
+	}
+
+	type causer interface {
+		Cause() error
+	}
+	for e := err; e != nil; {
+		switch e := e.(type) {
+		case *ReadError:
+			// already wrapped
+			return e
+		case *connError:
+			if re.ConnID == "" {
+				re.ConnID = e.connID
+			}
+		case *attemptError:
+			if re.Attempt == 0 {
+				re.Attempt = e.attempt
+			}
+		case *ServerError:
+			if re.StatusCode == 0 {
+				re.StatusCode = e.StatusCode
+			}
+		case *RangeNotSatisfiableError:
+			if re.StatusCode == 0 {
+				re.StatusCode = http.StatusRequestedRangeNotSatisfiable
+			}
+		}
+
+		c, ok := e.(causer)
+		if !ok {
+			break
+		}
+		e = c.Cause()
+	}
+	return re
+}
@@ -0,0 +1,318 @@
+package htfs
+
+import (
+	"container/list"
+)
+
+// An EvictionPolicy determines which blocks a Cache drops
+// first when it's over budget.
+type EvictionPolicy int
+
+const (
+	// EvictLRU drops the least recently used blocks first. This is the default.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU drops the least frequently used blocks first, and among those,
+	// the least recently used ones. Suited to workloads that keep coming back
+	// to the same structures (indexes, headers).
+	EvictLFU
+	// EvictARC uses Adaptive Replacement Caching, which balances between
+	// recency and frequency depending on what the workload rewards, and resists
+	// one-off scans (like verifying a whole file) flushing the cache.
+	EvictARC
+)
+
+func (ep EvictionPolicy) String() string {
+	switch ep {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	case EvictARC:
+		return "arc"
+	default:
+		return "unknown"
+	}
+}
+
+// evictor tracks resident keys of a Cache in the order they should be evicted.
+// It's only ever called with the Cache's lock held.
+type evictor interface {
+	added(key string)
+	accessed(key string)
+	removed(key string)
+	// walk calls fn with resident keys, in eviction order,
+	// for as long as it returns true.
+	walk(fn func(key string) bool)
+}
+
+func newEvictor(policy EvictionPolicy, capacity int) evictor {
+	switch policy {
+	case EvictLFU:
+		return newLFUEvictor()
+	case EvictARC:
+		return newARCEvictor(capacity)
+	default:
+		return newLRUEvictor()
+	}
+}
+
+// keyList is a list of keys, most recent at the front,
+// that also knows which keys it holds
+type keyList struct {
+	l        *list.List
+	elements map[string]*list.Element
+}
+
+func newKeyList() *keyList {
+	return &keyList{
+		l:        list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (kl *keyList) has(key string) bool {
+	_, ok := kl.elements[key]
+	return ok
+}
+
+func (kl *keyList) pushFront(key string) {
+	if el, ok := kl.elements[key]; ok {
+		kl.l.MoveToFront(el)
+		return
+	}
+	kl.elements[key] = kl.l.PushFront(key)
+}
+
+func (kl *keyList) remove(key string) bool {
+	el, ok := kl.elements[key]
+	if !ok {
+		return false
+	}
+	kl.l.Remove(el)
+	delete(kl.elements, key)
+	return true
+}
+
+func (kl *keyList) removeBack() {
+	if el := kl.l.Back(); el != nil {
+		kl.remove(el.Value.(string))
+	}
+}
+
+func (kl *keyList) len() int {
+	return kl.l.Len()
+}
+
+// walkBack iterates from the least recent key, and returns
+// false if fn asked to stop.
+func (kl *keyList) walkBack(fn func(key string) bool) bool {
+	for el := kl.l.Back(); el != nil; {
+		prev := el.Prev()
+		if !fn(el.Value.(string)) {
+			return false
+		}
+		el = prev
+	}
+	return true
+}
+
+type lruEvictor struct {
+	keys *keyList
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{keys: newKeyList()}
+}
+
+func (e *lruEvictor) added(key string)              { e.keys.pushFront(key) }
+func (e *lruEvictor) accessed(key string)           { e.keys.pushFront(key) }
+func (e *lruEvictor) removed(key string)            { e.keys.remove(key) }
+func (e *lruEvictor) walk(fn func(key string) bool) { e.keys.walkBack(fn) }
+
+// lfuEvictor keeps one recency list per access count
+type lfuEvictor struct {
+	counts  map[string]int
+	buckets map[int]*keyList
+	// sorted is the list of counts that have a bucket, lowest first
+	sorted []int
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{
+		counts:  make(map[string]int),
+		buckets: make(map[int]*keyList),
+	}
+}
+
+func (e *lfuEvictor) bucket(count int) *keyList {
+	b, ok := e.buckets[count]
+	if !ok {
+		b = newKeyList()
+		e.buckets[count] = b
+
+		i := 0
+		for i < len(e.sorted) && e.sorted[i] < count {
+			i++
+		}
+		e.sorted = append(e.sorted, 0)
+		copy(e.sorted[i+1:], e.sorted[i:])
+		e.sorted[i] = count
+	}
+	return b
+}
+
+func (e *lfuEvictor) unbucket(key string, count int) {
+	b := e.buckets[count]
+	b.remove(key)
+	if b.len() > 0 {
+		return
+	}
+
+	delete(e.buckets, count)
+	for i, c := range e.sorted {
+		if c == count {
+			e.sorted = append(e.sorted[:i], e.sorted[i+1:]...)
+			break
+		}
+	}
+}
+
+func (e *lfuEvictor) added(key string) {
+	if _, ok := e.counts[key]; ok {
+		e.accessed(key)
+		return
+	}
+	e.counts[key] = 1
+	e.bucket(1).pushFront(key)
+}
+
+func (e *lfuEvictor) accessed(key string) {
+	count, ok := e.counts[key]
+	if !ok {
+		return
+	}
+	e.unbucket(key, count)
+	e.counts[key] = count + 1
+	e.bucket(count + 1).pushFront(key)
+}
+
+func (e *lfuEvictor) removed(key string) {
+	count, ok := e.counts[key]
+	if !ok {
+		return
+	}
+	e.unbucket(key, count)
+	delete(e.counts, key)
+}
+
+func (e *lfuEvictor) walk(fn func(key string) bool) {
+	// fn may remove keys, so iterate over a snapshot of the counts
+	counts := append([]int(nil), e.sorted...)
+	for _, count := range counts {
+		b, ok := e.buckets[count]
+		if !ok {
+			continue
+		}
+		if !b.walkBack(fn) {
+			return
+		}
+	}
+}
+
+// arcEvictor implements Adaptive Replacement Caching: t1 holds keys seen
+// once recently, t2 keys seen at least twice. b1 and b2 remember keys
+// recently evicted from t1 and t2, and hits there adjust p, the share
+// of the capacity given to t1.
+type arcEvictor struct {
+	capacity int
+	p        int
+
+	t1, t2, b1, b2 *keyList
+}
+
+func newARCEvictor(capacity int) *arcEvictor {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &arcEvictor{
+		capacity: capacity,
+		t1:       newKeyList(),
+		t2:       newKeyList(),
+		b1:       newKeyList(),
+		b2:       newKeyList(),
+	}
+}
+
+func (e *arcEvictor) added(key string) {
+	switch {
+	case e.t1.has(key) || e.t2.has(key):
+		e.accessed(key)
+	case e.b1.has(key):
+		// we evicted it too early: recency deserves more room
+		delta := 1
+		if e.b1.len() < e.b2.len() {
+			delta = e.b2.len() / e.b1.len()
+		}
+		e.p = minInt(e.capacity, e.p+delta)
+		e.b1.remove(key)
+		e.t2.pushFront(key)
+	case e.b2.has(key):
+		// frequency deserves more room
+		delta := 1
+		if e.b2.len() < e.b1.len() {
+			delta = e.b1.len() / e.b2.len()
+		}
+		e.p = maxInt(0, e.p-delta)
+		e.b2.remove(key)
+		e.t2.pushFront(key)
+	default:
+		e.t1.pushFront(key)
+	}
+}
+
+func (e *arcEvictor) accessed(key string) {
+	if e.t1.remove(key) || e.t2.has(key) {
+		e.t2.pushFront(key)
+	}
+}
+
+func (e *arcEvictor) removed(key string) {
+	if e.t1.remove(key) {
+		e.b1.pushFront(key)
+	} else if e.t2.remove(key) {
+		e.b2.pushFront(key)
+	}
+
+	for e.b1.len() > e.capacity {
+		e.b1.removeBack()
+	}
+	for e.b2.len() > e.capacity {
+		e.b2.removeBack()
+	}
+}
+
+func (e *arcEvictor) walk(fn func(key string) bool) {
+	first, second := e.t2, e.t1
+	if e.t1.len() > 0 && e.t1.len() >= maxInt(e.p, 1) {
+		first, second = e.t1, e.t2
+	}
+
+	if !first.walkBack(fn) {
+		return
+	}
+	second.walkBack(fn)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
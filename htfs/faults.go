@@ -0,0 +1,169 @@
+package htfs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Fault is a failure injected into a File's requests, see InjectFault.
+// It's meant for testing how consumers of htfs handle errors, against a
+// well-behaved server.
+type Fault struct {
+	// Request is which of the next requests the fault is injected into,
+	// counting from 1 in the order they're sent, retries included. Zero
+	// means all of them. Parallel reads and readahead send requests in no
+	// particular order, turn them off (see Settings.NoReadAhead) or set Op.
+	Request int
+	// Op, if set, only counts requests for that purpose, as shown in
+	// logs: "Probe", "Connect", "FetchRanges", "Tail", and so on.
+	Op string
+
+	// Delay holds the request back before it's sent, like a slow
+	// network or a congested server would.
+	Delay time.Duration
+	// Err, if set, is returned instead of sending the request. It's
+	// retried if it's a network error, like a *net.OpError.
+	Err error
+	// StatusCode, if set, is that of an empty response returned
+	// instead of sending the request, like 503, or 403 for URLs
+	// that need renewing.
+	StatusCode int
+	// Corrupt flips the bits of the first byte of the response body
+	Corrupt bool
+}
+
+func (fa Fault) String() string {
+	var what string
+	switch {
+	case fa.Err != nil:
+		what = fmt.Sprintf("error %v", fa.Err)
+	case fa.StatusCode != 0:
+		what = fmt.Sprintf("HTTP %d", fa.StatusCode)
+	case fa.Corrupt:
+		what = "corruption"
+	default:
+		what = "nothing"
+	}
+	if fa.Delay > 0 {
+		what = fmt.Sprintf("%s after %s", what, fa.Delay)
+	}
+	return what
+}
+
+// faultInjector holds the faults of a File, and counts its requests
+type faultInjector struct {
+	mu     sync.Mutex
+	faults []*injectedFault
+	// counts are the requests sent so far, by Op, and in total under ""
+	counts map[string]int
+}
+
+type injectedFault struct {
+	Fault
+	// base is how many requests it counts were sent before it was injected
+	base int
+}
+
+// InjectFault makes the File fail one of its next requests, or all of
+// them, as described by fault, for testing. Faults already injected
+// stay in place.
+func (f *File) InjectFault(fault Fault) {
+	fi := f.faults
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.faults = append(fi.faults, &injectedFault{Fault: fault, base: fi.counts[fault.Op]})
+}
+
+// ClearFaults removes all faults injected into the File
+func (f *File) ClearFaults() {
+	fi := f.faults
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.faults = nil
+}
+
+// next counts a request for op, and returns the faults it gets
+func (fi *faultInjector) next(op string) []Fault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	if fi.counts == nil {
+		fi.counts = make(map[string]int)
+	}
+	fi.counts[""]++
+	if op != "" {
+		fi.counts[op]++
+	}
+
+	var res []Fault
+	kept := fi.faults[:0]
+	for _, fault := range fi.faults {
+		if fault.Op != "" && fault.Op != op {
+			kept = append(kept, fault)
+			continue
+		}
+		n := fi.counts[fault.Op] - fault.base
+		if fault.Request == 0 || fault.Request == n {
+			res = append(res, fault.Fault)
+		}
+		if fault.Request == 0 || fault.Request > n {
+			kept = append(kept, fault)
+		}
+	}
+	fi.faults = kept
+	return res
+}
+
+// injectFaults applies the faults req gets before it's sent. It returns
+// the response or error to use instead of sending it, if any, and
+// whether to corrupt the response.
+func (f *File) injectFaults(req *http.Request, rr rangeRequest) (res *http.Response, corrupt bool, err error) {
+	for _, fault := range f.faults.next(rr.op) {
+		f.log("[%9d-%9d] (%s) injecting %s", rr.offset, rr.offset, rr.op, fault)
+		if fault.Delay > 0 {
+			sleep(f.clock, req.Context(), fault.Delay)
+			if ctxErr := req.Context().Err(); ctxErr != nil {
+				return nil, false, errors.WithStack(ctxErr)
+			}
+		}
+		if fault.Err != nil {
+			return nil, false, fault.Err
+		}
+		if fault.StatusCode != 0 {
+			return &http.Response{
+				Status:     fmt.Sprintf("%d %s", fault.StatusCode, http.StatusText(fault.StatusCode)),
+				StatusCode: fault.StatusCode,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     make(http.Header),
+				Body:       http.NoBody,
+				Request:    req,
+			}, false, nil
+		}
+		corrupt = corrupt || fault.Corrupt
+	}
+	return nil, corrupt, nil
+}
+
+// corruptBody flips the bits of the first byte read from it
+type corruptBody struct {
+	io.ReadCloser
+	done bool
+}
+
+func (cb *corruptBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if n > 0 && !cb.done {
+		p[0] ^= 0xff
+		cb.done = true
+	}
+	return n, err
+}
@@ -0,0 +1,148 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// A Fetcher reads remote files from something other than an HTTP server,
+// like the API of an object store, see Settings.Fetcher. The File uses it
+// instead of its Client, and reuses streams for sequential reads, reads
+// ahead, retries, and keeps stats, just like it does with requests.
+//
+// Errors are retried if the File's retry settings deem them retriable,
+// see retrycontext.Settings.IsRetriable and neterr.RegisterPredicate.
+type Fetcher interface {
+	// Size returns the size of the remote file, or UnknownSize
+	Size(ctx context.Context) (int64, error)
+
+	// OpenRangeStream returns the bytes of the remote file from offset up
+	// to end, exclusive, or up to the end of the file if end is
+	// UnknownSize. If the file is shorter, the stream just stops early.
+	// The stream should stop when ctx is done.
+	OpenRangeStream(ctx context.Context, offset int64, end int64) (*RangeStream, error)
+}
+
+// A RangeStream is a part of a remote file, see Fetcher.OpenRangeStream
+type RangeStream struct {
+	// Body holds the bytes, it's closed by the File
+	Body io.ReadCloser
+	// Size is the size of the whole remote file, or UnknownSize
+	Size int64
+}
+
+// roundTrip sends req with the File's Client, or lets its
+// Fetcher answer it, see fetcherResponse. Injected faults
+// apply either way, see InjectFault.
+func (f *File) roundTrip(req *http.Request, rr rangeRequest) (*http.Response, error) {
+	res, corrupt, err := f.injectFaults(req, rr)
+	if res != nil || err != nil {
+		return res, err
+	}
+
+	if f.fetcher == nil {
+		res, err = f.client.Do(req)
+	} else {
+		res, err = f.fetcherResponse(req, rr)
+	}
+	if err == nil && corrupt {
+		res.Body = &corruptBody{ReadCloser: res.Body}
+	}
+	return res, err
+}
+
+// fetcherResponse makes the File's Fetcher answer req like an HTTP
+// server would: 200 for the whole file, 206 with a Content-Range for
+// parts of it, 416 for ranges past its end. Parts that go to the end
+// of a file of unknown size have no Content-Range.
+func (f *File) fetcherResponse(req *http.Request, rr rangeRequest) (*http.Response, error) {
+	ctx := req.Context()
+	res := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+
+	if req.Method == "HEAD" {
+		size, err := f.fetcher.Size(ctx)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		res.ContentLength = size
+		return res, nil
+	}
+
+	start, end := int64(0), UnknownSize
+	if rr.byteRange != "" {
+		br, err := parseByteRange(rr.byteRange)
+		if err != nil {
+			return nil, err
+		}
+		if br.Suffix() {
+			size, err := f.fetcher.Size(ctx)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if size == UnknownSize {
+				return nil, errors.Errorf("can't fetch range %s of a file of unknown size", br)
+			}
+			start = size + br.Start
+			if start < 0 {
+				start = 0
+			}
+		} else {
+			start = br.Start
+			if br.End >= 0 {
+				end = br.End + 1
+			}
+		}
+	}
+
+	stream, err := f.fetcher.OpenRangeStream(ctx, start, end)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	total := stream.Size
+	if total >= 0 && (end == UnknownSize || end > total) {
+		end = total
+	}
+
+	if rr.byteRange == "" || (start == 0 && end == UnknownSize) {
+		// all of it, of a size that may be unknown
+		res.ContentLength = total
+		res.Body = stream.Body
+		return res, nil
+	}
+
+	totalStr := "*"
+	if total >= 0 {
+		totalStr = strconv.FormatInt(total, 10)
+	}
+	if total >= 0 && start >= total {
+		stream.Body.Close()
+		res.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		res.Status = "416 Requested Range Not Satisfiable"
+		res.Header.Set("Content-Range", "bytes */"+totalStr)
+		return res, nil
+	}
+
+	res.StatusCode = http.StatusPartialContent
+	res.Status = "206 Partial Content"
+	res.ContentLength = -1
+	if end >= 0 {
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end-1, totalStr))
+		res.ContentLength = end - start
+	}
+	res.Body = stream.Body
+	return res, nil
+}
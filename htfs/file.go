@@ -1,18 +1,19 @@
 package htfs
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"math"
-	"mime"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	goerrors "errors"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/itchio/httpkit/neterr"
 	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
 	"github.com/pkg/errors"
 )
 
@@ -54,14 +56,22 @@ type hstats struct {
 	// this needs to be 64-bit aligned
 	fetchedBytes int64
 	cachedBytes  int64
+	hedges       int64
+	hedgeWins    int64
+	rampUps      int64
+	rotations    int64
 
 	numCacheMiss int64
 	numCacheHits int64
 
 	connectionWait time.Duration
-	connections    int
-	expired        int
-	renews         int
+	connections    int64
+	expired        int64
+	renews         int64
+	retries        int64
+
+	// connReports is filled as conns are closed, when dumping stats
+	connReports []connReport
 }
 
 var idSeed int64 = 1
@@ -69,36 +79,151 @@ var idMutex sync.Mutex
 
 // File allows accessing a file served by an HTTP server as if it was local
 // (for random-access reading purposes, not writing)
+//
+// ReadAt and ReadMulti may be called from any number of goroutines at once.
+// Read and Seek share a single cursor, and calls to them are serialized:
+// they're safe, but concurrent sequential readers will interleave. To
+// read sequentially from several goroutines, give each its own cursor
+// with io.NewSectionReader.
 type File struct {
 	getURL        GetURLFunc
 	needsRenewal  NeedsRenewalFunc
 	client        *http.Client
+	ownsClient    bool
 	retrySettings *retrycontext.Settings
 
 	Log      LogFunc
 	LogLevel int
+	// set by SetLogger, takes precedence over Log and LogLevel
+	logger atomic.Value
 
 	name   string
 	size   int64
 	offset int64 // for io.ReadSeeker
+	// protects offset, held for the whole duration of Read and Seek
+	offsetMutex sync.Mutex
 
 	ConnStaleThreshold time.Duration
 	MaxConns           int
 
+	tuner         *connTuner
+	probeStrategy ProbeStrategy
+	rangeStrategy RangeStrategy
+	fetcher       Fetcher
+	knownSizeHint int64
+
+	// opened is set atomically, under openMutex, see isOpened
+	opened    int32
+	openMutex sync.Mutex
+
 	closed bool
 
 	conns     map[string]*conn
 	connsLock sync.Mutex
 
-	currentURL string
-	urlMutex   sync.Mutex
-	header     http.Header
-	requestURL *url.URL
-
-	stats *hstats
+	currentURL     string
+	urlMutex       sync.Mutex
+	header         http.Header
+	requestURL     *url.URL
+	effectiveURL   *url.URL
+	redirectPolicy *RedirectPolicy
+	redirectTarget string
+	// when to stop using redirectTarget, zero if never
+	redirectTargetExpiry time.Time
+	extraHeader          http.Header
+
+	// urlHash identifies the File in pprof labels, see labels.go
+	urlHash string
+
+	// when currentURL expires, zero if unknown, see renewIfExpiring
+	currentURLExpiry time.Time
+	// held while renewing, so concurrent requests renew only once
+	renewalMutex sync.Mutex
+
+	decodeContentEncoding bool
+	acceptEncoding        AcceptEncoding
+
+	backingPath string
+	backing     *sparseBacking
+
+	// local is set when the URL points to a local file (see localPath),
+	// or is a data: URI
+	local localSource
+
+	stats    *hstats
+	transfer *transferCounters
+	phases   *phaseCounters
+	latency  *latencyCounters
+	faults   *faultInjector
+	heatmap  *heatmapRecorder
+	// privateStore holds the blocks of the File's own cache,
+	// when Settings.Cache is nil
+	privateStore *memoryStore
+
+	accessLog      io.Writer
+	accessLogJSON  bool
+	accessLogMutex sync.Mutex
+
+	disableRedaction bool
+
+	onRetry     func(info RetryInfo)
+	onRenewal   func(info RenewalInfo)
+	connHooks   connHooks
+	retryBudget *RetryBudget
+	hedgeAfter  time.Duration
+	noReadAhead bool
+	rampUp      *RampUp
+	userAgent   string
+	proxy       func(*http.Request) (*url.URL, error)
+	host        string
+	verifyReads float64
+	clock       Clock
+	rand        *rand.Rand
+
+	blockAligned bool
+	eagerConnect bool
+	readahead    *readahead
+	memoryBudget *MemoryBudget
+	memoryWait   time.Duration
+	maxRangeSpan int64
+	chunkSize    int64
+
+	maxBytesPerConn int64
+
+	responseHeaderTimeout time.Duration
+	stallTimeout          time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// workers tracks background goroutines, closedChan
+	// is closed by Close, see WaitClosed.
+	workers    *priorityGate
+	closedChan chan struct{}
+
+	suppressedMutex sync.Mutex
+	suppressed      []SuppressedError
+
+	pins filePins
+
+	// openedAt and closedAt bound the File's Summary
+	openedAt time.Time
+	closedAt time.Time
+
+	// endOffset is where the file turned out to end, for
+	// files of UnknownSize
+	endMutex  sync.Mutex
+	endOffset int64
+
+	blocks    *fileBlocks
+	preloader *preloader
+	gate      *priorityGate
+	// cacheKey is from Settings.CacheKey, nil means the whole URL
+	cacheKey func(urlStr string) string
 
 	ForbidBacktracking bool
 	DumpStats          bool
+	PropagatePanics    bool
 }
 
 type Resetter interface {
@@ -126,40 +251,473 @@ type Settings struct {
 	LogLevel           int
 	ForbidBacktracking bool
 	DumpStats          bool
+
+	// MaxConns is the number of connections a File keeps around
+	// to serve reads. When AutoTuneConns is set, it's the upper bound.
+	MaxConns int
+
+	// AutoTuneConns enables adaptive sizing of the connection pool:
+	// it grows while aggregate throughput improves, and shrinks when
+	// additional connections stop helping, between MinConns and MaxConns.
+	AutoTuneConns bool
+	MinConns      int
+
+	// Size can be set if the caller already knows the exact size of the
+	// remote file (from a manifest, for example). Open will then skip the
+	// initial request entirely. GetHeader will return nil in that case,
+	// and blocks already in Cache aren't revalidated.
+	Size int64
+
+	// ProbeStrategy determines which request is used to find out
+	// the size of the remote file on open. See ProbeStrategy.
+	//
+	// Files with the same Client opening the same URL at the same time
+	// share ProbeHead and ProbeSingleByte requests, as well as those
+	// revalidating cached blocks, and URL renewals. ProbeStream requests
+	// aren't shared, since each File keeps reading from its own.
+	ProbeStrategy ProbeStrategy
+
+	// RangeStrategy, if set, is how parts of the remote file are asked
+	// for, instead of Range headers, see QueryRanges. Then, each range
+	// of ReadMulti and preloads is a request of its own.
+	RangeStrategy RangeStrategy
+
+	// Fetcher, if set, reads the remote file instead of HTTP requests,
+	// see Fetcher. The URL still names the remote file, in logs, caches,
+	// and FileInfo, but isn't requested. Client, and settings about
+	// connections (Proxy, Timeouts, Host, Redirects), are ignored, and
+	// RangeStrategy can't be set.
+	Fetcher Fetcher
+
+	// Lazy defers all network activity (getting a URL, probing the
+	// remote file) until the first read, Seek, or Stat call. Open then
+	// returns immediately, and errors are returned by that first call.
+	Lazy bool
+
+	// Redirects controls how redirects are followed, see RedirectPolicy.
+	// If nil, the client's own policy is used.
+	Redirects *RedirectPolicy
+
+	// Header contains additional headers to send with every
+	// request, for example credentials. Files opened with different
+	// ones never share blocks of a Cache.
+	Header http.Header
+
+	// UserAgent is sent with every request, instead of DefaultUserAgent.
+	// A User-Agent in Header takes precedence.
+	UserAgent string
+
+	// Clock is what the File tells time with, for stale connection reaping,
+	// retry backoff, timeouts and stats. If nil, SystemClock is used.
+	// Tests can pass a ManualClock to avoid real sleeps.
+	Clock Clock
+
+	// Rand, if set, is the source of randomness for retry backoff jitter
+	// (unless RetrySettings has its own) and for VerifyReads sampling.
+	// With a seeded source, a File makes the same choices from one run
+	// to the next. It doesn't need to be safe for concurrent use.
+	Rand rand.Source
+
+	// DecodeContentEncoding makes File transparently decode responses
+	// servers compressed despite our "Accept-Encoding: identity" header,
+	// assuming they compressed the requested range on the fly. By default,
+	// a *ContentEncodingError is returned instead.
+	DecodeContentEncoding bool
+
+	// AcceptEncoding determines the Accept-Encoding header sent with
+	// requests, for servers that refuse "identity". See AcceptEncoding.
+	AcceptEncoding AcceptEncoding
+
+	// BackingFile is the path of a local file every fetched byte is also
+	// written to, at its real offset. The file is sparse, and a bitmap of
+	// present data is kept next to it (with a ".map" extension), so that
+	// reads can be served locally, even across Files. It's discarded if
+	// the remote file's ETag or Last-Modified date changed since.
+	BackingFile string
+
+	// Cache is where blocks of the file are kept once fetched, and it may
+	// be shared by many Files. When nil, each File has its own in-memory
+	// cache, which is dropped on Close. If Cache already holds blocks of
+	// the remote file, the initial request is a conditional one, and they
+	// are dropped if the file has changed since.
+	Cache *Cache
+
+	// BlockSize is the size of blocks in the File's private cache,
+	// when Cache is nil. Defaults to 256KB.
+	BlockSize int64
+
+	// BlockAligned rounds every fetch up to whole blocks of the cache's
+	// block size, and caches them, so that many small reads in the same
+	// area only cost one request. It needs the size of the file to be known.
+	// When Cache is nil, blocks are kept in memory until the File is
+	// closed, within its MemoryBudget and CacheQuota: those that don't fit
+	// are only used for the read that fetched them.
+	BlockAligned bool
+
+	// CacheQuota is the most this File may hold in its Cache, in bytes.
+	// When it's exceeded, the File's own blocks are evicted first.
+	// Zero means it's only bound by the Cache's size limit.
+	CacheQuota int64
+
+	// CacheKey tells which remote file a URL is for, as far as the Cache
+	// is concerned: URLs it returns the same string for share blocks
+	// (unless their size or ETag differ). It's given the File's first URL.
+	// Signed URLs, tokens, or cache busters in query strings otherwise
+	// make every renewal of the same object a different one. When nil, the
+	// whole URL is used. See CacheKeyWithoutQuery.
+	CacheKey func(urlStr string) string
+
+	// RecordHeatmap makes the File keep track of which ranges were read,
+	// and how often. See File.Heatmap.
+	RecordHeatmap bool
+
+	// HeatmapGranularity is the size of the buckets reads are counted in,
+	// when RecordHeatmap is set. Defaults to 4KB.
+	HeatmapGranularity int64
+
+	// AccessLog, if set, receives one line per HTTP request made,
+	// once it's done: method, range, status, bytes, timings, attempt.
+	AccessLog io.Writer
+
+	// AccessLogJSON makes AccessLog lines JSON objects
+	// instead of space-separated text.
+	AccessLogJSON bool
+
+	// DisableRedaction stops credentials (signatures, tokens, passwords)
+	// in URLs from being redacted in log output and errors.
+	DisableRedaction bool
+
+	// RetryBudget limits how many retries the File's connections can do
+	// in total. It can be shared by several Files for a process-wide budget.
+	// When nil, retries are only limited by RetrySettings, for each request.
+	RetryBudget *RetryBudget
+
+	// ResponseHeaderTimeout is how long we're willing to wait for response
+	// headers (time to first byte), and StallTimeout how long a single read
+	// from a response body may block. They're enforced regardless of Client,
+	// and time out with a *TimeoutError, which is retried. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+	StallTimeout          time.Duration
+
+	// NoReadAhead makes every read that isn't cached fetch exactly the
+	// bytes it needs with a bounded range request, instead of streaming
+	// from open-ended requests on pooled connections. That's wasteful for
+	// sequential reads, but ideal for tiny scattered ones (header sniffing,
+	// format detection) on metered connections.
+	NoReadAhead bool
+
+	// Readahead, if positive, is how many blocks (see CacheSettings.BlockSize)
+	// are fetched in the background ahead of sequential reads, each with its
+	// own request, so that a reader slower than the network never waits on
+	// it. At most that many blocks, plus the ones being read, are held in
+	// memory. Files of UnknownSize don't read ahead.
+	Readahead int
+
+	// MemoryBudget caps the memory held by readahead blocks, and by the
+	// File's private cache when Cache is nil. It can be shared by several
+	// Files for a process-wide cap. When nil, each File gets its own,
+	// without a limit. See File.MemoryStats.
+	MemoryBudget *MemoryBudget
+	// MemoryWait is how long a sequential read waits for memory to be
+	// released when its own blocks don't fit in the MemoryBudget, before
+	// fetching them without readahead, which takes a connection and its
+	// buffers. Zero means it doesn't wait.
+	MemoryWait time.Duration
+
+	// HedgeAfter enables hedged requests: when a connection's request
+	// hasn't gotten a response after that long, a duplicate request is
+	// sent, and whichever answers first is used, the other is cancelled.
+	// Zero disables hedging.
+	HedgeAfter time.Duration
+
+	// RampUp, if set, makes new connections request small bounded ranges
+	// at first, growing as they're read sequentially. See RampUp.
+	RampUp *RampUp
+
+	// MaxRangeSpan, if non-zero, makes connections always request bounded
+	// ranges (bytes=N-M) of at most that many bytes, and the next one once
+	// they've read it to the end, instead of open-ended ones (bytes=N-),
+	// for CDNs that handle those poorly or reject them. It also caps the
+	// ranges of RampUp.
+	MaxRangeSpan int64
+
+	// ChunkSize, if non-zero, makes connections read the file as a series
+	// of requests for fixed-size chunks, aligned on multiples of ChunkSize,
+	// instead of one long stream. Each is its own request, which CDNs and
+	// caches in between can store and serve as-is, and consecutive ones
+	// may go over different connections of the Client's pool. Reads that
+	// start within a chunk discard the start of it. It takes precedence
+	// over RampUp and MaxRangeSpan.
+	ChunkSize int64
+
+	// MaxBytesPerConn, if non-zero, makes connections that received that
+	// many bytes from a single response reconnect, with a new request for
+	// the rest. Their requests are sent with "Connection: close", so with
+	// HTTP/1.1, each goes over a fresh TCP connection: for servers whose
+	// throughput on a connection decays over time.
+	MaxBytesPerConn int64
+
+	// EagerConnect, with ProbeSingleByte or ProbeHead, sends a first data
+	// request, for bytes from the start of the file, at the same time as
+	// the initial request, instead of waiting for the first read. If the
+	// initial request succeeds, it's kept as a pooled connection, so
+	// reading file headers right after opening doesn't take two round
+	// trips. Otherwise, or if the first reads are elsewhere, its response
+	// is wasted. ProbeStream already keeps its connection around.
+	EagerConnect bool
+
+	// OnRetry, if set, is called every time a request is retried, with
+	// the error, attempt number, offset, and how long htfs will wait
+	// before trying again. It's called from the goroutine doing the
+	// read, so it shouldn't block.
+	OnRetry func(info RetryInfo)
+
+	// OnRenewal, if set, is called every time the File is done getting a
+	// new URL, with why, how long it took, and whether it worked. Like
+	// OnRetry, it's called from the goroutine doing the read.
+	OnRenewal func(info RenewalInfo)
+
+	// OnConnOpened, OnConnReused, OnConnClosed, and OnConnStalled, if set,
+	// are called as the File's connections come and go, with their ID and
+	// offset. They're called from the goroutine doing the read, some with
+	// the File's connection lock held, so they shouldn't block or call
+	// into the File.
+	//
+	// OnConnOpened is called when a connection gets a response to its
+	// request, whether it's new, reconnecting, or asking for more.
+	// OnConnReused is called when a pooled connection is picked for a read.
+	// OnConnClosed is called when a connection is closed, because it went
+	// stale, the pool had too many, or the File was closed. OnConnStalled
+	// is called when a read has been blocked for StallTimeout, or 10
+	// seconds if there's none, and doesn't abort anything by itself.
+	OnConnOpened  func(info ConnInfo)
+	OnConnReused  func(info ConnInfo)
+	OnConnClosed  func(info ConnInfo)
+	OnConnStalled func(info ConnInfo)
+
+	// Context, if set, bounds the lifetime of the File: once it's done,
+	// in-flight requests and pooled connections are aborted, retries and
+	// renewals stop, background preloading stops, and reads fail.
+	Context context.Context
+
+	// Timeouts, if set and Client is nil, are the per-phase limits
+	// (DNS, connect, TLS handshake, time to first byte, idle) of
+	// the client used for all requests. See timeout.Timeouts.
+	Timeouts *timeout.Timeouts
+
+	// Proxy, if set, picks the proxy for this File's requests, instead of
+	// the environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY) and the system
+	// settings. Use timeout.NoProxy to connect directly. It's honored by
+	// timeout clients (one is created if Client is nil), see timeout.WithProxy.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Host, if set, is sent as the Host header of requests to the URL's
+	// host, and as the server name of their TLS handshakes (SNI, and the
+	// name certificates are checked against), instead of the URL's host.
+	// It lets the URL point at an address, like a specific CDN node.
+	Host string
+
+	// StickyIP makes all of the File's connections to the URL's host go to
+	// the address the first one went to, so that every request hits the
+	// same CDN node, which has the blocks cached already, and the same
+	// version of the file. If that address stops answering, the next one
+	// the host resolves to is used. ConnectIP, if set, is used instead of
+	// resolving the host at all.
+	//
+	// Host, StickyIP and ConnectIP have no effect on redirect targets, or
+	// through proxies. The File makes its own transport for them, so
+	// Client, if set, must use an *http.Transport.
+	StickyIP  bool
+	ConnectIP string
+
+	// VerifyReads is a debugging aid: that fraction of reads, from 0 to 1,
+	// is fetched again with a separate request, and compared to what was
+	// returned. Mismatches are logged along with the response headers of
+	// the second request, and counted in TransferStats. It helps telling
+	// whether corrupted data comes from the server or from htfs.
+	VerifyReads float64
+
+	// Faults are injected into the File's requests from the start,
+	// including those of Open, for testing. See File.InjectFault.
+	Faults []Fault
+
+	// PropagatePanics lets panics in the read path crash the process,
+	// instead of being returned as a *PanicError. Useful while debugging,
+	// it can also be turned on with HTFS_PROPAGATE_PANICS=1.
+	PropagatePanics bool
 }
 
+// settingsClient returns the client requests should be made with, and
+// whether it was made just for them, and should be closed after use.
+func settingsClient(settings *Settings) (client *http.Client, owned bool) {
+	if settings.Client != nil {
+		return settings.Client, false
+	}
+	if settings.Timeouts != nil {
+		return timeout.NewClientWithTimeouts(*settings.Timeouts), true
+	}
+	if settings.Proxy != nil {
+		// http.DefaultClient always goes by the environment
+		return timeout.NewDefaultClient(), true
+	}
+	return http.DefaultClient, false
+}
+
+// defaultMaxConns was obtained through gut feeling, it
+// may not be suitable to all workloads
+const defaultMaxConns = 8
+
+// defaultAutoTuneMaxConns is the upper bound used when auto-tuning
+// and no MaxConns was specified.
+const defaultAutoTuneMaxConns = 16
+
 // Open returns a new htfs.File. Note that it differs from os.Open in that it does a first request
 // to determine the remote file's size. If that fails (after retries), an error will be returned.
+// The first request is skipped if Settings.Size is set, and deferred if Settings.Lazy is set.
 func Open(getURL GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings) (*File, error) {
-	client := settings.Client
-	if client == nil {
-		client = http.DefaultClient
-	}
+	client, ownsClient := settingsClient(settings)
 
 	retryCtx := retrycontext.NewDefault()
 	if settings.RetrySettings != nil {
 		retryCtx.Settings = *settings.RetrySettings
 	}
 
+	clock := settings.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
 	f := &File{
 		getURL:        getURL,
 		retrySettings: &retryCtx.Settings,
 		needsRenewal:  needsRenewal,
 		client:        client,
+		ownsClient:    ownsClient,
 		name:          "<remote file>",
 
-		conns: make(map[string]*conn),
-		stats: &hstats{},
+		conns:     make(map[string]*conn),
+		stats:     &hstats{},
+		transfer:  &transferCounters{},
+		phases:    &phaseCounters{},
+		latency:   &latencyCounters{},
+		faults:    &faultInjector{},
+		endOffset: UnknownSize,
+
+		preloader:  newPreloader(),
+		gate:       newPriorityGate(),
+		workers:    newPriorityGate(),
+		closedChan: make(chan struct{}),
+		clock:      clock,
+		openedAt:   clock.Now(),
 
 		ConnStaleThreshold: defaultConnStaleThreshold,
 		LogLevel:           defaultLogLevel,
 		ForbidBacktracking: forbidBacktracking,
 		DumpStats:          dumpStats,
-		// number obtained through gut feeling
-		// may not be suitable to all workloads
-		MaxConns: 8,
+		PropagatePanics:    propagatePanics,
+		MaxConns:           defaultMaxConns,
 	}
 	f.Log = settings.Log
+	f.probeStrategy = settings.ProbeStrategy
+	for _, fault := range settings.Faults {
+		f.InjectFault(fault)
+	}
+	f.rangeStrategy = settings.RangeStrategy
+	f.fetcher = settings.Fetcher
+	if f.fetcher != nil && f.rangeStrategy != nil {
+		return nil, errors.Errorf("htfs.Open: Settings.Fetcher and RangeStrategy can't be used together")
+	}
+	f.extraHeader = settings.Header
+	f.userAgent = settings.UserAgent
+	f.proxy = settings.Proxy
+	f.host = settings.Host
+	if f.userAgent == "" {
+		f.userAgent = DefaultUserAgent
+	}
+	f.decodeContentEncoding = settings.DecodeContentEncoding
+	f.acceptEncoding = settings.AcceptEncoding
+	f.backingPath = settings.BackingFile
+	f.onRetry = settings.OnRetry
+	f.onRenewal = settings.OnRenewal
+	f.connHooks = connHooks{
+		opened:  settings.OnConnOpened,
+		reused:  settings.OnConnReused,
+		closed:  settings.OnConnClosed,
+		stalled: settings.OnConnStalled,
+	}
+	f.hedgeAfter = settings.HedgeAfter
+	f.noReadAhead = settings.NoReadAhead
+	f.maxRangeSpan = settings.MaxRangeSpan
+	f.chunkSize = settings.ChunkSize
+	f.maxBytesPerConn = settings.MaxBytesPerConn
+	if settings.RampUp != nil {
+		f.rampUp = settings.RampUp.withDefaults()
+	}
+	f.eagerConnect = settings.EagerConnect
+	f.verifyReads = settings.VerifyReads
+	f.rand = newSharedRand(settings.Rand)
+	if f.retrySettings.Rand == nil {
+		f.retrySettings.Rand = f.rand
+	}
+	f.blockAligned = settings.BlockAligned
+	if settings.Readahead > 0 {
+		f.readahead = newReadahead(settings.Readahead)
+	}
+	parentCtx := settings.Context
+	if parentCtx == nil {
+		parentCtx = context.Background()
+	}
+	f.ctx, f.cancel = context.WithCancel(parentCtx)
+	f.responseHeaderTimeout = settings.ResponseHeaderTimeout
+	f.stallTimeout = settings.StallTimeout
+	f.retryBudget = settings.RetryBudget
+	f.memoryBudget = settings.MemoryBudget
+	if f.memoryBudget == nil {
+		f.memoryBudget = NewMemoryBudget(0)
+	}
+	f.memoryWait = settings.MemoryWait
+
+	cache := settings.Cache
+	if cache == nil {
+		// a private cache that goes away with the File
+		cache, f.privateStore = newMemoryCache(settings.BlockSize, f.memoryBudget)
+	}
+	f.blocks = newFileBlocks(cache, settings.CacheQuota)
+	f.cacheKey = settings.CacheKey
+
+	f.accessLog = settings.AccessLog
+	f.accessLogJSON = settings.AccessLogJSON
+	f.disableRedaction = settings.DisableRedaction
+
+	if settings.RecordHeatmap {
+		f.heatmap = newHeatmapRecorder(settings.HeatmapGranularity)
+	}
+
+	if usesStickyClient(settings) && f.fetcher == nil {
+		stickyClient, err := f.stickyClient(client, settings)
+		if err != nil {
+			return nil, errors.Wrapf(err, "htfs.Open")
+		}
+		f.client = stickyClient
+		f.ownsClient = true
+	}
+
+	if settings.Redirects != nil {
+		f.redirectPolicy = settings.Redirects
+		f.client = f.clientWithRedirectPolicy(f.client)
+	}
+
+	if settings.MaxConns != 0 {
+		f.MaxConns = settings.MaxConns
+	}
+	if settings.AutoTuneConns {
+		maxConns := settings.MaxConns
+		if maxConns == 0 {
+			maxConns = defaultAutoTuneMaxConns
+		}
+		f.tuner = newConnTuner(settings.MinConns, maxConns)
+		f.MaxConns = f.tuner.target()
+	}
 
 	if settings.LogLevel != 0 {
 		f.LogLevel = settings.LogLevel
@@ -170,55 +728,136 @@ func Open(getURL GetURLFunc, needsRenewal NeedsRenewalFunc, settings *Settings)
 	if settings.DumpStats {
 		f.DumpStats = true
 	}
+	if settings.PropagatePanics {
+		f.PropagatePanics = true
+	}
 
-	urlStr, err := getURL()
-	if err != nil {
-		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (getting URL)")
+	f.knownSizeHint = settings.Size
+
+	if settings.Lazy {
+		return f, nil
 	}
-	f.currentURL = urlStr
 
-	c, err := f.borrowConn(0)
+	err := f.ensureOpen()
 	if err != nil {
-		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (initial request)")
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ensureOpen gets a first URL and probes the remote file, unless that
+// already succeeded. For lazy Files, it's called on first use.
+func (f *File) ensureOpen() error {
+	_, err := f.open(0)
+	return err
+}
+
+// open does the work of ensureOpen. If tail is non-zero and the remote
+// file needs probing, it's done with a suffix range request for that
+// many bytes, which are returned.
+func (f *File) open(tail int64) ([]byte, error) {
+	f.openMutex.Lock()
+	defer f.openMutex.Unlock()
+
+	if f.isOpened() {
+		return nil, nil
 	}
-	f.header = c.header
 
-	err = f.returnConn(c)
+	urlStr, err := f.getURL()
 	if err != nil {
-		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (return conn after initial request)")
+		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (getting URL)")
+	}
+	f.urlMutex.Lock()
+	f.currentURL = urlStr
+	f.currentURLExpiry = urlExpiry(urlStr)
+	f.urlMutex.Unlock()
+	f.urlHash = labelHash(urlStr)
+
+	if strings.HasPrefix(urlStr, "data:") {
+		err = f.openDataURI(urlStr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.StoreInt32(&f.opened, 1)
+		return nil, nil
 	}
 
-	f.requestURL = c.requestURL
+	if path, ok := localPath(urlStr); ok {
+		err = f.openLocal(path)
+		if err != nil {
+			return nil, err
+		}
+		atomic.StoreInt32(&f.opened, 1)
+		return nil, nil
+	}
 
-	if c.statusCode == 206 {
-		rangeHeader := c.header.Get("content-range")
-		rangeTokens := strings.Split(rangeHeader, "/")
-		totalBytesStr := rangeTokens[len(rangeTokens)-1]
-		f.size, err = strconv.ParseInt(totalBytesStr, 10, 64)
+	var tailData []byte
+	cacheURL := urlStr
+	if f.cacheKey != nil {
+		cacheURL = f.cacheKey(urlStr)
+	}
+	credentials := credentialsKey(f.extraHeader)
+	resourceKey := cacheResourceKey(cacheURL, credentials)
+	if f.knownSizeHint > 0 {
+		// the caller already knows the size, skip the initial request
+		f.size = f.knownSizeHint
+		f.requestURL, err = url.Parse(urlStr)
 		if err != nil {
-			return nil, errors.Wrapf(normalizeError(err), "Could not parse file size")
+			return nil, errors.Wrapf(f.redactError(err), "htfs.Open (parsing URL)")
+		}
+		f.name = nameFromPath(f.requestURL.Path)
+	} else if v := f.blocks.cache.getValidators(resourceKey); v != nil {
+		// we may have blocks of that file already
+		err = f.revalidate(v)
+		if err != nil {
+			return nil, err
+		}
+	} else if tail > 0 {
+		tailData, err = f.probeTail(tail)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var ec *eagerConn
+		if f.eagerConnect && f.probeStrategy != ProbeStream {
+			ec = f.startEagerConnect()
+		}
+		err = f.probe()
+		if ec != nil {
+			// by the time open returns, so the first read can use it
+			defer func() { f.finishEagerConnect(ec, f.isOpened()) }()
+		}
+		if err != nil {
+			return nil, err
 		}
-	} else if c.statusCode == 200 {
-		f.size = c.contentLength
 	}
 
-	// we have to use requestURL because we want the URL after
-	// redirect (for hosts like sourceforge)
-	pathTokens := strings.Split(f.requestURL.Path, "/")
-	f.name = pathTokens[len(pathTokens)-1]
+	f.blocks.fileKey = cacheFileKey(cacheURL, credentials, f.size, f.headerValue("etag"))
+	if f.header != nil {
+		f.rememberValidators(resourceKey)
+	}
 
-	dispHeader := c.header.Get("content-disposition")
-	if dispHeader != "" {
-		_, mimeParams, err := mime.ParseMediaType(dispHeader)
-		if err == nil {
-			filename := mimeParams["filename"]
-			if filename != "" {
-				f.name = filename
-			}
+	if f.backingPath != "" && f.knownSize() {
+		f.backing, err = openSparseBacking(f.backingPath, f.size, f.headerValue("etag"), f.headerValue("last-modified"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "htfs.Open (opening backing file)")
 		}
 	}
 
-	return f, nil
+	atomic.StoreInt32(&f.opened, 1)
+	return tailData, nil
+}
+
+// isOpened returns true once ensureOpen succeeded, without
+// waiting for one that's in progress.
+func (f *File) isOpened() bool {
+	return atomic.LoadInt32(&f.opened) == 1
+}
+
+func nameFromPath(path string) string {
+	pathTokens := strings.Split(path, "/")
+	return pathTokens[len(pathTokens)-1]
 }
 
 func (f *File) newRetryContext() *retrycontext.Context {
@@ -226,9 +865,31 @@ func (f *File) newRetryContext() *retrycontext.Context {
 	if f.retrySettings != nil {
 		retryCtx.Settings = *f.retrySettings
 	}
+	if retryCtx.Settings.IsRetriable == nil {
+		retryCtx.Settings.IsRetriable = f.shouldRetry
+	}
+	if retryCtx.Settings.Context == nil {
+		retryCtx.Settings.Context = f.ctx
+	}
+	if !retryCtx.Settings.NoSleep {
+		// back off according to the File's clock
+		retryCtx.Settings.NoSleep = true
+		retryCtx.Settings.FakeSleep = func(d time.Duration) {
+			sleep(f.clock, retryCtx.Settings.Context, d)
+		}
+	}
 	return retryCtx
 }
 
+// isRetriable classifies errors that happen outside a retry loop
+// (on pooled connections) the same way the retry loops do.
+func (f *File) isRetriable(err error) bool {
+	if f.retrySettings != nil && f.retrySettings.IsRetriable != nil {
+		return f.retrySettings.IsRetriable(err)
+	}
+	return f.shouldRetry(err)
+}
+
 // NumConns returns the number of connections currently used by the File
 // to serve ReadAt calls
 func (f *File) NumConns() int {
@@ -254,7 +915,7 @@ func (f *File) borrowConn(offset int64) (*conn, error) {
 
 	for _, c := range f.conns {
 		if c.Stale() {
-			f.stats.expired++
+			atomic.AddInt64(&f.stats.expired, 1)
 			err := f.closeConn(c)
 			if err != nil {
 				return nil, err
@@ -263,15 +924,19 @@ func (f *File) borrowConn(offset int64) (*conn, error) {
 		}
 
 		diff := offset - c.Offset()
+		if c.rangeEnd > 0 && offset > c.rangeEnd {
+			// past the end of its range, discarding would fail
+			diff = math.MaxInt64
+		}
 		if diff < 0 && -diff < maxDiscard && -diff <= c.Cached() {
-			if -diff < bestBackDiff {
+			if -diff < bestBackDiff || (-diff == bestBackDiff && c.id < bestBackConn) {
 				bestBackConn = c.id
 				bestBackDiff = -diff
 			}
 		}
 
 		if diff >= 0 && diff < maxDiscard {
-			if diff < bestDiff {
+			if diff < bestDiff || (diff == bestDiff && c.id < bestConn) {
 				bestConn = c.id
 				bestDiff = diff
 			}
@@ -291,9 +956,17 @@ func (f *File) borrowConn(offset int64) (*conn, error) {
 			f.log2("[%9d-%9d] (Borrow) %d --> %d (%s)", offset, offset, c.Offset(), c.Offset()+bestDiff, c.id)
 
 			err := c.Discard(bestDiff)
-			if err != nil {
-				if f.shouldRetry(err) {
+			if err == nil {
+				atomic.AddInt64(&f.transfer.discarded, bestDiff)
+			} else {
+				if f.isRetriable(err) && f.retryBudget.withdraw() {
 					f.log2("[%9d-] (Borrow) discard failed, reconnecting", offset)
+					f.notifyRetry(RetryInfo{
+						Op:      "Discard",
+						Offset:  offset,
+						Attempt: 1,
+						Err:     err,
+					})
 					err = c.Connect(offset)
 					if err != nil {
 						return nil, err
@@ -304,6 +977,7 @@ func (f *File) borrowConn(offset int64) (*conn, error) {
 			}
 		}
 
+		f.notifyConn(f.connHooks.reused, c)
 		return c, nil
 	}
 
@@ -320,6 +994,7 @@ func (f *File) borrowConn(offset int64) (*conn, error) {
 			return nil, errors.WithStack(err)
 		}
 
+		f.notifyConn(f.connHooks.reused, c)
 		return c, nil
 	}
 
@@ -330,12 +1005,15 @@ func (f *File) borrowConn(offset int64) (*conn, error) {
 	c := &conn{
 		file:      f,
 		id:        fmt.Sprintf("reader-%d", id),
-		touchedAt: time.Now(),
+		touchedAt: f.clock.Now(),
+	}
+	if f.rampUp != nil {
+		c.window = f.rampUp.Initial
 	}
 
 	err := c.Connect(offset)
 	if err != nil {
-		return nil, err
+		return nil, &connError{connID: c.id, err: err}
 	}
 
 	return c, nil
@@ -350,15 +1028,24 @@ func (f *File) returnConn(c *conn) error {
 	f.connsLock.Lock()
 	defer f.connsLock.Unlock()
 
-	c.touchedAt = time.Now()
+	if f.closed {
+		// the File was closed while this conn was in use
+		return f.closeConn(c)
+	}
+
+	c.touchedAt = f.clock.Now()
 	f.conns[c.id] = c
 
 	if len(f.conns)*2 > f.MaxConns*3 {
 		var agedConns []agedConn
 		for id, c := range f.conns {
-			agedConns = append(agedConns, agedConn{id: id, age: time.Since(c.touchedAt)})
+			agedConns = append(agedConns, agedConn{id: id, age: since(f.clock, c.touchedAt)})
 		}
 		sort.Slice(agedConns, func(i, j int) bool {
+			if agedConns[i].age == agedConns[j].age {
+				// don't leave it to map iteration order
+				return agedConns[i].id < agedConns[j].id
+			}
 			return agedConns[i].age < agedConns[j].age
 		})
 
@@ -373,6 +1060,20 @@ func (f *File) returnConn(c *conn) error {
 	return nil
 }
 
+// tuneConns is called after every read when auto-tuning is enabled
+func (f *File) tuneConns(bytesRead int64) {
+	target, changed := f.tuner.record(bytesRead, f.clock.Now())
+	if !changed {
+		return
+	}
+
+	f.connsLock.Lock()
+	defer f.connsLock.Unlock()
+
+	f.log("(AutoTune) %d --> %d conns", f.MaxConns, target)
+	f.MaxConns = target
+}
+
 func (f *File) getCurrentURL() string {
 	f.urlMutex.Lock()
 	defer f.urlMutex.Unlock()
@@ -384,57 +1085,96 @@ func (f *File) renewURL() (string, error) {
 	f.urlMutex.Lock()
 	defer f.urlMutex.Unlock()
 
-	urlStr, err := f.getURL()
+	// Files sharing a Client and an expired URL only need one new one
+	key := f.flightKey("Renew", f.currentURL, "", "", nil)
+	val, shared, err := metadataFlights.do(f.ctx, key, func() (interface{}, error) {
+		return f.getURL()
+	})
 	if err != nil {
 		return "", err
 	}
+	urlStr := val.(string)
+	if shared {
+		f.log("(Renew) shared a renewal in flight for the same URL")
+	}
 
 	f.currentURL = urlStr
+	f.currentURLExpiry = urlExpiry(urlStr)
+	f.redirectTarget = ""
 	return f.currentURL, nil
 }
 
 // Stat returns an os.FileInfo for this particular file. Only the Size()
 // method is useful, the rest is default values.
 func (f *File) Stat() (os.FileInfo, error) {
+	err := f.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
 	return &FileInfo{f}, nil
 }
 
 // Seek the read head within the file - it's instant and never returns an
-// error, except if whence is one of os.SEEK_SET, os.SEEK_END, or os.SEEK_CUR.
+// error, except if whence is one of os.SEEK_SET, os.SEEK_END, or os.SEEK_CUR,
+// or if this is the first call on a lazy File and opening it fails.
+// Seeking relative to the end of a file of UnknownSize fails with ErrUnknownSize.
 // If an invalid offset is given, it will be truncated to a valid one, between
 // [0,size).
-func (f *File) Seek(offset int64, whence int) (int64, error) {
-	var newOffset int64
+func (f *File) Seek(offset int64, whence int) (newOffset int64, err error) {
+	f.offsetMutex.Lock()
+	defer f.offsetMutex.Unlock()
+	defer f.recoverPanic("Seek", offset, 0, nil, &err)
+
+	err = f.ensureOpen()
+	if err != nil {
+		return f.offset, newReadError("Seek", offset, 0, err)
+	}
 
 	switch whence {
 	case io.SeekStart:
 		newOffset = offset
 	case io.SeekEnd:
-		newOffset = f.size + offset
+		size := f.currentSize()
+		if size == UnknownSize {
+			return f.offset, newReadError("Seek", offset, 0, errors.WithStack(ErrUnknownSize))
+		}
+		newOffset = size + offset
 	case io.SeekCurrent:
 		newOffset = f.offset + offset
 	default:
-		return f.offset, errors.Errorf("invalid whence value %d", whence)
+		return f.offset, newReadError("Seek", offset, 0, errors.Errorf("invalid whence value %d", whence))
 	}
 
 	if newOffset < 0 {
 		newOffset = 0
 	}
 
-	if newOffset > f.size {
-		newOffset = f.size
+	if size := f.currentSize(); size != UnknownSize && newOffset > size {
+		newOffset = size
 	}
 
 	f.offset = newOffset
 	return f.offset, nil
 }
 
-func (f *File) Read(buf []byte) (int, error) {
+func (f *File) Read(buf []byte) (bytesRead int, err error) {
+	f.offsetMutex.Lock()
+	defer f.offsetMutex.Unlock()
+
 	initialOffset := f.offset
-	bytesRead, err := f.readAt(buf, f.offset)
+	defer f.recoverPanic("Read", initialOffset, len(buf), &bytesRead, &err)
+
+	bytesRead, err = f.readAt(buf, f.offset)
+	err = f.rangeEOF(err)
+	f.maybeVerify(buf[:bytesRead], initialOffset, err)
+	err = newReadError("Read", initialOffset, len(buf), err)
 	f.offset += int64(bytesRead)
+	atomic.AddInt64(&f.transfer.delivered, int64(bytesRead))
+	if f.heatmap != nil {
+		f.heatmap.record(initialOffset, int64(bytesRead), f.currentSize())
+	}
 
-	if f.LogLevel >= 2 {
+	if f.currentLogger(2) != nil {
 		bytesWanted := int64(len(buf))
 		start := initialOffset
 		end := initialOffset + bytesWanted
@@ -446,11 +1186,22 @@ func (f *File) Read(buf []byte) (int, error) {
 // ReadAt reads len(buf) byte from the remote file at offset.
 // It returns the number of bytes read, and an error. In case of temporary
 // network errors or timeouts, it will retry with truncated exponential backoff
-// according to RetrySettings
-func (f *File) ReadAt(buf []byte, offset int64) (int, error) {
-	bytesRead, err := f.readAt(buf, offset)
+// according to RetrySettings. Errors other than io.EOF are *ReadError.
+func (f *File) ReadAt(buf []byte, offset int64) (bytesRead int, err error) {
+	defer f.recoverPanic("ReadAt", offset, len(buf), &bytesRead, &err)
+
+	startTime := f.clock.Now()
+	bytesRead, err = f.readAt(buf, offset)
+	f.latency.readAt.record(since(f.clock, startTime))
+	err = f.rangeEOF(err)
+	f.maybeVerify(buf[:bytesRead], offset, err)
+	err = newReadError("ReadAt", offset, len(buf), err)
+	atomic.AddInt64(&f.transfer.delivered, int64(bytesRead))
+	if f.heatmap != nil {
+		f.heatmap.record(offset, int64(bytesRead), f.currentSize())
+	}
 
-	if f.LogLevel >= 2 {
+	if f.currentLogger(2) != nil {
 		bytesWanted := int64(len(buf))
 		start := offset
 		end := offset + bytesWanted
@@ -477,6 +1228,57 @@ func (f *File) readAt(data []byte, offset int64) (int, error) {
 		return 0, nil
 	}
 
+	f.gate.enter()
+	defer f.gate.leave()
+
+	if err := f.ctx.Err(); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	err := f.ensureOpen()
+	if err != nil {
+		return 0, err
+	}
+
+	if f.local != nil {
+		return f.readLocal(data, offset)
+	}
+
+	if f.size == 0 {
+		// there's no range to request in an empty file
+		return 0, io.EOF
+	}
+
+	if f.sizeUnknown() {
+		if end := f.currentSize(); end != UnknownSize && offset >= end {
+			return 0, io.EOF
+		}
+	}
+
+	if n, ok, err := f.readFromBlocks(data, offset); ok {
+		return n, err
+	}
+
+	if f.backing != nil {
+		if n, ok, err := f.backing.readAt(data, offset); ok {
+			return n, err
+		}
+	}
+
+	if f.readahead != nil && f.knownSize() {
+		if n, ok, err := f.readFromReadahead(data, offset); ok {
+			return n, err
+		}
+	}
+
+	if f.blockAligned && f.knownSize() {
+		return f.readAligned(data, offset)
+	}
+
+	if f.noReadAhead {
+		return f.readExact(data, offset)
+	}
+
 	c, err := f.borrowConn(offset)
 	if err != nil {
 		return 0, err
@@ -486,9 +1288,25 @@ func (f *File) readAt(data []byte, offset int64) (int, error) {
 
 	totalBytesRead := 0
 	bytesToRead := len(data)
+	reconnects := 0
+
+	if f.tuner != nil {
+		defer func() {
+			f.tuneConns(int64(totalBytesRead))
+		}()
+	}
 
 	for totalBytesRead < bytesToRead {
+		if c.shouldRotate(offset + int64(totalBytesRead)) {
+			err = c.rotate()
+			if err != nil {
+				return totalBytesRead, &connError{connID: c.id, err: err}
+			}
+		}
+
+		stopWatching := f.watchStall(c)
 		bytesRead, err := c.Read(data[totalBytesRead:])
+		stopWatching()
 		totalBytesRead += bytesRead
 
 		if err != nil {
@@ -503,20 +1321,55 @@ func (f *File) readAt(data []byte, offset int64) (int, error) {
 					return totalBytesRead, io.EOF
 				}
 			}
+			if isEOF && c.atRangeEnd() {
+				// not the end of the file, just of what we asked for
+				err = c.extend()
+				if err == io.EOF {
+					// it was, after all, see MaxRangeSpan
+					f.observeEnd(offset + int64(totalBytesRead))
+					return totalBytesRead, io.EOF
+				}
+				if err != nil {
+					return totalBytesRead, &connError{connID: c.id, err: err}
+				}
+				continue
+			}
+			if isEOF && f.sizeUnknown() {
+				// without a size to check against, we have to
+				// trust the server when it says it's done.
+				f.observeEnd(offset + int64(totalBytesRead))
+				return totalBytesRead, io.EOF
+			}
+
+			if f.isRetriable(err) && f.retryBudget.withdraw() {
+				reconnects++
+				atomic.AddInt64(&c.retries, 1)
+				f.notifyRetry(RetryInfo{
+					Op:      "Read",
+					Offset:  c.Offset(),
+					Attempt: reconnects,
+					Err:     err,
+				})
 
-			if f.shouldRetry(err) {
 				// for servers that don't support range requests
 				// *and* don't specify the content-length header,
 				// this will retry a bunch of times before returning
 				// EOF, which is less than ideal, but in my defense,
 				// screw those servers.
 				f.log("Got %s, retrying", err.Error())
-				err = c.Connect(c.Offset())
+				position := offset + int64(totalBytesRead)
+				if c.Offset() != position {
+					// we'd skip or duplicate bytes
+					return totalBytesRead, &connError{connID: c.id, err: errors.Errorf("resuming at %d, but read up to %d", c.Offset(), position)}
+				}
+				err = c.Connect(position)
 				if err != nil {
-					return totalBytesRead, err
+					return totalBytesRead, &connError{connID: c.id, err: err}
 				}
+				atomic.AddInt64(&f.transfer.resumes, 1)
+				f.log2("[%9d-%9d] (Resume) after %d bytes", position, position, totalBytesRead)
 			} else {
-				return totalBytesRead, err
+				return totalBytesRead, &connError{connID: c.id, err: err}
 			}
 		}
 	}
@@ -524,6 +1377,34 @@ func (f *File) readAt(data []byte, offset int64) (int, error) {
 	return totalBytesRead, nil
 }
 
+// readExact fetches exactly the bytes of data with a single bounded range
+// request, without using pooled connections. See Settings.NoReadAhead.
+func (f *File) readExact(data []byte, offset int64) (int, error) {
+	length := int64(len(data))
+	eof := false
+	if f.knownSize() {
+		if offset >= f.size {
+			return 0, io.EOF
+		}
+		if offset+length > f.size {
+			length = f.size - offset
+			eof = true
+		}
+	}
+
+	f.log2("[%9d-%9d] (ReadExact)", offset, offset+length)
+	result, err := f.fetchRanges([]Range{{Offset: offset, Length: length}})
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(data, result[0])
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 func (f *File) shouldRetry(err error) bool {
 	if errors.Cause(err) == io.EOF {
 		// *do* retry EOF, because apparently it's used interchangeably with
@@ -592,35 +1473,100 @@ func (f *File) Reset() error {
 
 func (f *File) closeConn(c *conn) error {
 	delete(f.conns, c.id)
+	f.log2("(Close) %s", c.id)
+	f.notifyConn(f.connHooks.closed, c)
 
 	if f.DumpStats {
 		f.stats.numCacheHits += c.NumCacheHits()
 		f.stats.numCacheMiss += c.NumCacheMiss()
 		f.stats.cachedBytes += c.CachedBytesServed()
 		f.stats.fetchedBytes += c.TotalBytesServed()
+		f.stats.connReports = append(f.stats.connReports, c.report())
 	}
 	return c.Close()
 }
 
-// Close closes all connections to the distant http server used by this File
+// Close closes all connections to the distant http server used by this File.
+// Reads blocked on the network, including background ones, are aborted
+// right away rather than at their next I/O. See WaitClosed.
 func (f *File) Close() error {
+	f.cancel()
+
 	f.connsLock.Lock()
 	defer f.connsLock.Unlock()
 
 	if f.closed {
 		return nil
 	}
+	f.closed = true
+	f.closedAt = f.clock.Now()
+	defer close(f.closedChan)
 
-	err := f.closeAllConns()
-	if err != nil {
-		return errors.Wrap(err, "in File.Close")
+	close(f.preloader.done)
+	if f.privateStore != nil {
+		f.privateStore.close()
+	}
+	f.unpinAll()
+	if f.readahead != nil {
+		f.dropReadahead()
+	}
+
+	// everything is closed even if something fails,
+	// the first error is returned and the others logged
+	var firstErr error
+	keepErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		} else {
+			f.log("While closing: %+v", err)
+		}
+	}
+
+	if err := f.closeAllConns(); err != nil {
+		keepErr(errors.Wrap(err, "in File.Close"))
+	}
+	f.closeIdleConns()
+
+	if f.backing != nil {
+		// background reads may still be writing to the backing file, they
+		// need connsLock to return their conns and be done.
+		f.connsLock.Unlock()
+		f.workers.waitIdle()
+		f.connsLock.Lock()
+
+		if err := f.backing.close(); err != nil {
+			keepErr(errors.Wrap(err, "in File.Close (closing backing file)"))
+		}
+	}
+
+	if f.local != nil {
+		if err := f.local.Close(); err != nil {
+			keepErr(errors.Wrap(err, "in File.Close (closing local source)"))
+		}
 	}
 
 	if f.DumpStats {
 		fetchedBytes := f.stats.fetchedBytes
 
 		log.Printf("====== htfs stats for %s", f.name)
-		log.Printf("= conns: %d total, %d expired, %d renews, wait %s", f.stats.connections, f.stats.expired, f.stats.renews, f.stats.connectionWait)
+		log.Printf("= conns: %d total, %d expired, %d renews, %d retries, wait %s", atomic.LoadInt64(&f.stats.connections),
+			atomic.LoadInt64(&f.stats.expired), atomic.LoadInt64(&f.stats.renews), atomic.LoadInt64(&f.stats.retries), f.stats.connectionWait)
+		if f.hedgeAfter > 0 {
+			log.Printf("= hedges: %d sent, %d won", atomic.LoadInt64(&f.stats.hedges), atomic.LoadInt64(&f.stats.hedgeWins))
+		}
+		if f.rampUp != nil {
+			log.Printf("= ramp-ups: %d", atomic.LoadInt64(&f.stats.rampUps))
+		}
+		if f.maxBytesPerConn > 0 {
+			log.Printf("= rotations: %d", atomic.LoadInt64(&f.stats.rotations))
+		}
+		if f.readahead != nil {
+			ms := f.MemoryStats()
+			log.Printf("= readahead memory: %s peak, %d blocks refused, %d waits", united.FormatBytes(ms.Peak), ms.Refused, ms.Waits)
+		}
+		if preemptions := f.gate.preemptions(); preemptions > 0 {
+			log.Printf("= background work preempted %d times", preemptions)
+		}
 		size := f.size
 		perc := 0.0
 		percCached := 0.0
@@ -633,51 +1579,179 @@ func (f *File) Close() error {
 		log.Printf("= fetched: %s / %s (%.2f%%)", united.FormatBytes(fetchedBytes), united.FormatBytes(size), perc)
 		log.Printf("= served from cache: %s (%.2f%% of all served bytes)", united.FormatBytes(f.stats.cachedBytes), percCached)
 
+		ts := f.TransferStats()
+		log.Printf("= downloaded: %s, delivered: %s, %d resumes", united.FormatBytes(ts.Downloaded), united.FormatBytes(ts.Delivered), ts.Resumes)
+		log.Printf("= wasted: %s (%s discarded, %s unconsumed, %s aborted)", united.FormatBytes(ts.Wasted()),
+			united.FormatBytes(ts.Discarded), united.FormatBytes(ts.Unconsumed), united.FormatBytes(ts.Aborted))
+		log.Printf("= also wasted: %s read ahead and dropped, %s retried, %s probing (amplification %.2fx)",
+			united.FormatBytes(ts.ReadaheadDropped), united.FormatBytes(ts.Retried), united.FormatBytes(ts.Probes), ts.Amplification())
+
 		totalReads := f.stats.numCacheHits + f.stats.numCacheMiss
 		if totalReads == 0 {
 			totalReads = -1 // avoid NaN hit rate
 		}
 		hitRate := float64(f.stats.numCacheHits) / float64(totalReads) * 100.0
 		log.Printf("= cache hit rate: %.2f%% (out of %d reads)", hitRate, totalReads)
+
+		ps := f.PhaseStats()
+		log.Printf("= requests: %d, %d on reused conns", ps.Requests, ps.ReusedConns)
+		log.Printf("= dns: %s / connect: %s / tls: %s / first byte: %s", ps.DNS, ps.Connect, ps.TLS, ps.FirstByte)
+		ls := f.LatencyStats()
+		log.Printf("= ReadAt latency: %s", ls.ReadAt)
+		log.Printf("= first byte latency: %s", ls.FirstByte)
+		for _, cr := range f.stats.connReports {
+			log.Printf("= %s", cr)
+		}
 		log.Printf("========================================")
 	}
 
-	f.closed = true
+	return firstErr
+}
 
+// WaitClosed blocks until Close has been called, and all reads and
+// background work that were in progress have returned, or until ctx
+// is done, in which case it returns ctx's error.
+//
+// Once it returns nil, none of the goroutines, timers, or connections
+// the File started remain. Connections to the server that completed
+// their response may still be idle in the pool of Settings.Client, or
+// of http.DefaultClient, for other requests to reuse: those belong to
+// the client.
+func (f *File) WaitClosed(ctx context.Context) error {
+	idle := make(chan struct{})
+	go func() {
+		select {
+		case <-f.closedChan:
+		case <-ctx.Done():
+			// not closed yet, nothing to wait for
+			return
+		}
+		f.gate.waitIdle()
+		f.workers.waitIdle()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+
+	// reads that were in progress may have returned connections since
+	f.closeIdleConns()
 	return nil
 }
 
+// closeIdleConns closes the connections pooled by the File's
+// client, if it was made for the File, see settingsClient.
+func (f *File) closeIdleConns() {
+	if f.ownsClient {
+		f.client.CloseIdleConnections()
+	}
+}
+
 func (f *File) knownSize() bool {
 	return f.size > 0
 }
 
+// fileLogger is what SetLogger stores
+type fileLogger struct {
+	log   LogFunc
+	level int
+}
+
+// SetLogger replaces the File's LogFunc and log level, and can be called
+// at any time, for example to raise verbosity while a user is debugging,
+// without reopening the File. Level 1 covers connections, retries, and
+// renewals, level 2 adds every read and the connection pool's decisions.
+// Level 0, or a nil LogFunc, disables logging. The Log and LogLevel fields
+// are ignored from then on.
+func (f *File) SetLogger(l LogFunc, level int) {
+	f.logger.Store(&fileLogger{log: l, level: level})
+}
+
+// currentLogger returns what to log with, if anything, at level
+func (f *File) currentLogger(level int) LogFunc {
+	if fl, ok := f.logger.Load().(*fileLogger); ok {
+		if fl.level < level {
+			return nil
+		}
+		return fl.log
+	}
+
+	if level > 1 && f.LogLevel < level {
+		return nil
+	}
+	return f.Log
+}
+
 func (f *File) log(format string, args ...interface{}) {
-	if f.Log == nil {
+	logFunc := f.currentLogger(1)
+	if logFunc == nil {
 		return
 	}
 
-	f.Log(fmt.Sprintf(format, args...))
+	logFunc(f.redact(fmt.Sprintf(format, args...)))
 }
 
-func (f *File) log2(format string, args ...interface{}) {
-	if f.LogLevel < 2 {
-		return
+func (f *File) redact(s string) string {
+	if f.disableRedaction {
+		return s
 	}
+	return redactURLs(s)
+}
 
-	if f.Log == nil {
+func (f *File) log2(format string, args ...interface{}) {
+	logFunc := f.currentLogger(2)
+	if logFunc == nil {
 		return
 	}
 
-	f.Log(fmt.Sprintf(format, args...))
+	logFunc(f.redact(fmt.Sprintf(format, args...)))
 }
 
 // GetHeader returns the header the server responded
 // with on our initial request. It may contain checksums
 // which could be used for integrity checking.
+// For lazy Files, it returns nil until the File is used.
 func (f *File) GetHeader() http.Header {
 	return f.header
 }
 
+// ContentType returns the MIME type the server reported for
+// the remote file, or an empty string if it didn't.
+func (f *File) ContentType() string {
+	return f.headerValue("content-type")
+}
+
+// ETag returns the entity tag the server reported for the remote
+// file, as-is (including quotes and weak prefix), or an empty string.
+func (f *File) ETag() string {
+	return f.headerValue("etag")
+}
+
+// LastModified returns the modification time the server reported
+// for the remote file, or the zero time if it's missing or invalid.
+func (f *File) LastModified() time.Time {
+	lm := f.headerValue("last-modified")
+	if lm == "" {
+		return time.Time{}
+	}
+
+	t, err := http.ParseTime(lm)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func (f *File) headerValue(key string) string {
+	if f.header == nil {
+		return ""
+	}
+	return f.header.Get(key)
+}
+
 // GetRequestURL returns the first good URL File
 // made a request to.
 func (f *File) GetRequestURL() *url.URL {
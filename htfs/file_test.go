@@ -2,15 +2,27 @@ package htfs_test
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,6 +30,7 @@ import (
 	"github.com/itchio/httpkit/neterr"
 
 	"github.com/itchio/httpkit/retrycontext"
+	"github.com/itchio/httpkit/timeout"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
@@ -141,6 +154,3716 @@ func Test_File(t *testing.T) {
 	}
 }
 
+func Test_FileWithSize(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	getURL := func() (string, error) {
+		return storageServer.URL + "/some/file.bin", nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(fakeData))
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(0, ctx.numGET, "no initial request")
+	assert.EqualValues(0, ctx.numHEAD, "no initial request")
+
+	s, err := f.Stat()
+	assert.NoError(err)
+	assert.Equal(int64(len(fakeData)), s.Size())
+	assert.Equal("file.bin", s.Name())
+
+	buf := make([]byte, 4)
+	readBytes, err := f.ReadAt(buf, 4)
+	assert.NoError(err)
+	assert.Equal(len(buf), readBytes)
+	assert.Equal([]byte("bbbb"), buf)
+	assert.EqualValues(1, ctx.numGET)
+
+	assert.NoError(f.Close())
+}
+
+func Test_FileProbeStrategies(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
+
+	for _, strategy := range []htfs.ProbeStrategy{htfs.ProbeStream, htfs.ProbeSingleByte, htfs.ProbeHead} {
+		ctx := &fakeStorageContext{}
+		storageServer := fakeStorage(t, fakeData, ctx)
+
+		settings := defaultSettings(t)
+		settings.ProbeStrategy = strategy
+		f, err := htfs.Open(func() (string, error) { return storageServer.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err, "with strategy %s", strategy)
+
+		s, err := f.Stat()
+		assert.NoError(err)
+		assert.Equal(int64(len(fakeData)), s.Size(), "with strategy %s", strategy)
+
+		if strategy == htfs.ProbeHead {
+			assert.EqualValues(1, ctx.numHEAD)
+			assert.EqualValues(0, ctx.numGET)
+		} else {
+			assert.EqualValues(0, ctx.numHEAD)
+			assert.EqualValues(1, ctx.numGET)
+		}
+
+		readData, err := ioutil.ReadAll(f)
+		assert.NoError(err)
+		assert.Equal(fakeData, readData)
+
+		assert.NoError(f.Close())
+		storageServer.CloseClientConnections()
+		storageServer.Close()
+	}
+}
+
+func Test_FileLazy(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	numGetURL := 0
+	getURL := func() (string, error) {
+		numGetURL++
+		return storageServer.URL, nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+
+	settings := defaultSettings(t)
+	settings.Lazy = true
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	assert.EqualValues(0, numGetURL)
+	assert.EqualValues(0, ctx.numGET)
+	assert.NoError(f.Close())
+
+	f, err = htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	s, err := f.Stat()
+	assert.NoError(err)
+	assert.Equal(int64(len(fakeData)), s.Size())
+	assert.EqualValues(1, numGetURL)
+	assert.EqualValues(1, ctx.numGET)
+
+	readData, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(fakeData, readData)
+	assert.EqualValues(1, numGetURL)
+	assert.NoError(f.Close())
+
+	// errors are returned on first use
+	notFound := fakeStorage(t, fakeData, &fakeStorageContext{simulateNotFound: true})
+	defer notFound.Close()
+
+	f, err = htfs.Open(func() (string, error) { return notFound.URL, nil }, needsRenewal, settings)
+	assert.NoError(err)
+	_, err = f.ReadAt(make([]byte, 1), 0)
+	assert.Error(err)
+	assert.True(errors.Cause(err) == htfs.ErrNotFound)
+}
+
+func Test_FileMetadata(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("aaaabbbb")
+
+	lastModified := time.Date(2019, time.July, 3, 10, 47, 31, 0, time.UTC)
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{
+		extraHeaders: map[string]string{
+			"etag":          `"abcdef"`,
+			"last-modified": lastModified.Format(http.TimeFormat),
+		},
+	})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	f, err := newSimple(t, storageServer.URL)
+	assert.NoError(err)
+
+	assert.Equal("application/octet-stream", f.ContentType())
+	assert.Equal(`"abcdef"`, f.ETag())
+	assert.True(lastModified.Equal(f.LastModified()))
+
+	stats, err := f.Stat()
+	assert.NoError(err)
+	assert.True(lastModified.Equal(stats.ModTime()))
+	sys, ok := stats.Sys().(*htfs.FileSys)
+	if assert.True(ok) {
+		assert.Equal(`"abcdef"`, sys.ETag)
+		assert.Equal("application/octet-stream", sys.ContentType)
+		assert.Equal(storageServer.URL, sys.URL.String())
+		assert.Equal(`"abcdef"`, sys.Header.Get("etag"))
+	}
+
+	assert.NoError(f.Close())
+}
+
+func Test_FileRedirects(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	ctx := &fakeStorageContext{}
+	storageServer := fakeStorage(t, fakeData, ctx)
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	numRedirects := 0
+	var storageAuth []string
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRedirects++
+		http.Redirect(w, r, storageServer.URL+"/target/file.bin", http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	authChecker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storageAuth = append(storageAuth, r.Header.Get("Authorization"))
+		storageServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer authChecker.Close()
+
+	open := func(u string, policy *htfs.RedirectPolicy) (*htfs.File, error) {
+		settings := defaultSettings(t)
+		settings.Client = &http.Client{
+			// like eos does, replay all headers on redirect
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				for key, values := range via[0].Header {
+					req.Header[key] = values
+				}
+				return nil
+			},
+		}
+		settings.Redirects = policy
+		settings.ForbidBacktracking = true
+		settings.Header = http.Header{}
+		settings.Header.Set("Authorization", "secret")
+		return htfs.Open(func() (string, error) { return u, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+	}
+
+	readAround := func(f *htfs.File) {
+		buf := make([]byte, 16)
+		for _, offset := range []int64{0, 3 * 1024 * 1024, 1024} {
+			_, err := f.ReadAt(buf, offset)
+			assert.NoError(err)
+			assert.Equal(fakeData[offset:offset+16], buf)
+		}
+	}
+
+	// default: follow the redirect every time
+	f, err := open(redirector.URL, &htfs.RedirectPolicy{})
+	assert.NoError(err)
+	assert.Equal("file.bin", f.EffectiveURL().Path[len("/target/"):])
+	readAround(f)
+	assert.EqualValues(2, numRedirects)
+	assert.NoError(f.Close())
+
+	// cache the target
+	numRedirects = 0
+	f, err = open(redirector.URL, &htfs.RedirectPolicy{CacheTarget: true})
+	assert.NoError(err)
+	readAround(f)
+	assert.EqualValues(1, numRedirects)
+	assert.NoError(f.Close())
+
+	// forget the cached target when it fails
+	failNext := false
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failNext {
+			failNext = false
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		storageServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	flakyRedirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRedirects++
+		http.Redirect(w, r, flaky.URL+"/target/file.bin", http.StatusFound)
+	}))
+	defer flakyRedirector.Close()
+
+	numRedirects = 0
+	f, err = open(flakyRedirector.URL, &htfs.RedirectPolicy{CacheTarget: true})
+	assert.NoError(err)
+	failNext = true
+	readAround(f)
+	assert.EqualValues(2, numRedirects)
+	assert.NoError(f.Close())
+
+	// max hops
+	f, err = open(redirector.URL, &htfs.RedirectPolicy{MaxHops: -1})
+	if assert.NoError(err, "negative MaxHops means no limit") {
+		assert.NoError(f.Close())
+	}
+	loop := httptest.NewServer(nil)
+	loop.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loop.URL, http.StatusFound)
+	})
+	defer loop.Close()
+	_, err = open(loop.URL, &htfs.RedirectPolicy{MaxHops: 3})
+	assert.Error(err)
+	if ue, ok := errors.Cause(err).(*url.Error); assert.True(ok) {
+		assert.True(errors.Cause(ue.Err) == htfs.ErrTooManyRedirects)
+	}
+
+	// host allowlist
+	_, err = open(redirector.URL, &htfs.RedirectPolicy{AllowedHosts: []string{"example.org"}})
+	assert.Error(err)
+	if ue, ok := errors.Cause(err).(*url.Error); assert.True(ok) {
+		assert.True(errors.Cause(ue.Err) == htfs.ErrRedirectNotAllowed)
+	}
+	f, err = open(redirector.URL, &htfs.RedirectPolicy{AllowedHosts: []string{"127.0.0.1"}})
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	// strip credentials when changing hosts
+	authRedirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, authChecker.URL, http.StatusFound)
+	}))
+	defer authRedirector.Close()
+
+	f, err = open(authRedirector.URL, &htfs.RedirectPolicy{})
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	f, err = open(authRedirector.URL, &htfs.RedirectPolicy{StripAuthAcrossHosts: true})
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	assert.EqualValues([]string{"secret", ""}, storageAuth)
+
+	// including when going straight to the cached target
+	storageAuth = nil
+	f, err = open(authRedirector.URL, &htfs.RedirectPolicy{StripAuthAcrossHosts: true, CacheTarget: true})
+	assert.NoError(err)
+	readAround(f)
+	assert.NoError(f.Close())
+	assert.True(len(storageAuth) > 1)
+	for _, auth := range storageAuth {
+		assert.Empty(auth)
+	}
+
+	// cached targets on other hosts never get them, like net/http
+	// wouldn't send them when following a redirect
+	storageAuth = nil
+	f, err = open(authRedirector.URL, &htfs.RedirectPolicy{CacheTarget: true})
+	assert.NoError(err)
+	readAround(f)
+	assert.NoError(f.Close())
+	assert.True(len(storageAuth) > 1)
+	// the first request followed the redirect, with the client's CheckRedirect
+	for _, auth := range storageAuth[1:] {
+		assert.Empty(auth)
+	}
+}
+
+func Test_FileContentEncoding(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	storageServer := fakeStorage(t, fakeData, &fakeStorageContext{})
+	defer storageServer.Close()
+	defer storageServer.CloseClientConnections()
+
+	var acceptEncodings []string
+	encodingServer := func(encoding string, newWriter func(w io.Writer) io.WriteCloser) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncodings = append(acceptEncodings, r.Header.Get("Accept-Encoding"))
+
+			rec := httptest.NewRecorder()
+			storageServer.Config.Handler.ServeHTTP(rec, r)
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Content-Encoding", encoding)
+			w.WriteHeader(rec.Code)
+			ew := newWriter(w)
+			ew.Write(rec.Body.Bytes())
+			ew.Close()
+		}))
+	}
+	gzipServer := encodingServer("gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	defer gzipServer.Close()
+
+	_, err := newSimple(t, gzipServer.URL)
+	assert.Error(err)
+	_, ok := errors.Cause(err).(*htfs.ContentEncodingError)
+	assert.True(ok)
+	assert.EqualValues([]string{"identity"}, acceptEncodings)
+
+	settings := defaultSettings(t)
+	settings.DecodeContentEncoding = true
+	f, err := htfs.Open(func() (string, error) { return gzipServer.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 1024)
+	_, err = f.ReadAt(buf, 2*1024*1024)
+	assert.NoError(err)
+	assert.Equal(fakeData[2*1024*1024:2*1024*1024+1024], buf)
+	assert.NoError(f.Close())
+
+	// "deflate" is zlib, or raw DEFLATE for some servers
+	deflateServers := []*httptest.Server{
+		encodingServer("deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }),
+		encodingServer("deflate", func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		}),
+	}
+	for _, server := range deflateServers {
+		defer server.Close()
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		if !assert.NoError(err) {
+			continue
+		}
+		_, err = f.ReadAt(buf, 3*1024*1024)
+		assert.NoError(err)
+		assert.Equal(fakeData[3*1024*1024:3*1024*1024+1024], buf)
+		assert.NoError(f.Close())
+	}
+}
+
+func Test_FileAcceptEncoding(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	// refuses to send anything uncompressed, but doesn't compress ranges
+	var mu sync.Mutex
+	var acceptEncodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ae := r.Header.Get("Accept-Encoding")
+		mu.Lock()
+		acceptEncodings = append(acceptEncodings, r.Method+" "+ae)
+		mu.Unlock()
+		if ae == "identity" && r.Header.Get("Range") == "" {
+			w.WriteHeader(406)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	read := func(probeStrategy htfs.ProbeStrategy, acceptEncoding htfs.AcceptEncoding) ([]string, error) {
+		mu.Lock()
+		acceptEncodings = nil
+		mu.Unlock()
+
+		settings := defaultSettings(t)
+		settings.ProbeStrategy = probeStrategy
+		settings.AcceptEncoding = acceptEncoding
+		settings.RetrySettings.MaxTries = 1
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stats, err := f.Stat()
+		assert.NoError(err)
+		assert.EqualValues(len(fakeData), stats.Size())
+
+		buf := make([]byte, 1024)
+		_, err = f.ReadAt(buf, 1024*1024)
+		assert.NoError(err)
+		assert.Equal(fakeData[1024*1024:1024*1024+1024], buf)
+
+		mu.Lock()
+		defer mu.Unlock()
+		return acceptEncodings, nil
+	}
+
+	_, err := read(htfs.ProbeHead, htfs.AcceptEncodingIdentity)
+	assert.Error(err)
+
+	seen, err := read(htfs.ProbeHead, htfs.AcceptEncodingGzipMetadata)
+	assert.NoError(err)
+	assert.EqualValues([]string{"HEAD gzip", "GET identity"}, seen)
+
+	seen, err = read(htfs.ProbeHead, htfs.AcceptEncodingTransport)
+	assert.NoError(err)
+	assert.EqualValues([]string{"HEAD ", "GET "}, seen)
+}
+
+func Test_FileReadMulti(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	numRequests := 0
+	var numRequestsMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequestsMutex.Lock()
+		numRequests++
+		numRequestsMutex.Unlock()
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	f, err := newSimple(t, server.URL)
+	assert.NoError(err)
+
+	prng := rand.New(rand.NewSource(0x1337))
+	var ranges []htfs.Range
+	for i := 0; i < 200; i++ {
+		length := int64(prng.Intn(4096))
+		offset := prng.Int63n(int64(len(fakeData)) - length)
+		ranges = append(ranges, htfs.Range{Offset: offset, Length: length})
+	}
+	ranges = append(ranges, htfs.Range{Offset: 0, Length: 0})
+
+	numRequests = 0
+	result, err := f.ReadMulti(ranges)
+	assert.NoError(err)
+	assert.Len(result, len(ranges))
+	for i, r := range ranges {
+		assert.Equal(fakeData[r.Offset:r.Offset+r.Length], result[i], "range %d", i)
+	}
+	assert.True(numRequests < len(ranges)/10, "should coalesce and batch requests, did %d", numRequests)
+
+	_, err = f.ReadMulti([]htfs.Range{{Offset: int64(len(fakeData)) - 1, Length: 2}})
+	assert.Error(err)
+
+	assert.NoError(f.Close())
+}
+
+func Test_FilePreload(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	ranges := []htfs.Range{
+		{Offset: 1024 * 1024, Length: 300 * 1024},
+		{Offset: int64(len(fakeData)) - 1000, Length: 1000},
+	}
+	assert.NoError(f.Preload(ranges))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.PendingPreloads() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(0, f.PendingPreloads())
+
+	requestsBefore := atomic.LoadInt64(&numRequests)
+	for _, r := range ranges {
+		buf := make([]byte, r.Length)
+		n, err := f.ReadAt(buf, r.Offset)
+		assert.NoError(err)
+		assert.EqualValues(r.Length, n)
+		assert.Equal(fakeData[r.Offset:r.Offset+r.Length], buf)
+	}
+
+	// reading past the end is served from blocks too
+	buf := make([]byte, 2000)
+	n, err := f.ReadAt(buf, int64(len(fakeData))-1000)
+	assert.Equal(io.EOF, err)
+	assert.EqualValues(1000, n)
+
+	assert.EqualValues(requestsBefore, atomic.LoadInt64(&numRequests), "reads served from preloaded data")
+
+	assert.NoError(f.Close())
+
+	// without a Cache, preloaded blocks count against the memory budget
+	settings.BlockSize = 64 * 1024
+	settings.MemoryBudget = htfs.NewMemoryBudget(2 * settings.BlockSize)
+	f, err = htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	assert.NoError(f.Preload([]htfs.Range{{Offset: 0, Length: 1024 * 1024}}))
+	deadline = time.Now().Add(5 * time.Second)
+	for f.PendingPreloads() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := f.MemoryStats()
+	assert.EqualValues(2*settings.BlockSize, stats.Used)
+	assert.EqualValues(14, stats.Refused)
+
+	buf = make([]byte, 1000)
+	_, err = f.ReadAt(buf, 512*1024)
+	assert.NoError(err)
+	assert.Equal(fakeData[512*1024:512*1024+1000], buf)
+
+	assert.NoError(f.Close())
+	assert.EqualValues(0, f.MemoryStats().Used)
+}
+
+func Test_FilePin(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	blockSize := int64(16 * 1024)
+	cache, err := htfs.NewCache(htfs.CacheSettings{BlockSize: blockSize, MaxBytes: 4 * blockSize})
+	assert.NoError(err)
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(fakeData))
+	settings.Cache = cache
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	waitPreloads := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for f.PendingPreloads() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.EqualValues(0, f.PendingPreloads())
+	}
+
+	index := htfs.Range{Offset: int64(len(fakeData)) - 1000, Length: 1000}
+	assert.NoError(f.Pin([]htfs.Range{index}))
+	waitPreloads()
+
+	// lots of other traffic
+	assert.NoError(f.Preload([]htfs.Range{{Offset: 0, Length: 10 * blockSize}}))
+	waitPreloads()
+	assert.EqualValues(1, cache.Stats().Pinned)
+
+	requestsBefore := atomic.LoadInt64(&numRequests)
+	buf := make([]byte, index.Length)
+	_, err = f.ReadAt(buf, index.Offset)
+	assert.NoError(err)
+	assert.Equal(fakeData[index.Offset:], buf)
+	assert.EqualValues(requestsBefore, atomic.LoadInt64(&numRequests), "pinned range is still cached")
+
+	f.Unpin([]htfs.Range{index})
+	assert.EqualValues(0, cache.Stats().Pinned)
+	assert.True(cache.Size() <= 4*blockSize)
+}
+
+func Test_FileGoroutineLabels(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	stalled := make(chan struct{})
+	release := make(chan struct{})
+	var stallOnce sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "bytes=0-0" {
+			stallOnce.Do(func() {
+				close(stalled)
+				<-release
+			})
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	f, err := htfs.Open(func() (string, error) { return server.URL + "/data.bin?sig=secret", nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	assert.NoError(f.Preload([]htfs.Range{{Offset: 1024 * 1024, Length: 1024}}))
+	<-stalled
+
+	dump := new(bytes.Buffer)
+	assert.NoError(pprof.Lookup("goroutine").WriteTo(dump, 1))
+	close(release)
+
+	assert.Contains(dump.String(), `"htfs.task":"Preload"`)
+	assert.Contains(dump.String(), `"htfs.name":"data.bin"`)
+	assert.Contains(dump.String(), `"htfs.url":"`)
+	assert.NotContains(dump.String(), "secret")
+}
+
+func Test_FilePreloadPreemption(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var stallNext int32
+	var preempted int32
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&stallNext, 1, 0) {
+			close(stalled)
+			select {
+			case <-r.Context().Done():
+				atomic.AddInt32(&preempted, 1)
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	atomic.StoreInt32(&stallNext, 1)
+	r := htfs.Range{Offset: 1024 * 1024, Length: 300 * 1024}
+	assert.NoError(f.Preload([]htfs.Range{r}))
+	<-stalled
+
+	// doesn't wait for the stalled preload
+	start := time.Now()
+	buf := make([]byte, 1024)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.Equal(fakeData[:1024], buf)
+	assert.True(time.Since(start) < 2*time.Second)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.PendingPreloads() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(0, f.PendingPreloads(), "the preload is tried again")
+
+	for atomic.LoadInt32(&preempted) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualValues(1, atomic.LoadInt32(&preempted), "the preload request was cancelled")
+
+	readBuf := make([]byte, r.Length)
+	_, err = f.ReadAt(readBuf, r.Offset)
+	assert.NoError(err)
+	assert.Equal(fakeData[r.Offset:r.Offset+r.Length], readBuf)
+}
+
+func Test_FileCloseAbortsReads(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		// send headers and a little data, then stall
+		var start, end int64
+		fmt.Sscanf(r.Header.Get("range"), "bytes=%d-%d", &start, &end)
+		if end == 0 {
+			end = 1024*1024 - 1
+		}
+		w.Header().Set("content-range", fmt.Sprintf("bytes %d-%d/%d", start, end, 1024*1024))
+		w.WriteHeader(206)
+		w.Write(make([]byte, 10))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = 1024 * 1024
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	waitRequests := func(n int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&requests) < n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// get both a preload and a foreground read stuck in body reads
+	assert.NoError(f.Preload([]htfs.Range{{Offset: 512 * 1024, Length: 1000}}))
+	waitRequests(1)
+
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := f.ReadAt(make([]byte, 1000), 0)
+		readDone <- err
+	}()
+	waitRequests(2)
+	assert.EqualValues(2, atomic.LoadInt64(&requests))
+
+	start := time.Now()
+	assert.NoError(f.Close())
+	assert.NoError(f.WaitClosed(context.Background()))
+	assert.True(time.Since(start) < time.Second, "Close doesn't wait for the next I/O")
+
+	select {
+	case err := <-readDone:
+		assert.Error(err)
+	case <-time.After(time.Second):
+		assert.Fail("ReadAt still blocked after WaitClosed")
+	}
+}
+
+func Test_FileWaitClosedLeaks(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var openConns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&openConns, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt64(&openConns, -1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	goroutinesBefore := runtime.NumGoroutine()
+	clock := htfs.NewManualClock(time.Now())
+
+	settings := defaultSettings(t)
+	// so the File makes its own client, and its pool can be checked
+	settings.Client = nil
+	settings.Timeouts = &timeout.Timeouts{Connect: 5 * time.Second, Idle: 5 * time.Second}
+	settings.Clock = clock
+	settings.HedgeAfter = time.Minute
+	settings.ResponseHeaderTimeout = time.Minute
+	settings.StallTimeout = time.Minute
+	settings.OnConnStalled = func(info htfs.ConnInfo) {}
+	f, err := htfs.Open(func() (string, error) { return server.URL + "/data.bin", nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 64*1024)
+	for offset := int64(0); offset < 1024*1024; offset += int64(len(buf)) {
+		_, err := f.ReadAt(buf, offset)
+		assert.NoError(err)
+	}
+	_, err = f.ReadAt(buf, int64(len(fakeData)/2))
+	assert.NoError(err)
+	assert.NoError(f.Preload([]htfs.Range{{Offset: int64(len(fakeData)) - 300*1024, Length: 200 * 1024}}))
+	// completed responses leave their connection in the client's pool
+	preloadDeadline := time.Now().Add(5 * time.Second)
+	for f.PendingPreloads() > 0 && time.Now().Before(preloadDeadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(0, f.PendingPreloads())
+
+	goroutinesOpen := runtime.NumGoroutine()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 10; i++ {
+		assert.Error(f.WaitClosed(cancelled), "not closed yet")
+	}
+	// giving up on WaitClosed doesn't leave anything waiting for Close
+	waitDeadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutinesOpen && time.Now().Before(waitDeadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(runtime.NumGoroutine() <= goroutinesOpen, "WaitClosed left goroutines behind: %d, had %d", runtime.NumGoroutine(), goroutinesOpen)
+
+	assert.NoError(f.Close())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(f.WaitClosed(ctx))
+	assert.EqualValues(0, clock.Pending(), "timers left behind")
+
+	// both ends notice closed connections on their own time
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt64(&openConns) == 0 && runtime.NumGoroutine() <= goroutinesBefore {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(0, atomic.LoadInt64(&openConns), "connections left open")
+	assert.True(runtime.NumGoroutine() <= goroutinesBefore, "goroutines left behind: %d, had %d", runtime.NumGoroutine(), goroutinesBefore)
+}
+
+func Test_FileNoReadAhead(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var rangesMutex sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		rangesMutex.Unlock()
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.NoReadAhead = true
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	buf := make([]byte, 16)
+	_, err = f.ReadAt(buf, 100)
+	assert.NoError(err)
+	assert.Equal(data[100:116], buf)
+
+	n, err := f.ReadAt(buf, int64(len(data))-8)
+	assert.Equal(io.EOF, err)
+	assert.EqualValues(8, n)
+	assert.Equal(data[len(data)-8:], buf[:8])
+
+	assert.Equal([]string{"bytes=100-115", fmt.Sprintf("bytes=%d-%d", len(data)-8, len(data)-1)}, ranges)
+	assert.EqualValues(16+8, f.TransferStats().Downloaded, "nothing is read ahead")
+	assert.EqualValues(0, f.NumConns())
+}
+
+func Test_FileRampUp(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var rangesMutex sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		rangesMutex.Unlock()
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.RampUp = &htfs.RampUp{Initial: 4096, Max: 16384}
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	buf := make([]byte, 16)
+	_, err = f.ReadAt(buf, 100)
+	assert.NoError(err)
+	assert.Equal(data[100:116], buf)
+	assert.Equal([]string{"bytes=100-4195"}, ranges, "a small read only asks for a small range")
+	assert.True(f.TransferStats().Downloaded <= 4096)
+
+	// reading on, across range boundaries
+	readData := make([]byte, len(data)-116)
+	_, err = io.ReadFull(io.NewSectionReader(f, 116, int64(len(readData))), readData)
+	assert.NoError(err)
+	assert.Equal(data[116:], readData)
+
+	assert.Equal([]string{
+		"bytes=100-4195",
+		"bytes=4196-12387",
+		"bytes=12388-28771",
+		"bytes=28772-",
+	}, ranges)
+	assert.EqualValues(1, f.NumConns())
+}
+
+func Test_FileMaxRangeSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	// rejects open-ended ranges, and doesn't tell the size if asked to
+	var rangesMutex sync.Mutex
+	var ranges []string
+	var hideSize bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		rangesMutex.Unlock()
+
+		var start, end int
+		if n, _ := fmt.Sscanf(r.Header.Get("range"), "bytes=%d-%d", &start, &end); n != 2 {
+			w.WriteHeader(400)
+			return
+		}
+		if !hideSize {
+			http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		if start >= len(data) {
+			w.Header().Set("content-range", "bytes */*")
+			w.WriteHeader(416)
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.Header().Set("content-range", fmt.Sprintf("bytes %d-%d/*", start, end))
+		w.WriteHeader(206)
+		w.Write(data[start : end+1])
+	}))
+	defer server.Close()
+
+	open := func(rampUp *htfs.RampUp) *htfs.File {
+		rangesMutex.Lock()
+		ranges = nil
+		rangesMutex.Unlock()
+
+		settings := defaultSettings(t)
+		settings.MaxRangeSpan = 16384
+		settings.RampUp = rampUp
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		return f
+	}
+
+	f := open(&htfs.RampUp{Initial: 4096, Max: 1024 * 1024})
+	readData, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(data, readData)
+	assert.NoError(f.Close())
+	assert.Equal([]string{
+		"bytes=0-4095",
+		"bytes=4096-12287",
+		"bytes=12288-28671",
+		"bytes=28672-45055",
+		"bytes=45056-61439",
+		"bytes=61440-65535",
+	}, ranges)
+
+	// the last range ends right where the file does
+	hideSize = true
+	f = open(nil)
+	readData, err = ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(data, readData)
+	assert.NoError(f.Close())
+	assert.Equal([]string{
+		"bytes=0-16383",
+		"bytes=16384-32767",
+		"bytes=32768-49151",
+		"bytes=49152-65535",
+		"bytes=65536-81919",
+	}, ranges)
+}
+
+func Test_FileChunkSize(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var rangesMutex sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		rangesMutex.Unlock()
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.ChunkSize = 32 * 1024
+	settings.RampUp = &htfs.RampUp{Initial: 4096}
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	// requests are for whole chunks, wherever reads start
+	readData := make([]byte, len(data)-5000)
+	_, err = io.ReadFull(io.NewSectionReader(f, 5000, int64(len(readData))), readData)
+	assert.NoError(err)
+	assert.Equal(data[5000:], readData)
+	assert.Equal([]string{
+		"bytes=0-32767",
+		"bytes=32768-65535",
+		"bytes=65536-98303",
+		"bytes=98304-102399",
+	}, ranges)
+	assert.EqualValues(5000, f.TransferStats().Discarded)
+}
+
+func Test_FileMaxBytesPerConn(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var rangesMutex sync.Mutex
+	var ranges []string
+	var tcpConns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		rangesMutex.Unlock()
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&tcpConns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.MaxBytesPerConn = 64 * 1024
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	readData := make([]byte, len(data))
+	for offset := 0; offset < len(data); offset += 16 * 1024 {
+		_, err = f.ReadAt(readData[offset:offset+16*1024], int64(offset))
+		if err != io.EOF {
+			assert.NoError(err)
+		}
+	}
+	assert.Equal(data, readData)
+
+	rangesMutex.Lock()
+	defer rangesMutex.Unlock()
+	assert.Equal([]string{
+		"bytes=0-",
+		"bytes=65536-",
+		"bytes=131072-",
+		"bytes=196608-",
+	}, ranges)
+	assert.EqualValues(len(ranges), atomic.LoadInt64(&tcpConns), "each response is on its own connection")
+	assert.EqualValues(1, f.NumConns())
+}
+
+func Test_FileEagerConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var requests int64
+	bothArrived := make(chan struct{})
+	var rangesMutex sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		rangesMutex.Unlock()
+
+		if atomic.AddInt64(&requests, 1) == 2 {
+			close(bothArrived)
+		}
+		select {
+		case <-bothArrived:
+		case <-time.After(5 * time.Second):
+			t.Errorf("requests weren't concurrent")
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.ProbeStrategy = htfs.ProbeHead
+	settings.EagerConnect = true
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+	assert.EqualValues(1, f.NumConns(), "the eager request is pooled")
+
+	buf := make([]byte, 512)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.Equal(data[:512], buf)
+
+	assert.EqualValues(2, atomic.LoadInt64(&requests), "the first read doesn't wait for another request")
+	assert.ElementsMatch([]string{"", "bytes=0-"}, ranges)
+	assert.EqualValues(1, f.Summary().Connections)
+}
+
+func Test_FileReadahead(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var rangesMutex sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		rangesMutex.Unlock()
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	cache, err := htfs.NewCache(htfs.CacheSettings{BlockSize: 16 * 1024})
+	assert.NoError(err)
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.Cache = cache
+	settings.Readahead = 4
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	readData, err := ioutil.ReadAll(io.LimitReader(f, int64(len(data))))
+	assert.NoError(err)
+	assert.Equal(data, readData)
+
+	rangesMutex.Lock()
+	defer rangesMutex.Unlock()
+	openEnded := 0
+	for _, r := range ranges {
+		if strings.HasSuffix(r, "-") {
+			openEnded++
+		}
+	}
+	assert.Equal(0, openEnded, "sequential reads don't use connections")
+	assert.Contains(ranges, "bytes=0-16383")
+	assert.Contains(ranges, fmt.Sprintf("bytes=%d-%d", len(data)-16384, len(data)-1))
+}
+
+func Test_FileMemoryBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	const blockSize = 16 * 1024
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	// not enough for both Files to read 4 blocks ahead
+	budget := htfs.NewMemoryBudget(5 * blockSize)
+	var files []*htfs.File
+	for i := 0; i < 2; i++ {
+		settings := defaultSettings(t)
+		settings.Size = int64(len(data))
+		settings.BlockSize = blockSize
+		settings.Readahead = 4
+		settings.MemoryBudget = budget
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		files = append(files, f)
+	}
+
+	buf := make([]byte, 4096)
+	for offset := int64(0); offset < int64(len(data)); offset += int64(len(buf)) {
+		for _, f := range files {
+			_, err := f.ReadAt(buf, offset)
+			assert.NoError(err)
+			assert.Equal(data[offset:offset+int64(len(buf))], buf)
+			assert.True(budget.Stats().Used <= 5*blockSize)
+		}
+	}
+
+	ms := files[0].MemoryStats()
+	assert.EqualValues(5*blockSize, ms.Limit)
+	assert.True(ms.Peak <= 5*blockSize)
+	assert.True(ms.Peak > 0)
+	assert.True(ms.Refused > 0, "some blocks didn't fit")
+
+	for _, f := range files {
+		assert.NoError(f.Close())
+		assert.NoError(f.WaitClosed(context.Background()))
+	}
+	assert.EqualValues(0, budget.Stats().Used, "closed Files give their memory back")
+}
+
+func Test_FileMemoryBackpressure(t *testing.T) {
+	assert := assert.New(t)
+
+	const blockSize = 16 * 1024
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var rangesMutex sync.Mutex
+	ranges := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesMutex.Lock()
+		ranges[r.URL.Path] = append(ranges[r.URL.Path], r.Header.Get("range"))
+		rangesMutex.Unlock()
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	budget := htfs.NewMemoryBudget(2 * blockSize)
+	open := func(path string) *htfs.File {
+		settings := defaultSettings(t)
+		settings.Size = int64(len(data))
+		settings.BlockSize = blockSize
+		settings.Readahead = 4
+		settings.MemoryBudget = budget
+		settings.MemoryWait = 5 * time.Second
+		f, err := htfs.Open(func() (string, error) { return server.URL + path, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		return f
+	}
+
+	// a takes up the whole budget
+	a := open("/a")
+	buf := make([]byte, 4096)
+	_, err := a.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues(2*blockSize, budget.Stats().Used)
+
+	b := open("/b")
+	defer b.Close()
+	readDone := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		_, err := b.ReadAt(buf, 0)
+		if err == nil && !bytes.Equal(buf, data[:4096]) {
+			err = errors.New("bad data")
+		}
+		readDone <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for budget.Stats().Waits == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.EqualValues(1, budget.Stats().Waits)
+	select {
+	case <-readDone:
+		assert.Fail("read didn't wait for memory")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// closing a gives its memory to b's read
+	assert.NoError(a.Close())
+	select {
+	case err := <-readDone:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("read still waiting after memory was released")
+	}
+
+	rangesMutex.Lock()
+	defer rangesMutex.Unlock()
+	assert.NotEmpty(ranges["/b"])
+	for _, r := range ranges["/b"] {
+		assert.False(strings.HasSuffix(r, "-"), "read from readahead, not a connection")
+	}
+	assert.True(budget.Stats().Used <= 2*blockSize)
+}
+
+func Test_FileBlockAligned(t *testing.T) {
+	assert := assert.New(t)
+
+	const blockSize = 64 * 1024
+	data := make([]byte, 1024*1024+100)
+	rand.New(rand.NewSource(0xcafe)).Read(data)
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.BlockAligned = true
+	settings.BlockSize = blockSize
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	read := func(offset int64, length int) {
+		t.Helper()
+		buf := make([]byte, length)
+		n, err := f.ReadAt(buf, offset)
+		if offset+int64(length) > int64(len(data)) {
+			assert.Equal(io.EOF, err)
+		} else {
+			assert.NoError(err)
+		}
+		assert.Equal(data[offset:offset+int64(n)], buf[:n])
+	}
+
+	// lots of small reads in the first 4 blocks
+	rng := rand.New(rand.NewSource(0xf00d))
+	for i := 0; i < 1000; i++ {
+		read(rng.Int63n(4*blockSize-4096), 4096)
+	}
+	assert.EqualValues(4, atomic.LoadInt64(&requests), "one request per block")
+
+	// a read spanning several missing blocks costs one request
+	read(6*blockSize-10, 2*blockSize+20)
+	assert.EqualValues(5, atomic.LoadInt64(&requests))
+
+	// the last block is partial
+	read(int64(len(data))-50, 200)
+	read(int64(len(data))-100, 100)
+	assert.EqualValues(6, atomic.LoadInt64(&requests))
+
+	// without a Cache, blocks are kept within the memory budget
+	settings.MemoryBudget = htfs.NewMemoryBudget(4 * blockSize)
+	f, err = htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	for offset := int64(0); offset < int64(len(data)); offset += 4096 {
+		read(offset, 4096)
+	}
+	stats := f.MemoryStats()
+	assert.EqualValues(4*blockSize, stats.Peak)
+	assert.True(stats.Refused > 0)
+	assert.NoError(f.Close())
+	assert.EqualValues(0, f.MemoryStats().Used)
+}
+
+func Test_FileBackingFile(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var numRequests int64
+	var etag atomic.Value
+	etag.Store(`"1"`)
+	var slow int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		w.Header().Set("etag", etag.Load().(string))
+		if atomic.LoadInt32(&slow) == 1 {
+			w = &slowResponseWriter{ResponseWriter: w}
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "htfs-backing")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	getURL := func() (string, error) { return server.URL, nil }
+	needsRenewal := func(res *http.Response, body []byte) bool { return false }
+
+	settings := defaultSettings(t)
+	settings.BackingFile = filepath.Join(dir, "data.bin")
+
+	readOffset := int64(1024 * 1024)
+	readLength := int64(192 * 1024)
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, readLength+1000)
+	_, err = f.ReadAt(buf, readOffset)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	// now re-open: the part we already read comes from disk
+	settings.Size = int64(len(fakeData))
+	f, err = htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	covered := false
+	for _, r := range f.PresentRanges() {
+		if r.Offset <= readOffset && readOffset+readLength <= r.Offset+r.Length {
+			covered = true
+		}
+	}
+	assert.True(covered, "read range is present in backing file")
+
+	requestsBefore := atomic.LoadInt64(&numRequests)
+	buf = make([]byte, readLength)
+	n, err := f.ReadAt(buf, readOffset)
+	assert.NoError(err)
+	assert.EqualValues(readLength, n)
+	assert.Equal(fakeData[readOffset:readOffset+readLength], buf)
+	assert.EqualValues(requestsBefore, atomic.LoadInt64(&numRequests), "reads served from backing file")
+
+	// other parts still go to the network
+	buf = make([]byte, 1000)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.Equal(fakeData[:1000], buf)
+
+	assert.NoError(f.Close())
+
+	// same size, another version: nothing is from disk
+	etag.Store(`"2"`)
+	settings.Size = 0
+	f, err = htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	assert.Empty(f.PresentRanges())
+	assert.NoError(f.Close())
+
+	// closing while a preload is still writing to the backing file
+	// leaves it consistent
+	atomic.StoreInt32(&slow, 1)
+	var failedWrites int64
+	log := settings.Log
+	settings.Log = func(msg string) {
+		if strings.Contains(msg, "(Backing) could not write") {
+			atomic.AddInt64(&failedWrites, 1)
+		}
+		log(msg)
+	}
+	f, err = htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	var ranges []htfs.Range
+	for offset := int64(0); offset < int64(len(fakeData)); offset += 256 * 1024 {
+		ranges = append(ranges, htfs.Range{Offset: offset, Length: 64 * 1024})
+	}
+	assert.NoError(f.Preload(ranges))
+	writeDeadline := time.Now().Add(5 * time.Second)
+	for len(f.PresentRanges()) == 0 && time.Now().Before(writeDeadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(f.Close())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(f.WaitClosed(ctx))
+	assert.EqualValues(0, atomic.LoadInt64(&failedWrites), "writes after the backing file was closed")
+
+	atomic.StoreInt32(&slow, 0)
+	settings.Log = log
+	settings.Size = int64(len(fakeData))
+	f, err = htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	present := f.PresentRanges()
+	assert.NotEmpty(present, "the preload wrote something before Close")
+	for _, r := range present {
+		buf := make([]byte, r.Length)
+		_, err := f.ReadAt(buf, r.Offset)
+		assert.NoError(err)
+		assert.Equal(fakeData[r.Offset:r.Offset+r.Length], buf)
+	}
+	assert.NoError(f.Close())
+}
+
+// slowResponseWriter flushes every write, then takes a little nap
+type slowResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (srw *slowResponseWriter) Write(p []byte) (int, error) {
+	n, err := srw.ResponseWriter.Write(p)
+	if f, ok := srw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	time.Sleep(time.Millisecond)
+	return n, err
+}
+
+func Test_FileSharedCache(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	cache, err := htfs.NewCache(htfs.CacheSettings{})
+	assert.NoError(err)
+
+	getURL := func() (string, error) { return server.URL, nil }
+	needsRenewal := func(res *http.Response, body []byte) bool { return false }
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(fakeData))
+	settings.Cache = cache
+
+	r := htfs.Range{Offset: 512 * 1024, Length: 128 * 1024}
+
+	f1, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	assert.NoError(f1.Preload([]htfs.Range{r}))
+	deadline := time.Now().Add(5 * time.Second)
+	for f1.PendingPreloads() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(f1.Close())
+	assert.EqualValues(cache.BlockSize(), cache.Size())
+
+	// another File for the same URL reads from the shared cache
+	f2, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	requestsBefore := atomic.LoadInt64(&numRequests)
+	buf := make([]byte, r.Length)
+	n, err := f2.ReadAt(buf, r.Offset)
+	assert.NoError(err)
+	assert.EqualValues(r.Length, n)
+	assert.Equal(fakeData[r.Offset:r.Offset+r.Length], buf)
+	assert.EqualValues(requestsBefore, atomic.LoadInt64(&numRequests), "reads served from shared cache")
+	assert.NoError(f2.Close())
+}
+
+func Test_FileCacheCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	// same URL, same size, different bytes depending on who's asking
+	contents := map[string][]byte{
+		"Bearer alice": bytes.Repeat([]byte("a"), 64*1024),
+		"Bearer bob":   bytes.Repeat([]byte("b"), 64*1024),
+	}
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		data, ok := contents[r.Header.Get("Authorization")]
+		if !ok {
+			w.WriteHeader(401)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	cache, err := htfs.NewCache(htfs.CacheSettings{BlockSize: 16 * 1024})
+	assert.NoError(err)
+
+	read := func(authorization string) []byte {
+		settings := defaultSettings(t)
+		settings.Size = 64 * 1024
+		settings.Cache = cache
+		settings.BlockAligned = true
+		settings.Header = http.Header{"Authorization": []string{authorization}}
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		defer f.Close()
+
+		buf := make([]byte, 1024)
+		_, err = f.ReadAt(buf, 0)
+		assert.NoError(err)
+		return buf
+	}
+
+	assert.Equal(contents["Bearer alice"][:1024], read("Bearer alice"))
+	assert.Equal(contents["Bearer bob"][:1024], read("Bearer bob"), "bob doesn't get alice's blocks")
+	requestsBefore := atomic.LoadInt64(&numRequests)
+	assert.Equal(contents["Bearer alice"][:1024], read("Bearer alice"))
+	assert.EqualValues(requestsBefore, atomic.LoadInt64(&numRequests), "alice still gets hers from the cache")
+}
+
+func Test_FileCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeData := getBigFakeData()
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		if r.URL.Query().Get("sig") == "" {
+			w.WriteHeader(403)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	var numURLs int64
+	getURL := func() (string, error) {
+		return fmt.Sprintf("%s/data.bin?sig=%d", server.URL, atomic.AddInt64(&numURLs, 1)), nil
+	}
+
+	read := func(cache *htfs.Cache, cacheKey func(string) string) {
+		settings := defaultSettings(t)
+		settings.Size = int64(len(fakeData))
+		settings.Cache = cache
+		settings.BlockAligned = true
+		settings.CacheKey = cacheKey
+		f, err := htfs.Open(getURL, func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		defer f.Close()
+
+		buf := make([]byte, 1024)
+		_, err = f.ReadAt(buf, 0)
+		assert.NoError(err)
+		assert.Equal(fakeData[:1024], buf)
+	}
+
+	cache, err := htfs.NewCache(htfs.CacheSettings{BlockSize: 16 * 1024})
+	assert.NoError(err)
+	read(cache, nil)
+	requestsBefore := atomic.LoadInt64(&numRequests)
+	read(cache, nil)
+	assert.True(atomic.LoadInt64(&numRequests) > requestsBefore, "a newly signed URL is another file by default")
+
+	cache, err = htfs.NewCache(htfs.CacheSettings{BlockSize: 16 * 1024})
+	assert.NoError(err)
+	read(cache, htfs.CacheKeyWithoutQuery)
+	requestsBefore = atomic.LoadInt64(&numRequests)
+	read(cache, htfs.CacheKeyWithoutQuery)
+	assert.EqualValues(requestsBefore, atomic.LoadInt64(&numRequests), "blocks are shared across signatures")
+
+	assert.Equal("https://example.org/a/b.zip", htfs.CacheKeyWithoutQuery("https://example.org/a/b.zip?sig=abc&exp=123#frag"))
+}
+
+func Test_FileCacheRevalidation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-revalidation")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	fakeData := getBigFakeData()
+	etag := `"v1"`
+	var conditionals []string
+	var numRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		mu.Lock()
+		data, tag := fakeData, etag
+		if inm := r.Header.Get("if-none-match"); inm != "" {
+			conditionals = append(conditionals, inm)
+		}
+		mu.Unlock()
+		w.Header().Set("etag", tag)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	getURL := func() (string, error) { return server.URL, nil }
+	needsRenewal := func(res *http.Response, body []byte) bool { return false }
+	r := htfs.Range{Offset: 512 * 1024, Length: 128 * 1024}
+
+	var cache *htfs.Cache
+	open := func() *htfs.File {
+		// a new Cache every time, as if from another process
+		cache, err = htfs.NewCache(htfs.CacheSettings{Dir: dir})
+		assert.NoError(err)
+		settings := defaultSettings(t)
+		settings.Cache = cache
+		f, err := htfs.Open(getURL, needsRenewal, settings)
+		assert.NoError(err)
+		return f
+	}
+
+	f1 := open()
+	assert.NoError(f1.Preload([]htfs.Range{r}))
+	deadline := time.Now().Add(5 * time.Second)
+	for f1.PendingPreloads() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(f1.Close())
+
+	// unchanged: served from the cache after a 304
+	f2 := open()
+	stats, err := f2.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData), stats.Size())
+	assert.Equal(`"v1"`, f2.ETag())
+	requestsBefore := atomic.LoadInt64(&numRequests)
+	buf := make([]byte, r.Length)
+	_, err = f2.ReadAt(buf, r.Offset)
+	assert.NoError(err)
+	assert.Equal(fakeData[r.Offset:r.Offset+r.Length], buf)
+	assert.EqualValues(requestsBefore, atomic.LoadInt64(&numRequests), "reads served from cache")
+	assert.NoError(f2.Close())
+
+	// a new build with the same size
+	mu.Lock()
+	newData := make([]byte, len(fakeData))
+	for i := range newData {
+		newData[i] = fakeData[i] ^ 0xff
+	}
+	fakeData, etag = newData, `"v2"`
+	mu.Unlock()
+
+	f3 := open()
+	_, err = f3.ReadAt(buf, r.Offset)
+	assert.NoError(err)
+	assert.Equal(newData[r.Offset:r.Offset+r.Length], buf, "stale blocks never served")
+	assert.Equal(`"v2"`, f3.ETag())
+	assert.EqualValues(1, cache.Stats().Invalidated)
+	assert.NoError(f3.Close())
+
+	mu.Lock()
+	assert.Equal([]string{`"v1"`, `"v1"`}, conditionals)
+	mu.Unlock()
+}
+
+func Test_FileReadTail(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var ranges []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	getURL := func() (string, error) { return server.URL, nil }
+	needsRenewal := func(res *http.Response, body []byte) bool { return false }
+
+	settings := defaultSettings(t)
+	settings.Lazy = true
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	// a single suffix range request, that also opens the file
+	tail, err := f.ReadTail(22)
+	assert.NoError(err)
+	assert.Equal(fakeData[len(fakeData)-22:], tail)
+	stats, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData), stats.Size())
+	mu.Lock()
+	assert.Equal([]string{"bytes=-22"}, ranges)
+	mu.Unlock()
+	assert.EqualValues(22, f.TransferStats().Delivered)
+
+	// once open, it's a regular read
+	tail, err = f.ReadTail(100)
+	assert.NoError(err)
+	assert.Equal(fakeData[len(fakeData)-100:], tail)
+	assert.NoError(f.Close())
+
+	// asking for more than there is returns the whole file
+	small := []byte("tiny")
+	smallServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "small.bin", time.Time{}, bytes.NewReader(small))
+	}))
+	defer smallServer.Close()
+
+	f, err = htfs.Open(func() (string, error) { return smallServer.URL, nil }, needsRenewal, settings)
+	assert.NoError(err)
+	tail, err = f.ReadTail(1024)
+	assert.NoError(err)
+	assert.Equal(small, tail)
+	assert.NoError(f.Close())
+}
+
+func Test_FileRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	fakeData := []byte("first build")
+	etag := `"1"`
+	var modTime time.Time
+	var conditionals int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		data, tag, mtime := fakeData, etag, modTime
+		mu.Unlock()
+		if r.Header.Get("if-none-match") != "" {
+			atomic.AddInt64(&conditionals, 1)
+		}
+		if tag != "" {
+			w.Header().Set("etag", tag)
+		}
+		http.ServeContent(w, r, "data.bin", mtime, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	getURL := func() (string, error) { return server.URL, nil }
+	needsRenewal := func(res *http.Response, body []byte) bool { return false }
+
+	f, err := htfs.Open(getURL, needsRenewal, defaultSettings(t))
+	assert.NoError(err)
+
+	changed, err := f.Refresh()
+	assert.NoError(err)
+	assert.False(changed)
+	assert.EqualValues(1, atomic.LoadInt64(&conditionals))
+
+	// same size, new ETag
+	mu.Lock()
+	fakeData, etag = []byte("other build"), `"2"`
+	mu.Unlock()
+	changed, err = f.Refresh()
+	assert.NoError(err)
+	assert.True(changed)
+	// the File is left alone
+	assert.Equal(`"1"`, f.ETag())
+	assert.NoError(f.Close())
+
+	// without validators, only the size can tell
+	mu.Lock()
+	etag = ""
+	mu.Unlock()
+	f, err = htfs.Open(getURL, needsRenewal, defaultSettings(t))
+	assert.NoError(err)
+	changed, err = f.Refresh()
+	assert.NoError(err)
+	assert.False(changed)
+
+	mu.Lock()
+	fakeData = []byte("a bigger build")
+	mu.Unlock()
+	changed, err = f.Refresh()
+	assert.NoError(err)
+	assert.True(changed)
+	assert.NoError(f.Close())
+
+	// files opened with a known size have no validators either,
+	// whatever the server sends
+	mu.Lock()
+	etag, modTime = `"3"`, time.Now()
+	mu.Unlock()
+	settings := defaultSettings(t)
+	settings.Size = int64(len("a bigger build"))
+	f, err = htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	changed, err = f.Refresh()
+	assert.NoError(err)
+	assert.False(changed)
+	assert.NoError(f.Close())
+}
+
+func Test_FileUnknownSize(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no Content-Length, no range support: chunked all the way
+		for i := 0; i < len(fakeData); i += 64 * 1024 {
+			end := i + 64*1024
+			if end > len(fakeData) {
+				end = len(fakeData)
+			}
+			w.Write(fakeData[i:end])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, defaultSettings(t))
+	assert.NoError(err)
+
+	stats, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(htfs.UnknownSize, stats.Size())
+
+	_, err = f.Seek(0, io.SeekEnd)
+	assert.Error(err)
+	assert.Equal(htfs.ErrUnknownSize, errors.Cause(err))
+
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(fakeData, data)
+
+	// now we know
+	assert.EqualValues(len(fakeData), stats.Size())
+	offset, err := f.Seek(-10, io.SeekEnd)
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData)-10, offset)
+	n, err := f.ReadAt(make([]byte, 10), int64(len(fakeData)))
+	assert.Equal(0, n)
+	assert.Equal(io.EOF, err)
+	assert.NoError(f.Close())
+}
+
+func Test_FileZeroLength(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int64
+	var ignoreRanges bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("content-disposition", `attachment; filename="empty.bin"`)
+		if ignoreRanges || r.Header.Get("range") == "" {
+			w.Header().Set("content-length", "0")
+			return
+		}
+		w.Header().Set("content-range", "bytes */0")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer server.Close()
+
+	check := func(strategy htfs.ProbeStrategy) {
+		settings := defaultSettings(t)
+		settings.ProbeStrategy = strategy
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		if !assert.NoError(err, "with %v", strategy) {
+			return
+		}
+		opened := atomic.LoadInt64(&requests)
+
+		stats, err := f.Stat()
+		assert.NoError(err)
+		assert.EqualValues(0, stats.Size())
+		assert.EqualValues("empty.bin", stats.Name())
+
+		buf := make([]byte, 16)
+		n, err := f.ReadAt(buf, 0)
+		assert.EqualValues(0, n)
+		assert.Equal(io.EOF, err)
+
+		n, err = f.Read(buf)
+		assert.EqualValues(0, n)
+		assert.Equal(io.EOF, err)
+
+		offset, err := f.Seek(0, io.SeekEnd)
+		assert.NoError(err)
+		assert.EqualValues(0, offset)
+
+		data, err := ioutil.ReadAll(f)
+		assert.NoError(err)
+		assert.Len(data, 0)
+
+		tail, err := f.ReadTail(16)
+		assert.NoError(err)
+		assert.Len(tail, 0)
+
+		assert.EqualValues(opened, atomic.LoadInt64(&requests), "no range requests once opened")
+		assert.NoError(f.Close())
+	}
+
+	for _, strategy := range []htfs.ProbeStrategy{htfs.ProbeStream, htfs.ProbeSingleByte, htfs.ProbeHead} {
+		check(strategy)
+	}
+	ignoreRanges = true
+	check(htfs.ProbeStream)
+
+	// a 416 that doesn't say the size isn't an empty file
+	bare := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer bare.Close()
+	for _, strategy := range []htfs.ProbeStrategy{htfs.ProbeStream, htfs.ProbeSingleByte} {
+		settings := defaultSettings(t)
+		settings.ProbeStrategy = strategy
+		_, err := htfs.Open(func() (string, error) { return bare.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.Error(err, "with %v", strategy)
+	}
+}
+
+func Test_FileRangeNotSatisfiable(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	fakeData := []byte("this will shrink")
+	unknownTotal := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		data := fakeData
+		total := strconv.Itoa(len(data))
+		if unknownTotal {
+			total = "*"
+		}
+		mu.Unlock()
+
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("range"), "bytes=-%d", &end); err == nil {
+			// suffix range
+			start = int64(len(data)) - end
+			if start < 0 {
+				start = 0
+			}
+		} else {
+			fmt.Sscanf(r.Header.Get("range"), "bytes=%d-", &start)
+		}
+		if start >= int64(len(data)) {
+			w.Header().Set("content-range", fmt.Sprintf("bytes */%d", len(data)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("content-range", fmt.Sprintf("bytes %d-%d/%s", start, len(data)-1, total))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start:])
+	}))
+	defer server.Close()
+
+	open := func(settings *htfs.Settings) *htfs.File {
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		return f
+	}
+
+	// past the end of a file of unknown size, it's just EOF
+	mu.Lock()
+	unknownTotal = true
+	mu.Unlock()
+	f := open(defaultSettings(t))
+	n, err := f.ReadAt(make([]byte, 4), 100)
+	assert.EqualValues(0, n)
+	assert.Equal(io.EOF, err)
+	stats, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len("this will shrink"), stats.Size(), "416 tells us the size")
+	assert.NoError(f.Close())
+
+	// before the end, the file changed under us
+	mu.Lock()
+	unknownTotal = false
+	mu.Unlock()
+	settings := defaultSettings(t)
+	// a fresh request, rather than the pooled connection
+	settings.NoReadAhead = true
+	f = open(settings)
+	mu.Lock()
+	fakeData = []byte("shrunk")
+	mu.Unlock()
+	_, err = f.ReadAt(make([]byte, 4), 10)
+	assert.Error(err)
+	rnse, ok := errors.Cause(err).(*htfs.RangeNotSatisfiableError)
+	if assert.True(ok, "got %v", err) {
+		assert.EqualValues(10, rnse.Offset)
+		assert.EqualValues(6, rnse.Size)
+	}
+	if re, ok := err.(*htfs.ReadError); assert.True(ok) {
+		assert.EqualValues(http.StatusRequestedRangeNotSatisfiable, re.StatusCode)
+	}
+	assert.NoError(f.Close())
+
+	// some servers answer suffix ranges of empty files with 416
+	mu.Lock()
+	fakeData = []byte{}
+	mu.Unlock()
+	settings = defaultSettings(t)
+	settings.Lazy = true
+	f = open(settings)
+	tail, err := f.ReadTail(16)
+	assert.NoError(err)
+	assert.Len(tail, 0)
+	stats, err = f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(0, stats.Size())
+	assert.NoError(f.Close())
+}
+
+func Test_FileSizeMismatch(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var rangeRequests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") == "bytes=0-0" {
+			http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+			return
+		}
+		// a cache layer serving ranges of another version
+		atomic.AddInt64(&rangeRequests, 1)
+		w.Header().Set("content-range", fmt.Sprintf("bytes 1000-1099/%d", len(fakeData)+1))
+		w.WriteHeader(206)
+		w.Write(fakeData[1000:1100])
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	_, err = f.ReadAt(make([]byte, 100), 1000)
+	assert.Error(err)
+	sme, ok := errors.Cause(err).(*htfs.SizeMismatchError)
+	assert.True(ok)
+	if ok {
+		assert.EqualValues(len(fakeData), sme.Expected)
+		assert.EqualValues(len(fakeData)+1, sme.Actual)
+	}
+	assert.EqualValues(1, atomic.LoadInt64(&rangeRequests), "not retried")
+	assert.NoError(f.Close())
+}
+
+func Test_FileResumeMidBody(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var failures int64 = 3
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") == "bytes=0-0" || atomic.AddInt64(&failures, -1) < 0 {
+			http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+			return
+		}
+
+		// send an odd number of bytes, then hang up
+		var start int64
+		fmt.Sscanf(r.Header.Get("range"), "bytes=%d-", &start)
+		w.Header().Set("content-range", fmt.Sprintf("bytes %d-%d/%d", start, len(fakeData)-1, len(fakeData)))
+		w.Header().Set("content-length", strconv.Itoa(len(fakeData)-int(start)))
+		w.WriteHeader(206)
+		w.Write(fakeData[start : start+100*1024+7])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	settings.MaxConns = 1
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(fakeData, data, "no byte skipped or duplicated")
+
+	ts := f.TransferStats()
+	assert.EqualValues(3, ts.Resumes)
+	assert.EqualValues(len(fakeData), ts.Delivered)
+	assert.NoError(f.Close())
+}
+
+func Test_FileVerifyReads(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		byteRange := r.Header.Get("range")
+		corrupt := byteRange == "bytes=5000-5099" && !seen[byteRange]
+		seen[byteRange] = true
+		mu.Unlock()
+
+		if corrupt {
+			data := append([]byte{}, fakeData...)
+			data[5042] ^= 0xff
+			http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	var logs []string
+	settings := defaultSettings(t)
+	settings.NoReadAhead = true
+	settings.VerifyReads = 1
+	settings.Log = func(msg string) {
+		mu.Lock()
+		logs = append(logs, msg)
+		mu.Unlock()
+	}
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 100)
+	_, err = f.ReadAt(buf, 1000)
+	assert.NoError(err)
+	_, err = f.ReadAt(buf, 5000)
+	assert.NoError(err)
+
+	ts := f.TransferStats()
+	assert.EqualValues(2, ts.Verified)
+	assert.EqualValues(1, ts.Mismatches)
+	mu.Lock()
+	assert.Contains(strings.Join(logs, "\n"), "at offset 5042")
+	mu.Unlock()
+	assert.NoError(f.Close())
+}
+
+func Test_FileUserAgent(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("identify yourself")
+
+	var mu sync.Mutex
+	var agents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.Header.Get("user-agent"))
+		mu.Unlock()
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	open := func(settings *htfs.Settings) {
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+	}
+
+	assert.True(strings.HasPrefix(htfs.DefaultUserAgent, "itchio-httpkit/"))
+	open(defaultSettings(t))
+
+	settings := defaultSettings(t)
+	settings.UserAgent = "butler/15.0"
+	open(settings)
+
+	settings.Header = http.Header{"User-Agent": {"explicit/1.0"}}
+	open(settings)
+
+	mu.Lock()
+	assert.Equal([]string{htfs.DefaultUserAgent, "butler/15.0", "explicit/1.0"}, agents)
+	mu.Unlock()
+}
+
+func Test_FileProxy(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("through the proxy")
+
+	var proxied int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// forwarding is beside the point, the proxy has the data
+		atomic.AddInt64(&proxied, 1)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer proxy.Close()
+
+	var direct int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&direct, 1)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(err)
+
+	read := func(settings *htfs.Settings) {
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		buf := make([]byte, len(fakeData))
+		_, err = f.ReadAt(buf, 0)
+		assert.NoError(err)
+		assert.EqualValues(fakeData, buf)
+		assert.NoError(f.Close())
+	}
+
+	settings := defaultSettings(t)
+	settings.Client = nil
+	settings.Proxy = http.ProxyURL(proxyURL)
+	read(settings)
+	assert.True(atomic.LoadInt64(&proxied) > 0)
+	assert.EqualValues(0, atomic.LoadInt64(&direct))
+
+	proxiedBefore := atomic.LoadInt64(&proxied)
+	settings = defaultSettings(t)
+	settings.Client = nil
+	settings.Proxy = timeout.NoProxy
+	read(settings)
+	assert.EqualValues(proxiedBefore, atomic.LoadInt64(&proxied))
+	assert.True(atomic.LoadInt64(&direct) > 0)
+}
+
+func Test_FileSetLogger(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := bytes.Repeat([]byte("verbose "), 1024)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	lines := make(map[string][]string)
+	logTo := func(name string) htfs.LogFunc {
+		return func(msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines[name] = append(lines[name], msg)
+		}
+	}
+	count := func(name string, substr string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := 0
+		for _, line := range lines[name] {
+			if strings.Contains(line, substr) {
+				n++
+			}
+		}
+		return n
+	}
+
+	settings := defaultSettings(t)
+	settings.Log = logTo("initial")
+	settings.LogLevel = 1
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 64)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.True(count("initial", "(Connect)") > 0)
+	assert.EqualValues(0, count("initial", "(ReadAt)"), "level 1")
+
+	// while reads are going on
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 32; i++ {
+			f.ReadAt(buf, int64(i*64))
+		}
+	}()
+	f.SetLogger(logTo("debug"), 2)
+	<-done
+
+	before := count("initial", "")
+	_, err = f.ReadAt(buf, 4096)
+	assert.NoError(err)
+	assert.True(count("debug", "(ReadAt)") > 0, "level 2")
+	assert.EqualValues(before, count("initial", ""), "replaced")
+
+	f.SetLogger(nil, 0)
+	debugBefore := count("debug", "")
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues(debugBefore, count("debug", ""), "disabled")
+
+	assert.NoError(f.Close())
+}
+
+func Test_FileSummary(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var failures int64 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&failures, -1) >= 0 {
+			w.WriteHeader(503)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, defaultSettings(t))
+	assert.NoError(err)
+
+	_, err = ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	s := f.Summary()
+	assert.EqualValues(len(fakeData), s.Delivered)
+	assert.True(s.Downloaded >= s.Delivered)
+	assert.True(s.Overhead >= 1)
+	assert.EqualValues(1, s.Retries)
+	assert.EqualValues(1, s.Connections)
+	assert.EqualValues(0, s.Renewals)
+	assert.True(s.Duration > 0)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(s.Duration, f.Summary().Duration, "stops counting at Close")
+}
+
+func Test_FilePhaseStats(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	// by name, so it's resolved
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.ServerName = "example.com"
+	u, err := url.Parse(server.URL)
+	assert.NoError(err)
+	u.Host = "localhost:" + u.Port()
+
+	settings := defaultSettings(t)
+	settings.Client = client
+	settings.NoReadAhead = true
+	f, err := htfs.Open(func() (string, error) { return u.String(), nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 4; i++ {
+		_, err = f.ReadAt(buf, int64(i)*64*1024)
+		assert.NoError(err)
+	}
+
+	ps := f.PhaseStats()
+	assert.True(ps.Requests >= 4)
+	assert.True(ps.ReusedConns >= 3, "reads reuse the connection")
+	assert.EqualValues(ps.Requests, ps.FirstByte.Count)
+	assert.EqualValues(ps.Requests-ps.ReusedConns, ps.TLS.Count)
+	assert.True(ps.DNS.Count >= 1)
+	assert.True(ps.Connect.Count >= 1)
+	assert.True(ps.Connect.Max > 0 && ps.Connect.Mean() <= ps.Connect.Max)
+
+	ls := f.LatencyStats()
+	assert.EqualValues(4, ls.ReadAt.Count)
+	assert.EqualValues(ps.FirstByte.Count, ls.FirstByte.Count)
+	assert.True(ls.FirstByte.Quantile(0.99) <= ls.FirstByte.Max)
+}
+
+func Test_FileHostOverride(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var mu sync.Mutex
+	var hosts, serverNames []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		serverNames = append(serverNames, r.TLS.ServerName)
+		mu.Unlock()
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	// the URL names no host that resolves, ConnectIP is where to go
+	u, err := url.Parse(server.URL)
+	assert.NoError(err)
+	u.Host = "cdn.invalid:" + u.Port()
+	u.Path = "/data.bin"
+
+	settings := defaultSettings(t)
+	settings.Client = server.Client()
+	settings.Host = "example.com"
+	settings.ConnectIP = "127.0.0.1"
+	settings.NoReadAhead = true
+	f, err := htfs.Open(func() (string, error) { return u.String(), nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 1024)
+	_, err = f.ReadAt(buf, 512*1024)
+	assert.NoError(err)
+	assert.Equal(fakeData[512*1024:512*1024+1024], buf)
+	assert.NoError(f.Close())
+
+	mu.Lock()
+	assert.NotEmpty(hosts)
+	for i := range hosts {
+		assert.Equal("example.com", hosts[i])
+		assert.Equal("example.com", serverNames[i], "the certificate checked is example.com's")
+	}
+	mu.Unlock()
+
+	// Host and sticky IPs need a transport of their own
+	settings.Host = "example.com"
+	settings.Client = &http.Client{Transport: &panickyTransport{}}
+	_, err = htfs.Open(func() (string, error) { return u.String(), nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.Error(err)
+	assert.Contains(err.Error(), "*http.Transport")
+}
+
+func Test_FileQueryRanges(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+	size := int64(len(fakeData))
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(r.Header.Get("Range"))
+		assert.Equal("abc", r.URL.Query().Get("token"))
+		assert.Len(r.URL.Query()["r"], 1, r.URL.RawQuery)
+
+		spec := r.URL.Query().Get("r")
+		mu.Lock()
+		ranges = append(ranges, spec)
+		mu.Unlock()
+
+		// no Range support, just a query parameter
+		start, end := int64(0), size-1
+		if strings.HasPrefix(spec, "-") {
+			n, _ := strconv.ParseInt(spec[1:], 10, 64)
+			start = size - n
+		} else {
+			tokens := strings.SplitN(spec, "-", 2)
+			start, _ = strconv.ParseInt(tokens[0], 10, 64)
+			if tokens[1] != "" {
+				end, _ = strconv.ParseInt(tokens[1], 10, 64)
+			}
+		}
+		if start > size {
+			start = size
+		}
+		if end >= size {
+			end = size - 1
+		}
+		w.Header().Set("X-File-Size", strconv.FormatInt(size, 10))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.Write(fakeData[start : end+1])
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.RangeStrategy = htfs.QueryRanges{Param: "r", SizeHeader: "X-File-Size"}
+	settings.MaxRangeSpan = 256 * 1024
+	f, err := htfs.Open(func() (string, error) { return server.URL + "/data.bin?token=abc", nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	stat, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(size, stat.Size())
+	assert.EqualValues("data.bin", stat.Name())
+
+	buf := make([]byte, 1024)
+	for _, offset := range []int64{0, 300 * 1024, size - 1024} {
+		_, err = f.ReadAt(buf, offset)
+		assert.NoError(err)
+		assert.Equal(fakeData[offset:offset+1024], buf)
+	}
+
+	parts, err := f.ReadMulti([]htfs.Range{
+		{Offset: 10, Length: 20},
+		{Offset: 700 * 1024, Length: 50},
+	})
+	assert.NoError(err)
+	assert.Equal(fakeData[10:30], parts[0])
+	assert.Equal(fakeData[700*1024:700*1024+50], parts[1])
+
+	mu.Lock()
+	assert.Equal("0-262143", ranges[0], "bounded by MaxRangeSpan")
+	for _, spec := range ranges {
+		assert.NotContains(spec, ",", "one range per request")
+	}
+	mu.Unlock()
+
+	// redirect targets are remembered without the range
+	var redirects int64
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&redirects, 1)
+		http.Redirect(w, r, server.URL+r.URL.RequestURI(), http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	settings.Redirects = &htfs.RedirectPolicy{CacheTarget: true}
+	rf, err := htfs.Open(func() (string, error) { return redirector.URL + "/data.bin?token=abc", nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer rf.Close()
+	assert.Equal("token=abc", rf.EffectiveURL().RawQuery)
+	for _, offset := range []int64{300 * 1024, 10, size - 1024} {
+		_, err = rf.ReadAt(buf, offset)
+		assert.NoError(err)
+		assert.Equal(fakeData[offset:offset+1024], buf)
+	}
+	assert.EqualValues(1, atomic.LoadInt64(&redirects))
+}
+
+// memFetcher serves a remote file from memory, without HTTP
+type memFetcher struct {
+	data        []byte
+	unknownSize bool
+
+	mu       sync.Mutex
+	opened   []string
+	failures int
+}
+
+func (mf *memFetcher) Size(ctx context.Context) (int64, error) {
+	if mf.unknownSize {
+		return htfs.UnknownSize, nil
+	}
+	return int64(len(mf.data)), nil
+}
+
+func (mf *memFetcher) OpenRangeStream(ctx context.Context, offset int64, end int64) (*htfs.RangeStream, error) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if mf.failures > 0 {
+		mf.failures--
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	mf.opened = append(mf.opened, fmt.Sprintf("%d-%d", offset, end))
+
+	size := int64(len(mf.data))
+	if end < 0 || end > size {
+		end = size
+	}
+	if offset > end {
+		offset = end
+	}
+	if mf.unknownSize {
+		size = htfs.UnknownSize
+	}
+	return &htfs.RangeStream{
+		Body: ioutil.NopCloser(bytes.NewReader(mf.data[offset:end])),
+		Size: size,
+	}, nil
+}
+
+func Test_FileFetcher(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+	fetcher := &memFetcher{data: fakeData, failures: 2}
+
+	settings := defaultSettings(t)
+	settings.Fetcher = fetcher
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	f, err := htfs.Open(func() (string, error) { return "mem://bucket/data.bin", nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	stat, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(len(fakeData), stat.Size())
+	assert.EqualValues("data.bin", stat.Name())
+
+	// sequential reads share a stream
+	buf := make([]byte, 1024)
+	for offset := int64(0); offset < 8*1024; offset += 1024 {
+		_, err = f.ReadAt(buf, 2048+offset)
+		assert.NoError(err)
+		assert.Equal(fakeData[2048+offset:2048+offset+1024], buf)
+	}
+
+	parts, err := f.ReadMulti([]htfs.Range{
+		{Offset: 10, Length: 20},
+		{Offset: 900 * 1024, Length: 50},
+	})
+	assert.NoError(err)
+	assert.Equal(fakeData[10:30], parts[0])
+	assert.Equal(fakeData[900*1024:900*1024+50], parts[1])
+
+	_, err = f.ReadAt(buf, int64(len(fakeData))+10)
+	assert.Equal(io.EOF, errors.Cause(err))
+
+	fetcher.mu.Lock()
+	assert.Equal("0-1", fetcher.opened[0], "probes for a single byte")
+	assert.Len(fetcher.opened, 4, "probe, stream, and ranges")
+	fetcher.mu.Unlock()
+	ts := f.TransferStats()
+	assert.True(ts.Downloaded >= 8*1024)
+
+	settings.RangeStrategy = htfs.QueryRanges{}
+	_, err = htfs.Open(func() (string, error) { return "mem://bucket/data.bin", nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.Error(err)
+
+	// fetchers may not know the size
+	for _, strategy := range []htfs.ProbeStrategy{htfs.ProbeStream, htfs.ProbeSingleByte} {
+		settings = defaultSettings(t)
+		settings.Fetcher = &memFetcher{data: fakeData, unknownSize: true}
+		settings.ProbeStrategy = strategy
+		uf, err := htfs.Open(func() (string, error) { return "mem://bucket/data.bin", nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		if !assert.NoError(err, "with %v", strategy) {
+			continue
+		}
+		stat, err := uf.Stat()
+		assert.NoError(err)
+		assert.EqualValues(htfs.UnknownSize, stat.Size())
+		_, err = uf.ReadAt(buf, 500*1024)
+		assert.NoError(err)
+		assert.Equal(fakeData[500*1024:500*1024+1024], buf)
+		assert.NoError(uf.Close())
+	}
+}
+
+func Test_FileFaults(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	var urls int64
+	settings := defaultSettings(t)
+	settings.NoReadAhead = true
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	settings.Faults = []htfs.Fault{
+		{Request: 1, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+	}
+	f, err := htfs.Open(func() (string, error) {
+		atomic.AddInt64(&urls, 1)
+		return server.URL + "/data.bin", nil
+	}, func(res *http.Response, body []byte) bool {
+		return res.StatusCode == 403
+	}, settings)
+	assert.NoError(err)
+	defer f.Close()
+	assert.EqualValues(1, atomic.LoadInt64(&requests), "the first probe never made it")
+
+	// the URL expires
+	f.InjectFault(htfs.Fault{Request: 1, StatusCode: 403})
+	buf := make([]byte, 1024)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.Equal(fakeData[:1024], buf)
+	assert.EqualValues(2, atomic.LoadInt64(&urls))
+
+	f.InjectFault(htfs.Fault{Op: "FetchRanges", Request: 1, Corrupt: true})
+	f.InjectFault(htfs.Fault{Op: "FetchRanges", Request: 2, Delay: 50 * time.Millisecond})
+	ranges := []htfs.Range{{Offset: 100, Length: 10}}
+	parts, err := f.ReadMulti(ranges)
+	assert.NoError(err)
+	assert.Equal(fakeData[101:110], parts[0][1:])
+	assert.Equal(fakeData[100]^0xff, parts[0][0])
+
+	start := time.Now()
+	parts, err = f.ReadMulti(ranges)
+	assert.NoError(err)
+	assert.Equal(fakeData[100:110], parts[0])
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+
+	// until cleared
+	f.InjectFault(htfs.Fault{Op: "FetchRanges", Err: errors.New("out of order")})
+	for i := 0; i < 2; i++ {
+		_, err = f.ReadMulti(ranges)
+		assert.Error(err)
+		assert.Contains(err.Error(), "out of order")
+	}
+	f.ClearFaults()
+	_, err = f.ReadMulti(ranges)
+	assert.NoError(err)
+}
+
+func Test_FileSuppressedErrors(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := []byte("eventually consistent")
+
+	var failures int64 = 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&failures, -1) >= 0 {
+			w.WriteHeader(502)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, defaultSettings(t))
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	suppressed := f.SuppressedErrors()
+	assert.Len(suppressed, 2)
+	for i, se := range suppressed {
+		assert.Equal("Connect", se.Op)
+		assert.Equal(i+1, se.Attempt)
+		assert.False(se.Time.IsZero())
+		se, ok := errors.Cause(se.Err).(*htfs.ServerError)
+		if assert.True(ok) {
+			assert.Equal(502, se.StatusCode)
+		}
+	}
+}
+
+func Test_FileClock(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var failures int64 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&failures, -1) >= 0 {
+			w.WriteHeader(503)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := htfs.NewManualClock(start)
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(fakeData))
+	settings.RetrySettings.NoSleep = false
+	settings.Clock = clock
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+	f.ConnStaleThreshold = time.Minute
+
+	done := make(chan error)
+	go func() {
+		_, err := f.ReadAt(make([]byte, 100), 0)
+		done <- err
+	}()
+
+	// the first request fails, wait for the retry to back off
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Pending() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("read returned before backoff: %v", err)
+	default:
+	}
+	clock.Advance(2 * time.Second)
+	assert.NoError(<-done)
+	assert.EqualValues(1, f.Summary().Retries)
+	assert.EqualValues(1, f.Summary().Connections)
+
+	// the connection is reused while it's fresh...
+	_, err = f.ReadAt(make([]byte, 100), 100)
+	assert.NoError(err)
+	assert.EqualValues(1, f.Summary().Connections)
+
+	// ...and closed once it's been idle for long enough
+	clock.Advance(2 * time.Minute)
+	_, err = f.ReadAt(make([]byte, 100), 200)
+	assert.NoError(err)
+	assert.EqualValues(2, f.Summary().Connections)
+
+	assert.NoError(f.Close())
+	assert.Equal(2*time.Minute+2*time.Second, f.Summary().Duration)
+}
+
+func Test_FileConnHooks(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	var stalling int64
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt64(&stalling) == 1 {
+			w.Header().Set("content-range", fmt.Sprintf("bytes 0-%d/%d", len(fakeData)-1, len(fakeData)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(fakeData[:1024])
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write(fakeData[1024:])
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var events []string
+	record := func(kind string) func(info htfs.ConnInfo) {
+		return func(info htfs.ConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.NotEmpty(info.ID)
+			events = append(events, fmt.Sprintf("%s@%d", kind, info.Offset))
+		}
+	}
+	getEvents := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, events...)
+	}
+
+	clock := htfs.NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	settings := defaultSettings(t)
+	settings.Clock = clock
+	settings.OnConnOpened = record("opened")
+	settings.OnConnReused = record("reused")
+	settings.OnConnClosed = record("closed")
+	settings.OnConnStalled = record("stalled")
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	_, err = f.ReadAt(make([]byte, 100), 0)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	assert.EqualValues([]string{"opened@0", "reused@0", "closed@100"}, getEvents())
+
+	// a server that stops sending halfway through
+	mu.Lock()
+	events = nil
+	mu.Unlock()
+	atomic.StoreInt64(&stalling, 1)
+	settings.Size = int64(len(fakeData))
+	f, err = htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	done := make(chan error)
+	go func() {
+		_, err := f.ReadAt(make([]byte, 4096), 0)
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if events := getEvents(); len(events) > 0 && events[len(events)-1] == "stalled@1024" {
+			break
+		}
+		if clock.Pending() > 0 {
+			clock.Advance(10 * time.Second)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	assert.NoError(<-done)
+	assert.NoError(f.Close())
+	// the first bytes may have taken a few reads too
+	seen := getEvents()
+	assert.Contains(seen, "stalled@1024")
+	assert.Equal("opened@0", seen[0])
+	assert.Equal("closed@4096", seen[len(seen)-1])
+}
+
+func Test_FileTransferStats(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.MaxConns = 1
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 1000)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+
+	// skipping ahead on the same connection discards what's in between
+	_, err = f.ReadAt(buf, 11000)
+	assert.NoError(err)
+
+	ts := f.TransferStats()
+	assert.EqualValues(2000, ts.Delivered)
+	assert.EqualValues(10000, ts.Discarded)
+	assert.True(ts.Downloaded >= ts.Delivered+ts.Discarded)
+
+	// coalesced ranges fetch bytes nobody asked for
+	_, err = f.ReadMulti([]htfs.Range{
+		{Offset: 100000, Length: 100},
+		{Offset: 100200, Length: 100},
+	})
+	assert.NoError(err)
+
+	ts = f.TransferStats()
+	assert.EqualValues(2200, ts.Delivered)
+	assert.EqualValues(100, ts.Unconsumed)
+
+	// whatever the connection read ahead of us is lost when it's closed
+	assert.NoError(f.Close())
+	ts = f.TransferStats()
+	assert.EqualValues(ts.Downloaded-ts.Delivered, ts.Wasted())
+}
+
+func Test_FileReadAmplification(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	// the first request for data fails halfway
+	var failures int64 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("range") != "bytes=0-0" && atomic.AddInt64(&failures, -1) >= 0 {
+			w.Header().Set("content-range", fmt.Sprintf("bytes 10000-10999/%d", len(data)))
+			w.Header().Set("content-length", "1000")
+			w.WriteHeader(206)
+			w.Write(data[10000:10500])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.ProbeStrategy = htfs.ProbeSingleByte
+	settings.NoReadAhead = true
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 1000)
+	_, err = f.ReadAt(buf, 10000)
+	assert.NoError(err)
+	assert.Equal(data[10000:11000], buf)
+	assert.NoError(f.Close())
+
+	ts := f.TransferStats()
+	assert.EqualValues(1, ts.Probes)
+	assert.EqualValues(500, ts.Retried)
+	assert.EqualValues(ts.Downloaded-ts.Delivered, ts.Wasted())
+	assert.InDelta(1.501, ts.Amplification(), 0.0001)
+
+	// skipping ahead within the readahead window drops blocks never read
+	cache, err := htfs.NewCache(htfs.CacheSettings{BlockSize: 16 * 1024})
+	assert.NoError(err)
+	settings = defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.Cache = cache
+	settings.Readahead = 4
+	f, err = htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, err = f.ReadAt(buf[:1], 0)
+	assert.NoError(err)
+	for f.TransferStats().Downloaded < 5*16*1024 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = f.ReadAt(buf[:1], 3*16*1024)
+	assert.NoError(err)
+	assert.EqualValues(2*16*1024, f.TransferStats().ReadaheadDropped)
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func Test_FileAccessLog(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	accessLog := &lockedBuffer{}
+	settings := defaultSettings(t)
+	settings.AccessLog = accessLog
+	settings.AccessLogJSON = true
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+
+	buf := make([]byte, 1000)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	_, err = f.ReadMulti([]htfs.Range{{Offset: 4000000, Length: 10}})
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	type entry struct {
+		Op      string `json:"op"`
+		Method  string `json:"method"`
+		Range   string `json:"range"`
+		Status  int    `json:"status"`
+		Bytes   int64  `json:"bytes"`
+		Attempt int    `json:"attempt"`
+	}
+	var entries []entry
+	for _, line := range strings.Split(strings.TrimSpace(accessLog.String()), "\n") {
+		var e entry
+		assert.NoError(json.Unmarshal([]byte(line), &e))
+		entries = append(entries, e)
+	}
+
+	if assert.Len(entries, 2) {
+		// the multi-range request finishes first, the connection is only closed by Close
+		assert.Equal(entry{Op: "FetchRanges", Method: "GET", Range: "bytes=4000000-4000009", Status: 206, Bytes: 10, Attempt: 1}, entries[0])
+		assert.Equal("Connect", entries[1].Op)
+		assert.Equal("bytes=0-", entries[1].Range)
+		assert.Equal(206, entries[1].Status)
+		assert.Equal(1, entries[1].Attempt)
+		assert.True(entries[1].Bytes >= 1000)
+	}
+}
+
+func Test_FileReadError(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = 4096
+	settings.RetrySettings.MaxTries = 3
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, err = f.ReadAt(make([]byte, 100), 1000)
+	assert.Error(err)
+
+	re, ok := err.(*htfs.ReadError)
+	if assert.True(ok, "ReadAt returns a *ReadError") {
+		assert.Equal("ReadAt", re.Op)
+		assert.EqualValues(1000, re.Offset)
+		assert.EqualValues(100, re.Length)
+		assert.Equal(503, re.StatusCode)
+		assert.Equal(3, re.Attempt)
+		assert.NotEmpty(re.ConnID)
+	}
+	assert.Contains(err.Error(), "HTTP 503")
+
+	se, ok := errors.Cause(err).(*htfs.ServerError)
+	assert.True(ok, "cause is still reachable")
+	if ok {
+		assert.Equal(503, se.StatusCode)
+	}
+}
+
+func Test_FileRetryCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var retries int64
+	settings := defaultSettings(t)
+	settings.Size = 4096
+	settings.RetrySettings.NoSleep = false
+	settings.RetrySettings.Context = ctx
+	settings.RetrySettings.OnRetry = func(info retrycontext.RetryInfo) {
+		atomic.AddInt64(&retries, 1)
+		cancel()
+	}
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	start := time.Now()
+	_, err = f.ReadAt(make([]byte, 100), 1000)
+	assert.Error(err)
+	assert.Equal(context.Canceled, errors.Cause(err))
+	assert.True(time.Since(start) < 500*time.Millisecond, "doesn't wait out the backoff")
+	assert.EqualValues(1, atomic.LoadInt64(&retries))
+}
+
+func Test_FileOnRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 4096)
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= 2 {
+			w.WriteHeader(503)
+			return
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	var infos []htfs.RetryInfo
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.OnRetry = func(info htfs.RetryInfo) {
+		infos = append(infos, info)
+	}
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, err = f.ReadAt(make([]byte, 100), 1000)
+	assert.NoError(err)
+
+	if assert.Len(infos, 2) {
+		for i, info := range infos {
+			assert.Equal("Connect", info.Op)
+			assert.EqualValues(1000, info.Offset)
+			assert.Equal(i+1, info.Attempt)
+			assert.True(info.Delay >= time.Second)
+			se, ok := errors.Cause(info.Err).(*htfs.ServerError)
+			if assert.True(ok) {
+				assert.Equal(503, se.StatusCode)
+			}
+		}
+	}
+}
+
+func Test_FileOnRenewal(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 4096)
+	var forbid int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt64(&forbid, 1, 0) {
+			w.WriteHeader(403)
+			return
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	clock := htfs.NewManualClock(time.Unix(1600000000, 0))
+	var getURLs int64
+	getURL := func() (string, error) {
+		atomic.AddInt64(&getURLs, 1)
+		return fmt.Sprintf("%s/data?Expires=%d", server.URL, clock.Now().Add(time.Minute).Unix()), nil
+	}
+
+	var mu sync.Mutex
+	var infos []htfs.RenewalInfo
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.NoReadAhead = true
+	settings.Clock = clock
+	settings.OnRenewal = func(info htfs.RenewalInfo) {
+		mu.Lock()
+		defer mu.Unlock()
+		infos = append(infos, info)
+	}
+	f, err := htfs.Open(getURL, func(res *http.Response, body []byte) bool {
+		return res.StatusCode == 403
+	}, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	buf := make([]byte, 100)
+	_, err = f.ReadAt(buf, 0)
+	assert.NoError(err)
+	assert.EqualValues(1, atomic.LoadInt64(&getURLs))
+
+	// less than 30 seconds left: renewed ahead of the request
+	clock.Advance(40 * time.Second)
+	_, err = f.ReadAt(buf, 1000)
+	assert.NoError(err)
+	assert.EqualValues(2, atomic.LoadInt64(&getURLs))
+
+	// the server says it has expired
+	atomic.StoreInt64(&forbid, 1)
+	_, err = f.ReadAt(buf, 2000)
+	assert.NoError(err)
+	assert.EqualValues(3, atomic.LoadInt64(&getURLs))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(infos, 2) {
+		assert.Equal(htfs.RenewalPredicted, infos[0].Trigger)
+		assert.EqualValues(1000, infos[0].Offset)
+		assert.Equal(1, infos[0].Attempts)
+		assert.NoError(infos[0].Err)
+
+		assert.Equal(htfs.RenewalObserved, infos[1].Trigger)
+		assert.EqualValues(2000, infos[1].Offset)
+		assert.Equal(1, infos[1].Attempts)
+		assert.NoError(infos[1].Err)
+	}
+}
+
+func Test_FileRand(t *testing.T) {
+	assert := assert.New(t)
+	data := make([]byte, 4096)
+
+	delays := func(seed int64) []time.Duration {
+		var requests int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt64(&requests, 1) <= 3 {
+				w.WriteHeader(503)
+				return
+			}
+			http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+		}))
+		defer server.Close()
+
+		var res []time.Duration
+		settings := defaultSettings(t)
+		settings.Size = int64(len(data))
+		settings.Rand = rand.NewSource(seed)
+		settings.OnRetry = func(info htfs.RetryInfo) {
+			res = append(res, info.Delay)
+		}
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		defer f.Close()
+
+		_, err = f.ReadAt(make([]byte, 100), 1000)
+		assert.NoError(err)
+		return res
+	}
+
+	first := delays(7)
+	assert.Len(first, 3)
+	assert.Equal(first, delays(7), "same seed, same backoff")
+}
+
+func Test_FileRetryBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	// shared by both files
+	budget := htfs.NewRetryBudget(3, 0.1)
+
+	open := func() *htfs.File {
+		settings := defaultSettings(t)
+		settings.Size = 1024 * 1024
+		settings.RetrySettings.MaxTries = 10
+		settings.RetryBudget = budget
+		f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+			func(res *http.Response, body []byte) bool { return false }, settings)
+		assert.NoError(err)
+		return f
+	}
+	f1 := open()
+	defer f1.Close()
+	f2 := open()
+	defer f2.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f := f1
+			if i%2 == 1 {
+				f = f2
+			}
+			_, err := f.ReadAt(make([]byte, 100), int64(i)*100*1024)
+			assert.Error(err)
+		}(i)
+	}
+	wg.Wait()
+
+	// one try per read, plus whatever the budget allowed
+	assert.EqualValues(4+3, atomic.LoadInt64(&requests))
+	assert.EqualValues(0, budget.Tokens())
+
+	// without one, every read gets all of its tries
+	atomic.StoreInt64(&requests, 0)
+	settings := defaultSettings(t)
+	settings.Size = 1024 * 1024
+	settings.RetrySettings.MaxTries = 3
+	f3, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f3.Close()
+	for i := 0; i < 4; i++ {
+		_, err := f3.ReadAt(make([]byte, 100), int64(i)*100*1024)
+		assert.Error(err)
+	}
+	assert.EqualValues(4*3, atomic.LoadInt64(&requests))
+}
+
+func Test_FileHeaderAndStallTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(0x1337)).Read(data)
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&requests, 1) {
+		case 1:
+			// slow to answer
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		case 2:
+			// answers quickly, then stalls
+			w.Header().Set("content-length", "3096")
+			w.Header().Set("content-range", "bytes 1000-4095/4096")
+			w.WriteHeader(206)
+			w.Write(data[1000:1010])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.ResponseHeaderTimeout = 100 * time.Millisecond
+	settings.StallTimeout = 100 * time.Millisecond
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	start := time.Now()
+	buf := make([]byte, 100)
+	_, err = f.ReadAt(buf, 1000)
+	assert.NoError(err)
+	assert.Equal(data[1000:1100], buf)
+	assert.True(time.Since(start) < 2*time.Second)
+	assert.EqualValues(3, atomic.LoadInt64(&requests))
+}
+
+func Test_FileHedging(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(0x1337)).Read(data)
+
+	var requests int64
+	loserCancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			// a slow POP
+			select {
+			case <-r.Context().Done():
+				close(loserCancelled)
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.HedgeAfter = 50 * time.Millisecond
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	start := time.Now()
+	buf := make([]byte, 100)
+	_, err = f.ReadAt(buf, 1000)
+	assert.NoError(err)
+	assert.Equal(data[1000:1100], buf)
+	assert.True(time.Since(start) < time.Second, "doesn't wait for the slow request")
+	assert.EqualValues(2, atomic.LoadInt64(&requests))
+
+	select {
+	case <-loserCancelled:
+	case <-time.After(time.Second):
+		assert.Fail("slow request wasn't cancelled")
+	}
+}
+
+func Test_FileContext(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := defaultSettings(t)
+	settings.Size = 4096
+	settings.Context = ctx
+	settings.RetrySettings.NoSleep = false
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = f.ReadAt(make([]byte, 100), 2048)
+	assert.Error(err)
+	assert.True(time.Since(start) < time.Second, "in-flight requests are aborted")
+
+	_, err = f.ReadAt(make([]byte, 100), 100)
+	assert.Error(err)
+	assert.Equal(context.Canceled, errors.Cause(err), "later reads fail right away")
+}
+
+func Test_FileTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	settings := defaultSettings(t)
+	settings.Client = nil
+	settings.RetrySettings.MaxTries = 2
+	settings.Timeouts = &timeout.Timeouts{
+		Connect:        time.Second,
+		ResponseHeader: 100 * time.Millisecond,
+		Idle:           time.Second,
+	}
+	_, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.Error(err)
+	assert.True(neterr.IsNetworkError(err), "header timeouts are retried")
+	assert.EqualValues(2, atomic.LoadInt64(&requests))
+}
+
+func Test_FileRedaction(t *testing.T) {
+	assert := assert.New(t)
+
+	// nothing listens there
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	badURL := fmt.Sprintf("http://%s/file?X-Amz-Signature=topsecret", listener.Addr())
+	listener.Close()
+
+	var logLines []string
+	var logMutex sync.Mutex
+
+	settings := defaultSettings(t)
+	settings.RetrySettings.MaxTries = 1
+	settings.Log = func(msg string) {
+		logMutex.Lock()
+		defer logMutex.Unlock()
+		logLines = append(logLines, msg)
+	}
+
+	_, err = htfs.Open(func() (string, error) { return badURL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.Error(err)
+	assert.NotContains(err.Error(), "topsecret")
+	assert.Contains(err.Error(), "X-Amz-Signature=REDACTED-")
+
+	logMutex.Lock()
+	assert.NotEmpty(logLines)
+	for _, line := range logLines {
+		assert.NotContains(line, "topsecret")
+	}
+	logMutex.Unlock()
+
+	settings.DisableRedaction = true
+	_, err = htfs.Open(func() (string, error) { return badURL, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.Error(err)
+	assert.Contains(err.Error(), "topsecret")
+}
+
+type panickyTransport struct{}
+
+func (pt *panickyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conns map[string]int
+	conns[req.URL.Path]++ // assignment to entry in nil map
+	return nil, nil
+}
+
+func Test_FilePanics(t *testing.T) {
+	assert := assert.New(t)
+
+	settings := defaultSettings(t)
+	settings.Size = 4096
+	settings.Client = &http.Client{Transport: &panickyTransport{}}
+	getURL := func() (string, error) { return "http://example.org/file", nil }
+	needsRenewal := func(res *http.Response, body []byte) bool { return false }
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+
+	n, err := f.ReadAt(make([]byte, 100), 0)
+	assert.EqualValues(0, n)
+	assert.Error(err)
+	_, ok := errors.Cause(err).(*htfs.PanicError)
+	assert.True(ok, "panic is returned as a PanicError")
+	assert.Contains(err.Error(), "nil map")
+
+	// the File is still usable (and still broken)
+	_, err = f.Read(make([]byte, 100))
+	assert.Error(err)
+	assert.NoError(f.Close())
+
+	settings.PropagatePanics = true
+	f, err = htfs.Open(getURL, needsRenewal, settings)
+	assert.NoError(err)
+	assert.Panics(func() {
+		f.ReadAt(make([]byte, 100), 0)
+	})
+}
+
+func Test_FileConcurrentRead(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := getBigFakeData()[:512*1024]
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	f, err := htfs.Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, defaultSettings(t))
+	assert.NoError(err)
+	defer f.Close()
+
+	// the shared cursor must not get corrupted: goroutines see
+	// disjoint parts of the file, which add up to all of it.
+	var total int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 7000)
+			for {
+				n, err := f.Read(buf)
+				atomic.AddInt64(&total, int64(n))
+				if err != nil {
+					assert.Equal(io.EOF, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(len(fakeData), total)
+}
+
 func Test_FileNotFound(t *testing.T) {
 	assert := assert.New(t)
 	fakeData := []byte("aaaabbbb")
@@ -282,6 +4005,101 @@ func Test_FileCodeDisruptions(t *testing.T) {
 	}()
 }
 
+func Test_FileConcurrentRenewal(t *testing.T) {
+	assert := assert.New(t)
+
+	const workers = 8
+	const region = 64 * 1024
+	data := make([]byte, workers*region)
+	rand.New(rand.NewSource(0xfeed)).Read(data)
+
+	// only URLs from the latest generation are valid
+	var validGen int64 = 1
+	var mu sync.Mutex
+	staleHits := make(map[int64]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gen, _ := strconv.ParseInt(r.URL.Query().Get("gen"), 10, 64)
+		if gen < atomic.LoadInt64(&validGen) {
+			var start int64
+			fmt.Sscanf(r.Header.Get("range"), "bytes=%d-", &start)
+			mu.Lock()
+			staleHits[start/region]++
+			mu.Unlock()
+			w.WriteHeader(403)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	var gens int64
+	getURL := func() (string, error) {
+		gen := atomic.AddInt64(&gens, 1)
+		return fmt.Sprintf("%s/data.bin?gen=%d", server.URL, gen), nil
+	}
+
+	settings := defaultSettings(t)
+	settings.Size = int64(len(data))
+	settings.NoReadAhead = true
+	settings.MaxConns = workers
+	settings.Log = nil
+	var renewals int64
+	settings.OnRenewal = func(info htfs.RenewalInfo) {
+		atomic.AddInt64(&renewals, 1)
+		assert.NoError(info.Err)
+	}
+	f, err := htfs.Open(getURL, func(res *http.Response, body []byte) bool {
+		return res.StatusCode == 403
+	}, settings)
+	assert.NoError(err)
+	defer f.Close()
+
+	// every worker reads its own region in small chunks, and the URL
+	// expires once they're all halfway through
+	var halfway sync.WaitGroup
+	halfway.Add(workers)
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			start := int64(i * region)
+			for offset := start; offset < start+region; offset += int64(len(buf)) {
+				if offset == start+region/2 {
+					halfway.Done()
+				}
+				_, err := f.ReadAt(buf, offset)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buf, data[offset:offset+int64(len(buf))]) {
+					errs <- errors.Errorf("worker %d: bad data at %d", i, offset)
+					return
+				}
+			}
+		}(i)
+	}
+	halfway.Wait()
+	atomic.StoreInt64(&validGen, 2)
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(err)
+	}
+
+	assert.EqualValues(1, atomic.LoadInt64(&renewals), "exactly one renewal")
+	assert.EqualValues(2, atomic.LoadInt64(&gens))
+	mu.Lock()
+	defer mu.Unlock()
+	for worker, hits := range staleHits {
+		assert.True(hits <= 1, "worker %d used the expired URL %d times", worker, hits)
+	}
+}
+
 func Test_FileURLRenewal(t *testing.T) {
 	assert := assert.New(t)
 	fakeData := make([]byte, 16)
@@ -595,6 +4413,7 @@ type fakeStorageContext struct {
 	numGET                 int
 	numHEAD                int
 	disruption             *storageDisruption
+	extraHeaders           map[string]string
 }
 
 type disruptionHandlerFunc func(w http.ResponseWriter)
@@ -654,6 +4473,9 @@ func fakeStorage(t *testing.T, content []byte, ctx *fakeStorageContext) *httptes
 			}
 
 			w.Header().Set("content-length", fmt.Sprintf("%d", len(content)))
+			for k, v := range ctx.extraHeaders {
+				w.Header().Set(k, v)
+			}
 			w.WriteHeader(200)
 			return
 		}
@@ -672,6 +4494,9 @@ func fakeStorage(t *testing.T, content []byte, ctx *fakeStorageContext) *httptes
 		time.Sleep(ctx.delay)
 
 		w.Header().Set("content-type", "application/octet-stream")
+		for k, v := range ctx.extraHeaders {
+			w.Header().Set(k, v)
+		}
 		rangeHeader := r.Header.Get("Range")
 
 		start := int64(0)
@@ -740,3 +4565,73 @@ func fakeStorage(t *testing.T, content []byte, ctx *fakeStorageContext) *httptes
 
 	return server
 }
+
+func Test_FileLocal(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "htfs-local")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("a local file, read through the same interface as remote ones")
+	path := filepath.Join(dir, "local.dat")
+	assert.NoError(ioutil.WriteFile(path, data, 0644))
+
+	for _, name := range []string{path, "file://" + filepath.ToSlash(path)} {
+		f, err := htfs.Open(func() (string, error) { return name, nil },
+			func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{})
+		assert.NoError(err)
+
+		stats, err := f.Stat()
+		assert.NoError(err)
+		assert.EqualValues(len(data), stats.Size())
+		assert.Equal("local.dat", stats.Name())
+		assert.False(f.LastModified().IsZero())
+
+		buf := make([]byte, 10)
+		_, err = f.ReadAt(buf, 2)
+		assert.NoError(err)
+		assert.Equal(data[2:12], buf)
+
+		_, err = f.Seek(-5, io.SeekEnd)
+		assert.NoError(err)
+		n, err := f.Read(buf)
+		assert.Equal(io.EOF, err)
+		assert.Equal(data[len(data)-5:], buf[:n])
+
+		parts, err := f.ReadMulti([]htfs.Range{{Offset: 0, Length: 3}, {Offset: 8, Length: 4}})
+		assert.NoError(err)
+		assert.Equal([][]byte{data[0:3], data[8:12]}, parts)
+
+		ts := f.TransferStats()
+		assert.EqualValues(10+5+7, ts.Downloaded)
+		assert.EqualValues(0, f.NumConns())
+		assert.NoError(f.Close())
+	}
+
+	_, err = htfs.Open(func() (string, error) { return filepath.Join(dir, "missing"), nil },
+		func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{})
+	assert.Error(err)
+}
+
+func Test_FileDataURI(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := htfs.Open(func() (string, error) { return "data:application/json;base64,eyJidWlsZCI6NDJ9", nil },
+		func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{})
+	assert.NoError(err)
+	defer f.Close()
+
+	assert.Equal("application/json", f.ContentType())
+	stats, err := f.Stat()
+	assert.NoError(err)
+	assert.EqualValues(12, stats.Size())
+
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.Equal(`{"build":42}`, string(buf))
+
+	_, err = htfs.Open(func() (string, error) { return "data:no-comma", nil },
+		func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{})
+	assert.Error(err)
+}
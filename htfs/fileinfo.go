@@ -1,6 +1,8 @@
 package htfs
 
 import (
+	"net/http"
+	"net/url"
 	"os"
 	"time"
 )
@@ -12,26 +14,56 @@ type FileInfo struct {
 
 var _ os.FileInfo = (*FileInfo)(nil)
 
+// FileSys is what FileInfo.Sys returns: what the server said about
+// the remote file in its response to the initial request.
+type FileSys struct {
+	// ETag is as reported (including quotes and weak prefix), or empty
+	ETag string
+	// ContentType is the MIME type reported, or empty
+	ContentType string
+	// URL is where the remote file was last fetched from,
+	// after following redirects
+	URL *url.URL
+	// Header holds all the response headers. It's nil
+	// if Settings.Size was set.
+	Header http.Header
+}
+
 func (hfi *FileInfo) Name() string {
 	return hfi.file.name
 }
 
+// Size returns UnknownSize if the server didn't report the size of the
+// file, until it's been read until the end.
 func (hfi *FileInfo) Size() int64 {
-	return hfi.file.size
+	return hfi.file.currentSize()
 }
 
 func (hfi *FileInfo) Mode() os.FileMode {
 	return os.FileMode(0)
 }
 
+// ModTime returns the Last-Modified date the server reported,
+// or the zero time if it didn't.
 func (hfi *FileInfo) ModTime() time.Time {
-	return time.Now()
+	return hfi.file.LastModified()
 }
 
 func (hfi *FileInfo) IsDir() bool {
 	return false
 }
 
+// Sys returns a *FileSys
 func (hfi *FileInfo) Sys() interface{} {
-	return nil
+	f := hfi.file
+	u := f.EffectiveURL()
+	if u == nil {
+		u = f.requestURL
+	}
+	return &FileSys{
+		ETag:        f.ETag(),
+		ContentType: f.ContentType(),
+		URL:         u,
+		Header:      f.header,
+	}
 }
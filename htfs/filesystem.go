@@ -0,0 +1,211 @@
+package htfs
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileSystem implements http.FileSystem on top of Files, so that remote
+// content can be relayed with http.FileServer. Every Open returns a handle
+// with its own offset, reading through the shared File: nothing is
+// buffered beyond what the File itself caches, and range requests only
+// fetch the ranges asked for.
+//
+// Directories are implied by the names Files are added under. Listing
+// them doesn't open lazy Files, which are listed with UnknownSize until
+// they're used. Files whose size is still unknown can't be opened,
+// since serving them takes a size.
+type FileSystem struct {
+	mu    sync.RWMutex
+	files map[string]*File
+}
+
+var _ http.FileSystem = (*FileSystem)(nil)
+
+// NewFileSystem returns an empty FileSystem
+func NewFileSystem() *FileSystem {
+	return &FileSystem{
+		files: make(map[string]*File),
+	}
+}
+
+// Add serves f under name, like "/builds/game.zip". The FileSystem
+// doesn't take ownership of f: closing it is up to the caller.
+func (fs *FileSystem) Add(name string, f *File) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[path.Clean("/"+name)] = f
+}
+
+// Remove stops serving name. Handles that are already open keep working
+// until f is closed.
+func (fs *FileSystem) Remove(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.files, path.Clean("/"+name))
+}
+
+// Open is part of the http.FileSystem interface
+func (fs *FileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+
+	fs.mu.RLock()
+	f, ok := fs.files[name]
+	fs.mu.RUnlock()
+
+	if ok {
+		// this may probe the remote file
+		info, err := f.Stat()
+		if err != nil {
+			return nil, errors.Wrapf(err, "in FileSystem.Open")
+		}
+		size := info.Size()
+		if size == UnknownSize {
+			return nil, errors.Wrapf(ErrUnknownSize, "in FileSystem.Open")
+		}
+		return &fsFile{
+			SectionReader: io.NewSectionReader(f, 0, size),
+			info:          fsFileInfo{name: path.Base(name), size: size, modTime: f.LastModified()},
+		}, nil
+	}
+	return fs.openDir(name)
+}
+
+// openDir lists the Files under name, without opening any of them
+func (fs *FileSystem) openDir(name string) (http.File, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	prefix := name
+	if prefix != "/" {
+		prefix += "/"
+	}
+	children := make(map[string]os.FileInfo)
+	for fileName, f := range fs.files {
+		if !strings.HasPrefix(fileName, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(fileName, prefix)
+		if slash := strings.IndexByte(rest, '/'); slash >= 0 {
+			child := rest[:slash]
+			children[child] = fsFileInfo{name: child, dir: true}
+		} else if _, ok := children[rest]; !ok {
+			info := fsFileInfo{name: rest, size: UnknownSize}
+			if f.isOpened() {
+				info.size = f.currentSize()
+				info.modTime = f.LastModified()
+			}
+			children[rest] = info
+		}
+	}
+	if len(children) == 0 && name != "/" {
+		return nil, os.ErrNotExist
+	}
+
+	var entries []os.FileInfo
+	for _, info := range children {
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return &fsDir{
+		info:    fsFileInfo{name: path.Base(name), dir: true},
+		entries: entries,
+	}, nil
+}
+
+// fsFile is a handle on a File, with its own offset
+type fsFile struct {
+	*io.SectionReader
+	info fsFileInfo
+}
+
+var _ http.File = (*fsFile)(nil)
+
+func (ff *fsFile) Close() error {
+	return nil
+}
+
+func (ff *fsFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (ff *fsFile) Stat() (os.FileInfo, error) {
+	return ff.info, nil
+}
+
+type fsDir struct {
+	info    fsFileInfo
+	entries []os.FileInfo
+	read    int
+}
+
+var _ http.File = (*fsDir)(nil)
+
+func (fd *fsDir) Close() error {
+	return nil
+}
+
+func (fd *fsDir) Read(buf []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (fd *fsDir) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		fd.read = 0
+		return 0, nil
+	}
+	return 0, errors.New("is a directory")
+}
+
+// Readdir follows os.File's semantics
+func (fd *fsDir) Readdir(count int) ([]os.FileInfo, error) {
+	remaining := fd.entries[fd.read:]
+	if count <= 0 {
+		fd.read = len(fd.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	fd.read += count
+	return remaining[:count], nil
+}
+
+func (fd *fsDir) Stat() (os.FileInfo, error) {
+	return fd.info, nil
+}
+
+type fsFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+var _ os.FileInfo = fsFileInfo{}
+
+func (fi fsFileInfo) Name() string       { return fi.name }
+func (fi fsFileInfo) Size() int64        { return fi.size }
+func (fi fsFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fsFileInfo) IsDir() bool        { return fi.dir }
+func (fi fsFileInfo) Sys() interface{}   { return nil }
+
+func (fi fsFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
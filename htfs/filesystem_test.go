@@ -0,0 +1,116 @@
+package htfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileSystem(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("relayed build contents "), 10000)
+	lastModified := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	var rangesSeen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangesSeen = append(rangesSeen, r.Header.Get("range"))
+		http.ServeContent(w, r, "game.zip", lastModified, bytes.NewReader(data))
+	}))
+	defer upstream.Close()
+
+	f, err := htfs.Open(func() (string, error) { return upstream.URL + "/game.zip", nil },
+		func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{NoReadAhead: true})
+	assert.NoError(err)
+	defer f.Close()
+
+	fs := htfs.NewFileSystem()
+	fs.Add("/builds/windows/game.zip", f)
+	relay := httptest.NewServer(http.FileServer(fs))
+	defer relay.Close()
+
+	req, err := http.NewRequest("GET", relay.URL+"/builds/windows/game.zip", nil)
+	assert.NoError(err)
+	req.Header.Set("Range", "bytes=1000-1999")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.Equal(206, res.StatusCode)
+	assert.Equal(data[1000:2000], body)
+	assert.Equal(lastModified.Format(http.TimeFormat), res.Header.Get("last-modified"))
+	// only what was asked for, past the initial probe
+	for _, r := range rangesSeen[1:] {
+		var start, end int64
+		_, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end)
+		assert.NoError(err)
+		assert.True(start >= 1000 && end <= 1999, r)
+	}
+
+	res, err = http.Get(relay.URL + "/builds/windows/game.zip")
+	assert.NoError(err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.Equal(data, body)
+
+	res, err = http.Get(relay.URL + "/builds/")
+	assert.NoError(err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.True(strings.Contains(string(body), `href="windows/"`), string(body))
+
+	res, err = http.Get(relay.URL + "/builds/linux/game.zip")
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(404, res.StatusCode)
+
+	// listings don't open lazy Files
+	var lazyRequests int64
+	lazyUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&lazyRequests, 1)
+		http.ServeContent(w, r, "game.zip", lastModified, bytes.NewReader(data))
+	}))
+	defer lazyUpstream.Close()
+	lazy, err := htfs.Open(func() (string, error) { return lazyUpstream.URL + "/game.zip", nil },
+		func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{Lazy: true})
+	assert.NoError(err)
+	defer lazy.Close()
+	fs.Add("/builds/linux/game.zip", lazy)
+
+	res, err = http.Get(relay.URL + "/builds/linux/")
+	assert.NoError(err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.True(strings.Contains(string(body), `href="game.zip"`), string(body))
+	assert.EqualValues(0, atomic.LoadInt64(&lazyRequests))
+
+	// nor can files of unknown size be served
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		w.Write(data)
+	}))
+	defer chunked.Close()
+	unknown, err := htfs.Open(func() (string, error) { return chunked.URL + "/game.zip", nil },
+		func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{NoReadAhead: true})
+	assert.NoError(err)
+	defer unknown.Close()
+	fs.Add("/builds/mac/game.zip", unknown)
+
+	res, err = http.Get(relay.URL + "/builds/mac/game.zip")
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(500, res.StatusCode)
+}
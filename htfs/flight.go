@@ -0,0 +1,151 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// probeDrainLimit is how much of a probe's response body is read
+const probeDrainLimit = 4 * 1024
+
+// A flightGroup runs a function once for all callers asking for the same
+// key at the same time: the first one does the work, the others wait for
+// its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	// dups is the number of callers waiting on the first one
+	dups int
+	val  interface{}
+	err  error
+}
+
+// metadataFlights deduplicates probes and renewals across all Files,
+// keys include the Client, see flightKey.
+var metadataFlights flightGroup
+
+// do calls fn, unless another call for key is in flight, in which case it
+// waits for that one's result, and shared is true. Waiting stops when ctx
+// is done. If the call in flight was cancelled by its own caller's
+// context, fn is called again.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (interface{}, error)) (val interface{}, shared bool, err error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flightCall)
+		}
+		if call, ok := g.calls[key]; ok {
+			call.dups++
+			g.mu.Unlock()
+
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, true, errors.WithStack(ctx.Err())
+			}
+			if isCancellation(call.err) && ctx.Err() == nil {
+				continue
+			}
+			return call.val, true, call.err
+		}
+
+		call := &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		g.mu.Unlock()
+
+		call.val, call.err = fn()
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+		return call.val, false, call.err
+	}
+}
+
+// waiting returns the number of callers waiting for the call in flight for key
+func (g *flightGroup) waiting(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if call, ok := g.calls[key]; ok {
+		return call.dups
+	}
+	return 0
+}
+
+func isCancellation(err error) bool {
+	cause := errors.Cause(err)
+	return cause == context.Canceled || cause == context.DeadlineExceeded
+}
+
+// flightKey identifies a metadata request: Files only share one if they
+// use the same Client and Proxy, and would send the same request to the
+// same URL, in the same way, see Settings.RangeStrategy and Fetcher.
+func (f *File) flightKey(op string, urlStr string, method string, byteRange string, header http.Header) string {
+	var conditions []string
+	for _, key := range []string{"If-None-Match", "If-Modified-Since"} {
+		conditions = append(conditions, header.Get(key))
+	}
+	return fmt.Sprintf("%p %p %#v\x00%s\x00%s\x00%s %s %#v\x00%s\x00%s\x00%s\x00%s", f.client, f.proxy, f.fetcher, op, urlStr,
+		method, byteRange, f.rangeStrategy, f.acceptEncoding, f.userAgent, strings.Join(conditions, "\x00"), credentialsKey(f.extraHeader))
+}
+
+// sharedProbe does a request that only tells about the remote file (one
+// for its headers, or for its first byte), or waits for the same one
+// another File is doing. The response body is closed already.
+func (f *File) sharedProbe(op string, method string, byteRange string, header http.Header) (*http.Response, error) {
+	key := f.flightKey(op, f.getCurrentURL(), method, byteRange, header)
+	val, shared, err := metadataFlights.do(f.ctx, key, func() (interface{}, error) {
+		var res *http.Response
+		err := f.withRetries(0, op, func(attempt int) error {
+			var err error
+			res, err = f.doRangeRequest(rangeRequest{
+				op:        op,
+				method:    method,
+				byteRange: byteRange,
+				header:    header,
+				attempt:   attempt,
+				probe:     true,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		// reading small bodies to the end lets the connection be reused,
+		// but if the server ignored our range, we definitely don't want
+		// to read the whole thing.
+		n, _ := io.Copy(ioutil.Discard, io.LimitReader(res.Body, probeDrainLimit))
+		f.countWasted(&f.transfer.probes, n)
+		res.Body.Close()
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := val.(*http.Response)
+	if shared {
+		f.log("(%s) shared a request in flight for the same URL", op)
+		// every File gets its own headers
+		copied := *res
+		copied.Header = make(http.Header, len(res.Header))
+		for key, values := range res.Header {
+			copied.Header[key] = append([]string(nil), values...)
+		}
+		res = &copied
+	}
+	return res, nil
+}
@@ -0,0 +1,160 @@
+package htfs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func flightSettings(t *testing.T) *Settings {
+	return &Settings{
+		Client:        http.DefaultClient,
+		RetrySettings: &retrycontext.Settings{MaxTries: 5, NoSleep: true},
+		Log:           func(msg string) { t.Log(msg) },
+		LogLevel:      2,
+	}
+}
+
+// waitFlight waits until n callers wait on the call in flight for key
+func waitFlight(t *testing.T, key string, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for metadataFlights.waiting(key) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d callers waiting for %q", metadataFlights.waiting(key), key)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func Test_FlightSharedProbe(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := bytes.Repeat([]byte("probe me "), 10000)
+
+	const files = 4
+	var heads int64
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			atomic.AddInt64(&heads, 1)
+			<-release
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+	urlStr := server.URL + "/data.bin"
+
+	var wg sync.WaitGroup
+	opened := make(chan *File, files)
+	for i := 0; i < files; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			settings := flightSettings(t)
+			settings.ProbeStrategy = ProbeHead
+			f, err := Open(func() (string, error) { return urlStr, nil },
+				func(res *http.Response, body []byte) bool { return false }, settings)
+			assert.NoError(err)
+			opened <- f
+		}()
+	}
+
+	probe := &File{client: http.DefaultClient, userAgent: DefaultUserAgent}
+	waitFlight(t, probe.flightKey("Probe", urlStr, "HEAD", "", nil), files-1)
+	close(release)
+	wg.Wait()
+	close(opened)
+
+	assert.EqualValues(1, atomic.LoadInt64(&heads))
+	for f := range opened {
+		assert.EqualValues(len(fakeData), f.size)
+		assert.EqualValues("data.bin", f.name)
+		f.Close()
+	}
+
+	// other clients don't share it
+	settings := flightSettings(t)
+	settings.Client = &http.Client{}
+	settings.ProbeStrategy = ProbeHead
+	f, err := Open(func() (string, error) { return urlStr, nil },
+		func(res *http.Response, body []byte) bool { return false }, settings)
+	assert.NoError(err)
+	f.Close()
+	assert.EqualValues(2, atomic.LoadInt64(&heads))
+
+	// nor do other user agents or proxies
+	key := probe.flightKey("Probe", urlStr, "HEAD", "", nil)
+	otherAgent := &File{client: http.DefaultClient, userAgent: "other/1.0"}
+	assert.NotEqual(key, otherAgent.flightKey("Probe", urlStr, "HEAD", "", nil))
+	proxied := &File{client: http.DefaultClient, userAgent: DefaultUserAgent, proxy: http.ProxyFromEnvironment}
+	assert.NotEqual(key, proxied.flightKey("Probe", urlStr, "HEAD", "", nil))
+}
+
+func Test_FlightSharedRenewal(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := bytes.Repeat([]byte("renew me "), 10000)
+
+	var validGen int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("gen") != fmt.Sprint(atomic.LoadInt64(&validGen)) {
+			w.WriteHeader(403)
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	// the first URL is handed out to both Files, renewing waits for the test
+	var gens int64
+	releaseRenewal := make(chan struct{})
+	getURL := func() (string, error) {
+		gen := atomic.LoadInt64(&gens)
+		if gen > 0 {
+			<-releaseRenewal
+			gen = atomic.AddInt64(&gens, 1)
+		}
+		return fmt.Sprintf("%s/data.bin?gen=%d", server.URL, gen), nil
+	}
+	openFile := func() *File {
+		settings := flightSettings(t)
+		settings.Size = int64(len(fakeData))
+		settings.NoReadAhead = true
+		f, err := Open(getURL, func(res *http.Response, body []byte) bool {
+			return res.StatusCode == 403
+		}, settings)
+		assert.NoError(err)
+		return f
+	}
+	a, b := openFile(), openFile()
+	defer a.Close()
+	defer b.Close()
+	staleURL := a.getCurrentURL()
+	atomic.StoreInt64(&gens, 1)
+	atomic.StoreInt64(&validGen, 2)
+
+	var wg sync.WaitGroup
+	for _, f := range []*File{a, b} {
+		wg.Add(1)
+		go func(f *File) {
+			defer wg.Done()
+			buf := make([]byte, 1024)
+			_, err := f.ReadAt(buf, 0)
+			assert.NoError(err)
+			assert.Equal(fakeData[:1024], buf)
+		}(f)
+	}
+
+	waitFlight(t, a.flightKey("Renew", staleURL, "", "", nil), 1)
+	close(releaseRenewal)
+	wg.Wait()
+
+	assert.EqualValues(2, atomic.LoadInt64(&gens), "only one new URL was asked for")
+	assert.Equal(a.getCurrentURL(), b.getCurrentURL())
+}
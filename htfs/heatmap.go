@@ -0,0 +1,117 @@
+package htfs
+
+import (
+	"sync"
+)
+
+// defaultHeatmapGranularity is the size of the buckets reads are
+// counted in, unless Settings.HeatmapGranularity says otherwise.
+const defaultHeatmapGranularity int64 = 4 * 1024
+
+// A Heatmap tells which parts of a remote file were read, and how often.
+type Heatmap struct {
+	// Granularity is the size of the buckets reads were counted in. A read
+	// touching any part of a bucket counts as a read of the whole bucket.
+	Granularity int64 `json:"granularity"`
+	// Size is the size of the remote file, if known
+	Size int64 `json:"size"`
+	// Runs lists consecutive stretches of the file that were read the
+	// same number of times, in order. Parts that were never read are omitted.
+	Runs []HeatmapRun `json:"runs"`
+}
+
+// A HeatmapRun is a stretch of a remote file that was read Count times
+type HeatmapRun struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	Count  int64 `json:"count"`
+}
+
+// heatmapRecorder counts reads per bucket
+type heatmapRecorder struct {
+	mu          sync.Mutex
+	granularity int64
+	// counts holds a count per bucket, it's allocated once for the size
+	// of the file, or grown as reads go further if it's unknown.
+	counts []int64
+}
+
+func newHeatmapRecorder(granularity int64) *heatmapRecorder {
+	if granularity <= 0 {
+		granularity = defaultHeatmapGranularity
+	}
+	return &heatmapRecorder{
+		granularity: granularity,
+	}
+}
+
+// record counts a read of length bytes at offset,
+// in a file of the given size, or UnknownSize
+func (hr *heatmapRecorder) record(offset int64, length int64, size int64) {
+	end := offset + length
+	if size >= 0 && end > size {
+		end = size
+	}
+	if end <= offset {
+		return
+	}
+
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	if hr.counts == nil && size > 0 {
+		hr.counts = make([]int64, (size+hr.granularity-1)/hr.granularity)
+	}
+	last := (end - 1) / hr.granularity
+	for int64(len(hr.counts)) <= last {
+		hr.counts = append(hr.counts, 0)
+	}
+	for bucket := offset / hr.granularity; bucket <= last; bucket++ {
+		hr.counts[bucket]++
+	}
+}
+
+func (hr *heatmapRecorder) export(size int64) Heatmap {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	hm := Heatmap{
+		Granularity: hr.granularity,
+		Size:        size,
+		Runs:        []HeatmapRun{},
+	}
+	for bucket, count := range hr.counts {
+		if count == 0 {
+			continue
+		}
+		offset := int64(bucket) * hr.granularity
+		length := hr.granularity
+		if size > 0 && offset+length > size {
+			length = size - offset
+		}
+
+		if len(hm.Runs) > 0 {
+			last := &hm.Runs[len(hm.Runs)-1]
+			if last.Offset+last.Length == offset && last.Count == count {
+				last.Length += length
+				continue
+			}
+		}
+		hm.Runs = append(hm.Runs, HeatmapRun{Offset: offset, Length: length, Count: count})
+	}
+	return hm
+}
+
+// Heatmap returns which parts of the remote file were read so far, and how
+// often. It's empty unless Settings.RecordHeatmap was set.
+func (f *File) Heatmap() Heatmap {
+	if f.heatmap == nil {
+		return Heatmap{Runs: []HeatmapRun{}}
+	}
+
+	var size int64
+	if f.knownSize() {
+		size = f.size
+	}
+	return f.heatmap.export(size)
+}
@@ -0,0 +1,38 @@
+package htfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Heatmap(t *testing.T) {
+	assert := assert.New(t)
+
+	hr := newHeatmapRecorder(10)
+	hr.record(0, 30, 105)
+	hr.record(5, 10, 105)
+	hr.record(100, 1, 105)
+	hr.record(100, 1, 105)
+	hr.record(110, 0, 105)
+	assert.Len(hr.counts, 11)
+
+	hm := hr.export(105)
+	assert.EqualValues(10, hm.Granularity)
+	assert.Equal([]HeatmapRun{
+		{Offset: 0, Length: 20, Count: 2},
+		{Offset: 20, Length: 10, Count: 1},
+		{Offset: 100, Length: 5, Count: 2},
+	}, hm.Runs)
+
+	// files of unknown size only get the buckets that were read
+	hr = newHeatmapRecorder(10)
+	hr.record(40, 15, UnknownSize)
+	assert.Len(hr.counts, 6)
+	hr.record(0, 5, UnknownSize)
+	assert.Len(hr.counts, 6)
+	assert.Equal([]HeatmapRun{
+		{Offset: 0, Length: 10, Count: 1},
+		{Offset: 40, Length: 20, Count: 1},
+	}, hr.export(0).Runs)
+}
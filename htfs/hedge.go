@@ -0,0 +1,108 @@
+package htfs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+type hedgeResult struct {
+	res   *http.Response
+	err   error
+	hedge bool
+}
+
+// doHedgedRangeRequest is doRangeRequest, except that if no response
+// arrived after hedgeAfter, a duplicate request is sent, and whichever
+// responds first is used. The other one is cancelled. Both are done
+// within rr.ctx, if set.
+func (f *File) doHedgedRangeRequest(rr rangeRequest) (*http.Response, error) {
+	if f.hedgeAfter <= 0 {
+		return f.doRangeRequest(rr)
+	}
+
+	parent := rr.ctx
+	if parent == nil {
+		parent = f.ctx
+	}
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	launch := func(hedge bool) {
+		ctx, cancel := context.WithCancel(parent)
+		cancels = append(cancels, cancel)
+
+		hrr := rr
+		hrr.ctx = ctx
+		if hedge {
+			hrr.op = rr.op + "/Hedge"
+		}
+		f.goLabeled(hrr.op, rr.conn, func() {
+			res, err := f.doRangeRequest(hrr)
+			results <- hedgeResult{res: res, err: err, hedge: hedge}
+		})
+	}
+
+	launch(false)
+	hedgeChan := make(chan struct{})
+	timer := f.clock.AfterFunc(f.hedgeAfter, func() { close(hedgeChan) })
+	defer timer.Stop()
+
+	inflight := 1
+	for {
+		select {
+		case <-hedgeChan:
+			if inflight == 1 && len(cancels) == 1 {
+				f.log("[%9d-%9d] (%s) no response after %s, hedging", rr.offset, rr.offset, rr.op, f.hedgeAfter)
+				atomic.AddInt64(&f.stats.hedges, 1)
+				launch(true)
+				inflight++
+			}
+		case r := <-results:
+			inflight--
+			winner := 0
+			if r.hedge {
+				winner = 1
+			}
+
+			if r.err != nil {
+				cancels[winner]()
+				if inflight == 0 {
+					return nil, r.err
+				}
+				// the other request may still succeed
+				continue
+			}
+
+			if r.hedge {
+				atomic.AddInt64(&f.stats.hedgeWins, 1)
+			}
+			if inflight > 0 {
+				cancels[1-winner]()
+				f.workers.enter()
+				f.goLabeled(rr.op+"/Drain", rr.conn, func() {
+					defer f.workers.leave()
+					loser := <-results
+					if loser.err == nil {
+						loser.res.Body.Close()
+					}
+				})
+			}
+
+			r.res.Body = &cancelOnClose{ReadCloser: r.res.Body, cancel: cancels[winner]}
+			return r.res, nil
+		}
+	}
+}
+
+// cancelOnClose releases a request's context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (coc *cancelOnClose) Close() error {
+	err := coc.ReadCloser.Close()
+	coc.cancel()
+	return err
+}
@@ -0,0 +1,71 @@
+package htfs
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HedgeContext(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := bytes.Repeat([]byte("hedged "), 10000)
+
+	var requests int64
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) > 1 {
+			// everything but the probe hangs
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	f, err := Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, &Settings{
+			RetrySettings: &retrycontext.Settings{MaxTries: 1, NoSleep: true},
+			HedgeAfter:    10 * time.Millisecond,
+		})
+	assert.NoError(err)
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		res, err := f.doHedgedRangeRequest(rangeRequest{
+			op:        "Connect",
+			method:    "GET",
+			byteRange: "bytes=1000-",
+			offset:    1000,
+			ctx:       ctx,
+		})
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+
+	for atomic.LoadInt64(&requests) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	// the request and its hedge both give up
+	cancel()
+	select {
+	case err := <-done:
+		assert.Error(err)
+	case <-time.After(5 * time.Second):
+		t.Error("hedged request outlived its context")
+	}
+}
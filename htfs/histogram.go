@@ -0,0 +1,185 @@
+package htfs
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// histogramSubBits is how many bits of precision values keep
+// in a Histogram, past their most significant one
+const histogramSubBits = 4
+
+const (
+	histogramSubBuckets = 1 << histogramSubBits
+	histogramBuckets    = (64 - histogramSubBits + 1) * histogramSubBuckets
+)
+
+// A Histogram is a distribution of durations, in buckets growing
+// logarithmically like those of HDR histograms, so quantiles are within
+// about 6% of the real ones at any scale. See File.LatencyStats.
+type Histogram struct {
+	Count int64
+	Total time.Duration
+	Min   time.Duration
+	Max   time.Duration
+
+	counts []int64
+}
+
+// A HistogramBucket is a range of durations of a Histogram, and the
+// number of them recorded. Max is inclusive, the range starts right
+// after the previous bucket's.
+type HistogramBucket struct {
+	Max   time.Duration
+	Count int64
+}
+
+// histogramIndex returns the index of the bucket d goes in. Values
+// below histogramSubBuckets get one each, then every power of two is
+// split in histogramSubBuckets.
+func histogramIndex(d time.Duration) int {
+	v := uint64(d)
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1
+	sub := (v >> uint(exp-histogramSubBits)) & (histogramSubBuckets - 1)
+	return (exp-histogramSubBits+1)*histogramSubBuckets + int(sub)
+}
+
+// histogramBucketMax returns the largest duration of a bucket
+func histogramBucketMax(index int) time.Duration {
+	if index < histogramSubBuckets {
+		return time.Duration(index)
+	}
+	exp := uint(index/histogramSubBuckets + histogramSubBits - 1)
+	sub := uint64(index % histogramSubBuckets)
+	width := uint64(1) << (exp - histogramSubBits)
+	upper := (histogramSubBuckets+sub)*width + width - 1
+	if upper > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(upper)
+}
+
+func (h *Histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	if h.counts == nil {
+		h.counts = make([]int64, histogramBuckets)
+	}
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Total += d
+	h.counts[histogramIndex(d)]++
+}
+
+// Mean returns the average duration, zero if there are none
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Quantile returns the duration that a fraction q (between 0 and 1) of
+// the recorded ones don't exceed, like 0.99 for the 99th percentile.
+// It's zero if there are none.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for index, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			d := histogramBucketMax(index)
+			if d > h.Max {
+				d = h.Max
+			}
+			if d < h.Min {
+				d = h.Min
+			}
+			return d
+		}
+	}
+	return h.Max
+}
+
+// Buckets returns the buckets that aren't empty, in order,
+// for exporting to metrics systems.
+func (h Histogram) Buckets() []HistogramBucket {
+	var res []HistogramBucket
+	for index, count := range h.counts {
+		if count > 0 {
+			res = append(res, HistogramBucket{Max: histogramBucketMax(index), Count: count})
+		}
+	}
+	return res
+}
+
+func (h Histogram) String() string {
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s (%d)", h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99), h.Max, h.Count)
+}
+
+// syncHistogram is a Histogram recorded into from many goroutines
+type syncHistogram struct {
+	mu sync.Mutex
+	h  Histogram
+}
+
+func (sh *syncHistogram) record(d time.Duration) {
+	sh.mu.Lock()
+	sh.h.record(d)
+	sh.mu.Unlock()
+}
+
+// snapshot returns a copy of the Histogram, unaffected by later records
+func (sh *syncHistogram) snapshot() Histogram {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	h := sh.h
+	h.counts = append([]int64(nil), sh.h.counts...)
+	return h
+}
+
+// LatencyStats holds the distributions of a File's latencies,
+// see File.LatencyStats
+type LatencyStats struct {
+	// ReadAt is how long ReadAt calls took, whether they were
+	// served from caches or from the network
+	ReadAt Histogram
+	// FirstByte is how long requests waited for the first byte
+	// of their response, like PhaseStats.FirstByte
+	FirstByte Histogram
+}
+
+// latencyCounters is updated from many goroutines
+type latencyCounters struct {
+	readAt    syncHistogram
+	firstByte syncHistogram
+}
+
+// LatencyStats returns the distributions of latencies so far,
+// for percentiles that averages hide.
+func (f *File) LatencyStats() LatencyStats {
+	return LatencyStats{
+		ReadAt:    f.latency.readAt.snapshot(),
+		FirstByte: f.latency.firstByte.snapshot(),
+	}
+}
@@ -0,0 +1,56 @@
+package htfs
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HistogramBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	prng := rand.New(rand.NewSource(0x5eed))
+	for i := 0; i < 10000; i++ {
+		d := time.Duration(prng.Int63n(int64(time.Hour)))
+		index := histogramIndex(d)
+		assert.True(d <= histogramBucketMax(index), "%s fits in bucket %d", d, index)
+		if index > 0 {
+			assert.True(d > histogramBucketMax(index-1), "%s doesn't fit in bucket %d", d, index-1)
+		}
+	}
+	assert.True(histogramIndex(time.Duration(1<<62)) < histogramBuckets)
+}
+
+func Test_HistogramQuantiles(t *testing.T) {
+	assert := assert.New(t)
+
+	var h Histogram
+	assert.EqualValues(0, h.Quantile(0.99))
+
+	// 1ms to 1000ms, shuffled
+	prng := rand.New(rand.NewSource(0x5eed))
+	for _, i := range prng.Perm(1000) {
+		h.record(time.Duration(i+1) * time.Millisecond)
+	}
+	assert.EqualValues(1000, h.Count)
+	assert.Equal(time.Millisecond, h.Min)
+	assert.Equal(time.Second, h.Max)
+
+	within := func(expected time.Duration, actual time.Duration) {
+		t.Helper()
+		assert.InEpsilon(float64(expected), float64(actual), 0.07, "got %s, expected %s", actual, expected)
+	}
+	within(500*time.Millisecond, h.Quantile(0.5))
+	within(900*time.Millisecond, h.Quantile(0.9))
+	within(990*time.Millisecond, h.Quantile(0.99))
+	assert.Equal(time.Second, h.Quantile(1))
+	within(time.Millisecond, h.Quantile(0))
+
+	var total int64
+	for _, b := range h.Buckets() {
+		total += b.Count
+	}
+	assert.EqualValues(h.Count, total)
+}
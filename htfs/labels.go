@@ -0,0 +1,59 @@
+package htfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"runtime/pprof"
+)
+
+// The pprof labels set on goroutines a File starts, so that goroutine
+// dumps and profiles can be attributed to it. Goroutines started from
+// those, like net/http's for the connections they dial, inherit them.
+const (
+	// labelURL is a hash of the URL the File was opened with, without
+	// its query string: signed URLs don't end up in profiles, and it
+	// stays the same when they're renewed.
+	labelURL = "htfs.url"
+	// labelName is the name of the remote file, once it's known
+	labelName = "htfs.name"
+	// labelTask is what the goroutine does, like "Readahead"
+	labelTask = "htfs.task"
+	// labelConn is the ID of the connection the goroutine works for
+	labelConn = "htfs.conn"
+)
+
+// labelHash returns the value of labelURL for urlStr
+func labelHash(urlStr string) string {
+	if u, err := url.Parse(urlStr); err == nil {
+		u.User = nil
+		u.RawQuery = ""
+		u.Fragment = ""
+		urlStr = u.String()
+	}
+	h := sha256.Sum256([]byte(urlStr))
+	return hex.EncodeToString(h[:])[:12]
+}
+
+// labels returns the pprof labels for a goroutine doing task, for the
+// conn with the given ID, if it's not empty.
+func (f *File) labels(task string, connID string) pprof.LabelSet {
+	list := []string{labelURL, f.urlHash, labelTask, task}
+	if f.name != "" {
+		list = append(list, labelName, f.name)
+	}
+	if connID != "" {
+		list = append(list, labelConn, connID)
+	}
+	return pprof.Labels(list...)
+}
+
+// goLabeled calls fn in a new goroutine labelled with f.labels(task, connID).
+// The labels are computed before it starts.
+func (f *File) goLabeled(task string, connID string, fn func()) {
+	labels := f.labels(task, connID)
+	go pprof.Do(context.Background(), labels, func(context.Context) {
+		fn()
+	})
+}
@@ -0,0 +1,122 @@
+package htfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A MemoryBudget caps the memory held by readahead blocks (see
+// Settings.Readahead) across all Files it's shared with, so that opening
+// many Files at once doesn't multiply it. Blocks that don't fit aren't
+// fetched ahead of time: the window shrinks, and reads that need them
+// wait for memory to be released (see Settings.MemoryWait), or fetch them
+// like they would without readahead.
+type MemoryBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	peak    int64
+	refused int64
+	waits   int64
+	// freed is closed when memory is released, if anyone's waiting
+	freed chan struct{}
+}
+
+// NewMemoryBudget returns a budget that lets Files hold up to limit
+// bytes of readahead blocks. Zero or less means no limit, which
+// is still useful to know how much memory they use.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// MemoryStats tells how much of a MemoryBudget is in use
+type MemoryStats struct {
+	// Limit is what the budget was created with
+	Limit int64
+	// Used is the number of bytes held right now, and Peak
+	// the largest number of bytes held at once so far.
+	Used int64
+	Peak int64
+	// Refused is the number of blocks that weren't fetched ahead because
+	// they didn't fit, and Waits the number of reads that waited for
+	// memory to be released. Together, they tell how often the budget
+	// pushed back.
+	Refused int64
+	Waits   int64
+}
+
+// Stats returns how much of the budget is in use, and has been
+func (mb *MemoryBudget) Stats() MemoryStats {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return MemoryStats{
+		Limit:   mb.limit,
+		Used:    mb.used,
+		Peak:    mb.peak,
+		Refused: mb.refused,
+		Waits:   mb.waits,
+	}
+}
+
+// reserve sets aside n bytes, and returns false if they don't fit
+func (mb *MemoryBudget) reserve(n int64) bool {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.limit > 0 && mb.used+n > mb.limit {
+		mb.refused++
+		return false
+	}
+	mb.used += n
+	if mb.used > mb.peak {
+		mb.peak = mb.used
+	}
+	return true
+}
+
+// release gives back n bytes set aside with reserve
+func (mb *MemoryBudget) release(n int64) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.used -= n
+	if mb.freed != nil {
+		close(mb.freed)
+		mb.freed = nil
+	}
+}
+
+// wait blocks until some memory is released, and returns true, or
+// until d has elapsed according to clock, or ctx is done.
+func (mb *MemoryBudget) wait(ctx context.Context, clock Clock, d time.Duration) bool {
+	mb.mu.Lock()
+	if mb.freed == nil {
+		mb.freed = make(chan struct{})
+	}
+	freed := mb.freed
+	mb.mu.Unlock()
+
+	timeout := make(chan struct{})
+	timer := clock.AfterFunc(d, func() { close(timeout) })
+	defer timer.Stop()
+
+	select {
+	case <-freed:
+		return true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// countWait records that a read waited for memory
+func (mb *MemoryBudget) countWait() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.waits++
+}
+
+// MemoryStats returns the stats of the File's MemoryBudget. If it's
+// shared with other Files, they're for all of them.
+func (f *File) MemoryStats() MemoryStats {
+	return f.memoryBudget.Stats()
+}
@@ -0,0 +1,91 @@
+package htfs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+)
+
+// maxMmapMappings bounds the number of blocks an mmapStore keeps mapped,
+// well below the usual per-process limits on memory mappings.
+const maxMmapMappings = 16 * 1024
+
+// mmapStore is a diskStore that serves blocks from memory mappings of their
+// files, so that repeated reads don't cost read syscalls, and the OS page
+// cache decides what stays resident. Blocks are verified against their
+// checksum when they're mapped, and copied out of their mapping, so callers
+// never hold on to mapped memory.
+type mmapStore struct {
+	*diskStore
+
+	mu       sync.RWMutex
+	mappings map[string][]byte
+}
+
+var _ cacheStore = (*mmapStore)(nil)
+
+func newMmapStore(ds *diskStore) *mmapStore {
+	return &mmapStore{
+		diskStore: ds,
+		mappings:  make(map[string][]byte),
+	}
+}
+
+func (ms *mmapStore) get(key string) ([]byte, error) {
+	ms.mu.RLock()
+	if m, ok := ms.mappings[key]; ok {
+		data := append([]byte(nil), m[blockChecksumSize:]...)
+		ms.mu.RUnlock()
+		return data, nil
+	}
+	ms.mu.RUnlock()
+
+	m, err := mapFile(ms.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(m) < blockChecksumSize || binary.LittleEndian.Uint32(m) != crc32.Checksum(m[blockChecksumSize:], blockChecksumTable) {
+		unmapFile(m)
+		return nil, errCorruptBlock
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if existing, ok := ms.mappings[key]; ok {
+		// mapped concurrently
+		unmapFile(m)
+		m = existing
+	} else {
+		if len(ms.mappings) >= maxMmapMappings {
+			for other, om := range ms.mappings {
+				delete(ms.mappings, other)
+				unmapFile(om)
+				break
+			}
+		}
+		ms.mappings[key] = m
+	}
+	return append([]byte(nil), m[blockChecksumSize:]...), nil
+}
+
+func (ms *mmapStore) put(key string, data []byte) (int64, error) {
+	size, err := ms.diskStore.put(key, data)
+	// the old mapping, if any, is of the file that was replaced
+	ms.unmap(key)
+	return size, err
+}
+
+func (ms *mmapStore) remove(key string) error {
+	ms.unmap(key)
+	return ms.diskStore.remove(key)
+}
+
+func (ms *mmapStore) unmap(key string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if m, ok := ms.mappings[key]; ok {
+		delete(ms.mappings, key)
+		unmapFile(m)
+	}
+}
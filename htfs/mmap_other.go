@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package htfs
+
+import "github.com/pkg/errors"
+
+const mmapSupported = false
+
+func mapFile(path string) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func unmapFile(m []byte) error {
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package htfs
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const mmapSupported = true
+
+// mapFile maps the whole contents of the file at path, read-only
+func mapFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if stats.Size() == 0 {
+		// can't map nothing, and it's corrupt anyway
+		return []byte{}, nil
+	}
+
+	m, err := syscall.Mmap(int(file.Fd()), 0, int(stats.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return m, nil
+}
+
+func unmapFile(m []byte) error {
+	if len(m) == 0 {
+		return nil
+	}
+	return syscall.Munmap(m)
+}
@@ -0,0 +1,273 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// A Range is a span of bytes within a remote file
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+func (r Range) end() int64 {
+	return r.Offset + r.Length
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%d-%d", r.Offset, r.end()-1)
+}
+
+// rangePart is a piece of a response to a multi-range request
+type rangePart struct {
+	offset int64
+	data   []byte
+	// total is the size of the file according to the part's
+	// Content-Range, or -1 if it didn't say.
+	total int64
+}
+
+// multiRangeHeader formats a Range header asking for all of ranges at once
+func multiRangeHeader(ranges []Range) string {
+	specs := make([]string, len(ranges))
+	for i, r := range ranges {
+		specs[i] = r.String()
+	}
+	return "bytes=" + strings.Join(specs, ",")
+}
+
+// parseContentRange parses a Content-Range header value like "bytes 0-99/1000".
+// total is -1 if the server reported it as unknown ("*").
+func parseContentRange(value string) (start int64, end int64, total int64, err error) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimPrefix(value, "bytes ")
+
+	slashTokens := strings.Split(value, "/")
+	if len(slashTokens) != 2 {
+		err = errors.Errorf("invalid content-range %q", value)
+		return
+	}
+
+	if slashTokens[1] == "*" {
+		total = -1
+	} else {
+		total, err = strconv.ParseInt(slashTokens[1], 10, 64)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid content-range total %q", value)
+			return
+		}
+	}
+
+	dashTokens := strings.Split(slashTokens[0], "-")
+	if len(dashTokens) != 2 {
+		err = errors.Errorf("invalid content-range %q", value)
+		return
+	}
+
+	start, err = strconv.ParseInt(dashTokens[0], 10, 64)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid content-range start %q", value)
+		return
+	}
+	end, err = strconv.ParseInt(dashTokens[1], 10, 64)
+	if err != nil {
+		err = errors.Wrapf(err, "invalid content-range end %q", value)
+		return
+	}
+	return
+}
+
+// fetchRanges requests all of ranges in a single HTTP request, and returns
+// their contents in the same order. Servers may answer with a
+// multipart/byteranges response, a single range covering all of them,
+// or the whole file. ranges must not be empty.
+func (f *File) fetchRanges(ranges []Range) ([][]byte, error) {
+	return f.fetchRangesContext(nil, ranges)
+}
+
+// fetchRangesContext is fetchRanges, with requests that are
+// cancelled when ctx is done, if it's not nil.
+func (f *File) fetchRangesContext(ctx context.Context, ranges []Range) ([][]byte, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	if len(ranges) > 1 && !f.multiRange() {
+		// one request per range, see Settings.RangeStrategy
+		var result [][]byte
+		for _, r := range ranges {
+			data, err := f.fetchRangesContext(ctx, []Range{r})
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, data[0])
+		}
+		return result, nil
+	}
+
+	var result [][]byte
+	offset := ranges[0].Offset
+	err := f.withRetries(offset, "FetchRanges", func(attempt int) error {
+		res, err := f.doRangeRequest(rangeRequest{
+			op:        "FetchRanges",
+			method:    "GET",
+			byteRange: multiRangeHeader(ranges),
+			offset:    offset,
+			attempt:   attempt,
+			ctx:       ctx,
+		})
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		// what's received isn't counted until the parts are usable
+		var received int64
+		res.Body = &countingBody{ReadCloser: res.Body, total: &received}
+		parts, err := readRangeParts(res, ranges)
+		if err == nil {
+			for _, p := range parts {
+				if err = f.checkTotal(res.Request.URL.Host, p.total); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			f.countWasted(&f.transfer.retried, received)
+			return err
+		}
+		f.countRangeParts(parts, ranges)
+
+		if f.backing != nil {
+			for _, p := range parts {
+				werr := f.backing.write(p.data, p.offset)
+				if werr != nil {
+					f.log("(Backing) could not write %d bytes at %d: %v", len(p.data), p.offset, werr)
+				}
+			}
+		}
+
+		result, err = assembleRanges(parts, ranges)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "in File.fetchRanges")
+	}
+	return result, nil
+}
+
+// countRangeParts accounts for data received in response to a
+// (multi-)range request, and whatever we didn't ask for.
+func (f *File) countRangeParts(parts []rangePart, ranges []Range) {
+	var received, requested int64
+	for _, p := range parts {
+		received += int64(len(p.data))
+	}
+	for _, r := range ranges {
+		requested += r.Length
+	}
+
+	atomic.AddInt64(&f.transfer.downloaded, received)
+	if received > requested {
+		atomic.AddInt64(&f.transfer.unconsumed, received-requested)
+	}
+}
+
+// readRangeParts reads all the parts of a response to a (multi-)range request
+func readRangeParts(res *http.Response, ranges []Range) ([]rangePart, error) {
+	if res.StatusCode == 200 {
+		// the server ignored our ranges, and is sending the whole file
+		// read only as much as we need.
+		var maxEnd int64
+		for _, r := range ranges {
+			if r.end() > maxEnd {
+				maxEnd = r.end()
+			}
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxEnd))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return []rangePart{{offset: 0, data: data, total: -1}}, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("content-type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		// single range, possibly coalesced by the server
+		start, _, total, err := parseContentRange(res.Header.Get("content-range"))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return []rangePart{{offset: start, data: data, total: total}}, nil
+	}
+
+	var parts []rangePart
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		start, end, total, err := parseContentRange(p.Header.Get("content-range"))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if int64(len(data)) != end-start+1 {
+			return nil, errors.Errorf("multipart range %d-%d: got %d bytes", start, end, len(data))
+		}
+
+		parts = append(parts, rangePart{offset: start, data: data, total: total})
+	}
+	return parts, nil
+}
+
+// assembleRanges finds the data for each requested range among the parts
+// we received. Servers are allowed to reorder and coalesce ranges.
+func assembleRanges(parts []rangePart, ranges []Range) ([][]byte, error) {
+	result := make([][]byte, len(ranges))
+
+	for i, r := range ranges {
+		if r.Length == 0 {
+			result[i] = []byte{}
+			continue
+		}
+
+		for _, p := range parts {
+			if p.offset <= r.Offset && r.end() <= p.offset+int64(len(p.data)) {
+				start := r.Offset - p.offset
+				result[i] = p.data[start : start+r.Length]
+				break
+			}
+		}
+
+		if result[i] == nil {
+			return nil, errors.Errorf("range %s missing from server response", r)
+		}
+	}
+	return result, nil
+}
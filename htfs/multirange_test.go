@@ -0,0 +1,74 @@
+package htfs
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FetchRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(0xbeef)).Read(data)
+
+	var rangeHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeaders = append(rangeHeaders, r.Header.Get("Range"))
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	f, err := Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false },
+		&Settings{ProbeStrategy: ProbeSingleByte})
+	assert.NoError(err)
+
+	check := func(ranges []Range) {
+		t.Helper()
+		rangeHeaders = nil
+		result, err := f.fetchRanges(ranges)
+		assert.NoError(err)
+		assert.Len(rangeHeaders, 1, "single request")
+		for i, r := range ranges {
+			assert.Equal(data[r.Offset:r.end()], result[i], "range %s", r)
+		}
+	}
+
+	// multipart/byteranges
+	check([]Range{
+		{Offset: 10, Length: 100},
+		{Offset: 4096, Length: 1},
+		{Offset: 512 * 1024, Length: 64 * 1024},
+	})
+
+	// single range
+	check([]Range{{Offset: 1000, Length: 24}})
+
+	assert.NoError(f.Close())
+}
+
+func Test_AssembleRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	// servers may coalesce and reorder ranges
+	parts := []rangePart{
+		{offset: 100, data: []byte("klmnop")},
+		{offset: 0, data: []byte("abcdefghij")},
+	}
+	result, err := assembleRanges(parts, []Range{
+		{Offset: 2, Length: 3},
+		{Offset: 101, Length: 5},
+		{Offset: 5, Length: 5},
+	})
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("cde"), []byte("lmnop"), []byte("fghij")}, result)
+
+	_, err = assembleRanges(parts, []Range{{Offset: 8, Length: 5}})
+	assert.Error(err)
+}
@@ -0,0 +1,49 @@
+package htfs
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+var propagatePanics = os.Getenv("HTFS_PROPAGATE_PANICS") == "1"
+
+// A PanicError is returned (wrapped in a *ReadError) when htfs runs into
+// a bug while reading, instead of crashing the whole process.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (pe *PanicError) Error() string {
+	return fmt.Sprintf("internal error (recovered panic): %v", pe.Value)
+}
+
+// recoverPanic is deferred by public read methods. It turns a panic into
+// an error stored in *errp, unless File.PropagatePanics is set.
+func (f *File) recoverPanic(op string, offset int64, length int, n *int, errp *error) {
+	if f.PropagatePanics {
+		return
+	}
+
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	pe := &PanicError{
+		Value: r,
+		Stack: debug.Stack(),
+	}
+	f.log("(%s) recovered from panic: %v\n%s", op, r, pe.Stack)
+
+	// whatever connection we were using may be in a bad state
+	if err := f.Reset(); err != nil {
+		f.log("(%s) while resetting after panic: %v", op, err)
+	}
+
+	if n != nil {
+		*n = 0
+	}
+	*errp = newReadError(op, offset, length, pe)
+}
@@ -0,0 +1,148 @@
+package htfs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// PhaseStats tells where the time spent on a File's requests went,
+// according to net/http/httptrace, see File.PhaseStats
+type PhaseStats struct {
+	// Requests is the number of requests made, and ReusedConns the number
+	// of those sent over a connection the Client already had open, which
+	// skip DNS, Connect, and TLS.
+	Requests    int64
+	ReusedConns int64
+
+	// DNS is resolving host names
+	DNS PhaseTiming
+	// Connect is establishing TCP connections, including failed attempts
+	// at other addresses of the same host
+	Connect PhaseTiming
+	// TLS is handshakes
+	TLS PhaseTiming
+	// FirstByte is from when a request was written to when the first byte
+	// of its response arrived: the time spent by the origin, and by the
+	// network in between.
+	FirstByte PhaseTiming
+}
+
+// PhaseTiming aggregates the durations of one phase for a File's requests
+type PhaseTiming struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean returns the average duration of the phase, zero if it never happened
+func (pt PhaseTiming) Mean() time.Duration {
+	if pt.Count == 0 {
+		return 0
+	}
+	return pt.Total / time.Duration(pt.Count)
+}
+
+func (pt PhaseTiming) String() string {
+	return fmt.Sprintf("%d, mean %s, max %s", pt.Count, pt.Mean(), pt.Max)
+}
+
+func (pt *PhaseTiming) add(d time.Duration) {
+	pt.Count++
+	pt.Total += d
+	if d > pt.Max {
+		pt.Max = d
+	}
+}
+
+// phaseCounters is updated from httptrace hooks, which
+// may be called from the Transport's own goroutines
+type phaseCounters struct {
+	mu    sync.Mutex
+	stats PhaseStats
+}
+
+// PhaseStats returns how long requests spent resolving names, connecting,
+// handshaking, and waiting for the origin, so far.
+func (f *File) PhaseStats() PhaseStats {
+	f.phases.mu.Lock()
+	defer f.phases.mu.Unlock()
+	return f.phases.stats
+}
+
+func (f *File) recordPhase(phase func(ps *PhaseStats) *PhaseTiming, start time.Time) time.Duration {
+	d := since(f.clock, start)
+	f.phases.mu.Lock()
+	phase(&f.phases.stats).add(d)
+	f.phases.mu.Unlock()
+	return d
+}
+
+// withPhaseTrace returns req with hooks that time its phases
+// into the File's PhaseStats
+func (f *File) withPhaseTrace(req *http.Request) *http.Request {
+	f.phases.mu.Lock()
+	f.phases.stats.Requests++
+	f.phases.mu.Unlock()
+
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart, wroteAt time.Time
+	mark := func(t *time.Time) {
+		mu.Lock()
+		*t = f.clock.Now()
+		mu.Unlock()
+	}
+	// done records a phase once, if it was started, and returns how long it took
+	done := func(t *time.Time, phase func(ps *PhaseStats) *PhaseTiming) (time.Duration, bool) {
+		mu.Lock()
+		start := *t
+		*t = time.Time{}
+		mu.Unlock()
+		if start.IsZero() {
+			return 0, false
+		}
+		return f.recordPhase(phase, start), true
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			done(&dnsStart, func(ps *PhaseStats) *PhaseTiming { return &ps.DNS })
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			if connectStart.IsZero() {
+				// from the first attempt
+				connectStart = f.clock.Now()
+			}
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				done(&connectStart, func(ps *PhaseStats) *PhaseTiming { return &ps.Connect })
+			}
+		},
+		TLSHandshakeStart: func() { mark(&tlsStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			done(&tlsStart, func(ps *PhaseStats) *PhaseTiming { return &ps.TLS })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				f.phases.mu.Lock()
+				f.phases.stats.ReusedConns++
+				f.phases.mu.Unlock()
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { mark(&wroteAt) },
+		GotFirstResponseByte: func() {
+			d, ok := done(&wroteAt, func(ps *PhaseStats) *PhaseTiming { return &ps.FirstByte })
+			if ok {
+				f.latency.firstByte.record(d)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,147 @@
+package htfs
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// filePins are the blocks a File pinned in its Cache
+type filePins struct {
+	mu     sync.Mutex
+	counts map[int64]int
+}
+
+// Pin keeps the blocks spanning ranges in the File's cache (see
+// Settings.Cache) until they're unpinned, regardless of its size
+// limits and of the File's quota, so that structures read over and over
+// (archive central directories, indexes) aren't evicted by streaming
+// traffic. Blocks that aren't cached yet are preloaded, see Preload.
+//
+// Pins are counted: ranges pinned twice must be unpinned twice. They're
+// all released when the File is closed. Pinned blocks count towards the
+// cache's size, which can go over its limit if too much is pinned.
+func (f *File) Pin(ranges []Range) error {
+	err := f.ensureOpen()
+	if err != nil {
+		return errors.Wrapf(err, "in File.Pin")
+	}
+	if f.local != nil {
+		return nil
+	}
+
+	indices := f.rangeBlocks(ranges)
+	f.pins.mu.Lock()
+	if f.pins.counts == nil {
+		f.pins.counts = make(map[int64]int)
+	}
+	for _, index := range indices {
+		f.pins.counts[index]++
+	}
+	f.pins.mu.Unlock()
+	f.blocks.cache.pin(f.blocks.keys(indices))
+
+	err = f.Preload(ranges)
+	if err != nil {
+		return errors.Wrapf(err, "in File.Pin")
+	}
+	return nil
+}
+
+// Unpin releases pins taken with Pin, the blocks are then
+// evicted like any other. Ranges that weren't pinned are ignored.
+func (f *File) Unpin(ranges []Range) {
+	var released []int64
+	f.pins.mu.Lock()
+	if len(f.pins.counts) == 0 {
+		f.pins.mu.Unlock()
+		return
+	}
+	for _, index := range f.rangeBlocks(ranges) {
+		if f.pins.counts[index] == 0 {
+			continue
+		}
+		f.pins.counts[index]--
+		if f.pins.counts[index] == 0 {
+			delete(f.pins.counts, index)
+		}
+		released = append(released, index)
+	}
+	f.pins.mu.Unlock()
+	f.blocks.cache.unpin(f.blocks.keys(released))
+}
+
+// unpinAll releases all of the File's pins, on close
+func (f *File) unpinAll() {
+	var released []int64
+	f.pins.mu.Lock()
+	for index, count := range f.pins.counts {
+		for i := 0; i < count; i++ {
+			released = append(released, index)
+		}
+	}
+	f.pins.counts = nil
+	f.pins.mu.Unlock()
+	f.blocks.cache.unpin(f.blocks.keys(released))
+}
+
+// rangeBlocks returns the indices of the blocks spanning ranges
+func (f *File) rangeBlocks(ranges []Range) []int64 {
+	var indices []int64
+	seen := make(map[int64]bool)
+	blockSize := f.blocks.blockSize
+	for _, r := range ranges {
+		if r.Length <= 0 {
+			continue
+		}
+		end := r.end()
+		if f.knownSize() && end > f.size {
+			end = f.size
+		}
+		for index := r.Offset / blockSize; index*blockSize < end; index++ {
+			if !seen[index] {
+				seen[index] = true
+				indices = append(indices, index)
+			}
+		}
+	}
+	return indices
+}
+
+func (fb *fileBlocks) keys(indices []int64) []string {
+	keys := make([]string, len(indices))
+	for i, index := range indices {
+		keys[i] = fb.key(index)
+	}
+	return keys
+}
+
+// pin protects blocks from eviction, whether they're
+// in the cache yet or not
+func (c *Cache) pin(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		c.pinned[key]++
+	}
+}
+
+func (c *Cache) unpin(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if c.pinned[key] <= 1 {
+			delete(c.pinned, key)
+		} else {
+			c.pinned[key]--
+		}
+	}
+	// unpinned blocks may have been keeping the cache over budget
+	c.evict("", 0)
+}
@@ -0,0 +1,383 @@
+package htfs
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// how many blocks the preloader fetches in a single request
+const preloadBlocksPerRequest = 16
+
+// priorityGate lets background work wait until there
+// are no foreground reads in progress, and preempts it
+// when one starts. It's also used to wait for background
+// work itself, on close.
+type priorityGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+
+	// background work in progress, cancelled by enter
+	preemptible map[int64]context.CancelFunc
+	nextID      int64
+	preempted   int64
+}
+
+func newPriorityGate() *priorityGate {
+	pg := &priorityGate{
+		preemptible: make(map[int64]context.CancelFunc),
+	}
+	pg.cond = sync.NewCond(&pg.mu)
+	return pg
+}
+
+func (pg *priorityGate) enter() {
+	pg.mu.Lock()
+	pg.active++
+	for id, cancel := range pg.preemptible {
+		cancel()
+		delete(pg.preemptible, id)
+		pg.preempted++
+	}
+	pg.mu.Unlock()
+}
+
+func (pg *priorityGate) leave() {
+	pg.mu.Lock()
+	pg.active--
+	if pg.active == 0 {
+		pg.cond.Broadcast()
+	}
+	pg.mu.Unlock()
+}
+
+func (pg *priorityGate) waitIdle() {
+	pg.mu.Lock()
+	for pg.active > 0 {
+		pg.cond.Wait()
+	}
+	pg.mu.Unlock()
+}
+
+// startBackground waits until there's no foreground work in progress, and
+// returns a context for background work, that's cancelled as soon as some
+// starts (or when parent is done). done must be called once it's over.
+func (pg *priorityGate) startBackground(parent context.Context) (ctx context.Context, done func()) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	for pg.active > 0 {
+		pg.cond.Wait()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	id := pg.nextID
+	pg.nextID++
+	pg.preemptible[id] = cancel
+
+	return ctx, func() {
+		pg.mu.Lock()
+		delete(pg.preemptible, id)
+		pg.mu.Unlock()
+		cancel()
+	}
+}
+
+// preemptions returns how many times background work was cancelled
+// because foreground work started
+func (pg *priorityGate) preemptions() int64 {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return pg.preempted
+}
+
+// preloader fetches blocks in the background
+type preloader struct {
+	mu      sync.Mutex
+	queue   []int64
+	queued  map[int64]bool
+	pending int
+	wake    chan struct{}
+	done    chan struct{}
+	running bool
+}
+
+func newPreloader() *preloader {
+	return &preloader{
+		queued: make(map[int64]bool),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// Preload declares ranges that will be read soon. They're fetched in the
+// background and kept in memory, at a lower priority than foreground reads:
+// the preloader only issues requests while no ReadAt call is in progress,
+// and those in flight are cancelled (to be sent again later) when one starts,
+// so they don't compete for bandwidth.
+// Preloaded data is kept in the File's cache (see Settings.Cache), or until
+// the File is closed if it doesn't have one, in which case it counts against
+// its MemoryBudget: blocks that don't fit aren't kept.
+func (f *File) Preload(ranges []Range) error {
+	err := f.ensureOpen()
+	if err != nil {
+		return errors.Wrapf(err, "in File.Preload")
+	}
+	if f.local != nil {
+		// local reads are cheap enough
+		return nil
+	}
+
+	pl := f.preloader
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	for _, r := range ranges {
+		if r.Length <= 0 {
+			continue
+		}
+
+		end := r.end()
+		if f.knownSize() && end > f.size {
+			end = f.size
+		}
+		blockSize := f.blocks.blockSize
+		for index := r.Offset / blockSize; index*blockSize < end; index++ {
+			if pl.queued[index] || f.blocks.has(index) {
+				continue
+			}
+			pl.queued[index] = true
+			pl.queue = append(pl.queue, index)
+			pl.pending++
+		}
+	}
+
+	if !pl.running {
+		pl.running = true
+		f.workers.enter()
+		f.goLabeled("Preload", "", f.preloadWork)
+	}
+
+	select {
+	case pl.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PendingPreloads returns the number of blocks that have been
+// requested with Preload but haven't been fetched yet.
+func (f *File) PendingPreloads() int {
+	pl := f.preloader
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	return pl.pending
+}
+
+func (f *File) preloadWork() {
+	defer f.workers.leave()
+	pl := f.preloader
+
+	for {
+		select {
+		case <-pl.done:
+			return
+		case <-f.ctx.Done():
+			return
+		case <-pl.wake:
+		}
+
+		for {
+			pl.mu.Lock()
+			n := len(pl.queue)
+			if n > preloadBlocksPerRequest {
+				n = preloadBlocksPerRequest
+			}
+			batch := append([]int64(nil), pl.queue[:n]...)
+			pl.queue = pl.queue[n:]
+			pl.mu.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+
+			// foreground reads go first
+			ctx, done := f.gate.startBackground(f.ctx)
+
+			select {
+			case <-pl.done:
+				done()
+				return
+			case <-f.ctx.Done():
+				done()
+				return
+			default:
+			}
+
+			f.preloadBlocks(ctx, batch)
+			preempted := ctx.Err() != nil && f.ctx.Err() == nil
+			done()
+
+			pl.mu.Lock()
+			if preempted {
+				// try again once foreground reads are done
+				f.log2("(Preload) preempted by a foreground read")
+				pl.queue = append(batch, pl.queue...)
+				pl.mu.Unlock()
+				continue
+			}
+			for _, index := range batch {
+				delete(pl.queued, index)
+			}
+			pl.pending -= len(batch)
+			pl.mu.Unlock()
+		}
+	}
+}
+
+func (f *File) preloadBlocks(ctx context.Context, indices []int64) {
+	ranges := make([]Range, len(indices))
+	for i, index := range indices {
+		ranges[i] = f.blockRange(index, f.blocks.blockSize)
+	}
+
+	result, err := f.fetchRangesContext(ctx, ranges)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		// preloading is best-effort, foreground reads will
+		// surface any persistent error.
+		f.log("(Preload) failed: %v", err)
+		return
+	}
+
+	for i, index := range indices {
+		err := f.blocks.put(index, result[i])
+		if err != nil {
+			f.log("(Preload) could not store block %d: %v", index, err)
+		}
+	}
+}
+
+func (f *File) blockRange(index int64, blockSize int64) Range {
+	r := Range{
+		Offset: index * blockSize,
+		Length: blockSize,
+	}
+	if f.knownSize() && r.end() > f.size {
+		r.Length = f.size - r.Offset
+	}
+	return r
+}
+
+// readFromBlocks serves a read entirely from cached blocks, if they're
+// all present. Otherwise, it returns false and nothing is read.
+func (f *File) readFromBlocks(data []byte, offset int64) (int, bool, error) {
+	end := offset + int64(len(data))
+	var eof bool
+	if f.knownSize() && end >= f.size {
+		end = f.size
+		eof = true
+	}
+	if offset >= end {
+		return 0, false, nil
+	}
+
+	bs := f.blocks
+	var blocks [][]byte
+	for index := offset / bs.blockSize; index*bs.blockSize < end; index++ {
+		block, ok := bs.get(index)
+		if !ok {
+			return 0, false, nil
+		}
+		blocks = append(blocks, block)
+	}
+
+	n := 0
+	pos := offset
+	for _, block := range blocks {
+		blockStart := pos / bs.blockSize * bs.blockSize
+		n += copy(data[n:end-offset], block[pos-blockStart:])
+		pos = offset + int64(n)
+	}
+
+	if eof && int64(len(data)) > end-offset {
+		return n, true, io.EOF
+	}
+	return n, true, nil
+}
+
+// readAligned serves a read by fetching the whole blocks it spans, in a
+// single request, and caching them. See Settings.BlockAligned.
+func (f *File) readAligned(data []byte, offset int64) (int, error) {
+	end := offset + int64(len(data))
+	eof := false
+	if end > f.size {
+		end = f.size
+		eof = true
+	}
+	if offset >= end {
+		return 0, io.EOF
+	}
+
+	bs := f.blocks.blockSize
+	first := offset / bs
+	blocks := make([][]byte, (end-1)/bs-first+1)
+
+	// contiguous missing blocks are fetched as a single range
+	var ranges []Range
+	for i := range blocks {
+		index := first + int64(i)
+		if block, ok := f.blocks.get(index); ok {
+			blocks[i] = block
+			continue
+		}
+
+		r := f.blockRange(index, bs)
+		if n := len(ranges); n > 0 && ranges[n-1].end() == r.Offset {
+			ranges[n-1].Length += r.Length
+		} else {
+			ranges = append(ranges, r)
+		}
+	}
+
+	if len(ranges) > 0 {
+		f.log2("[%9d-%9d] (ReadAligned) fetching %d ranges", offset, end, len(ranges))
+		result, err := f.fetchRanges(ranges)
+		if err != nil {
+			return 0, err
+		}
+
+		for i, r := range ranges {
+			for pos := r.Offset; pos < r.end(); pos += bs {
+				blockEnd := pos + bs
+				if blockEnd > r.end() {
+					blockEnd = r.end()
+				}
+				block := result[i][pos-r.Offset : blockEnd-r.Offset]
+
+				index := pos / bs
+				blocks[index-first] = block
+				err := f.blocks.put(index, block)
+				if err != nil {
+					f.log("(ReadAligned) could not store block %d: %v", index, err)
+				}
+			}
+		}
+	}
+
+	n := 0
+	for n < int(end-offset) {
+		pos := offset + int64(n)
+		block := blocks[pos/bs-first]
+		n += copy(data[n:end-offset], block[pos%bs:])
+	}
+
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,138 @@
+package htfs
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A ProbeStrategy determines how a File finds out the size of the
+// remote file when it's opened.
+type ProbeStrategy int
+
+const (
+	// ProbeStream does a ranged GET for the whole file (bytes=0-), and keeps
+	// the connection around to serve the first reads. This is the default.
+	ProbeStream ProbeStrategy = iota
+	// ProbeSingleByte does a ranged GET for the first byte only (bytes=0-0).
+	// Useful for backends that don't handle HEAD properly on pre-signed URLs.
+	ProbeSingleByte
+	// ProbeHead does a HEAD request.
+	ProbeHead
+)
+
+func (ps ProbeStrategy) String() string {
+	switch ps {
+	case ProbeStream:
+		return "stream"
+	case ProbeSingleByte:
+		return "single-byte"
+	case ProbeHead:
+		return "head"
+	default:
+		return "unknown"
+	}
+}
+
+// probe does a first request to determine the remote file's size,
+// name, and headers.
+func (f *File) probe() error {
+	switch f.probeStrategy {
+	case ProbeSingleByte:
+		return f.probeWithRequest("GET", "bytes=0-0")
+	case ProbeHead:
+		return f.probeWithRequest("HEAD", "")
+	}
+
+	c, err := f.borrowConn(0)
+	if rnse, ok := errors.Cause(err).(*RangeNotSatisfiableError); ok && rnse.Offset == 0 && rnse.Size == 0 {
+		// not even the first byte: it's an empty file
+		return f.applyProbe(rnse.header, rnse.requestURL, http.StatusOK, 0)
+	}
+	if err != nil {
+		return errors.Wrapf(normalizeError(err), "htfs.Open (initial request)")
+	}
+
+	err = f.returnConn(c)
+	if err != nil {
+		return errors.Wrapf(normalizeError(err), "htfs.Open (return conn after initial request)")
+	}
+
+	return f.applyProbe(c.header, c.requestURL, c.statusCode, c.contentLength)
+}
+
+func (f *File) probeWithRequest(method string, byteRange string) error {
+	res, err := f.sharedProbe("Probe", method, byteRange, nil)
+	if err != nil {
+		return errors.Wrapf(normalizeError(err), "htfs.Open (initial %s request)", method)
+	}
+	return f.applyProbe(res.Header, res.Request.URL, res.StatusCode, res.ContentLength)
+}
+
+func (f *File) applyProbe(header http.Header, requestURL *url.URL, statusCode int, contentLength int64) error {
+	f.header = header
+	f.requestURL = requestURL
+
+	size, err := probedSize(header, statusCode, contentLength)
+	if err != nil {
+		return err
+	}
+	f.size = size
+
+	// we have to use requestURL because we want the URL after
+	// redirect (for hosts like sourceforge)
+	f.name = nameFromPath(f.requestURL.Path)
+
+	dispHeader := header.Get("content-disposition")
+	if dispHeader != "" {
+		_, mimeParams, err := mime.ParseMediaType(dispHeader)
+		if err == nil {
+			filename := mimeParams["filename"]
+			if filename != "" {
+				f.name = filename
+			}
+		}
+	}
+
+	return nil
+}
+
+// probedSize returns the size of the remote file, according
+// to the response to an initial request.
+func probedSize(header http.Header, statusCode int, contentLength int64) (int64, error) {
+	if statusCode == 206 {
+		rangeHeader := header.Get("content-range")
+		rangeTokens := strings.Split(rangeHeader, "/")
+		totalBytesStr := rangeTokens[len(rangeTokens)-1]
+		if totalBytesStr == "*" {
+			return UnknownSize, nil
+		}
+		size, err := strconv.ParseInt(totalBytesStr, 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(normalizeError(err), "Could not parse file size")
+		}
+		return size, nil
+	} else if statusCode == http.StatusRequestedRangeNotSatisfiable {
+		// "bytes */size", for ranges past the end, like any range of an empty file
+		size := unsatisfiedRangeSize(header.Get("content-range"))
+		if size == UnknownSize {
+			return 0, errors.Errorf("HTTP 416 without a size in content-range")
+		}
+		return size, nil
+	} else if statusCode == 200 {
+		if contentLength < 0 {
+			// streamed without a Content-Length header
+			return UnknownSize, nil
+		}
+		if encoding := strings.ToLower(header.Get("content-encoding")); encoding != "" && encoding != "identity" {
+			// that's the compressed size, see AcceptEncodingGzipMetadata
+			return UnknownSize, nil
+		}
+		return contentLength, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,112 @@
+package htfs
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// RampUp makes connections start with a small bounded range, and ask for
+// twice as much every time they're read to the end of it, like TCP slow
+// start. A one-off small read then doesn't commit the server to streaming
+// megabytes that will be discarded, while long sequential reads quickly
+// get back to open-ended requests. Files of UnknownSize don't ramp up.
+// See Settings.RampUp.
+type RampUp struct {
+	// Initial is the length of the first range a connection requests,
+	// defaults to 64KiB.
+	Initial int64
+	// Max is the longest bounded range requested, after which connections
+	// switch to open-ended ranges. Defaults to 16MiB.
+	Max int64
+}
+
+const (
+	defaultRampUpInitial = 64 * 1024
+	defaultRampUpMax     = 16 * 1024 * 1024
+)
+
+func (ru RampUp) withDefaults() *RampUp {
+	if ru.Initial <= 0 {
+		ru.Initial = defaultRampUpInitial
+	}
+	if ru.Max < ru.Initial {
+		ru.Max = defaultRampUpMax
+		if ru.Max < ru.Initial {
+			ru.Max = ru.Initial
+		}
+	}
+	return &ru
+}
+
+// byteRange returns the range a conn should request to read from offset,
+// where it starts, which is before offset for ChunkSize, and where it
+// ends (exclusive), zero if it's open-ended.
+func (c *conn) byteRange(offset int64) (string, int64, int64) {
+	hf := c.file
+	if hf.chunkSize > 0 {
+		start := offset / hf.chunkSize * hf.chunkSize
+		end := start + hf.chunkSize
+		if hf.knownSize() && end > hf.size {
+			end = hf.size
+		}
+		return fmt.Sprintf("bytes=%d-%d", start, end-1), start, end
+	}
+
+	window := c.window
+	if span := hf.maxRangeSpan; span > 0 && (window <= 0 || window > span) {
+		window = span
+	}
+	if window <= 0 || (!hf.knownSize() && hf.maxRangeSpan <= 0) {
+		// without a size, asking past the end could fail
+		return fmt.Sprintf("bytes=%d-", offset), offset, 0
+	}
+
+	end := offset + window
+	if hf.knownSize() && end >= hf.size {
+		// the rest of the file fits, no need to come back for more
+		c.window = 0
+		if hf.maxRangeSpan <= 0 {
+			return fmt.Sprintf("bytes=%d-", offset), offset, 0
+		}
+		end = hf.size
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, end-1), offset, end
+}
+
+// atRangeEnd returns true if the conn read its whole bounded range,
+// and must be extended to keep reading.
+func (c *conn) atRangeEnd() bool {
+	return c.rangeEnd > 0 && c.Offset() == c.rangeEnd
+}
+
+// extend reconnects a conn that read its whole bounded range, asking
+// for twice as much as last time, or for the next MaxRangeSpan bytes or
+// chunk.
+// It returns io.EOF if the range turns out to have ended where a file of
+// UnknownSize does.
+func (c *conn) extend() error {
+	hf := c.file
+
+	offset := c.Offset()
+	if hf.chunkSize > 0 {
+		hf.log2("[%9d-%9d] (Chunk) next chunk for %s", offset, offset, c.id)
+	} else if c.window > 0 {
+		c.window *= 2
+		if c.window > hf.rampUp.Max {
+			c.window = 0
+		}
+		hf.log2("[%9d-%9d] (RampUp) extending %s, window %d", offset, offset, c.id, c.window)
+		atomic.AddInt64(&hf.stats.rampUps, 1)
+	} else {
+		hf.log2("[%9d-%9d] (Span) extending %s", offset, offset, c.id)
+	}
+
+	err := c.Connect(offset)
+	if rnse, ok := errors.Cause(err).(*RangeNotSatisfiableError); ok && rnse.Offset == offset && hf.sizeUnknown() {
+		return io.EOF
+	}
+	return err
+}
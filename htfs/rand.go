@@ -0,0 +1,42 @@
+package htfs
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// lockedSource makes a rand.Source safe for concurrent use, so the
+// *rand.Rand built on it can be shared by reads and retry loops.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (ls *lockedSource) Int63() int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.src.Int63()
+}
+
+func (ls *lockedSource) Seed(seed int64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.src.Seed(seed)
+}
+
+// newSharedRand returns nil if src is nil, so that the global
+// source is used instead.
+func newSharedRand(src rand.Source) *rand.Rand {
+	if src == nil {
+		return nil
+	}
+	return rand.New(&lockedSource{src: src})
+}
+
+// randFloat64 is rand.Float64, from Settings.Rand if it was set
+func (f *File) randFloat64() float64 {
+	if f.rand != nil {
+		return f.rand.Float64()
+	}
+	return rand.Float64()
+}
@@ -0,0 +1,228 @@
+package htfs
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A RangeStrategy is how a File asks for parts of the remote file, for
+// backends that don't honor Range headers, see Settings.RangeStrategy.
+type RangeStrategy interface {
+	// SetRange makes req ask for the bytes of r
+	SetRange(req *http.Request, r ByteRange) error
+
+	// AdaptResponse is called with every response to a request SetRange
+	// was called for, before the File looks at it. It should make it look
+	// like the response to a Range header: 206 with a Content-Range for
+	// the bytes in the body, or 416 for ranges past the end of the file.
+	// Responses that already do are left alone.
+	AdaptResponse(res *http.Response, r ByteRange) error
+
+	// StripRange returns u, the URL a request SetRange was called for
+	// got redirected to, without what SetRange added to it, if the
+	// redirect kept it. That's what the File remembers and reuses for
+	// other ranges, see RedirectPolicy.CacheTarget.
+	StripRange(u *url.URL) *url.URL
+}
+
+// A ByteRange is a range of bytes a File asks for
+type ByteRange struct {
+	// Start is the offset of the first byte. If it's negative, the
+	// range is the last -Start bytes of the file instead.
+	Start int64
+	// End is the offset of the last byte, or -1 for the end of the file
+	End int64
+}
+
+// Suffix returns true if the range is at the end of the file,
+// of a size given by -Start
+func (br ByteRange) Suffix() bool {
+	return br.Start < 0
+}
+
+// String formats the range like the value of a Range
+// header, without the unit: "0-1023", "1024-", or "-512".
+func (br ByteRange) String() string {
+	if br.Suffix() {
+		return fmt.Sprintf("%d", br.Start)
+	}
+	if br.End < 0 {
+		return fmt.Sprintf("%d-", br.Start)
+	}
+	return fmt.Sprintf("%d-%d", br.Start, br.End)
+}
+
+// parseByteRange parses the single ranges of Range headers the File
+// sends, like "bytes=0-1023", "bytes=1024-", or "bytes=-512".
+func parseByteRange(value string) (ByteRange, error) {
+	spec := strings.TrimPrefix(value, "bytes=")
+	if spec == value || strings.Contains(spec, ",") {
+		return ByteRange{}, errors.Errorf("unsupported range %q", value)
+	}
+
+	if strings.HasPrefix(spec, "-") {
+		n, err := strconv.ParseInt(spec[1:], 10, 64)
+		if err != nil || n <= 0 {
+			return ByteRange{}, errors.Errorf("invalid suffix range %q", value)
+		}
+		return ByteRange{Start: -n, End: -1}, nil
+	}
+
+	tokens := strings.SplitN(spec, "-", 2)
+	if len(tokens) != 2 {
+		return ByteRange{}, errors.Errorf("invalid range %q", value)
+	}
+	br := ByteRange{End: -1}
+	var err error
+	br.Start, err = strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return ByteRange{}, errors.Wrapf(err, "invalid range start %q", value)
+	}
+	if tokens[1] != "" {
+		br.End, err = strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil {
+			return ByteRange{}, errors.Wrapf(err, "invalid range end %q", value)
+		}
+	}
+	return br, nil
+}
+
+// setRange makes req ask for byteRange, with a Range
+// header or as set by Settings.RangeStrategy.
+func (f *File) setRange(req *http.Request, byteRange string) error {
+	if f.rangeStrategy == nil {
+		req.Header.Set("Range", byteRange)
+		return nil
+	}
+
+	br, err := parseByteRange(byteRange)
+	if err != nil {
+		return err
+	}
+	return f.rangeStrategy.SetRange(req, br)
+}
+
+// adaptResponse lets the File's RangeStrategy
+// rewrite res, the response to a byteRange request
+func (f *File) adaptResponse(res *http.Response, byteRange string) error {
+	if f.rangeStrategy == nil || byteRange == "" {
+		return nil
+	}
+
+	br, err := parseByteRange(byteRange)
+	if err != nil {
+		return err
+	}
+	return f.rangeStrategy.AdaptResponse(res, br)
+}
+
+// multiRange returns true if several ranges can be
+// asked for in a single request, see fetchRanges.
+func (f *File) multiRange() bool {
+	return f.rangeStrategy == nil && f.fetcher == nil
+}
+
+// QueryRanges is a RangeStrategy for backends that take ranges in a query
+// parameter, like "?range=0-1023", and respond with just those bytes.
+type QueryRanges struct {
+	// Param is the name of the query parameter, "range" if empty. Its
+	// value is formatted like ByteRange.String.
+	Param string
+
+	// SizeHeader, if set, is the response header holding the size of
+	// the whole file. Without it, the File's size is unknown, unless
+	// given in Settings.Size, and ranges at its end can't be asked for.
+	SizeHeader string
+}
+
+var _ RangeStrategy = QueryRanges{}
+
+func (qr QueryRanges) param() string {
+	if qr.Param == "" {
+		return "range"
+	}
+	return qr.Param
+}
+
+// SetRange adds the range to the query of
+// req's URL, leaving the rest of it as is
+func (qr QueryRanges) SetRange(req *http.Request, r ByteRange) error {
+	u := *req.URL
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += url.QueryEscape(qr.param()) + "=" + url.QueryEscape(r.String())
+	req.URL = &u
+	return nil
+}
+
+// StripRange removes the range parameter from the query of u,
+// leaving the rest of it as is, in order, since it may be signed
+func (qr QueryRanges) StripRange(u *url.URL) *url.URL {
+	if u.RawQuery == "" {
+		return u
+	}
+
+	var kept []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		key := pair
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			key = pair[:i]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == qr.param() {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	res := *u
+	res.RawQuery = strings.Join(kept, "&")
+	return &res
+}
+
+// AdaptResponse turns 200 responses into 206 ones, and
+// empty ones into 416, with the matching Content-Range
+func (qr QueryRanges) AdaptResponse(res *http.Response, r ByteRange) error {
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	total := "*"
+	size := int64(-1)
+	if qr.SizeHeader != "" {
+		value := res.Header.Get(qr.SizeHeader)
+		var err error
+		size, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return errors.Errorf("invalid size in %s header: %q", qr.SizeHeader, value)
+		}
+		total = strconv.FormatInt(size, 10)
+	}
+
+	if res.ContentLength < 0 {
+		// there'd be no telling where the range ends
+		return errors.Errorf("response to range %s has no Content-Length", r)
+	}
+	if res.ContentLength == 0 {
+		res.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		res.Status = "416 Requested Range Not Satisfiable"
+		res.Header.Set("Content-Range", "bytes */"+total)
+		return nil
+	}
+
+	start := r.Start
+	if r.Suffix() {
+		if size < 0 {
+			return errors.Errorf("can't place range %s without knowing the size", r)
+		}
+		start = size - res.ContentLength
+	}
+	res.StatusCode = http.StatusPartialContent
+	res.Status = "206 Partial Content"
+	res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, start+res.ContentLength-1, total))
+	return nil
+}
@@ -0,0 +1,232 @@
+package htfs
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// readahead keeps blocks in flight ahead of a sequential reader,
+// see Settings.Readahead
+type readahead struct {
+	mu    sync.Mutex
+	depth int64
+	// next is where the last read ended,
+	// reading from the start is sequential too
+	next   int64
+	blocks map[int64]*readaheadBlock
+}
+
+type readaheadBlock struct {
+	done chan struct{}
+	data []byte
+	err  error
+
+	// size is what the block holds against the File's MemoryBudget,
+	// until it's both finished and dropped. Both are guarded by ra.mu,
+	// like read, which is set once a read used the block.
+	size     int64
+	finished bool
+	dropped  bool
+	read     bool
+}
+
+func newReadahead(depth int) *readahead {
+	return &readahead{
+		depth:  int64(depth),
+		blocks: make(map[int64]*readaheadBlock),
+	}
+}
+
+// readFromReadahead serves a read from blocks fetched ahead of time, if
+// they're all there (possibly still in flight). Otherwise, it returns
+// false and nothing is read. Sequential reads always find their blocks:
+// the missing ones are fetched along with those after them.
+func (f *File) readFromReadahead(data []byte, offset int64) (int, bool, error) {
+	end := offset + int64(len(data))
+	var eof bool
+	if end >= f.size {
+		end = f.size
+		eof = true
+	}
+	if offset >= end {
+		return 0, false, nil
+	}
+
+	ra := f.readahead
+	bs := f.blocks.blockSize
+	first, last := offset/bs, (end-1)/bs
+
+	ra.mu.Lock()
+	_, inWindow := ra.blocks[first]
+	sequential := offset == ra.next || inWindow
+	ra.next = end
+	if sequential {
+		f.moveReadaheadWindowOrWait(first, last)
+	}
+
+	var blocks []*readaheadBlock
+	for index := first; index <= last; index++ {
+		b, ok := ra.blocks[index]
+		if !ok {
+			ra.mu.Unlock()
+			return 0, false, nil
+		}
+		blocks = append(blocks, b)
+	}
+	for _, b := range blocks {
+		b.read = true
+	}
+	ra.mu.Unlock()
+
+	n := 0
+	pos := offset
+	for i, b := range blocks {
+		select {
+		case <-b.done:
+		case <-f.ctx.Done():
+			return 0, true, errors.WithStack(f.ctx.Err())
+		}
+		if b.err != nil {
+			// it'll be fetched again by the caller
+			ra.mu.Lock()
+			if ra.blocks[first+int64(i)] == b {
+				f.dropReadaheadBlock(first + int64(i))
+			}
+			ra.mu.Unlock()
+			return 0, false, nil
+		}
+
+		blockStart := pos / bs * bs
+		n += copy(data[n:end-offset], b.data[pos-blockStart:])
+		pos = offset + int64(n)
+	}
+
+	if eof && int64(len(data)) > end-offset {
+		return n, true, io.EOF
+	}
+	return n, true, nil
+}
+
+// moveReadaheadWindowOrWait is moveReadaheadWindow, except that if the
+// read's own blocks don't fit in the MemoryBudget, it waits for memory to
+// be released, for up to Settings.MemoryWait. ra.mu must be held, and is
+// released while waiting.
+func (f *File) moveReadaheadWindowOrWait(first, last int64) {
+	if f.moveReadaheadWindow(first, last) || f.memoryWait <= 0 {
+		return
+	}
+
+	ra := f.readahead
+	f.memoryBudget.countWait()
+	deadline := f.clock.Now().Add(f.memoryWait)
+	for {
+		remaining := deadline.Sub(f.clock.Now())
+		if remaining <= 0 {
+			return
+		}
+		f.log2("[%9d-%9d] (Readahead) waiting for memory", first*f.blocks.blockSize, (last+1)*f.blocks.blockSize)
+		ra.mu.Unlock()
+		freed := f.memoryBudget.wait(f.ctx, f.clock, remaining)
+		ra.mu.Lock()
+		if !freed || f.moveReadaheadWindow(first, last) {
+			return
+		}
+	}
+}
+
+// moveReadaheadWindow drops blocks that aren't needed by a read of blocks
+// first through last or the ones after it, and starts fetching those that
+// are missing, including the read's own. It returns false if some of the
+// read's own didn't fit in the MemoryBudget. ra.mu must be held.
+func (f *File) moveReadaheadWindow(first, last int64) bool {
+	ra := f.readahead
+	horizon := last + ra.depth
+	for index := range ra.blocks {
+		if index < first || index > horizon {
+			f.dropReadaheadBlock(index)
+		}
+	}
+
+	bs := f.blocks.blockSize
+	for index := first; index <= horizon && index*bs < f.size; index++ {
+		if _, ok := ra.blocks[index]; ok {
+			continue
+		}
+		if f.ctx.Err() != nil {
+			return true
+		}
+
+		size := f.blockRange(index, bs).Length
+		if !f.memoryBudget.reserve(size) {
+			// read ahead less, the read fetches its own blocks if need be
+			f.log2("[%9d-%9d] (Readahead) memory budget exhausted, not fetching block %d", index*bs, index*bs+size, index)
+			return index > last
+		}
+
+		index, b := index, &readaheadBlock{done: make(chan struct{}), size: size}
+		ra.blocks[index] = b
+		f.workers.enter()
+		f.goLabeled("Readahead", "", func() { f.fetchReadaheadBlock(index, b) })
+	}
+	return true
+}
+
+// dropReadaheadBlock forgets about a block, and releases its memory
+// unless it's still being fetched. ra.mu must be held.
+func (f *File) dropReadaheadBlock(index int64) {
+	ra := f.readahead
+	b := ra.blocks[index]
+	delete(ra.blocks, index)
+	b.dropped = true
+	if b.finished {
+		f.releaseReadaheadBlock(b)
+	}
+}
+
+// releaseReadaheadBlock releases the memory of a block that's both
+// finished and dropped, and counts it as wasted if it was never read.
+// ra.mu must be held.
+func (f *File) releaseReadaheadBlock(b *readaheadBlock) {
+	f.memoryBudget.release(b.size)
+	if !b.read {
+		f.countWasted(&f.transfer.dropped, int64(len(b.data)))
+	}
+}
+
+// dropReadahead forgets about all blocks, when the File is closed
+func (f *File) dropReadahead() {
+	ra := f.readahead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for index := range ra.blocks {
+		f.dropReadaheadBlock(index)
+	}
+}
+
+func (f *File) fetchReadaheadBlock(index int64, b *readaheadBlock) {
+	defer f.workers.leave()
+	defer close(b.done)
+	defer func() {
+		ra := f.readahead
+		ra.mu.Lock()
+		defer ra.mu.Unlock()
+		b.finished = true
+		if b.dropped {
+			f.releaseReadaheadBlock(b)
+		}
+	}()
+
+	r := f.blockRange(index, f.blocks.blockSize)
+	f.log2("[%9d-%9d] (Readahead) fetching block %d", r.Offset, r.end(), index)
+	result, err := f.fetchRanges([]Range{r})
+	if err != nil {
+		// best-effort, the read that needs it will fetch it again
+		// and surface any persistent error.
+		f.log("(Readahead) block %d failed: %v", index, err)
+		b.err = err
+		return
+	}
+	b.data = result[0]
+}
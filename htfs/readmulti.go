@@ -0,0 +1,152 @@
+package htfs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ranges closer than this are fetched as one, since the overhead
+// of a separate range is worth more than the bytes in between.
+const readMultiMaxGap int64 = 64 * 1024
+
+// we don't want Range headers to grow unreasonably large
+const readMultiMaxRangesPerRequest = 32
+
+// ReadMulti reads many (possibly small and discontiguous) ranges of the
+// remote file at once. Nearby ranges are coalesced, the rest are requested
+// in batches using multi-range requests, on several connections in parallel.
+// The result has one entry per range, in the same order.
+func (f *File) ReadMulti(ranges []Range) ([][]byte, error) {
+	err := f.ensureOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 || (f.knownSize() && r.end() > f.size) {
+			return nil, errors.Errorf("in File.ReadMulti: range %s out of bounds (size %d)", r, f.size)
+		}
+	}
+
+	if f.local != nil {
+		return f.readMultiLocal(ranges)
+	}
+
+	planned := planRanges(ranges, readMultiMaxGap)
+
+	// the gaps we fetch to coalesce ranges are never delivered
+	var wanted, fetched int64
+	for _, r := range planRanges(ranges, 0) {
+		wanted += r.Length
+	}
+	for _, r := range planned {
+		fetched += r.Length
+	}
+
+	var batches [][]Range
+	for len(planned) > 0 {
+		n := len(planned)
+		if n > readMultiMaxRangesPerRequest {
+			n = readMultiMaxRangesPerRequest
+		}
+		batches = append(batches, planned[:n])
+		planned = planned[n:]
+	}
+
+	var parts []rangePart
+	var partsMutex sync.Mutex
+	var firstErr error
+
+	parallelism := f.MaxConns
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for _, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		batch := batch
+		f.goLabeled("ReadMulti", "", func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			f.log2("[%9d-%9d] (ReadMulti) fetching %d ranges", batch[0].Offset, batch[len(batch)-1].end(), len(batch))
+			result, err := f.fetchRanges(batch)
+
+			partsMutex.Lock()
+			defer partsMutex.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for i, data := range result {
+				parts = append(parts, rangePart{offset: batch[i].Offset, data: data, total: -1})
+			}
+		})
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, errors.Wrapf(firstErr, "in File.ReadMulti")
+	}
+
+	result, err := assembleRanges(parts, ranges)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in File.ReadMulti")
+	}
+
+	// don't let callers hold on to (and mutate) our big coalesced buffers
+	var delivered int64
+	for i, data := range result {
+		result[i] = make([]byte, len(data))
+		copy(result[i], data)
+		delivered += int64(len(data))
+	}
+
+	atomic.AddInt64(&f.transfer.unconsumed, fetched-wanted)
+	atomic.AddInt64(&f.transfer.delivered, delivered)
+	if f.heatmap != nil {
+		for _, r := range ranges {
+			f.heatmap.record(r.Offset, r.Length, f.currentSize())
+		}
+	}
+	return result, nil
+}
+
+// planRanges sorts ranges and merges those that overlap or are less
+// than maxGap apart. Empty ranges are skipped.
+func planRanges(ranges []Range, maxGap int64) []Range {
+	sorted := make([]Range, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Length > 0 {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+
+	var planned []Range
+	for _, r := range sorted {
+		if len(planned) > 0 {
+			last := &planned[len(planned)-1]
+			if r.Offset <= last.end()+maxGap {
+				if r.end() > last.end() {
+					last.Length = r.end() - last.Offset
+				}
+				continue
+			}
+		}
+		planned = append(planned, r)
+	}
+	return planned
+}
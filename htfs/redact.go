@@ -0,0 +1,111 @@
+package htfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// query parameters that carry credentials, matched case-insensitively
+var sensitiveQueryParams = map[string]bool{
+	"x-amz-signature":      true,
+	"x-amz-credential":     true,
+	"x-amz-security-token": true,
+	"x-goog-signature":     true,
+	"x-goog-credential":    true,
+	"signature":            true,
+	"sig":                  true,
+	"token":                true,
+	"access_token":         true,
+	"key":                  true,
+	"api_key":              true,
+	"policy":               true,
+	"key-pair-id":          true,
+	"awsaccesskeyid":       true,
+	"googleaccessid":       true,
+}
+
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// RedactURL replaces credentials in a URL (signatures, tokens, passwords)
+// with a short hash of their value, so URLs can be told apart in logs
+// without being usable. Strings that don't parse as URLs are returned as-is.
+func RedactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return s
+	}
+
+	changed := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedValue(u.User.String()))
+			changed = true
+		}
+	}
+
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			tokens := strings.SplitN(param, "=", 2)
+			if len(tokens) != 2 {
+				continue
+			}
+			key, err := url.QueryUnescape(tokens[0])
+			if err != nil {
+				key = tokens[0]
+			}
+			if sensitiveQueryParams[strings.ToLower(key)] {
+				params[i] = tokens[0] + "=" + redactedValue(tokens[1])
+				changed = true
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+
+	if !changed {
+		return s
+	}
+	return u.String()
+}
+
+func redactedValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "REDACTED-" + hex.EncodeToString(sum[:4])
+}
+
+// redactURLs redacts all the URLs found in a piece of text
+func redactURLs(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	return urlPattern.ReplaceAllStringFunc(s, RedactURL)
+}
+
+// redactError redacts the URLs contained in *url.Error values along
+// err's chain of causes, which net/http returns for transport errors.
+func (f *File) redactError(err error) error {
+	if f.disableRedaction {
+		return err
+	}
+
+	type causer interface {
+		Cause() error
+	}
+	for e := err; e != nil; {
+		if ue, ok := e.(*url.Error); ok {
+			ue.URL = RedactURL(ue.URL)
+			e = ue.Err
+			continue
+		}
+
+		c, ok := e.(causer)
+		if !ok {
+			break
+		}
+		e = c.Cause()
+	}
+	return err
+}
@@ -0,0 +1,285 @@
+package htfs
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	goerrors "errors"
+
+	"github.com/pkg/errors"
+)
+
+// RedirectPolicy controls how a File follows HTTP redirects.
+type RedirectPolicy struct {
+	// MaxHops is the maximum number of redirects followed for a single
+	// request. Zero or less means no limit other than the client's own.
+	MaxHops int
+
+	// StripAuthAcrossHosts removes credentials (Authorization, Cookie, etc.)
+	// from requests that are redirected to a different host. Requests
+	// that go straight to a cached target (see CacheTarget) on another
+	// host than the original's or its subdomains never have them.
+	StripAuthAcrossHosts bool
+
+	// CacheTarget makes new connections go straight to wherever the
+	// last redirect landed, instead of going through the redirector again.
+	// The target is forgotten whenever the URL is renewed, when it expires
+	// (see TargetTTL), or as soon as a request to it fails.
+	CacheTarget bool
+
+	// TargetTTL is how long a cached redirect target may be used. If the
+	// target looks like a signed URL (S3, GCS, CloudFront), its own expiry
+	// is honored if it's sooner. Zero means "until the target expires".
+	TargetTTL time.Duration
+
+	// AllowedHosts restricts which hosts redirects may land on. Entries are
+	// either exact host names, or start with "*." to allow all subdomains.
+	// An empty list allows any host.
+	AllowedHosts []string
+
+	// AllowDowngrade allows redirects from https to plain http.
+	AllowDowngrade bool
+}
+
+// signed URLs are forgotten a little before they actually expire,
+// so we don't race against the clock.
+const redirectTargetExpiryMargin = 30 * time.Second
+
+// headers that should never be sent to a host the caller didn't choose
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Cookie2",
+	"WWW-Authenticate",
+}
+
+func isSensitiveHeader(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	for _, sensitive := range sensitiveHeaders {
+		if key == sensitive {
+			return true
+		}
+	}
+	return false
+}
+
+// stripsAuthTo returns true if credentials shouldn't be sent to
+// targetURL, a cached redirect target of currentURL. Whatever
+// StripAuthAcrossHosts says, that's like net/http does when following
+// redirects by default: only the same host and its subdomains get them.
+func (f *File) stripsAuthTo(targetURL string, currentURL string) bool {
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return true
+	}
+	current, err := url.Parse(currentURL)
+	if err != nil {
+		return true
+	}
+	if target.Host == current.Host {
+		return false
+	}
+	if f.redirectPolicy != nil && f.redirectPolicy.StripAuthAcrossHosts {
+		return true
+	}
+	return !isDomainOrSubdomain(hostAddr(targetURL), hostAddr(currentURL))
+}
+
+// isDomainOrSubdomain returns true if sub is parent, or a subdomain of it,
+// on the same port, like net/http's function of that name. Both are
+// "host:port" addresses.
+func isDomainOrSubdomain(sub string, parent string) bool {
+	if sub == "" || parent == "" {
+		return false
+	}
+	if sub == parent {
+		return true
+	}
+	if strings.HasPrefix(parent, "[") {
+		// IPv6 literals have no subdomains
+		return false
+	}
+	return strings.HasSuffix(sub, "."+parent)
+}
+
+// ErrTooManyRedirects is returned when a request exceeds RedirectPolicy.MaxHops
+var ErrTooManyRedirects = goerrors.New("too many redirects")
+
+// ErrRedirectNotAllowed is returned when a redirect goes to a host that's
+// not in RedirectPolicy.AllowedHosts, or downgrades from https to http.
+var ErrRedirectNotAllowed = goerrors.New("redirect not allowed by policy")
+
+// clientWithRedirectPolicy returns a shallow copy of client that enforces
+// the File's redirect policy, on top of the client's own CheckRedirect.
+func (f *File) clientWithRedirectPolicy(client *http.Client) *http.Client {
+	policy := f.redirectPolicy
+	upstream := client.CheckRedirect
+
+	wrapped := *client
+	wrapped.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if policy.MaxHops > 0 && len(via) > policy.MaxHops {
+			return errors.Wrapf(ErrTooManyRedirects, "stopped after %d redirects", policy.MaxHops)
+		}
+
+		prev := via[len(via)-1]
+		if !policy.AllowDowngrade && prev.URL.Scheme == "https" && req.URL.Scheme != "https" {
+			return errors.Wrapf(ErrRedirectNotAllowed, "refusing to downgrade from https to %s", req.URL.Scheme)
+		}
+
+		if !policy.hostAllowed(req.URL.Hostname()) {
+			return errors.Wrapf(ErrRedirectNotAllowed, "host %s is not allowed", req.URL.Hostname())
+		}
+
+		if upstream != nil {
+			err := upstream(req, via)
+			if err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			// mirror net/http's default policy
+			return errors.Wrapf(ErrTooManyRedirects, "stopped after 10 redirects")
+		}
+
+		if policy.StripAuthAcrossHosts && req.URL.Host != via[0].URL.Host {
+			for _, key := range sensitiveHeaders {
+				req.Header.Del(key)
+			}
+		}
+
+		return nil
+	}
+	return &wrapped
+}
+
+func (policy *RedirectPolicy) hostAllowed(host string) bool {
+	if len(policy.AllowedHosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	for _, allowed := range policy.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// requestTargetURL returns the URL new requests should be made to:
+// the cached redirect target if there is one, the current URL otherwise.
+func (f *File) requestTargetURL() string {
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	if f.redirectTarget != "" {
+		if !f.redirectTargetExpiry.IsZero() && f.clock.Now().After(f.redirectTargetExpiry) {
+			f.log2("(Redirect) cached target expired")
+			f.redirectTarget = ""
+		} else {
+			return f.redirectTarget
+		}
+	}
+	return f.currentURL
+}
+
+// forgetRedirectTarget is called when a request to the cached redirect
+// target fails, so the next one goes through the redirector again.
+func (f *File) forgetRedirectTarget(target string) {
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	if f.redirectTarget == target {
+		f.redirectTarget = ""
+	}
+}
+
+// recordEffectiveURL is called after every successful request with the
+// URL that request ended up at, after following redirects.
+func (f *File) recordEffectiveURL(requested string, effective *url.URL) {
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	f.effectiveURL = effective
+
+	if f.redirectPolicy == nil || !f.redirectPolicy.CacheTarget {
+		return
+	}
+
+	effectiveStr := effective.String()
+	if requested == f.currentURL && effectiveStr != requested && f.redirectTarget == "" {
+		f.log2("(Redirect) caching target %s", effective.Host)
+		f.redirectTarget = effectiveStr
+		f.redirectTargetExpiry = redirectTargetExpiry(effective, f.clock.Now(), f.redirectPolicy.TargetTTL)
+	}
+}
+
+// redirectTargetExpiry returns when a redirect target should stop being
+// used, or the zero time if it can be used until it fails.
+func redirectTargetExpiry(u *url.URL, now time.Time, ttl time.Duration) time.Time {
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = now.Add(ttl)
+	}
+
+	signed := signedURLExpiry(u)
+	if !signed.IsZero() {
+		signed = signed.Add(-redirectTargetExpiryMargin)
+		if expiry.IsZero() || signed.Before(expiry) {
+			expiry = signed
+		}
+	}
+	return expiry
+}
+
+// signedURLExpiry recognizes common signed URL schemes and returns
+// their expiry time, or the zero time if none was found.
+func signedURLExpiry(u *url.URL) time.Time {
+	q := u.Query()
+
+	// AWS SigV4 & GCS V4: a start date and a validity in seconds
+	for _, prefix := range []string{"X-Amz-", "X-Goog-"} {
+		date := q.Get(prefix + "Date")
+		expires := q.Get(prefix + "Expires")
+		if date == "" || expires == "" {
+			continue
+		}
+
+		start, err := time.Parse("20060102T150405Z", date)
+		if err != nil {
+			continue
+		}
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			continue
+		}
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	// AWS SigV2, GCS V2, CloudFront: a unix timestamp
+	if expires := q.Get("Expires"); expires != "" {
+		ts, err := strconv.ParseInt(expires, 10, 64)
+		if err == nil {
+			return time.Unix(ts, 0)
+		}
+	}
+
+	return time.Time{}
+}
+
+// EffectiveURL returns the URL the last successful request
+// ended up at, after following redirects.
+func (f *File) EffectiveURL() *url.URL {
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+
+	return f.effectiveURL
+}
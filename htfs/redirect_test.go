@@ -0,0 +1,68 @@
+package htfs
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RedirectTargetExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	mustParse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		assert.NoError(err)
+		return u
+	}
+
+	now := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	plain := mustParse("https://cdn.example.org/file.zip")
+	assert.True(redirectTargetExpiry(plain, now, 0).IsZero())
+	assert.Equal(now.Add(time.Minute), redirectTargetExpiry(plain, now, time.Minute))
+
+	amz := mustParse("https://bucket.s3.amazonaws.com/file.zip?X-Amz-Date=20200301T115000Z&X-Amz-Expires=900&X-Amz-Signature=abc")
+	assert.Equal(
+		time.Date(2020, time.March, 1, 12, 5, 0, 0, time.UTC).Add(-redirectTargetExpiryMargin),
+		redirectTargetExpiry(amz, now, 0))
+	// the TTL wins if it's sooner
+	assert.Equal(now.Add(time.Minute), redirectTargetExpiry(amz, now, time.Minute))
+
+	cloudfront := mustParse("https://d111111abcdef8.cloudfront.net/file.zip?Expires=1583064000&Signature=abc")
+	assert.Equal(time.Unix(1583064000, 0).Add(-redirectTargetExpiryMargin), redirectTargetExpiry(cloudfront, now, 0))
+}
+
+func Test_RedirectAllowedHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	open := &RedirectPolicy{}
+	assert.True(open.hostAllowed("anything.example.org"))
+
+	policy := &RedirectPolicy{
+		AllowedHosts: []string{"itch.io", "*.itch.zone"},
+	}
+	assert.True(policy.hostAllowed("itch.io"))
+	assert.True(policy.hostAllowed("ITCH.io"))
+	assert.False(policy.hostAllowed("evil-itch.io"))
+	assert.True(policy.hostAllowed("cdn.itch.zone"))
+	assert.True(policy.hostAllowed("a.b.itch.zone"))
+	assert.False(policy.hostAllowed("itch.zone"))
+	assert.False(policy.hostAllowed("notitch.zone"))
+}
+
+func Test_RedirectStripsAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &File{redirectPolicy: &RedirectPolicy{CacheTarget: true}}
+	assert.False(f.stripsAuthTo("https://example.org/a?sig=1", "https://example.org/b"))
+	assert.False(f.stripsAuthTo("https://cdn.example.org/a", "https://example.org/b"))
+	assert.True(f.stripsAuthTo("https://cdn.example.net/a", "https://example.org/b"))
+	assert.True(f.stripsAuthTo("https://evilexample.org/a", "https://example.org/b"))
+	assert.True(f.stripsAuthTo("http://example.org:8080/a", "https://example.org/b"))
+
+	f.redirectPolicy.StripAuthAcrossHosts = true
+	assert.False(f.stripsAuthTo("https://example.org/a?sig=1", "https://example.org/b"))
+	assert.True(f.stripsAuthTo("https://cdn.example.org/a", "https://example.org/b"))
+}
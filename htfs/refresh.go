@@ -0,0 +1,61 @@
+package htfs
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Refresh asks the server whether the remote file changed since the File
+// was opened (its size, ETag, or Last-Modified date), with a conditional
+// request when possible, and returns true if it did.
+//
+// The File itself isn't updated: it keeps its size and headers, and bytes
+// it already holds may be from the old version. To read the new one, open
+// another File.
+func (f *File) Refresh() (bool, error) {
+	err := f.ensureOpen()
+	if err != nil {
+		return false, errors.Wrapf(err, "in File.Refresh")
+	}
+
+	if f.local != nil {
+		return f.refreshLocal()
+	}
+
+	v := newCacheValidators("", f.size, f.name, f.header)
+	res, err := f.conditionalRequest("Refresh", v)
+	if err != nil {
+		return false, errors.Wrapf(normalizeError(err), "in File.Refresh")
+	}
+	if res.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+
+	size, err := probedSize(res.Header, res.StatusCode, res.ContentLength)
+	if err != nil {
+		return false, errors.Wrapf(err, "in File.Refresh")
+	}
+	changed := !v.matches(size, res.Header)
+	if changed {
+		f.log("(Refresh) remote file changed, size %d => %d", f.size, size)
+	}
+	return changed, nil
+}
+
+// refreshLocal checks local files, data URIs never change
+func (f *File) refreshLocal() (bool, error) {
+	file, ok := f.local.(*os.File)
+	if !ok {
+		return false, nil
+	}
+
+	// by path: republishing usually renames a new file over the old one
+	stats, err := os.Stat(file.Name())
+	if err != nil {
+		return false, errors.Wrapf(err, "in File.Refresh")
+	}
+	lastModified := stats.ModTime().UTC().Format(http.TimeFormat)
+	return stats.Size() != f.size || lastModified != f.headerValue("last-modified"), nil
+}
@@ -0,0 +1,110 @@
+package htfs
+
+import (
+	"net/url"
+	"time"
+)
+
+// A RenewalTrigger tells why a File got a new URL
+type RenewalTrigger int
+
+const (
+	// RenewalObserved means the server answered a request in a way
+	// NeedsRenewalFunc recognized as an expired URL, like HTTP 403.
+	RenewalObserved RenewalTrigger = iota
+	// RenewalPredicted means the URL was signed with an expiry date
+	// (see RedirectPolicy.TargetTTL for the schemes recognized) that was
+	// about to pass, so it was renewed before making a request with it.
+	RenewalPredicted
+)
+
+func (rt RenewalTrigger) String() string {
+	switch rt {
+	case RenewalObserved:
+		return "observed"
+	case RenewalPredicted:
+		return "predicted"
+	default:
+		return "unknown"
+	}
+}
+
+// RenewalInfo describes a URL renewal, see Settings.OnRenewal
+type RenewalInfo struct {
+	Trigger RenewalTrigger
+	// Offset is the position in the file the request needing a new URL was for
+	Offset int64
+	// Duration is how long getting a new URL took, retries included
+	Duration time.Duration
+	// Attempts is the number of times GetURLFunc was called
+	Attempts int
+	// Err is nil if the File got a new URL
+	Err error
+}
+
+// predictedRenewalMargin is how long before their expiry
+// signed URLs are renewed
+const predictedRenewalMargin = 30 * time.Second
+
+// urlExpiry returns when a signed URL expires, or the zero time
+func urlExpiry(urlStr string) time.Time {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return time.Time{}
+	}
+	return signedURLExpiry(u)
+}
+
+// renewIfExpiring gets a new URL ahead of a request if the current one
+// is about to expire. If it fails, the request is made anyway: the URL
+// may still be good, and if not, it'll be renewed like any other.
+func (f *File) renewIfExpiring(offset int64) {
+	f.urlMutex.Lock()
+	expiry := f.currentURLExpiry
+	f.urlMutex.Unlock()
+	if expiry.IsZero() || f.clock.Now().Add(predictedRenewalMargin).Before(expiry) {
+		return
+	}
+
+	// one renewal is enough for concurrent requests
+	f.renewalMutex.Lock()
+	defer f.renewalMutex.Unlock()
+
+	f.urlMutex.Lock()
+	stale := f.currentURLExpiry.Equal(expiry)
+	f.urlMutex.Unlock()
+	if !stale {
+		return
+	}
+
+	f.log("[%9d-%9d] (Renew) URL expires at %s, renewing ahead", offset, offset, expiry.Format(time.RFC3339))
+	err := f.renewURLWithRetries(offset, RenewalPredicted)
+
+	f.urlMutex.Lock()
+	defer f.urlMutex.Unlock()
+	if err != nil || !f.currentURLExpiry.After(expiry) {
+		// don't try again for every request
+		f.currentURLExpiry = time.Time{}
+	}
+}
+
+// renewExpired renews the URL after the server rejected expiredURL. When
+// several requests fail at once, whichever gets here first renews it, and
+// the others just retry with the URL it got.
+func (f *File) renewExpired(expiredURL string, offset int64) error {
+	f.renewalMutex.Lock()
+	defer f.renewalMutex.Unlock()
+
+	if f.getCurrentURL() != expiredURL {
+		f.log("[%9d-%9d] (Renew) already renewed, retrying", offset, offset)
+		return nil
+	}
+	return f.renewURLWithRetries(offset, RenewalObserved)
+}
+
+func (f *File) notifyRenewal(info RenewalInfo) {
+	if f.onRenewal == nil {
+		return
+	}
+	f.onRenewal(info)
+}
@@ -0,0 +1,315 @@
+package htfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+)
+
+// withRetries calls try until it succeeds, renewing the URL whenever
+// the server tells us it has expired, and retrying temporary errors
+// with exponential backoff. op is only used for logging. try is passed
+// the attempt number, starting at 1.
+func (f *File) withRetries(offset int64, op string, try func(attempt int) error) error {
+	retryCtx := f.newRetryContext()
+	f.hookRetries(retryCtx, op, offset)
+	renewalTries := 0
+	attempt := 0
+
+	for retryCtx.ShouldTry() {
+		attempt++
+		err := try(attempt)
+		if err != nil {
+			if nre, ok := errors.Cause(err).(*needsRenewalError); ok {
+				renewalTries++
+				if renewalTries >= maxRenewals {
+					return errors.Wrapf(ErrTooManyRenewals, "in %s, exceeded maxRenewals", op)
+				}
+				f.log("[%9d-%9d] (%s) renewing on %v", offset, offset, op, err)
+
+				err = f.renewExpired(nre.url, offset)
+				if err != nil {
+					// if we reach this point, we've failed to generate
+					// a download URL a bunch of times in a row
+					return errors.Wrapf(err, "in %s (failed to generate URLs a few times)", op)
+				}
+				continue
+			} else if retryCtx.IsRetriable(err) {
+				if !f.retryBudget.withdraw() {
+					return errors.Wrapf(withAttempt(attempt, err), "in %s, retry budget exhausted", op)
+				}
+				f.log("[%9d-%9d] (%s) retrying %v", offset, offset, op, err)
+				retryCtx.Retry(err)
+				continue
+			} else {
+				return errors.Wrapf(withAttempt(attempt, err), "in %s, non-retriable error", op)
+			}
+		}
+
+		f.retryBudget.deposit()
+		return nil
+	}
+
+	if err := retryCtx.Err(); err != nil {
+		return errors.Wrapf(withAttempt(attempt, err), "in %s, cancelled", op)
+	}
+	return errors.Wrapf(withAttempt(attempt, retryCtx.LastError), "in %s, exhausted retry context", op)
+}
+
+func (f *File) renewURLWithRetries(offset int64, trigger RenewalTrigger) (err error) {
+	info := RenewalInfo{Trigger: trigger, Offset: offset}
+	startTime := f.clock.Now()
+	defer func() {
+		info.Duration = since(f.clock, startTime)
+		info.Err = err
+		f.notifyRenewal(info)
+	}()
+
+	renewRetryCtx := f.newRetryContext()
+	f.hookRetries(renewRetryCtx, "Renew", offset)
+
+	for renewRetryCtx.ShouldTry() {
+		atomic.AddInt64(&f.stats.renews, 1)
+		info.Attempts++
+		_, err := f.renewURL()
+		if err != nil {
+			if renewRetryCtx.IsRetriable(err) {
+				if !f.retryBudget.withdraw() {
+					return errors.Wrapf(err, "in File.renewURLWithRetries, retry budget exhausted")
+				}
+				f.log("[%9d-%9d] (Renew) retrying %v", offset, offset, err)
+				renewRetryCtx.Retry(err)
+				continue
+			} else {
+				f.log("[%9d-%9d] (Renew) bailing on %v", offset, offset, err)
+				return errors.Wrapf(err, "in File.renewURLWithRetries, non-retriable error")
+			}
+		}
+
+		f.log("[%9d-%9d] (Renew) got a new URL", offset, offset)
+		return nil
+	}
+	if err := renewRetryCtx.Err(); err != nil {
+		return errors.Wrapf(err, "in File.renewURLWithRetries, cancelled")
+	}
+	return errors.Wrapf(renewRetryCtx.LastError, "in File.renewURLWithRetries, exhausted retry context")
+}
+
+// rangeRequest describes a single attempt at a ranged HTTP request
+type rangeRequest struct {
+	// op is what the request is for, for logging purposes
+	op        string
+	method    string
+	byteRange string
+	offset    int64
+	attempt   int
+	// header holds additional headers for this request only
+	header http.Header
+	// probe is set for requests that find out the size of the
+	// file, so it isn't checked against their response.
+	probe bool
+	// ctx, if set, can be used to cancel the request. It
+	// should derive from the File's own context.
+	ctx context.Context
+	// conn is the ID of the conn the request is for, if any,
+	// for the pprof labels of goroutines doing it.
+	conn string
+	// close asks for the TCP connection to be closed after the
+	// response instead of reused, see Settings.MaxBytesPerConn
+	close bool
+}
+
+// doRangeRequest performs a single HTTP request against the current URL
+// with the given Range header. Non-2XX responses are turned into errors,
+// including *needsRenewalError when the URL has expired. On success, the
+// caller is responsible for closing the response body.
+func (f *File) doRangeRequest(rr rangeRequest) (*http.Response, error) {
+	f.renewIfExpiring(rr.offset)
+	currentURL := f.getCurrentURL()
+	targetURL := f.requestTargetURL()
+
+	res, err := f.doRangeRequestTo(targetURL, currentURL, rr)
+	if err != nil && targetURL != currentURL {
+		// the cached redirect target failed us: it may have expired, or
+		// the CDN node may be unhealthy. Go through the redirector again.
+		f.log("[%9d-%9d] (Redirect) cached target failed, forgetting it: %v", rr.offset, rr.offset, err)
+		f.forgetRedirectTarget(targetURL)
+		return f.doRangeRequestTo(currentURL, currentURL, rr)
+	}
+	return res, err
+}
+
+func (f *File) doRangeRequestTo(targetURL string, currentURL string, rr rangeRequest) (*http.Response, error) {
+	req, err := http.NewRequest(rr.method, targetURL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while creating new %s request", rr.method)
+	}
+	parent := rr.ctx
+	if parent == nil {
+		parent = f.ctx
+	}
+	if f.proxy != nil {
+		parent = timeout.WithProxy(parent, f.proxy)
+	}
+	timer := newRequestTimer(parent, f.clock)
+	req = req.WithContext(timer.ctx)
+	req = f.withPhaseTrace(req)
+	req.Close = rr.close
+	if f.host != "" && targetURL == currentURL {
+		// cached redirect targets are other hosts
+		req.Host = f.host
+	}
+
+	stripAuth := targetURL != currentURL && f.stripsAuthTo(targetURL, currentURL)
+	for key, values := range f.extraHeader {
+		if stripAuth && isSensitiveHeader(key) {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	for key, values := range rr.header {
+		req.Header[key] = values
+	}
+
+	requestedURL := req.URL
+	if rr.byteRange != "" {
+		err = f.setRange(req, rr.byteRange)
+		if err != nil {
+			timer.cancel()
+			return nil, errors.Wrapf(err, "while setting range of %s request", rr.method)
+		}
+	}
+	f.setAcceptEncoding(req)
+
+	entry := f.newAccessLogEntry(req, rr)
+	stopHeaderTimer := timer.arm("response header", f.responseHeaderTimeout)
+	res, err := f.roundTrip(req, rr)
+	stopHeaderTimer()
+	if err != nil {
+		err = f.redactError(timer.err(err))
+		timer.cancel()
+		entry.finish(0, 0, err)
+		return nil, errors.Wrapf(err, "while doing %s request", rr.method)
+	}
+	res.Body = &stallBody{ReadCloser: res.Body, timer: timer, timeout: f.stallTimeout}
+	err = f.adaptResponse(res, rr.byteRange)
+	if err != nil {
+		res.Body.Close()
+		entry.finish(res.StatusCode, 0, err)
+		return nil, errors.Wrapf(err, "while adapting response to %s", rr.byteRange)
+	}
+	if req.URL != requestedURL {
+		// what the RangeStrategy added to the URL isn't
+		// part of the remote file's, nor of redirect targets
+		shown := *res.Request
+		if res.Request.URL == req.URL {
+			shown.URL = requestedURL
+		} else {
+			shown.URL = f.rangeStrategy.StripRange(res.Request.URL)
+		}
+		res.Request = &shown
+	}
+	entry.gotResponse(res.StatusCode)
+
+	if res.StatusCode == 200 && rr.offset > 0 {
+		entry.finish(res.StatusCode, 0, nil)
+		defer res.Body.Close()
+		se := &ServerError{
+			Host:       req.Host,
+			Message:    "HTTP Range header not supported",
+			Code:       ServerErrorCodeNoRangeSupport,
+			StatusCode: res.StatusCode,
+		}
+		return nil, errors.Wrapf(se, "got HTTP 200 for non-zero offset")
+	}
+
+	if res.StatusCode == http.StatusNotModified && isConditional(req.Header) {
+		entry.finish(res.StatusCode, 0, nil)
+		f.recordEffectiveURL(currentURL, res.Request.URL)
+		return res, nil
+	}
+
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		if rr.probe {
+			// it tells us the size, see probedSize
+			entry.finish(res.StatusCode, 0, nil)
+			res.Body.Close()
+			res.Body = http.NoBody
+			f.recordEffectiveURL(currentURL, res.Request.URL)
+			return res, nil
+		}
+		defer res.Body.Close()
+		entry.finish(res.StatusCode, 0, nil)
+		rnse := &RangeNotSatisfiableError{
+			Host:       req.Host,
+			Offset:     rr.offset,
+			Size:       unsatisfiedRangeSize(res.Header.Get("content-range")),
+			header:     res.Header,
+			requestURL: res.Request.URL,
+		}
+		return nil, errors.Wrapf(rnse, "got HTTP 416")
+	}
+
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			body = []byte("could not read error body")
+		}
+		entry.finish(res.StatusCode, int64(len(body)), nil)
+
+		if f.needsRenewal(res, body) {
+			return nil, &needsRenewalError{url: currentURL}
+		}
+
+		se := &ServerError{
+			Host:       req.Host,
+			Message:    fmt.Sprintf("HTTP %d: %v", res.StatusCode, string(body)),
+			StatusCode: res.StatusCode,
+		}
+		return nil, errors.Wrapf(se, "got HTTP non-2XX")
+	}
+
+	res.Body = entry.wrapBody(res.Body, res.StatusCode)
+
+	err = f.checkContentEncoding(req, res)
+	if err != nil {
+		res.Body.Close()
+		return nil, errors.Wrapf(err, "got compressed response")
+	}
+
+	if res.StatusCode == 206 && !rr.probe && res.Header.Get("content-range") != "" {
+		_, _, total, perr := parseContentRange(res.Header.Get("content-range"))
+		if perr == nil {
+			err = f.checkTotal(req.Host, total)
+			if err != nil {
+				res.Body.Close()
+				return nil, errors.Wrapf(err, "got mismatched content-range")
+			}
+		}
+	}
+
+	f.recordEffectiveURL(currentURL, res.Request.URL)
+	return res, nil
+}
+
+// checkTotal returns a *SizeMismatchError if a server reported a total
+// size other than the one the File was opened with.
+func (f *File) checkTotal(host string, total int64) error {
+	if total < 0 || !f.knownSize() || total == f.size {
+		return nil
+	}
+	return &SizeMismatchError{Host: host, Expected: f.size, Actual: total}
+}
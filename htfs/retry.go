@@ -0,0 +1,51 @@
+package htfs
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/itchio/httpkit/retrycontext"
+)
+
+// RetryInfo describes a retry htfs is about to do,
+// see Settings.OnRetry.
+type RetryInfo struct {
+	// Op is what was being done, for example "Connect", "Probe", "Renew",
+	// or "Read" when a connection was lost mid-read.
+	Op string
+	// Offset is the position in the file the operation was for
+	Offset int64
+	// Attempt is the number of the attempt that just failed, starting at 1
+	Attempt int
+	// Err is the error being retried
+	Err error
+	// Delay is how long htfs waits before trying again
+	Delay time.Duration
+}
+
+// hookRetries makes retryCtx count its retries and report them to
+// OnRetry, in addition to whatever callback its settings already had.
+func (f *File) hookRetries(retryCtx *retrycontext.Context, op string, offset int64) {
+	previous := retryCtx.Settings.OnRetry
+	retryCtx.Settings.OnRetry = func(info retrycontext.RetryInfo) {
+		if previous != nil {
+			previous(info)
+		}
+		f.notifyRetry(RetryInfo{
+			Op:      op,
+			Offset:  offset,
+			Attempt: info.Tries,
+			Err:     info.Err,
+			Delay:   info.Delay,
+		})
+	}
+}
+
+func (f *File) notifyRetry(info RetryInfo) {
+	atomic.AddInt64(&f.stats.retries, 1)
+	f.recordSuppressed(info)
+	if f.onRetry == nil {
+		return
+	}
+	f.onRetry(info)
+}
@@ -0,0 +1,289 @@
+package htfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// cacheValidators are what a Cache remembers about a remote file, so
+// that the next File opening it can check whether the blocks it holds
+// are still current, with a conditional request.
+type cacheValidators struct {
+	// FileKey is the key the blocks were stored under
+	FileKey string
+	Size    int64
+	Name    string
+	// Header holds the ETag, Last-Modified, and a few other headers
+	// from the response the blocks were fetched after.
+	Header http.Header
+}
+
+// validatorHeaders are the headers kept in cacheValidators, so that a
+// File revalidated with a 304 behaves like one that was probed.
+var validatorHeaders = []string{
+	"Etag",
+	"Last-Modified",
+	"Content-Type",
+	"Content-Disposition",
+	"Accept-Ranges",
+}
+
+func newCacheValidators(fileKey string, size int64, name string, header http.Header) *cacheValidators {
+	v := &cacheValidators{
+		FileKey: fileKey,
+		Size:    size,
+		Name:    name,
+		Header:  make(http.Header),
+	}
+	for _, key := range validatorHeaders {
+		if value := header.Get(key); value != "" {
+			v.Header.Set(key, value)
+		}
+	}
+	return v
+}
+
+// usable returns true if the server gave us something to revalidate with
+func (v *cacheValidators) usable() bool {
+	return v.Header.Get("etag") != "" || v.Header.Get("last-modified") != ""
+}
+
+// matches returns true if a response to a non-conditional request
+// describes the same version of the file. Without an ETag or a
+// Last-Modified date to compare, only the size can tell.
+func (v *cacheValidators) matches(size int64, header http.Header) bool {
+	if size != v.Size {
+		return false
+	}
+	if etag := v.Header.Get("etag"); etag != "" {
+		return header.Get("etag") == etag
+	}
+	if lastModified := v.Header.Get("last-modified"); lastModified != "" {
+		return header.Get("last-modified") == lastModified
+	}
+	return true
+}
+
+func (v *cacheValidators) equal(other *cacheValidators) bool {
+	if v.FileKey != other.FileKey || v.Size != other.Size || v.Name != other.Name {
+		return false
+	}
+	for _, key := range validatorHeaders {
+		if v.Header.Get(key) != other.Header.Get(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheResourceKey identifies a remote file within a Cache,
+// regardless of its version, as fetched with credentials,
+// see credentialsKey.
+func cacheResourceKey(urlStr string, credentials string) string {
+	h := sha256.New()
+	h.Write([]byte(urlStr))
+	if credentials != "" {
+		fmt.Fprintf(h, "\x00%s", credentials)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+func (c *Cache) getValidators(resourceKey string) *cacheValidators {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.validators[resourceKey]
+}
+
+func (c *Cache) setValidators(resourceKey string, v *cacheValidators) {
+	c.mu.Lock()
+	if old, ok := c.validators[resourceKey]; ok && old.equal(v) {
+		c.mu.Unlock()
+		return
+	}
+	c.validators[resourceKey] = v
+	c.mu.Unlock()
+
+	// if this fails, the next open will just probe again
+	c.store.putValidators(resourceKey, v)
+}
+
+func (c *Cache) removeValidators(resourceKey string) {
+	c.mu.Lock()
+	_, ok := c.validators[resourceKey]
+	delete(c.validators, resourceKey)
+	c.mu.Unlock()
+
+	if ok {
+		c.store.putValidators(resourceKey, nil)
+	}
+}
+
+// invalidate drops all blocks stored under fileKey, because
+// the remote file has changed since they were fetched.
+func (c *Cache) invalidate(fileKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.entries {
+		if e.owner == fileKey {
+			c.stats.Invalidated++
+			c.remove(e)
+		}
+	}
+}
+
+// revalidate replaces the initial request when the Cache already holds
+// blocks of the remote file: it asks whether they're still current with
+// If-None-Match and If-Modified-Since. On 304, the File is set up from
+// what the Cache remembers. Otherwise, the response serves as a probe,
+// and the stale blocks are dropped.
+func (f *File) revalidate(v *cacheValidators) error {
+	res, err := f.conditionalRequest("Revalidate", v)
+	if err != nil {
+		return errors.Wrapf(normalizeError(err), "htfs.Open (revalidating cached blocks)")
+	}
+
+	if res.StatusCode == http.StatusNotModified {
+		f.log("(Revalidate) cached blocks are current")
+		f.size = v.Size
+		f.name = v.Name
+		f.requestURL = res.Request.URL
+		f.header = make(http.Header)
+		for key, values := range v.Header {
+			f.header[key] = values
+		}
+		return nil
+	}
+
+	err = f.applyProbe(res.Header, res.Request.URL, res.StatusCode, res.ContentLength)
+	if err != nil {
+		return err
+	}
+	if !v.matches(f.size, f.header) {
+		f.log("(Revalidate) remote file changed, dropping cached blocks")
+		f.blocks.cache.invalidate(v.FileKey)
+	}
+	return nil
+}
+
+// conditionalRequest asks for the first byte of the remote file (or its
+// headers, with ProbeHead), unless it still matches v. The response body
+// is closed already. Files asking the same at the same time share it,
+// see sharedProbe.
+func (f *File) conditionalRequest(op string, v *cacheValidators) (*http.Response, error) {
+	method, byteRange := "GET", "bytes=0-0"
+	if f.probeStrategy == ProbeHead {
+		method, byteRange = "HEAD", ""
+	}
+
+	header := make(http.Header)
+	if etag := v.Header.Get("etag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lm := v.Header.Get("last-modified"); lm != "" {
+		header.Set("If-Modified-Since", lm)
+	}
+
+	return f.sharedProbe(op, method, byteRange, header)
+}
+
+// rememberValidators records what the File was opened with, so
+// that later Files can revalidate the blocks it caches.
+func (f *File) rememberValidators(resourceKey string) {
+	v := newCacheValidators(f.blocks.fileKey, f.size, f.name, f.header)
+	if !v.usable() {
+		f.blocks.cache.removeValidators(resourceKey)
+		return
+	}
+	f.blocks.cache.setValidators(resourceKey, v)
+}
+
+// isConditional returns true if a request would be answered
+// with 304 when the remote file is unchanged.
+func isConditional(header http.Header) bool {
+	return header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != ""
+}
+
+const diskValidatorsSuffix = ".val"
+
+func (ds *diskStore) validatorsPath(key string) string {
+	return filepath.Join(ds.dir, key+diskValidatorsSuffix)
+}
+
+// putValidators stores v, or removes what was stored under key if v is nil
+func (ds *diskStore) putValidators(key string, v *cacheValidators) error {
+	if v == nil {
+		err := os.Remove(ds.validatorsPath(key))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// write then rename, so readers never see a partial file
+	tmp, err := ioutil.TempFile(ds.dir, key+".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = tmp.Write(contents)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ds.validatorsPath(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// loadValidators reads the validators stored in the directory.
+// Unreadable ones are skipped: the file will be probed instead.
+func (ds *diskStore) loadValidators() (map[string]*cacheValidators, error) {
+	infos, err := ioutil.ReadDir(ds.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	res := make(map[string]*cacheValidators)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, diskValidatorsSuffix) {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(ds.dir, name))
+		if err != nil {
+			continue
+		}
+		v := &cacheValidators{}
+		if json.Unmarshal(contents, v) != nil || v.Header == nil {
+			continue
+		}
+		res[strings.TrimSuffix(name, diskValidatorsSuffix)] = v
+	}
+	return res, nil
+}
+
+func (ms *memoryStore) putValidators(key string, v *cacheValidators) error {
+	// the Cache itself remembers them for as long as they're useful
+	return nil
+}
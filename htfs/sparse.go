@@ -0,0 +1,310 @@
+package htfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// backingUnitSize is the granularity at which the presence
+// of data in a backing file is tracked.
+const backingUnitSize int64 = 64 * 1024
+
+var backingMapMagic = []byte("HTFSMAP2")
+
+// sparseBacking mirrors every byte fetched from the network into a sparse
+// local file, at its real offset. A bitmap records which units are fully
+// present, and is persisted next to the backing file, so partially-read files
+// become partially-downloaded files.
+type sparseBacking struct {
+	mu sync.Mutex
+
+	file     *os.File
+	mapPath  string
+	size     int64
+	unitSize int64
+	// etag and lastModified are those of the version of the remote
+	// file the bytes are from, saved with the bitmap
+	etag         string
+	lastModified string
+	bitmap       []byte
+	// written ranges of units that aren't complete yet
+	partial map[int64][]Range
+}
+
+// openSparseBacking opens the backing file at path, for the version of the
+// remote file with the given size, ETag, and Last-Modified date. What it
+// holds of another version is discarded.
+func openSparseBacking(path string, size int64, etag string, lastModified string) (*sparseBacking, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	numUnits := (size + backingUnitSize - 1) / backingUnitSize
+	sb := &sparseBacking{
+		file:         file,
+		mapPath:      path + ".map",
+		size:         size,
+		unitSize:     backingUnitSize,
+		etag:         etag,
+		lastModified: lastModified,
+		bitmap:       make([]byte, (numUnits+7)/8),
+		partial:      make(map[int64][]Range),
+	}
+
+	if !sb.loadMap() {
+		// either there was no map, or it was for another version of the file
+		err = file.Truncate(0)
+		if err != nil {
+			file.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	err = file.Truncate(size)
+	if err != nil {
+		file.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return sb, nil
+}
+
+func (sb *sparseBacking) loadMap() bool {
+	data, err := ioutil.ReadFile(sb.mapPath)
+	if err != nil {
+		return false
+	}
+
+	headerLen := len(backingMapMagic) + 16
+	if len(data) < headerLen || !bytes.Equal(data[:len(backingMapMagic)], backingMapMagic) {
+		return false
+	}
+
+	header := data[len(backingMapMagic):headerLen]
+	if int64(binary.LittleEndian.Uint64(header[0:8])) != sb.unitSize {
+		return false
+	}
+	if int64(binary.LittleEndian.Uint64(header[8:16])) != sb.size {
+		return false
+	}
+
+	rest := data[headerLen:]
+	etag, rest, ok := readMapString(rest)
+	if !ok {
+		return false
+	}
+	lastModified, rest, ok := readMapString(rest)
+	if !ok || len(rest) != len(sb.bitmap) {
+		return false
+	}
+	// like cacheValidators.matches, without validators of
+	// its own (see Settings.Size), the File goes by size
+	if sb.etag != "" && etag != sb.etag {
+		return false
+	}
+	if sb.etag == "" && sb.lastModified != "" && lastModified != sb.lastModified {
+		return false
+	}
+
+	copy(sb.bitmap, rest)
+	return true
+}
+
+// readMapString reads a string written by writeMapString from
+// the start of data, and returns it along with what follows
+func readMapString(data []byte) (string, []byte, bool) {
+	if len(data) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+n {
+		return "", nil, false
+	}
+	return string(data[2 : 2+n]), data[2+n:], true
+}
+
+func writeMapString(buf *bytes.Buffer, s string) {
+	if len(s) > 0xffff {
+		// no validator is that long, treat it as missing
+		s = ""
+	}
+	binary.Write(buf, binary.LittleEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+// saveMap persists the presence bitmap
+func (sb *sparseBacking) saveMap() error {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	buf.Write(backingMapMagic)
+	binary.Write(buf, binary.LittleEndian, uint64(sb.unitSize))
+	binary.Write(buf, binary.LittleEndian, uint64(sb.size))
+	writeMapString(buf, sb.etag)
+	writeMapString(buf, sb.lastModified)
+	buf.Write(sb.bitmap)
+
+	return errors.WithStack(ioutil.WriteFile(sb.mapPath, buf.Bytes(), 0644))
+}
+
+func (sb *sparseBacking) hasUnit(unit int64) bool {
+	return sb.bitmap[unit/8]&(1<<uint(unit%8)) != 0
+}
+
+func (sb *sparseBacking) unitLength(unit int64) int64 {
+	length := sb.unitSize
+	if (unit+1)*sb.unitSize > sb.size {
+		length = sb.size - unit*sb.unitSize
+	}
+	return length
+}
+
+// write stores data fetched from the network at offset
+func (sb *sparseBacking) write(data []byte, offset int64) error {
+	if offset >= sb.size {
+		return nil
+	}
+	if offset+int64(len(data)) > sb.size {
+		data = data[:sb.size-offset]
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	_, err := sb.file.WriteAt(data, offset)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	end := offset + int64(len(data))
+	for unit := offset / sb.unitSize; unit*sb.unitSize < end; unit++ {
+		if sb.hasUnit(unit) {
+			continue
+		}
+
+		unitStart := unit * sb.unitSize
+		unitEnd := unitStart + sb.unitLength(unit)
+		wStart, wEnd := offset, end
+		if wStart < unitStart {
+			wStart = unitStart
+		}
+		if wEnd > unitEnd {
+			wEnd = unitEnd
+		}
+		written := Range{Offset: wStart, Length: wEnd - wStart}
+
+		merged := planRanges(append(sb.partial[unit], written), 0)
+		if len(merged) == 1 && merged[0].Offset == unitStart && merged[0].Length == sb.unitLength(unit) {
+			sb.bitmap[unit/8] |= 1 << uint(unit%8)
+			delete(sb.partial, unit)
+		} else {
+			sb.partial[unit] = merged
+		}
+	}
+	return nil
+}
+
+// readAt serves a read from the backing file if all the units it
+// covers are present. Otherwise, it returns false and nothing is read.
+func (sb *sparseBacking) readAt(data []byte, offset int64) (int, bool, error) {
+	end := offset + int64(len(data))
+	var eof bool
+	if end >= sb.size {
+		end = sb.size
+		eof = true
+	}
+	if offset >= end {
+		return 0, false, nil
+	}
+
+	sb.mu.Lock()
+	for unit := offset / sb.unitSize; unit*sb.unitSize < end; unit++ {
+		if !sb.hasUnit(unit) {
+			sb.mu.Unlock()
+			return 0, false, nil
+		}
+	}
+	sb.mu.Unlock()
+
+	n, err := sb.file.ReadAt(data[:end-offset], offset)
+	if err != nil && err != io.EOF {
+		return n, true, errors.WithStack(err)
+	}
+
+	if eof && int64(len(data)) > end-offset {
+		return n, true, io.EOF
+	}
+	return n, true, nil
+}
+
+// presentRanges returns the parts of the file that are fully present
+func (sb *sparseBacking) presentRanges() []Range {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	var ranges []Range
+	numUnits := (sb.size + sb.unitSize - 1) / sb.unitSize
+	for unit := int64(0); unit < numUnits; unit++ {
+		if !sb.hasUnit(unit) {
+			continue
+		}
+
+		r := Range{Offset: unit * sb.unitSize, Length: sb.unitLength(unit)}
+		if len(ranges) > 0 && ranges[len(ranges)-1].end() == r.Offset {
+			ranges[len(ranges)-1].Length += r.Length
+		} else {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+func (sb *sparseBacking) close() error {
+	err := sb.saveMap()
+	if err != nil {
+		sb.file.Close()
+		return err
+	}
+	return errors.WithStack(sb.file.Close())
+}
+
+// backingReader writes everything read from upstream into the backing file
+type backingReader struct {
+	io.ReadCloser
+
+	file    *File
+	backing *sparseBacking
+	offset  int64
+}
+
+func (br *backingReader) Read(buf []byte) (int, error) {
+	n, err := br.ReadCloser.Read(buf)
+	if n > 0 {
+		werr := br.backing.write(buf[:n], br.offset)
+		if werr != nil {
+			br.file.log("(Backing) could not write %d bytes at %d: %v", n, br.offset, werr)
+		}
+		br.offset += int64(n)
+	}
+	return n, err
+}
+
+// PresentRanges returns the parts of the remote file that are available
+// in the backing file, when Settings.BackingFile is set.
+func (f *File) PresentRanges() []Range {
+	if f.backing == nil {
+		return nil
+	}
+	return f.backing.presentRanges()
+}
@@ -0,0 +1,57 @@
+package htfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/retrycontext"
+	"github.com/stretchr/testify/assert"
+)
+
+type closeCounter struct {
+	*bytes.Reader
+	closes int
+}
+
+func (cc *closeCounter) Close() error {
+	cc.closes++
+	return nil
+}
+
+func Test_CloseBackingErrors(t *testing.T) {
+	assert := assert.New(t)
+	fakeData := bytes.Repeat([]byte("backing "), 20000)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(fakeData))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "htfs-backing")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	f, err := Open(func() (string, error) { return server.URL, nil },
+		func(res *http.Response, body []byte) bool { return false }, &Settings{
+			RetrySettings: &retrycontext.Settings{MaxTries: 3, NoSleep: true},
+			BackingFile:   filepath.Join(dir, "data.bin"),
+		})
+	assert.NoError(err)
+	if !assert.NotNil(f.backing) {
+		return
+	}
+
+	// closing the backing file fails, the rest still gets closed
+	assert.NoError(f.backing.file.Close())
+	local := &closeCounter{Reader: bytes.NewReader(nil)}
+	f.local = local
+
+	assert.Error(f.Close())
+	assert.Equal(1, local.closes)
+}
@@ -0,0 +1,278 @@
+package htfs
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// stickyDialer connects to the host of the File's current URL the way
+// Settings.Host, StickyIP and ConnectIP say. Other hosts (redirect
+// targets, proxies) are dialed as usual.
+type stickyDialer struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// origin returns the "host:port" the overrides apply to
+	origin func() string
+
+	serverName string
+	connectIP  string
+	sticky     bool
+
+	tlsConfig           *tls.Config
+	tlsHandshakeTimeout time.Duration
+	log                 func(format string, args ...interface{})
+
+	mu sync.Mutex
+	// pinnedIP is what pinnedOrigin resolved to when first connected to
+	pinnedOrigin string
+	pinnedIP     string
+}
+
+func (sd *stickyDialer) pinned(addr string) string {
+	if sd.connectIP != "" {
+		return sd.connectIP
+	}
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.sticky && sd.pinnedOrigin == addr {
+		return sd.pinnedIP
+	}
+	return ""
+}
+
+func (sd *stickyDialer) pin(addr string, conn net.Conn) {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	sd.mu.Lock()
+	changed := sd.pinnedOrigin != addr || sd.pinnedIP != ip
+	sd.pinnedOrigin, sd.pinnedIP = addr, ip
+	sd.mu.Unlock()
+	if changed {
+		sd.log("(Sticky) pinned %s to %s", addr, ip)
+	}
+}
+
+// unpin forgets ip, so the next connection resolves the host again
+func (sd *stickyDialer) unpin(addr string, ip string) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	if sd.pinnedOrigin == addr && sd.pinnedIP == ip {
+		sd.pinnedOrigin, sd.pinnedIP = "", ""
+	}
+}
+
+func (sd *stickyDialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr != sd.origin() {
+		return sd.dial(ctx, network, addr)
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ip := sd.pinned(addr); ip != "" {
+		conn, err := sd.dial(ctx, network, net.JoinHostPort(ip, port))
+		if err != nil && sd.connectIP == "" {
+			// that node may be gone, rather than fail forever, let the
+			// next connection go wherever DNS says
+			sd.log("(Sticky) could not connect to %s, unpinning: %v", ip, err)
+			sd.unpin(addr, ip)
+		}
+		return conn, err
+	}
+
+	conn, err := sd.dial(ctx, network, addr)
+	if err == nil && sd.sticky {
+		sd.pin(addr, conn)
+	}
+	return conn, err
+}
+
+// dialTLS is only used when Settings.Host is set, so that
+// it's what the origin gets as the TLS server name.
+func (sd *stickyDialer) dialTLS(network, addr string) (net.Conn, error) {
+	conn, err := sd.dialContext(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg *tls.Config
+	if sd.tlsConfig != nil {
+		cfg = sd.tlsConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if addr == sd.origin() {
+		cfg.ServerName = sd.serverName
+	} else if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, errors.WithStack(err)
+		}
+		cfg.ServerName = host
+	}
+
+	if sd.tlsHandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(sd.tlsHandshakeTimeout))
+	}
+	tlsConn := tls.Client(conn, cfg)
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// hostAddr returns the "host:port" connections for urlStr go to
+func hostAddr(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// usesStickyClient returns true if settings need a client made for the File
+func usesStickyClient(settings *Settings) bool {
+	return settings.Host != "" || settings.StickyIP || settings.ConnectIP != ""
+}
+
+// stickyClient returns a client like base, with a transport of its own
+// that connects as set by Settings.Host, StickyIP and ConnectIP. When
+// Client is nil, it's like a timeout client. Otherwise, the Client's
+// Transport must be an *http.Transport.
+func (f *File) stickyClient(base *http.Client, settings *Settings) (*http.Client, error) {
+	if settings.ConnectIP != "" && net.ParseIP(settings.ConnectIP) == nil {
+		return nil, errors.Errorf("invalid Settings.ConnectIP %q", settings.ConnectIP)
+	}
+
+	var transport *http.Transport
+	if settings.Client == nil {
+		timeouts := timeout.DefaultTimeouts()
+		if settings.Timeouts != nil {
+			timeouts = *settings.Timeouts
+		}
+		if timeouts.ResponseHeader > 0 && timeouts.Idle > 0 {
+			// like timeout clients, don't mistake waiting for headers
+			// for an idle connection
+			timeouts.Idle += timeouts.ResponseHeader
+		}
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return timeout.DialContext(ctx, timeouts, network, addr)
+			},
+			TLSHandshakeTimeout:   timeouts.TLSHandshake,
+			ResponseHeaderTimeout: timeouts.ResponseHeader,
+		}
+		if timeout.IgnoreCertificateErrors {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		// the connections it pools are the File's own
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if f.proxy != nil {
+				return f.proxy(req)
+			}
+			return timeout.ProxyFromSystem(req)
+		}
+	} else {
+		var err error
+		transport, err = copyTransport(base.Transport)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	sd := &stickyDialer{
+		dial:       dial,
+		origin:     func() string { return hostAddr(f.getCurrentURL()) },
+		serverName: settings.Host,
+		connectIP:  settings.ConnectIP,
+		sticky:     settings.StickyIP,
+		log: func(format string, args ...interface{}) {
+			f.log(format, args...)
+		},
+	}
+	transport.DialContext = sd.dialContext
+
+	if transport.TLSNextProto == nil {
+		err := http2.ConfigureTransport(transport)
+		if err != nil {
+			f.log("Could not configure transport for http/2: %+v", err)
+		}
+	}
+	if settings.Host != "" {
+		// from here on, transport.TLSClientConfig and TLSHandshakeTimeout
+		// are only used through the dialer
+		sd.tlsConfig = transport.TLSClientConfig
+		sd.tlsHandshakeTimeout = transport.TLSHandshakeTimeout
+		transport.DialTLS = sd.dialTLS
+	}
+
+	client := &http.Client{Transport: transport}
+	if base != nil {
+		client.CheckRedirect = base.CheckRedirect
+		client.Jar = base.Jar
+		client.Timeout = base.Timeout
+	}
+	return client, nil
+}
+
+// copyTransport returns a new *http.Transport configured like rt, since
+// Transport.Clone isn't available to us.
+func copyTransport(rt http.RoundTripper) (*http.Transport, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, errors.Errorf("Settings.Host, StickyIP and ConnectIP need a Client whose Transport is an *http.Transport, not %T", rt)
+	}
+
+	res := &http.Transport{
+		Proxy:                  t.Proxy,
+		DialContext:            t.DialContext,
+		TLSHandshakeTimeout:    t.TLSHandshakeTimeout,
+		DisableKeepAlives:      t.DisableKeepAlives,
+		DisableCompression:     t.DisableCompression,
+		MaxIdleConns:           t.MaxIdleConns,
+		MaxIdleConnsPerHost:    t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:        t.MaxConnsPerHost,
+		IdleConnTimeout:        t.IdleConnTimeout,
+		ResponseHeaderTimeout:  t.ResponseHeaderTimeout,
+		ExpectContinueTimeout:  t.ExpectContinueTimeout,
+		ProxyConnectHeader:     t.ProxyConnectHeader,
+		MaxResponseHeaderBytes: t.MaxResponseHeaderBytes,
+	}
+	if t.TLSClientConfig != nil {
+		res.TLSClientConfig = t.TLSClientConfig.Clone()
+	}
+	if t.TLSNextProto != nil && len(t.TLSNextProto) == 0 {
+		// HTTP/2 was turned off
+		res.TLSNextProto = t.TLSNextProto
+	}
+	return res, nil
+}
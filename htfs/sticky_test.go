@@ -0,0 +1,86 @@
+package htfs
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// addrConn is a connection that seems to go to addr
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (ac *addrConn) RemoteAddr() net.Addr {
+	return ac.addr
+}
+
+func Test_StickyDialer(t *testing.T) {
+	assert := assert.New(t)
+
+	var dialed []string
+	nodes := []string{"10.0.0.1", "10.0.0.2"}
+	down := map[string]bool{}
+	sd := &stickyDialer{
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			host, port, _ := net.SplitHostPort(addr)
+			if host == "cdn.example.com" {
+				// DNS hands out nodes in turn
+				host, nodes = nodes[0], append(nodes[1:], nodes[0])
+			}
+			if down[host] {
+				return nil, errors.New("connection refused")
+			}
+			a, b := net.Pipe()
+			b.Close()
+			tcpAddr, _ := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+			return &addrConn{Conn: a, addr: tcpAddr}, nil
+		},
+		origin: func() string { return "cdn.example.com:443" },
+		sticky: true,
+		log:    func(format string, args ...interface{}) { t.Logf(format, args...) },
+	}
+
+	dial := func(addr string) error {
+		conn, err := sd.dialContext(context.Background(), "tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	assert.NoError(dial("cdn.example.com:443"))
+	assert.NoError(dial("cdn.example.com:443"))
+	assert.NoError(dial("cdn.example.com:443"))
+	assert.NoError(dial("other.example.com:443"))
+	assert.Equal([]string{
+		"cdn.example.com:443",
+		"10.0.0.1:443",
+		"10.0.0.1:443",
+		"other.example.com:443",
+	}, dialed)
+
+	// when the node goes away, the next one is picked up
+	dialed = nil
+	down["10.0.0.1"] = true
+	assert.Error(dial("cdn.example.com:443"))
+	assert.NoError(dial("cdn.example.com:443"))
+	assert.NoError(dial("cdn.example.com:443"))
+	assert.Equal([]string{
+		"10.0.0.1:443",
+		"cdn.example.com:443",
+		"10.0.0.2:443",
+	}, dialed)
+
+	// ConnectIP always wins
+	dialed = nil
+	sd.connectIP = "10.0.0.1"
+	assert.Error(dial("cdn.example.com:443"))
+	assert.Error(dial("cdn.example.com:443"))
+	assert.Equal([]string{"10.0.0.1:443", "10.0.0.1:443"}, dialed)
+}
@@ -0,0 +1,53 @@
+package htfs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A Summary tells what a File did over its lifetime, see File.Summary
+type Summary struct {
+	// Downloaded is the number of bytes received from the server, and
+	// Delivered the number of bytes returned to callers.
+	Downloaded int64
+	Delivered  int64
+	// Overhead is Downloaded divided by Delivered. It's 1 when no byte
+	// was wasted, less than 1 when reads were served from caches.
+	Overhead float64
+
+	// Connections is the number of times a connection was (re-)established
+	Connections int64
+	// Retries is the number of failed requests or reads that were tried again
+	Retries int64
+	// Renewals is the number of times the URL was renewed
+	Renewals int64
+
+	// Duration is the time between Open and Close,
+	// or until now if the File is still open.
+	Duration time.Duration
+}
+
+// Summary returns totals for the File's session. It's meant to be
+// called after Close, but can be called at any time.
+func (f *File) Summary() Summary {
+	ts := f.TransferStats()
+	s := Summary{
+		Downloaded:  ts.Downloaded,
+		Delivered:   ts.Delivered,
+		Connections: atomic.LoadInt64(&f.stats.connections),
+		Retries:     atomic.LoadInt64(&f.stats.retries),
+		Renewals:    atomic.LoadInt64(&f.stats.renews),
+	}
+	if s.Delivered > 0 {
+		s.Overhead = float64(s.Downloaded) / float64(s.Delivered)
+	}
+
+	f.connsLock.Lock()
+	closedAt := f.closedAt
+	f.connsLock.Unlock()
+	if closedAt.IsZero() {
+		closedAt = f.clock.Now()
+	}
+	s.Duration = closedAt.Sub(f.openedAt)
+	return s
+}
@@ -0,0 +1,41 @@
+package htfs
+
+import (
+	"time"
+)
+
+// maxSuppressedErrors is how many suppressed errors a File remembers,
+// only the most recent ones are kept.
+const maxSuppressedErrors = 256
+
+// A SuppressedError is an error htfs didn't return, because it retried
+// whatever failed instead: timeouts, connection resets, 5xx responses...
+type SuppressedError struct {
+	// Time is when the error happened
+	Time time.Time
+	RetryInfo
+}
+
+// SuppressedErrors returns the errors that were retried so far, oldest
+// first, so that even successful sessions can tell how healthy the
+// server and the network were. Only the most recent 256 are kept, but
+// Summary.Retries counts them all.
+func (f *File) SuppressedErrors() []SuppressedError {
+	f.suppressedMutex.Lock()
+	defer f.suppressedMutex.Unlock()
+
+	res := make([]SuppressedError, len(f.suppressed))
+	copy(res, f.suppressed)
+	return res
+}
+
+func (f *File) recordSuppressed(info RetryInfo) {
+	f.suppressedMutex.Lock()
+	defer f.suppressedMutex.Unlock()
+
+	if len(f.suppressed) >= maxSuppressedErrors {
+		copy(f.suppressed, f.suppressed[1:])
+		f.suppressed = f.suppressed[:len(f.suppressed)-1]
+	}
+	f.suppressed = append(f.suppressed, SuppressedError{Time: f.clock.Now(), RetryInfo: info})
+}
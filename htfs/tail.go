@@ -0,0 +1,105 @@
+package htfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ReadTail returns the last n bytes of the remote file, or all of it if
+// it's smaller. That's where archive formats like zip keep their index.
+//
+// If the File hasn't done its initial request yet (see Settings.Lazy),
+// ReadTail does it with a single "bytes=-n" suffix range request, which
+// also tells the size of the file. Otherwise, it reads from the end of the
+// file like ReadAt would.
+func (f *File) ReadTail(n int64) ([]byte, error) {
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	if err := f.ctx.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	data, err := f.open(n)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in File.ReadTail")
+	}
+	if data != nil {
+		offset := f.size - int64(len(data))
+		if f.backing != nil {
+			werr := f.backing.write(data, offset)
+			if werr != nil {
+				f.log("(Backing) could not write %d bytes at %d: %v", len(data), offset, werr)
+			}
+		}
+		atomic.AddInt64(&f.transfer.delivered, int64(len(data)))
+		if f.heatmap != nil && f.knownSize() {
+			f.heatmap.record(offset, int64(len(data)), f.currentSize())
+		}
+		return data, nil
+	}
+
+	size := f.currentSize()
+	if size == UnknownSize {
+		return nil, errors.Wrapf(ErrUnknownSize, "in File.ReadTail")
+	}
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	read, err := f.ReadAt(buf, size-n)
+	if err != nil && !(err == io.EOF && int64(read) == n) {
+		return nil, errors.Wrapf(err, "in File.ReadTail")
+	}
+	return buf, nil
+}
+
+// probeTail does the initial request with a suffix range, and returns
+// the bytes it got. They're nil if the server ignored the range.
+func (f *File) probeTail(n int64) ([]byte, error) {
+	var res *http.Response
+	var data []byte
+	err := f.withRetries(0, "ProbeTail", func(attempt int) error {
+		var err error
+		res, err = f.doRangeRequest(rangeRequest{
+			op:        "ProbeTail",
+			method:    "GET",
+			byteRange: fmt.Sprintf("bytes=-%d", n),
+			attempt:   attempt,
+			probe:     true,
+		})
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		data = nil
+		if res.StatusCode != 206 {
+			// we definitely don't want to read the whole thing
+			return nil
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(res.Body, n))
+		if err != nil {
+			return err
+		}
+		if res.ContentLength >= 0 && int64(len(data)) != res.ContentLength {
+			return errors.WithStack(io.ErrUnexpectedEOF)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(normalizeError(err), "htfs.Open (initial suffix range request)")
+	}
+	atomic.AddInt64(&f.transfer.downloaded, int64(len(data)))
+
+	err = f.applyProbe(res.Header, res.Request.URL, res.StatusCode, res.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,170 @@
+// Package tarfile provides random access to entries of remote tar archives:
+// the archive is walked once to build an index of entry offsets, after which
+// entries can be read individually without re-reading the whole archive.
+package tarfile
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	goerrors "errors"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+)
+
+// ErrEntryNotFound is returned when looking up an entry that's not in the index
+var ErrEntryNotFound = goerrors.New("tar entry not found")
+
+// Entry describes where the contents of a tar entry are located
+type Entry struct {
+	Name     string `json:"name"`
+	Typeflag byte   `json:"typeflag"`
+	Mode     int64  `json:"mode"`
+	// Offset is where the entry's contents start in the archive
+	Offset int64 `json:"offset"`
+	// Size is the size of the entry's contents
+	Size int64 `json:"size"`
+}
+
+// Index maps entry names to their location in a tar archive
+type Index struct {
+	Entries []*Entry `json:"entries"`
+
+	byName map[string]*Entry
+}
+
+// BuildIndex walks the tar archive in r once, only reading headers
+// (contents are skipped over). Sparse entries are not supported.
+// r can be an htfs.File, or any io.ReaderAt serving uncompressed data.
+func BuildIndex(r io.ReaderAt, size int64) (*Index, error) {
+	sr := io.NewSectionReader(r, 0, size)
+	// since sr implements io.Seeker, tar.Reader skips over contents
+	// instead of reading them.
+	tr := tar.NewReader(sr)
+
+	idx := &Index{}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.Wrapf(err, "in tarfile.BuildIndex")
+		}
+
+		if hdr.Typeflag == tar.TypeGNUSparse {
+			return nil, errors.Errorf("in tarfile.BuildIndex: sparse entry %s is not supported", hdr.Name)
+		}
+
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		idx.Entries = append(idx.Entries, &Entry{
+			Name:     hdr.Name,
+			Typeflag: hdr.Typeflag,
+			Mode:     hdr.Mode,
+			Offset:   offset,
+			Size:     hdr.Size,
+		})
+	}
+
+	idx.buildLookup()
+	return idx, nil
+}
+
+// LoadIndex reads an index previously written with Save
+func LoadIndex(r io.Reader) (*Index, error) {
+	idx := &Index{}
+	err := json.NewDecoder(r).Decode(idx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in tarfile.LoadIndex")
+	}
+
+	idx.buildLookup()
+	return idx, nil
+}
+
+// Save writes the index as JSON, so it can be reused with LoadIndex
+func (idx *Index) Save(w io.Writer) error {
+	return errors.WithStack(json.NewEncoder(w).Encode(idx))
+}
+
+func (idx *Index) buildLookup() {
+	idx.byName = make(map[string]*Entry, len(idx.Entries))
+	for _, e := range idx.Entries {
+		// later entries win, just like when extracting
+		idx.byName[e.Name] = e
+	}
+}
+
+// Lookup returns the entry with the given name, or nil
+func (idx *Index) Lookup(name string) *Entry {
+	return idx.byName[name]
+}
+
+// Open returns a reader for the contents of the named entry in r
+func (idx *Index) Open(r io.ReaderAt, name string) (*io.SectionReader, error) {
+	e := idx.Lookup(name)
+	if e == nil {
+		return nil, errors.Wrapf(ErrEntryNotFound, "%s", name)
+	}
+	return io.NewSectionReader(r, e.Offset, e.Size), nil
+}
+
+// Archive is a remote tar archive along with its index
+type Archive struct {
+	*Index
+
+	file *htfs.File
+}
+
+// OpenRemoteTar opens the tar archive at url and indexes it. settings may be nil.
+func OpenRemoteTar(url string, settings *htfs.Settings) (*Archive, error) {
+	if settings == nil {
+		settings = &htfs.Settings{}
+	}
+
+	getURL := func() (string, error) {
+		return url, nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in tarfile.OpenRemoteTar")
+	}
+
+	stats, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "in tarfile.OpenRemoteTar")
+	}
+
+	idx, err := BuildIndex(f, stats.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Archive{
+		Index: idx,
+		file:  f,
+	}, nil
+}
+
+// Open returns a reader for the contents of the named entry
+func (a *Archive) Open(name string) (*io.SectionReader, error) {
+	return a.Index.Open(a.file, name)
+}
+
+// Close closes the underlying htfs.File
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
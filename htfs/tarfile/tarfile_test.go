@@ -0,0 +1,77 @@
+package tarfile_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs/tarfile"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OpenRemoteTar(t *testing.T) {
+	assert := assert.New(t)
+
+	entries := make(map[string][]byte)
+	prng := rand.New(rand.NewSource(0xfeed))
+
+	tarBuf := new(bytes.Buffer)
+	tw := tar.NewWriter(tarBuf)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("dir/file-%d.bin", i)
+		data := make([]byte, prng.Intn(256*1024))
+		prng.Read(data)
+		entries[name] = data
+
+		assert.NoError(tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		assert.NoError(err)
+	}
+	assert.NoError(tw.Close())
+	tarData := tarBuf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "archive.tar", time.Time{}, bytes.NewReader(tarData))
+	}))
+	defer server.Close()
+
+	a, err := tarfile.OpenRemoteTar(server.URL+"/archive.tar", nil)
+	assert.NoError(err)
+	assert.Len(a.Entries, len(entries))
+
+	for name, expected := range entries {
+		r, err := a.Open(name)
+		assert.NoError(err)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(expected, data, "contents of %s", name)
+	}
+
+	_, err = a.Open("nope")
+	assert.True(errors.Cause(err) == tarfile.ErrEntryNotFound)
+
+	// indexes can be saved and reloaded
+	indexBuf := new(bytes.Buffer)
+	assert.NoError(a.Save(indexBuf))
+	idx, err := tarfile.LoadIndex(indexBuf)
+	assert.NoError(err)
+	e := idx.Lookup("dir/file-3.bin")
+	if assert.NotNil(e) {
+		assert.EqualValues(len(entries["dir/file-3.bin"]), e.Size)
+		assert.Equal(entries["dir/file-3.bin"], tarData[e.Offset:e.Offset+e.Size])
+	}
+
+	assert.NoError(a.Close())
+}
@@ -0,0 +1,131 @@
+package htfs
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// TransferStats tells how many bytes a File downloaded, and
+// how many of those actually made it to callers.
+type TransferStats struct {
+	// Downloaded is the number of bytes received from the server
+	Downloaded int64
+	// Delivered is the number of bytes returned by ReadAt and ReadMulti,
+	// including those served from caches or from backtracking.
+	Delivered int64
+
+	// Discarded is the number of bytes skipped over when
+	// re-using a connection for a read further ahead.
+	Discarded int64
+	// Unconsumed is the number of bytes fetched along with requested ranges
+	// (to coalesce them, or because the server sent more), and never asked for.
+	Unconsumed int64
+	// Aborted is the number of bytes buffered from a connection
+	// that was closed or reconnected before they were read.
+	Aborted int64
+	// ReadaheadDropped is the number of bytes fetched ahead of sequential
+	// reads (see Settings.Readahead) that were dropped before being read.
+	ReadaheadDropped int64
+	// Retried is the number of bytes received from responses that failed
+	// before they could be used, which were then requested again, or
+	// given up on.
+	Retried int64
+	// Probes is the number of bytes received in response to requests about
+	// the remote file rather than for its contents, like ProbeSingleByte's.
+	Probes int64
+
+	// Resumes is the number of times a read picked up where it left off
+	// on a new request, after a response body failed halfway.
+	Resumes int64
+
+	// Verified is the number of reads fetched again to be compared, and
+	// Mismatches the number of those that differed, see Settings.VerifyReads.
+	Verified   int64
+	Mismatches int64
+}
+
+// Wasted returns the number of downloaded bytes that were thrown away
+func (ts TransferStats) Wasted() int64 {
+	return ts.Discarded + ts.Unconsumed + ts.Aborted + ts.ReadaheadDropped + ts.Retried + ts.Probes
+}
+
+// Amplification returns Downloaded divided by Delivered: how many bytes
+// were fetched for every byte returned, 1 if none were wasted. Each cause
+// of waste adds its own share, like Retried divided by Delivered. It's
+// less than 1 when reads were served from caches, and zero when nothing
+// was delivered.
+func (ts TransferStats) Amplification() float64 {
+	if ts.Delivered == 0 {
+		return 0
+	}
+	return float64(ts.Downloaded) / float64(ts.Delivered)
+}
+
+// transferCounters is updated from many goroutines, and
+// kept separate from File so it's 64-bit aligned.
+type transferCounters struct {
+	downloaded int64
+	delivered  int64
+	discarded  int64
+	unconsumed int64
+	aborted    int64
+	dropped    int64
+	retried    int64
+	probes     int64
+	resumes    int64
+	verified   int64
+	mismatches int64
+}
+
+// TransferStats returns how many bytes were downloaded and
+// delivered so far, and how many were wasted.
+func (f *File) TransferStats() TransferStats {
+	tc := f.transfer
+	return TransferStats{
+		Downloaded: atomic.LoadInt64(&tc.downloaded),
+		Delivered:  atomic.LoadInt64(&tc.delivered),
+		Discarded:  atomic.LoadInt64(&tc.discarded),
+		Unconsumed: atomic.LoadInt64(&tc.unconsumed),
+		Aborted:    atomic.LoadInt64(&tc.aborted),
+		Resumes:    atomic.LoadInt64(&tc.resumes),
+		Verified:   atomic.LoadInt64(&tc.verified),
+		Mismatches: atomic.LoadInt64(&tc.mismatches),
+
+		ReadaheadDropped: atomic.LoadInt64(&tc.dropped),
+		Retried:          atomic.LoadInt64(&tc.retried),
+		Probes:           atomic.LoadInt64(&tc.probes),
+	}
+}
+
+// countWasted accounts for n bytes that were downloaded and thrown
+// away, into one of the transferCounters
+func (f *File) countWasted(counter *int64, n int64) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&f.transfer.downloaded, n)
+	atomic.AddInt64(counter, n)
+}
+
+// countingBody counts bytes read from a response body
+type countingBody struct {
+	io.ReadCloser
+
+	total *int64
+	// n is only accessed by the body's owner
+	n int64
+}
+
+func (f *File) countDownload(body io.ReadCloser) *countingBody {
+	return &countingBody{
+		ReadCloser: body,
+		total:      &f.transfer.downloaded,
+	}
+}
+
+func (cb *countingBody) Read(buf []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(buf)
+	cb.n += int64(n)
+	atomic.AddInt64(cb.total, int64(n))
+	return n, err
+}
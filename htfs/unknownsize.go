@@ -0,0 +1,41 @@
+package htfs
+
+import (
+	goerrors "errors"
+)
+
+// UnknownSize is the size of remote files that didn't report it, like
+// chunked responses without a Content-Length header. FileInfo.Size returns
+// it until a read reaches the end of the file.
+const UnknownSize int64 = -1
+
+// ErrUnknownSize is returned when seeking relative to the end of a File
+// whose size is still unknown, see UnknownSize.
+var ErrUnknownSize = goerrors.New("htfs: size of remote file is unknown")
+
+func (f *File) sizeUnknown() bool {
+	return f.size == UnknownSize
+}
+
+// currentSize returns the size of the file if it's known, or was
+// found out by reading until the end, and UnknownSize otherwise.
+func (f *File) currentSize() int64 {
+	if !f.sizeUnknown() {
+		return f.size
+	}
+
+	f.endMutex.Lock()
+	defer f.endMutex.Unlock()
+	return f.endOffset
+}
+
+// observeEnd records that a file of unknown size ends at offset
+func (f *File) observeEnd(offset int64) {
+	f.endMutex.Lock()
+	defer f.endMutex.Unlock()
+
+	if f.endOffset == UnknownSize {
+		f.log("[%9d-%9d] (EOF) found out size of remote file", offset, offset)
+	}
+	f.endOffset = offset
+}
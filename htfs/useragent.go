@@ -0,0 +1,30 @@
+package htfs
+
+import (
+	"runtime/debug"
+)
+
+const modulePath = "github.com/itchio/httpkit"
+
+// DefaultUserAgent is sent with every request, unless Settings.UserAgent
+// or Settings.Header say otherwise. It's "itchio-httpkit/" followed by the
+// version of the httpkit module the program was built with.
+var DefaultUserAgent = "itchio-httpkit/" + moduleVersion()
+
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				if dep.Replace != nil && dep.Replace.Version != "" {
+					return dep.Replace.Version
+				}
+				return dep.Version
+			}
+		}
+	}
+	return "devel"
+}
@@ -0,0 +1,75 @@
+package htfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// shouldVerify decides whether a read is part of the sample
+// fetched again, see Settings.VerifyReads
+func (f *File) shouldVerify() bool {
+	if f.verifyReads <= 0 || f.local != nil {
+		return false
+	}
+	return f.verifyReads >= 1 || f.randFloat64() < f.verifyReads
+}
+
+// maybeVerify fetches what a read returned again, if it's part of the
+// sample, with a bounded range request separate from the File's
+// connections and caches, and logs any difference in detail.
+func (f *File) maybeVerify(data []byte, offset int64, err error) {
+	if len(data) == 0 || (err != nil && err != io.EOF) || !f.shouldVerify() {
+		return
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(data))-1)
+	var res *http.Response
+	var again []byte
+	err = f.withRetries(offset, "Verify", func(attempt int) error {
+		var err error
+		res, err = f.doRangeRequest(rangeRequest{
+			op:        "Verify",
+			method:    "GET",
+			byteRange: byteRange,
+			offset:    offset,
+			attempt:   attempt,
+		})
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		again, err = ioutil.ReadAll(io.LimitReader(res.Body, int64(len(data))))
+		return err
+	})
+	if err != nil {
+		f.log("[%9d-%9d] (Verify) could not fetch again: %v", offset, offset+int64(len(data)), err)
+		return
+	}
+	atomic.AddInt64(&f.transfer.verified, 1)
+
+	if bytes.Equal(data, again) {
+		return
+	}
+	atomic.AddInt64(&f.transfer.mismatches, 1)
+
+	first := 0
+	for first < len(data) && first < len(again) && data[first] == again[first] {
+		first++
+	}
+	var headers []string
+	for key, values := range res.Header {
+		headers = append(headers, fmt.Sprintf("%s: %s", key, strings.Join(values, ", ")))
+	}
+	sort.Strings(headers)
+	f.log("[%9d-%9d] (Verify) MISMATCH: read differs from %s at offset %d (got %d bytes the second time)",
+		offset, offset+int64(len(data)), f.getCurrentURL(), offset+int64(first), len(again))
+	f.log("[%9d-%9d] (Verify) second request: HTTP %d for %s, %s", offset, offset+int64(len(data)),
+		res.StatusCode, byteRange, strings.Join(headers, "; "))
+}
@@ -0,0 +1,206 @@
+package htfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+)
+
+// WebDAV lists and opens files under a URL prefix on a WebDAV server.
+// Listings use PROPFIND, files are opened as regular Files, which only
+// need range support from the server.
+type WebDAV struct {
+	prefix   *url.URL
+	settings *Settings
+}
+
+// NewWebDAV returns a WebDAV for the collection at prefix, like
+// "https://dav.example.org/mirror/". Credentials can be passed in the
+// URL or in settings.Header. settings are used for every File opened,
+// and for listings (client, headers, user agent, proxy, context).
+func NewWebDAV(prefix string, settings *Settings) (*WebDAV, error) {
+	u, err := url.Parse(prefix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in htfs.NewWebDAV")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("in htfs.NewWebDAV: unsupported scheme %q", u.Scheme)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	if settings == nil {
+		settings = &Settings{}
+	}
+	return &WebDAV{prefix: u, settings: settings}, nil
+}
+
+// resolve returns the URL of name, relative to the prefix
+func (w *WebDAV) resolve(name string) *url.URL {
+	u := *w.prefix
+	u.Path = path.Join(w.prefix.Path, path.Clean("/"+name))
+	if strings.HasSuffix(name, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	return &u
+}
+
+// Open opens the file at name, relative to the prefix
+func (w *WebDAV) Open(name string) (*File, error) {
+	urlStr := w.resolve(name).String()
+	getURL := func() (string, error) { return urlStr, nil }
+	needsRenewal := func(res *http.Response, body []byte) bool { return false }
+	return Open(getURL, needsRenewal, w.settings)
+}
+
+// webdavPropfind asks for what Readdir returns
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop>
+    <D:resourcetype/>
+    <D:getcontentlength/>
+    <D:getlastmodified/>
+  </D:prop>
+</D:propfind>`
+
+type webdavMultistatus struct {
+	Responses []webdavResponse `xml:"DAV: response"`
+}
+
+type webdavResponse struct {
+	Href      string           `xml:"DAV: href"`
+	Propstats []webdavPropstat `xml:"DAV: propstat"`
+}
+
+type webdavPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		ContentLength string `xml:"DAV: getcontentlength"`
+		LastModified  string `xml:"DAV: getlastmodified"`
+	} `xml:"DAV: prop"`
+}
+
+// Readdir lists the collection at dir, relative to the prefix ("" or "/"
+// for the prefix itself), with a PROPFIND of depth 1. Entries are sorted
+// by name, and subcollections are directories.
+func (w *WebDAV) Readdir(dir string) ([]os.FileInfo, error) {
+	u := w.resolve(strings.TrimSuffix(dir, "/") + "/")
+
+	req, err := http.NewRequest("PROPFIND", u.String(), bytes.NewReader([]byte(webdavPropfind)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "in WebDAV.Readdir")
+	}
+	ctx := w.settings.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if w.settings.Proxy != nil {
+		ctx = timeout.WithProxy(ctx, w.settings.Proxy)
+	}
+	req = req.WithContext(ctx)
+	for key, values := range w.settings.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if req.Header.Get("User-Agent") == "" {
+		userAgent := w.settings.UserAgent
+		if userAgent == "" {
+			userAgent = DefaultUserAgent
+		}
+		req.Header.Set("User-Agent", userAgent)
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+
+	client, owned := settingsClient(w.settings)
+	if owned {
+		defer client.CloseIdleConnections()
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in WebDAV.Readdir")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errors.Wrapf(ErrNotFound, "in WebDAV.Readdir")
+	}
+	if res.StatusCode != http.StatusMultiStatus {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		se := &ServerError{
+			Host:       req.Host,
+			Message:    fmt.Sprintf("PROPFIND: HTTP %d: %s", res.StatusCode, string(body)),
+			StatusCode: res.StatusCode,
+		}
+		return nil, errors.Wrapf(se, "in WebDAV.Readdir")
+	}
+
+	var ms webdavMultistatus
+	err = xml.NewDecoder(res.Body).Decode(&ms)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in WebDAV.Readdir, while parsing multistatus")
+	}
+	return webdavEntries(res.Request.URL, &ms), nil
+}
+
+// webdavEntries returns the members of the collection at
+// base, leaving out the collection itself
+func webdavEntries(base *url.URL, ms *webdavMultistatus) []os.FileInfo {
+	basePath := strings.TrimSuffix(base.Path, "/")
+
+	var entries []os.FileInfo
+	for _, r := range ms.Responses {
+		href, err := base.Parse(strings.TrimSpace(r.Href))
+		if err != nil {
+			continue
+		}
+		hrefPath := strings.TrimSuffix(href.Path, "/")
+		if hrefPath == basePath || path.Dir(hrefPath) != basePath {
+			continue
+		}
+
+		info := fsFileInfo{name: path.Base(hrefPath)}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				// properties the server doesn't have
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				info.dir = true
+			}
+			if size, err := strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64); err == nil {
+				info.size = size
+			}
+			if t, err := http.ParseTime(strings.TrimSpace(ps.Prop.LastModified)); err == nil {
+				info.modTime = t
+			}
+		}
+		if info.dir {
+			info.size = 0
+		}
+		entries = append(entries, info)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
@@ -0,0 +1,71 @@
+package htfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func Test_WebDAV(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := webdav.NewMemFS()
+	ctx := context.Background()
+	write := func(name string, contents string) {
+		f, err := fs.OpenFile(ctx, name, os.O_CREATE|os.O_WRONLY, 0644)
+		assert.NoError(err)
+		_, err = f.Write([]byte(contents))
+		assert.NoError(err)
+		assert.NoError(f.Close())
+	}
+	assert.NoError(fs.Mkdir(ctx, "/mirror", 0755))
+	assert.NoError(fs.Mkdir(ctx, "/mirror/builds", 0755))
+	assert.NoError(fs.Mkdir(ctx, "/mirror/builds/old", 0755))
+	write("/mirror/builds/game 1.0.zip", "first build")
+	write("/mirror/builds/game-1.1.zip", "second build, with fixes")
+	write("/mirror/other.txt", "outside")
+
+	server := httptest.NewServer(&webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer server.Close()
+
+	dav, err := htfs.NewWebDAV(server.URL+"/mirror", &htfs.Settings{})
+	assert.NoError(err)
+
+	entries, err := dav.Readdir("builds")
+	assert.NoError(err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.EqualValues([]string{"game 1.0.zip", "game-1.1.zip", "old"}, names)
+	if len(entries) == 3 {
+		assert.False(entries[0].IsDir())
+		assert.EqualValues(len("first build"), entries[0].Size())
+		assert.False(entries[0].ModTime().IsZero())
+		assert.True(entries[2].IsDir())
+	}
+
+	entries, err = dav.Readdir("/")
+	assert.NoError(err)
+	assert.Len(entries, 2)
+
+	f, err := dav.Open("builds/game-1.1.zip")
+	assert.NoError(err)
+	data, err := ioutil.ReadAll(f)
+	assert.NoError(err)
+	assert.EqualValues("second build, with fixes", string(data))
+	assert.NoError(f.Close())
+
+	_, err = dav.Readdir("missing")
+	assert.Equal(htfs.ErrNotFound, errors.Cause(err))
+}
@@ -0,0 +1,182 @@
+// Package zipfile provides random access to remote zip archives through htfs,
+// only fetching the central directory and the entries that are actually read.
+package zipfile
+
+import (
+	"archive/zip"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/pkg/errors"
+)
+
+// DefaultBlockSize is the granularity at which archive data is fetched.
+// Both the central directory and compressed entries are read sequentially
+// through small buffers, so rounding reads up avoids many tiny ReadAt calls.
+const DefaultBlockSize = 256 * 1024
+
+// numBlocks is how many recently-read blocks are kept around, which
+// allows interleaving reads from the central directory and a few entries.
+const numBlocks = 4
+
+// Archive is a zip archive backed by a remote htfs.File. The embedded
+// zip.Reader exposes entries, each of which can be opened for reading.
+type Archive struct {
+	*zip.Reader
+
+	file *htfs.File
+}
+
+// OpenRemoteZip opens the zip archive at url. settings may be nil.
+func OpenRemoteZip(url string, settings *htfs.Settings) (*Archive, error) {
+	if settings == nil {
+		settings = &htfs.Settings{}
+	}
+
+	getURL := func() (string, error) {
+		return url, nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in zipfile.OpenRemoteZip")
+	}
+
+	a, err := Open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Open reads the central directory of an already-opened htfs.File.
+// Closing the Archive closes f.
+func Open(f *htfs.File) (*Archive, error) {
+	stats, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "in zipfile.Open")
+	}
+
+	ra := newBlockReaderAt(f, stats.Size(), DefaultBlockSize)
+	zr, err := zip.NewReader(ra, stats.Size())
+	if err != nil {
+		return nil, errors.Wrapf(err, "in zipfile.Open, while reading central directory")
+	}
+
+	return &Archive{
+		Reader: zr,
+		file:   f,
+	}, nil
+}
+
+// Entry returns the entry with the given name, or nil if there's none.
+func (a *Archive) Entry(name string) *zip.File {
+	for _, zf := range a.File {
+		if zf.Name == name {
+			return zf
+		}
+	}
+	return nil
+}
+
+// HTFSFile returns the underlying htfs.File
+func (a *Archive) HTFSFile() *htfs.File {
+	return a.file
+}
+
+// Close closes the underlying htfs.File
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+type block struct {
+	offset int64
+	data   []byte
+}
+
+// blockReaderAt rounds reads up to aligned blocks, and keeps the
+// last few blocks around.
+type blockReaderAt struct {
+	file      *htfs.File
+	size      int64
+	blockSize int64
+
+	mu     sync.Mutex
+	blocks []*block
+}
+
+func newBlockReaderAt(file *htfs.File, size int64, blockSize int64) *blockReaderAt {
+	return &blockReaderAt{
+		file:      file,
+		size:      size,
+		blockSize: blockSize,
+	}
+}
+
+func (br *blockReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	total := 0
+	for total < len(buf) {
+		pos := offset + int64(total)
+		if pos >= br.size {
+			return total, io.EOF
+		}
+
+		b, err := br.getBlock(pos / br.blockSize * br.blockSize)
+		if err != nil {
+			return total, err
+		}
+		total += copy(buf[total:], b.data[pos-b.offset:])
+	}
+	return total, nil
+}
+
+func (br *blockReaderAt) getBlock(offset int64) (*block, error) {
+	if b := br.findBlock(offset); b != nil {
+		return b, nil
+	}
+
+	length := br.blockSize
+	if offset+length > br.size {
+		length = br.size - offset
+	}
+
+	// don't hold the lock while fetching, so entries can be read in parallel
+	b := &block{
+		offset: offset,
+		data:   make([]byte, length),
+	}
+	n, err := br.file.ReadAt(b.data, offset)
+	if err != nil && !(err == io.EOF && int64(n) == length) {
+		return nil, err
+	}
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if len(br.blocks) >= numBlocks {
+		br.blocks = br.blocks[:numBlocks-1]
+	}
+	br.blocks = append([]*block{b}, br.blocks...)
+	return b, nil
+}
+
+func (br *blockReaderAt) findBlock(offset int64) *block {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	for i, b := range br.blocks {
+		if b.offset == offset {
+			// move to front
+			copy(br.blocks[1:i+1], br.blocks[:i])
+			br.blocks[0] = b
+			return b
+		}
+	}
+	return nil
+}
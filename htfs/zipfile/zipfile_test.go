@@ -0,0 +1,76 @@
+package zipfile_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs/zipfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OpenRemoteZip(t *testing.T) {
+	assert := assert.New(t)
+
+	entries := make(map[string][]byte)
+	prng := rand.New(rand.NewSource(0xfeed))
+
+	zipBuf := new(bytes.Buffer)
+	zw := zip.NewWriter(zipBuf)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("dir/file-%d.bin", i)
+		data := make([]byte, prng.Intn(512*1024))
+		prng.Read(data)
+		entries[name] = data
+
+		method := zip.Store
+		if i%2 == 0 {
+			method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		assert.NoError(err)
+		_, err = w.Write(data)
+		assert.NoError(err)
+	}
+	assert.NoError(zw.Close())
+	zipData := zipBuf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "archive.zip", time.Time{}, bytes.NewReader(zipData))
+	}))
+	defer server.Close()
+
+	a, err := zipfile.OpenRemoteZip(server.URL+"/archive.zip", nil)
+	assert.NoError(err)
+	assert.Len(a.File, len(entries))
+
+	name := "dir/file-7.bin"
+	zf := a.Entry(name)
+	if assert.NotNil(zf) {
+		rc, err := zf.Open()
+		assert.NoError(err)
+		data, err := ioutil.ReadAll(rc)
+		assert.NoError(err)
+		assert.NoError(rc.Close())
+		assert.Equal(entries[name], data)
+	}
+
+	assert.Nil(a.Entry("does/not/exist"))
+
+	for _, zf := range a.File {
+		rc, err := zf.Open()
+		assert.NoError(err)
+		data, err := ioutil.ReadAll(rc)
+		assert.NoError(err)
+		assert.NoError(rc.Close())
+		assert.Equal(entries[zf.Name], data, "contents of %s", zf.Name)
+	}
+
+	assert.NoError(a.Close())
+}
@@ -0,0 +1,290 @@
+// Package zstdfile provides random access to remote files compressed in the
+// zstd seekable format through htfs: the seek table is fetched once, and
+// reads only fetch and decompress the frames they need.
+//
+// See https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+package zstdfile
+
+import (
+	"encoding/binary"
+	goerrors "errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	skippableMagic = 0x184D2A5E
+	seekableMagic  = 0x8F92EAB1
+
+	// skippable frame header: magic number, frame size
+	skippableHeaderSize = 8
+	// seek table footer: number of frames, descriptor, seekable magic number
+	footerSize = 9
+
+	checksumFlag = 1 << 7
+	reservedBits = 0x7c
+)
+
+// numFrames is how many recently-decompressed frames are kept around
+const numFrames = 4
+
+// ErrNotSeekable is returned when a file doesn't end with a seek table
+var ErrNotSeekable = goerrors.New("not a seekable zstd file")
+
+// A Frame is an independently-compressed piece of a seekable zstd file
+type Frame struct {
+	// CompressedOffset is where the frame starts in the compressed file
+	CompressedOffset int64
+	CompressedSize   int64
+	// Offset is where the frame's data starts in the uncompressed stream
+	Offset int64
+	Size   int64
+}
+
+// File is the uncompressed view of a seekable zstd file. It's safe
+// for concurrent use.
+type File struct {
+	r      io.ReaderAt
+	closer io.Closer
+	frames []Frame
+	size   int64
+
+	decoder *zstd.Decoder
+
+	mu     sync.Mutex
+	cached []*decodedFrame
+}
+
+type decodedFrame struct {
+	index int
+	data  []byte
+}
+
+var _ io.ReaderAt = (*File)(nil)
+
+// OpenRemote opens the seekable zstd file at url. settings may be nil.
+func OpenRemote(url string, settings *htfs.Settings) (*File, error) {
+	if settings == nil {
+		settings = &htfs.Settings{}
+	}
+
+	getURL := func() (string, error) {
+		return url, nil
+	}
+	needsRenewal := func(res *http.Response, body []byte) bool {
+		return false
+	}
+
+	f, err := htfs.Open(getURL, needsRenewal, settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in zstdfile.OpenRemote")
+	}
+
+	zf, err := Open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return zf, nil
+}
+
+// Open reads the seek table of an already-opened htfs.File.
+// Closing the returned File closes f.
+func Open(f *htfs.File) (*File, error) {
+	stats, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "in zstdfile.Open")
+	}
+
+	zf, err := NewReader(f, stats.Size())
+	if err != nil {
+		return nil, err
+	}
+	zf.closer = f
+	return zf, nil
+}
+
+// NewReader reads the seek table of the seekable zstd file r, of
+// compressed size size.
+func NewReader(r io.ReaderAt, size int64) (*File, error) {
+	frames, err := readSeekTable(r, size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in zstdfile.NewReader")
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "in zstdfile.NewReader")
+	}
+
+	zf := &File{
+		r:       r,
+		frames:  frames,
+		decoder: decoder,
+	}
+	if len(frames) > 0 {
+		last := frames[len(frames)-1]
+		zf.size = last.Offset + last.Size
+	}
+	return zf, nil
+}
+
+func readSeekTable(r io.ReaderAt, size int64) ([]Frame, error) {
+	if size < skippableHeaderSize+footerSize {
+		return nil, ErrNotSeekable
+	}
+
+	footer := make([]byte, footerSize)
+	_, err := r.ReadAt(footer, size-footerSize)
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+	if binary.LittleEndian.Uint32(footer[5:9]) != seekableMagic {
+		return nil, ErrNotSeekable
+	}
+
+	numFrames := int64(binary.LittleEndian.Uint32(footer[0:4]))
+	descriptor := footer[4]
+	if descriptor&reservedBits != 0 {
+		return nil, errors.Errorf("invalid seek table descriptor %#x", descriptor)
+	}
+	entrySize := int64(8)
+	if descriptor&checksumFlag != 0 {
+		entrySize = 12
+	}
+
+	tableSize := skippableHeaderSize + numFrames*entrySize + footerSize
+	if tableSize > size {
+		return nil, errors.Errorf("seek table of %d frames doesn't fit in %d bytes", numFrames, size)
+	}
+
+	table := make([]byte, tableSize-footerSize)
+	_, err = r.ReadAt(table, size-tableSize)
+	if err != nil && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+	if binary.LittleEndian.Uint32(table[0:4]) != skippableMagic {
+		return nil, errors.Errorf("seek table isn't in a skippable frame")
+	}
+	if frameSize := int64(binary.LittleEndian.Uint32(table[4:8])); frameSize != tableSize-skippableHeaderSize {
+		return nil, errors.Errorf("seek table frame size is %d, expected %d", frameSize, tableSize-skippableHeaderSize)
+	}
+
+	frames := make([]Frame, numFrames)
+	var compressedOffset, offset int64
+	for i := range frames {
+		entry := table[skippableHeaderSize+int64(i)*entrySize:]
+		f := Frame{
+			CompressedOffset: compressedOffset,
+			CompressedSize:   int64(binary.LittleEndian.Uint32(entry[0:4])),
+			Offset:           offset,
+			Size:             int64(binary.LittleEndian.Uint32(entry[4:8])),
+		}
+		compressedOffset += f.CompressedSize
+		offset += f.Size
+		frames[i] = f
+	}
+
+	if compressedOffset > size-tableSize {
+		return nil, errors.Errorf("seek table describes %d compressed bytes, only %d available", compressedOffset, size-tableSize)
+	}
+	return frames, nil
+}
+
+// Size returns the uncompressed size of the file
+func (zf *File) Size() int64 {
+	return zf.size
+}
+
+// Frames returns the frames listed in the seek table
+func (zf *File) Frames() []Frame {
+	return zf.frames
+}
+
+// ReadAt reads uncompressed data, fetching and decompressing
+// only the frames that overlap [offset, offset+len(buf)).
+func (zf *File) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, errors.Errorf("zstdfile: negative offset %d", offset)
+	}
+
+	total := 0
+	for total < len(buf) {
+		pos := offset + int64(total)
+		if pos >= zf.size {
+			return total, io.EOF
+		}
+
+		index := sort.Search(len(zf.frames), func(i int) bool {
+			return zf.frames[i].Offset+zf.frames[i].Size > pos
+		})
+		data, err := zf.frameData(index)
+		if err != nil {
+			return total, err
+		}
+		total += copy(buf[total:], data[pos-zf.frames[index].Offset:])
+	}
+	return total, nil
+}
+
+func (zf *File) frameData(index int) ([]byte, error) {
+	if data := zf.findFrame(index); data != nil {
+		return data, nil
+	}
+
+	// don't hold the lock while fetching, so frames can be read in parallel
+	f := zf.frames[index]
+	compressed := make([]byte, f.CompressedSize)
+	n, err := zf.r.ReadAt(compressed, f.CompressedOffset)
+	if err != nil && !(err == io.EOF && int64(n) == f.CompressedSize) {
+		return nil, errors.Wrapf(err, "zstdfile: fetching frame %d", index)
+	}
+
+	data, err := zf.decoder.DecodeAll(compressed, make([]byte, 0, f.Size))
+	if err != nil {
+		return nil, errors.Wrapf(err, "zstdfile: decompressing frame %d", index)
+	}
+	if int64(len(data)) != f.Size {
+		return nil, errors.Errorf("zstdfile: frame %d decompressed to %d bytes, seek table says %d", index, len(data), f.Size)
+	}
+
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+
+	if len(zf.cached) >= numFrames {
+		zf.cached = zf.cached[:numFrames-1]
+	}
+	zf.cached = append([]*decodedFrame{{index: index, data: data}}, zf.cached...)
+	return data, nil
+}
+
+func (zf *File) findFrame(index int) []byte {
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+
+	for i, df := range zf.cached {
+		if df.index == index {
+			// move to front
+			copy(zf.cached[1:i+1], zf.cached[:i])
+			zf.cached[0] = df
+			return df.data
+		}
+	}
+	return nil
+}
+
+// Close releases the decoder, and closes the underlying htfs.File if
+// the File was obtained with Open or OpenRemote.
+func (zf *File) Close() error {
+	zf.decoder.Close()
+	if zf.closer != nil {
+		return zf.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package zstdfile_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/htfs"
+	"github.com/itchio/httpkit/htfs/zstdfile"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeSeekable compresses data in frames of frameSize, and appends a seek table
+func makeSeekable(t *testing.T, data []byte, frameSize int, checksums bool) []byte {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+
+	out := new(bytes.Buffer)
+	var entries []byte
+	numFrames := 0
+	for start := 0; start < len(data); start += frameSize {
+		end := start + frameSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame := enc.EncodeAll(data[start:end], nil)
+		out.Write(frame)
+		numFrames++
+
+		entry := make([]byte, 8)
+		binary.LittleEndian.PutUint32(entry[0:4], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(entry[4:8], uint32(end-start))
+		if checksums {
+			// readers don't check it
+			entry = append(entry, 0, 0, 0, 0)
+		}
+		entries = append(entries, entry...)
+	}
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], 0x184D2A5E)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(entries)+9))
+	footer := make([]byte, 9)
+	binary.LittleEndian.PutUint32(footer[0:4], uint32(numFrames))
+	if checksums {
+		footer[4] = 1 << 7
+	}
+	binary.LittleEndian.PutUint32(footer[5:9], 0x8F92EAB1)
+
+	out.Write(header)
+	out.Write(entries)
+	out.Write(footer)
+	return out.Bytes()
+}
+
+func Test_OpenRemote(t *testing.T) {
+	assert := assert.New(t)
+
+	// compressible, but not too much
+	data := make([]byte, 4*1024*1024+123)
+	prng := rand.New(rand.NewSource(0xfeed))
+	for i := range data {
+		data[i] = byte(prng.Intn(16))
+	}
+	const frameSize = 256 * 1024
+	compressed := makeSeekable(t, data, frameSize, false)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.zst", time.Time{}, bytes.NewReader(compressed))
+	}))
+	defer server.Close()
+
+	f, err := htfs.Open(func() (string, error) { return server.URL + "/data.zst", nil },
+		func(res *http.Response, body []byte) bool { return false }, &htfs.Settings{})
+	assert.NoError(err)
+	zf, err := zstdfile.Open(f)
+	assert.NoError(err)
+	defer zf.Close()
+
+	assert.EqualValues(len(data), zf.Size())
+	assert.Len(zf.Frames(), (len(data)+frameSize-1)/frameSize)
+
+	// spans two frames
+	buf := make([]byte, 1000)
+	offset := int64(3*frameSize - 500)
+	_, err = zf.ReadAt(buf, offset)
+	assert.NoError(err)
+	assert.Equal(data[offset:offset+1000], buf)
+
+	// only the seek table and the frames we needed were read
+	frames := zf.Frames()
+	assert.True(f.TransferStats().Delivered < frames[2].CompressedSize+frames[3].CompressedSize+4096)
+
+	// past the end
+	n, err := zf.ReadAt(buf, int64(len(data))-100)
+	assert.Equal(io.EOF, err)
+	assert.EqualValues(100, n)
+	assert.Equal(data[len(data)-100:], buf[:n])
+
+	// whole thing
+	all := make([]byte, len(data))
+	_, err = zf.ReadAt(all, 0)
+	assert.NoError(err)
+	assert.Equal(data, all)
+}
+
+func Test_NewReader(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("seekable zstd "), 10000)
+	compressed := makeSeekable(t, data, 4096, true)
+
+	zf, err := zstdfile.NewReader(bytes.NewReader(compressed), int64(len(compressed)))
+	assert.NoError(err)
+	defer zf.Close()
+
+	section := io.NewSectionReader(zf, 0, zf.Size())
+	buf := new(bytes.Buffer)
+	_, err = io.Copy(buf, section)
+	assert.NoError(err)
+	assert.Equal(data, buf.Bytes())
+
+	_, err = zstdfile.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Equal(zstdfile.ErrNotSeekable, errors.Cause(err))
+}
@@ -4,15 +4,47 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/getlantern/idletiming"
 )
 
+// A Predicate reports whether an error should be considered a
+// (transient) network error. See RegisterPredicate.
+type Predicate func(err error) bool
+
+var predicatesLock sync.RWMutex
+var predicates []Predicate
+
+// RegisterPredicate adds p to the checks IsNetworkError does, for transient
+// failures it doesn't know about (custom transports, proxies, etc.).
+// p is called for every error in the cause chain, and should be
+// safe to call from multiple goroutines.
+func RegisterPredicate(p Predicate) {
+	predicatesLock.Lock()
+	defer predicatesLock.Unlock()
+	predicates = append(predicates, p)
+}
+
+func matchesPredicate(err error) bool {
+	predicatesLock.RLock()
+	defer predicatesLock.RUnlock()
+	for _, p := range predicates {
+		if p(err) {
+			return true
+		}
+	}
+	return false
+}
+
 // IsNetworkError returns true if the error's cause is: io.ErrUnexpectedEOF,
-// any *net.OpError, any *url.Error, any URL that implements `Temporary()`
-// (and returns true)
+// any *net.OpError, any *url.Error, a temporary DNS failure, a TLS
+// handshake timeout, a proxy CONNECT failure, an HTTP/2 GOAWAY or stream
+// reset, anything that implements `Temporary()` (and returns true),
+// or anything a registered Predicate matches.
 func IsNetworkError(err error) bool {
 	if err == nil {
 		return false
@@ -22,6 +54,10 @@ func IsNetworkError(err error) bool {
 		return true
 	}
 
+	if matchesPredicate(err) {
+		return true
+	}
+
 	if causer, ok := err.(causer); ok {
 		return IsNetworkError(causer.Cause())
 	}
@@ -32,6 +68,9 @@ func IsNetworkError(err error) bool {
 		if urlError.Err == io.EOF {
 			return true
 		}
+		if isProxyConnectError(urlError.Err) {
+			return true
+		}
 		return IsNetworkError(urlError.Err)
 	}
 
@@ -39,6 +78,10 @@ func IsNetworkError(err error) bool {
 		return true
 	}
 
+	if dnsError, ok := err.(*net.DNSError); ok {
+		return dnsError.IsTemporary || dnsError.IsTimeout
+	}
+
 	if err == idletiming.ErrIdled {
 		return true
 	}
@@ -54,6 +97,15 @@ func IsNetworkError(err error) bool {
 		if strings.HasPrefix(msg, "connection error: ") {
 			return true
 		}
+		if strings.Contains(msg, "server sent GOAWAY") {
+			return true
+		}
+		if strings.Contains(msg, "http2: client connection lost") {
+			return true
+		}
+		if strings.Contains(msg, "TLS handshake timeout") {
+			return true
+		}
 		if strings.Contains(msg, "forcibly closed by the remote host") {
 			return true
 		}
@@ -79,3 +131,20 @@ type temporary interface {
 type causer interface {
 	Cause() error
 }
+
+// isProxyConnectError returns true if err looks like a proxy answered our
+// CONNECT request with a gateway error. net/http only reports the status
+// text for those (as a bare error), so that's what we match.
+func isProxyConnectError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	for _, code := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		if msg == http.StatusText(code) {
+			return true
+		}
+	}
+	return false
+}
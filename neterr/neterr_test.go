@@ -1,9 +1,12 @@
 package neterr_test
 
 import (
+	stdErrors "errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -109,3 +112,79 @@ func Test_UnexpectedEof(t *testing.T) {
 	t.Logf("%v", err)
 	assert.True(neterr.IsNetworkError(err))
 }
+
+func Test_ProxyConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+		},
+	}
+	_, err = client.Get("https://example.org/")
+	t.Logf("%v", err)
+	assert.True(neterr.IsNetworkError(err))
+}
+
+func Test_TLSHandshakeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// accept, but never complete the handshake
+			go func() {
+				time.Sleep(1 * time.Second)
+				conn.Close()
+			}()
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSHandshakeTimeout: 100 * time.Millisecond,
+		},
+	}
+	_, err = client.Get("https://" + l.Addr().String() + "/")
+	t.Logf("%v", err)
+	assert.True(neterr.IsNetworkError(err))
+}
+
+func Test_Classification(t *testing.T) {
+	assert := assert.New(t)
+
+	wrap := func(err error) error {
+		return errors.WithStack(&url.Error{Op: "Get", URL: "https://example.org", Err: err})
+	}
+
+	assert.True(neterr.IsNetworkError(&net.DNSError{Err: "server misbehaving", IsTemporary: true}))
+	assert.False(neterr.IsNetworkError(&net.DNSError{Err: "no such host", IsNotFound: true}))
+
+	assert.True(neterr.IsNetworkError(wrap(stdErrors.New("http2: server sent GOAWAY and closed the connection; LastStreamID=1, ErrCode=NO_ERROR, debug=\"\""))))
+	assert.True(neterr.IsNetworkError(wrap(stdErrors.New("stream error: stream ID 3; INTERNAL_ERROR"))))
+	assert.True(neterr.IsNetworkError(wrap(stdErrors.New("http2: client connection lost"))))
+
+	assert.False(neterr.IsNetworkError(errors.New("permission denied")))
+
+	customError := errors.New("custom transient error")
+	assert.False(neterr.IsNetworkError(errors.Wrap(customError, "wrapped")))
+	neterr.RegisterPredicate(func(err error) bool {
+		return err == customError
+	})
+	assert.True(neterr.IsNetworkError(errors.Wrap(customError, "wrapped")))
+}
@@ -1,6 +1,7 @@
 package retrycontext
 
 import (
+	"context"
 	"math"
 	"math/rand"
 	"time"
@@ -27,6 +28,33 @@ type Settings struct {
 	Consumer  *state.Consumer
 	NoSleep   bool
 	FakeSleep func(d time.Duration)
+
+	// Context, if set, interrupts backoff sleeps when it's done,
+	// after which ShouldTry returns false.
+	Context context.Context
+
+	// OnRetry, if set, is called every time an error is retried,
+	// before sleeping.
+	OnRetry func(info RetryInfo)
+
+	// IsRetriable, if set, decides which errors are worth retrying,
+	// see Context.IsRetriable.
+	IsRetriable func(err error) bool
+
+	// Rand, if set, is where backoff jitter comes from instead of the
+	// global source, so that delays are reproducible given a seed. Its
+	// Source must be safe for concurrent use if the Settings are shared.
+	Rand *rand.Rand
+}
+
+// RetryInfo describes a retry that's about to happen
+type RetryInfo struct {
+	// Tries is the number of tries that failed so far
+	Tries int
+	// Err is the error being retried
+	Err error
+	// Delay is how long we're going to sleep before the next try
+	Delay time.Duration
 }
 
 // New returns a new retry context with specific settings.
@@ -67,9 +95,29 @@ func NewDefault() *Context {
 // If you forget to return an error after the loop,
 // if there are too many errors you'll just keep running.
 func (rc *Context) ShouldTry() bool {
+	if rc.Err() != nil {
+		return false
+	}
 	return rc.Tries < rc.Settings.MaxTries
 }
 
+// Err returns the error of Settings.Context, if it's done.
+func (rc *Context) Err() error {
+	if rc.Settings.Context == nil {
+		return nil
+	}
+	return rc.Settings.Context.Err()
+}
+
+// IsRetriable returns true if err is worth retrying, according to
+// Settings.IsRetriable, or if it's a network error when that's unset.
+func (rc *Context) IsRetriable(err error) bool {
+	if rc.Settings.IsRetriable != nil {
+		return rc.Settings.IsRetriable(err)
+	}
+	return neterr.IsNetworkError(err)
+}
+
 // Retry records an error that was retried (accessible in LastError)
 // If a consumer was passed, it'll pause progress, and log the error.
 // It's also in charge of sleeping (following exponential backoff)
@@ -89,19 +137,27 @@ func (rc *Context) Retry(err error) {
 	delay := int(math.Pow(2, float64(rc.Tries)))
 	// ...plus a random number of milliseconds.
 	// see https://cloud.google.com/storage/docs/exponential-backoff
-	jitter := rand.Int() % 1000
+	jitter := rc.jitter()
 
 	if rc.Settings.Consumer != nil {
 		rc.Settings.Consumer.Infof("Sleeping %d seconds then retrying", delay)
 	}
 
 	sleepDuration := time.Second*time.Duration(delay) + time.Millisecond*time.Duration(jitter)
+	if rc.Settings.OnRetry != nil {
+		rc.Settings.OnRetry(RetryInfo{
+			Tries: rc.Tries + 1,
+			Err:   err,
+			Delay: sleepDuration,
+		})
+	}
+
 	if rc.Settings.NoSleep {
 		if rc.Settings.FakeSleep != nil {
 			rc.Settings.FakeSleep(sleepDuration)
 		}
 	} else {
-		time.Sleep(sleepDuration)
+		rc.sleep(sleepDuration)
 	}
 
 	rc.Tries++
@@ -110,3 +166,27 @@ func (rc *Context) Retry(err error) {
 		rc.Settings.Consumer.ResumeProgress()
 	}
 }
+
+// jitter returns a random number of milliseconds, below 1000
+func (rc *Context) jitter() int {
+	if rc.Settings.Rand != nil {
+		return rc.Settings.Rand.Intn(1000)
+	}
+	return rand.Int() % 1000
+}
+
+// sleep waits for d, or until Settings.Context is done
+func (rc *Context) sleep(d time.Duration) {
+	if rc.Settings.Context == nil {
+		time.Sleep(d)
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-rc.Settings.Context.Done():
+	}
+}
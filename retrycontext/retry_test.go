@@ -1,7 +1,9 @@
 package retrycontext_test
 
 import (
+	"context"
 	"math"
+	"math/rand"
 	"testing"
 	"time"
 
@@ -79,3 +81,71 @@ func Test_Retry(t *testing.T) {
 	failCount = 4
 	assert.EqualError(run(), markerError.Error())
 }
+
+func Test_RetryCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc := retrycontext.NewDefault()
+	rc.Settings.Context = ctx
+
+	var infos []retrycontext.RetryInfo
+	rc.Settings.OnRetry = func(info retrycontext.RetryInfo) {
+		infos = append(infos, info)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	assert.True(rc.ShouldTry())
+	// first backoff is at least a second long
+	rc.Retry(errors.New("first"))
+	assert.True(time.Since(start) < 500*time.Millisecond, "cancelling interrupts the sleep")
+
+	assert.False(rc.ShouldTry())
+	assert.Equal(context.Canceled, rc.Err())
+
+	assert.Len(infos, 1)
+	assert.Equal(1, infos[0].Tries)
+	assert.EqualError(infos[0].Err, "first")
+	assert.True(infos[0].Delay >= time.Second)
+}
+
+func Test_RetryClassification(t *testing.T) {
+	assert := assert.New(t)
+	markerError := errors.New("marker")
+
+	rc := retrycontext.NewDefault()
+	assert.False(rc.IsRetriable(markerError), "by default, only network errors are retried")
+
+	rc.Settings.IsRetriable = func(err error) bool {
+		return errors.Cause(err) == markerError
+	}
+	assert.True(rc.IsRetriable(errors.Wrap(markerError, "wrapped")))
+	assert.False(rc.IsRetriable(errors.New("other")))
+}
+
+func Test_RetryJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	delays := func(seed int64) []time.Duration {
+		rc := retrycontext.NewDefault()
+		rc.Settings.NoSleep = true
+		rc.Settings.Rand = rand.New(rand.NewSource(seed))
+
+		var res []time.Duration
+		rc.Settings.OnRetry = func(info retrycontext.RetryInfo) {
+			res = append(res, info.Delay)
+		}
+		for i := 0; i < 5; i++ {
+			rc.Retry(errors.New("again"))
+		}
+		return res
+	}
+
+	assert.Equal(delays(42), delays(42), "same seed, same delays")
+	assert.NotEqual(delays(42), delays(43))
+}
@@ -0,0 +1,81 @@
+package timeout
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/idletiming"
+)
+
+// idleTransport enforces the idle timeout on response bodies rather than
+// on connections, so that time spent waiting for response headers (which
+// has its own limit) isn't mistaken for a stalled transfer.
+type idleTransport struct {
+	transport *http.Transport
+	idle      time.Duration
+}
+
+var _ http.RoundTripper = (*idleTransport)(nil)
+
+func (it *idleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	res, err := it.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = &idleBody{
+		body:   res.Body,
+		idle:   it.idle,
+		cancel: cancel,
+	}
+	return res, nil
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections
+// reach the underlying transport.
+func (it *idleTransport) CloseIdleConnections() {
+	it.transport.CloseIdleConnections()
+}
+
+// idleBody cancels its request if a single Read blocks for longer
+// than idle, and reports it as idletiming.ErrIdled.
+type idleBody struct {
+	body   io.ReadCloser
+	idle   time.Duration
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	idled bool
+}
+
+func (ib *idleBody) Read(buf []byte) (int, error) {
+	timer := time.AfterFunc(ib.idle, func() {
+		ib.mu.Lock()
+		ib.idled = true
+		ib.mu.Unlock()
+		ib.cancel()
+	})
+	n, err := ib.body.Read(buf)
+	timer.Stop()
+
+	if err != nil {
+		ib.mu.Lock()
+		idled := ib.idled
+		ib.mu.Unlock()
+		if idled {
+			return n, idletiming.ErrIdled
+		}
+	}
+	return n, err
+}
+
+func (ib *idleBody) Close() error {
+	err := ib.body.Close()
+	ib.cancel()
+	return err
+}
@@ -0,0 +1,301 @@
+package timeout
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// systemProxyRefresh is how long the OS proxy settings are cached for,
+// so changes are picked up without reading them for every request.
+const systemProxyRefresh = time.Minute
+
+// systemProxySettings are the proxy settings of the operating system
+type systemProxySettings struct {
+	// HTTP and HTTPS are "host:port" proxy addresses, empty when disabled
+	HTTP  string
+	HTTPS string
+	// Exceptions are hosts, domains, and address ranges
+	// that are contacted directly
+	Exceptions []string
+	// BypassLocal sends requests to hosts without dots directly
+	BypassLocal bool
+	// AutoConfigURL is where a proxy auto-config script lives. We can't
+	// evaluate those, but it's worth mentioning in logs.
+	AutoConfigURL string
+}
+
+// systemProxyState caches the OS proxy settings. Reading them can take a
+// while (macOS runs scutil), so it's never done while holding mu: the
+// first read blocks callers of ProxyFromSystem, later ones happen
+// in the background.
+var systemProxyState struct {
+	firstRead  sync.Once
+	mu         sync.Mutex
+	fetchedAt  time.Time
+	refreshing bool
+	settings   *systemProxySettings
+	proxyFunc  func(*url.URL) (*url.URL, error)
+	warnedPAC  bool
+}
+
+var envProxyOnce sync.Once
+var envHasProxy bool
+
+// ProxyFromSystem is like http.ProxyFromEnvironment, except that when no
+// proxy is set in the environment, it uses the one configured in the
+// operating system's settings, on Windows and macOS. It's what timeout
+// clients use, unless overridden with WithProxy.
+//
+// Only static proxy settings are read: the WinINet registry keys on
+// Windows, "scutil --proxy" on macOS. Evaluating proxy auto-config (PAC)
+// scripts, and WPAD discovery, are out of scope: when one is configured,
+// it's logged once and requests are sent to the static proxy, if any,
+// or directly.
+func ProxyFromSystem(req *http.Request) (*url.URL, error) {
+	envProxyOnce.Do(func() {
+		cfg := httpproxy.FromEnvironment()
+		envHasProxy = cfg.HTTPProxy != "" || cfg.HTTPSProxy != ""
+	})
+	if envHasProxy {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	st := &systemProxyState
+	st.firstRead.Do(refreshSystemProxy)
+	st.mu.Lock()
+	if !st.refreshing && time.Since(st.fetchedAt) > systemProxyRefresh {
+		st.refreshing = true
+		go refreshSystemProxy()
+	}
+	settings, proxyFunc := st.settings, st.proxyFunc
+	st.mu.Unlock()
+
+	if proxyFunc == nil {
+		return nil, nil
+	}
+	if settings != nil && settings.BypassLocal && isLocalHost(req.URL.Hostname()) {
+		return nil, nil
+	}
+	return proxyFunc(req.URL)
+}
+
+// refreshSystemProxy reads the OS proxy settings, then swaps
+// them into systemProxyState
+func refreshSystemProxy() {
+	settings, err := readSystemProxy()
+
+	st := &systemProxyState
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		// keep whatever we had, and try again later
+		log.Printf("Could not read system proxy settings: %+v", err)
+	} else {
+		st.settings = settings
+		st.proxyFunc = settings.proxyFunc()
+		if settings != nil && settings.AutoConfigURL != "" && !st.warnedPAC {
+			st.warnedPAC = true
+			log.Printf("Ignoring proxy auto-config script %s (not supported)", settings.AutoConfigURL)
+		}
+	}
+	st.fetchedAt = time.Now()
+	st.refreshing = false
+}
+
+type proxyContextKey struct{}
+
+// WithProxy returns a copy of ctx that makes timeout clients pick the proxy
+// for requests made with it by calling proxy, instead of ProxyFromSystem.
+// Use NoProxy to connect directly.
+func WithProxy(ctx context.Context, proxy func(*http.Request) (*url.URL, error)) context.Context {
+	return context.WithValue(ctx, proxyContextKey{}, proxy)
+}
+
+// NoProxy never uses a proxy, see WithProxy
+func NoProxy(req *http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+// proxyForRequest is the proxy function of timeout clients
+func proxyForRequest(req *http.Request) (*url.URL, error) {
+	if proxy, ok := req.Context().Value(proxyContextKey{}).(func(*http.Request) (*url.URL, error)); ok && proxy != nil {
+		return proxy(req)
+	}
+	return ProxyFromSystem(req)
+}
+
+func (sps *systemProxySettings) proxyFunc() func(*url.URL) (*url.URL, error) {
+	if sps == nil || (sps.HTTP == "" && sps.HTTPS == "") {
+		return func(*url.URL) (*url.URL, error) { return nil, nil }
+	}
+
+	var noProxy []string
+	for _, e := range sps.Exceptions {
+		if entry, ok := noProxyEntry(e); ok {
+			noProxy = append(noProxy, entry)
+		}
+	}
+	cfg := &httpproxy.Config{
+		HTTPProxy:  sps.HTTP,
+		HTTPSProxy: sps.HTTPS,
+		NoProxy:    strings.Join(noProxy, ","),
+	}
+	return cfg.ProxyFunc()
+}
+
+// isLocalHost returns true for intranet names, like "<local>" in
+// Windows proxy exceptions
+func isLocalHost(host string) bool {
+	return host != "" && !strings.Contains(host, ".") && net.ParseIP(host) == nil
+}
+
+// noProxyEntry converts an OS proxy exception ("*.example.com",
+// "192.168.*", "169.254/16") to the NO_PROXY format
+func noProxyEntry(pattern string) (string, bool) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || pattern == "<local>" {
+		return "", false
+	}
+
+	if strings.HasPrefix(pattern, "*.") {
+		return pattern[1:], true
+	}
+
+	if i := strings.Index(pattern, "/"); i >= 0 {
+		// partial addresses are allowed before the prefix length
+		octets := strings.Split(pattern[:i], ".")
+		for len(octets) < 4 {
+			octets = append(octets, "0")
+		}
+		cidr := strings.Join(octets, ".") + pattern[i:]
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return "", false
+		}
+		return cidr, true
+	}
+
+	if strings.HasSuffix(pattern, ".*") {
+		// only whole trailing octets, like "10.*" or "192.168.*"
+		octets := strings.Split(strings.TrimSuffix(pattern, ".*"), ".")
+		if len(octets) > 3 {
+			return "", false
+		}
+		for _, o := range octets {
+			if n, err := strconv.Atoi(o); err != nil || n < 0 || n > 255 {
+				return "", false
+			}
+		}
+		bits := 8 * len(octets)
+		for len(octets) < 4 {
+			octets = append(octets, "0")
+		}
+		return fmt.Sprintf("%s/%d", strings.Join(octets, "."), bits), true
+	}
+
+	if strings.Contains(pattern, "*") {
+		// other wildcards have no NO_PROXY equivalent
+		return "", false
+	}
+	return pattern, true
+}
+
+// parseWindowsProxy interprets the WinINet settings stored in the registry:
+// ProxyServer is either "host:port" for all protocols, or a list like
+// "http=host:port;https=host:port", ProxyOverride a list of exceptions
+// separated by semicolons.
+func parseWindowsProxy(enable bool, server string, override string, autoConfigURL string) *systemProxySettings {
+	sps := &systemProxySettings{AutoConfigURL: autoConfigURL}
+	if !enable || server == "" {
+		return sps
+	}
+
+	if !strings.Contains(server, "=") {
+		sps.HTTP = server
+		sps.HTTPS = server
+	} else {
+		for _, entry := range strings.Split(server, ";") {
+			tokens := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+			if len(tokens) != 2 {
+				continue
+			}
+			switch strings.ToLower(tokens[0]) {
+			case "http":
+				sps.HTTP = tokens[1]
+			case "https":
+				sps.HTTPS = tokens[1]
+			}
+		}
+	}
+
+	for _, e := range strings.Split(override, ";") {
+		e = strings.TrimSpace(e)
+		if e == "<local>" {
+			sps.BypassLocal = true
+		} else if e != "" {
+			sps.Exceptions = append(sps.Exceptions, e)
+		}
+	}
+	return sps
+}
+
+// parseScutilProxy interprets the output of "scutil --proxy" on macOS
+func parseScutilProxy(output string) *systemProxySettings {
+	values := make(map[string]string)
+	var exceptions []string
+	inExceptions := false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if inExceptions {
+			if line == "}" {
+				inExceptions = false
+				continue
+			}
+			if tokens := strings.SplitN(line, " : ", 2); len(tokens) == 2 {
+				exceptions = append(exceptions, strings.TrimSpace(tokens[1]))
+			}
+			continue
+		}
+
+		tokens := strings.SplitN(line, " : ", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(tokens[0]), strings.TrimSpace(tokens[1])
+		if key == "ExceptionsList" && strings.HasPrefix(value, "<array>") {
+			inExceptions = true
+			continue
+		}
+		values[key] = value
+	}
+
+	sps := &systemProxySettings{Exceptions: exceptions}
+	address := func(prefix string) string {
+		if values[prefix+"Enable"] != "1" || values[prefix+"Proxy"] == "" {
+			return ""
+		}
+		if port := values[prefix+"Port"]; port != "" {
+			return net.JoinHostPort(values[prefix+"Proxy"], port)
+		}
+		return values[prefix+"Proxy"]
+	}
+	sps.HTTP = address("HTTP")
+	sps.HTTPS = address("HTTPS")
+	sps.BypassLocal = values["ExcludeSimpleHostnames"] == "1"
+	if values["ProxyAutoConfigEnable"] == "1" {
+		sps.AutoConfigURL = values["ProxyAutoConfigURLString"]
+	}
+	return sps
+}
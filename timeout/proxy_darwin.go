@@ -0,0 +1,17 @@
+package timeout
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// readSystemProxy asks SystemConfiguration for the proxy settings of the
+// current network service. scutil saves us from linking against it.
+func readSystemProxy() (*systemProxySettings, error) {
+	output, err := exec.Command("scutil", "--proxy").Output()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return parseScutilProxy(string(output)), nil
+}
@@ -0,0 +1,10 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package timeout
+
+// readSystemProxy returns nil: elsewhere, proxies are
+// configured with environment variables.
+func readSystemProxy() (*systemProxySettings, error) {
+	return nil, nil
+}
@@ -0,0 +1,93 @@
+package timeout
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseWindowsProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	sps := parseWindowsProxy(false, "proxy:8080", "", "")
+	assert.EqualValues("", sps.HTTP, "disabled proxy")
+
+	sps = parseWindowsProxy(true, "proxy:8080", "<local>;*.example.com;10.*", "")
+	assert.EqualValues("proxy:8080", sps.HTTP)
+	assert.EqualValues("proxy:8080", sps.HTTPS)
+	assert.True(sps.BypassLocal)
+	assert.EqualValues([]string{"*.example.com", "10.*"}, sps.Exceptions)
+
+	sps = parseWindowsProxy(true, "http=web:80;https=secure:443;socks=socks:1080", "", "http://wpad/wpad.dat")
+	assert.EqualValues("web:80", sps.HTTP)
+	assert.EqualValues("secure:443", sps.HTTPS)
+	assert.EqualValues("http://wpad/wpad.dat", sps.AutoConfigURL)
+}
+
+func Test_ParseScutilProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	sps := parseScutilProxy(`<dictionary> {
+  ExceptionsList : <array> {
+    0 : *.local
+    1 : 169.254/16
+  }
+  ExcludeSimpleHostnames : 1
+  FTPPassive : 1
+  HTTPEnable : 1
+  HTTPPort : 3128
+  HTTPProxy : proxy.corp
+  HTTPSEnable : 0
+  HTTPSPort : 3129
+  HTTPSProxy : proxy.corp
+  ProxyAutoConfigEnable : 1
+  ProxyAutoConfigURLString : http://corp/proxy.pac
+}
+`)
+	assert.EqualValues("proxy.corp:3128", sps.HTTP)
+	assert.EqualValues("", sps.HTTPS, "disabled proxy")
+	assert.True(sps.BypassLocal)
+	assert.EqualValues([]string{"*.local", "169.254/16"}, sps.Exceptions)
+	assert.EqualValues("http://corp/proxy.pac", sps.AutoConfigURL)
+
+	sps = parseScutilProxy("<dictionary> {\n  HTTPEnable : 0\n}\n")
+	assert.EqualValues("", sps.HTTP)
+	assert.EqualValues("", sps.HTTPS)
+}
+
+func Test_SystemProxyFunc(t *testing.T) {
+	assert := assert.New(t)
+
+	sps := &systemProxySettings{
+		HTTP:       "proxy:3128",
+		HTTPS:      "proxy:3129",
+		Exceptions: []string{"*.example.com", "10.*", "169.254/16", "foo*bar"},
+	}
+	proxyFunc := sps.proxyFunc()
+
+	proxyFor := func(rawurl string) string {
+		u, err := url.Parse(rawurl)
+		assert.NoError(err)
+		proxy, err := proxyFunc(u)
+		assert.NoError(err)
+		if proxy == nil {
+			return ""
+		}
+		return proxy.Host
+	}
+
+	assert.EqualValues("proxy:3128", proxyFor("http://itch.io/"))
+	assert.EqualValues("proxy:3129", proxyFor("https://itch.io/"))
+	assert.EqualValues("", proxyFor("https://cdn.example.com/"))
+	assert.EqualValues("", proxyFor("http://10.1.2.3/"))
+	assert.EqualValues("", proxyFor("http://169.254.1.1/"))
+	assert.EqualValues("proxy:3128", proxyFor("http://192.168.1.1/"))
+
+	proxy, err := (*systemProxySettings)(nil).proxyFunc()(&url.URL{Scheme: "http", Host: "itch.io"})
+	assert.NoError(err)
+	assert.Nil(proxy, "no settings")
+	assert.True(isLocalHost("intranet"))
+	assert.False(isLocalHost("itch.io"))
+	assert.False(isLocalHost("127.0.0.1"))
+}
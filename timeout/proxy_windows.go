@@ -0,0 +1,68 @@
+package timeout
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// readSystemProxy reads the WinINet proxy settings of the current user,
+// the ones set in "Internet Options" and the Settings app.
+func readSystemProxy() (*systemProxySettings, error) {
+	path, err := syscall.UTF16PtrFromString(`Software\Microsoft\Windows\CurrentVersion\Internet Settings`)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var key syscall.Handle
+	err = syscall.RegOpenKeyEx(syscall.HKEY_CURRENT_USER, path, 0, syscall.KEY_READ, &key)
+	if err != nil {
+		if err == syscall.ERROR_FILE_NOT_FOUND {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer syscall.RegCloseKey(key)
+
+	enable := registryDword(key, "ProxyEnable") != 0
+	return parseWindowsProxy(enable, registryString(key, "ProxyServer"),
+		registryString(key, "ProxyOverride"), registryString(key, "AutoConfigURL")), nil
+}
+
+// registryString returns a REG_SZ value, or "" if it's missing
+func registryString(key syscall.Handle, name string) string {
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return ""
+	}
+
+	var typ, size uint32
+	err = syscall.RegQueryValueEx(key, namep, nil, &typ, nil, &size)
+	if err != nil || typ != syscall.REG_SZ || size == 0 {
+		return ""
+	}
+	buf := make([]uint16, size/2+1)
+	err = syscall.RegQueryValueEx(key, namep, nil, &typ, (*byte)(unsafe.Pointer(&buf[0])), &size)
+	if err != nil {
+		return ""
+	}
+	return syscall.UTF16ToString(buf)
+}
+
+// registryDword returns a REG_DWORD value, or 0 if it's missing
+func registryDword(key syscall.Handle, name string) uint32 {
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 0
+	}
+
+	var typ uint32
+	var value uint32
+	size := uint32(unsafe.Sizeof(value))
+	err = syscall.RegQueryValueEx(key, namep, nil, &typ, (*byte)(unsafe.Pointer(&value)), &size)
+	if err != nil || typ != syscall.REG_DWORD {
+		return 0
+	}
+	return value
+}
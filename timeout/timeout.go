@@ -3,6 +3,7 @@
 package timeout
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net"
@@ -49,43 +50,160 @@ func SetSimulateOffline(enabled bool) {
 	simulateOffline = enabled
 }
 
-func timeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (net.Conn, error) {
-	return func(netw, addr string) (net.Conn, error) {
-		if simulateOffline {
-			return nil, &net.OpError{
-				Op:  "dial",
-				Err: errors.New("simulated offline"),
-			}
-		}
+// Timeouts holds the limits a timeout client enforces on each phase of
+// a request. A zero value means that phase isn't limited on its own.
+type Timeouts struct {
+	// DNS is how long we're willing to wait for name resolution.
+	// When zero, resolution counts towards Connect.
+	DNS time.Duration
+	// Connect is how long we're willing to wait to establish a TCP connection
+	Connect time.Duration
+	// TLSHandshake is how long we're willing to wait for the TLS handshake
+	TLSHandshake time.Duration
+	// ResponseHeader is how long we're willing to wait for the response
+	// headers once the request is written (time to first byte)
+	ResponseHeader time.Duration
+	// Idle is the duration after which, if there's no I/O activity, we declare a connection dead.
+	// When ResponseHeader is set, it only applies to reading response bodies.
+	Idle time.Duration
+}
 
-		// if it takes too long to establish a connection, give up
-		timeoutConn, err := net.DialTimeout(netw, addr, cTimeout)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		// respect global throttle settings
-		throttledConn, err := ThrottlerPool.AddConn(timeoutConn)
-		if err != nil {
-			return nil, errors.WithStack(err)
+// DefaultTimeouts returns the timeouts used by NewDefaultClient
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect: DefaultConnectTimeout,
+		Idle:    DefaultIdleTimeout,
+	}
+}
+
+func timeoutDialer(timeouts Timeouts) func(ctx context.Context, net, addr string) (net.Conn, error) {
+	return func(ctx context.Context, netw, addr string) (net.Conn, error) {
+		// so that closing idle connections doesn't wait for their
+		// pending reads to time out, see eagerCloseConn
+		return DialContext(ctx, timeouts, netw, addr)
+	}
+}
+
+// dialMonitored returns a connection that's throttled, monitored, and
+// closed when idle, along with the connection it wraps. Without an
+// idle timeout, both are the same.
+func dialMonitored(ctx context.Context, timeouts Timeouts, netw, addr string) (net.Conn, net.Conn, error) {
+	if simulateOffline {
+		return nil, nil, &net.OpError{
+			Op:  "dial",
+			Err: errors.New("simulated offline"),
 		}
-		// measure bps
-		monitorConn := &monitoringConn{
-			Conn: throttledConn,
+	}
+
+	// if it takes too long to establish a connection, give up
+	timeoutConn, err := dial(ctx, timeouts, netw, addr)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// respect global throttle settings
+	throttledConn, err := ThrottlerPool.AddConn(timeoutConn)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	// measure bps
+	monitorConn := &monitoringConn{
+		Conn: throttledConn,
+	}
+
+	if timeouts.Idle <= 0 {
+		return monitorConn, monitorConn, nil
+	}
+
+	// if we stay idle too long, close
+	idleConn := idletiming.Conn(monitorConn, timeouts.Idle, func() {
+		monitorConn.Close()
+	})
+
+	return idleConn, monitorConn, nil
+}
+
+// DialContext connects to addr like a timeout client would: it enforces
+// timeouts, respects global throttle settings, and closes the connection
+// if it stays idle for too long. It's useful for non-HTTP protocols.
+func DialContext(ctx context.Context, timeouts Timeouts, network, addr string) (net.Conn, error) {
+	idleConn, monitorConn, err := dialMonitored(ctx, timeouts, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if idleConn == monitorConn {
+		return monitorConn, nil
+	}
+	return &eagerCloseConn{Conn: idleConn, inner: monitorConn}, nil
+}
+
+// eagerCloseConn closes the wrapped connection first, since closing an
+// idletiming conn otherwise waits for pending reads to time out.
+type eagerCloseConn struct {
+	net.Conn
+	inner net.Conn
+}
+
+func (ec *eagerCloseConn) Close() error {
+	ec.inner.Close()
+	return ec.Conn.Close()
+}
+
+// dial resolves addr within the DNS timeout, if any, then
+// connects to the resulting addresses in turn.
+func dial(ctx context.Context, timeouts Timeouts, netw, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeouts.Connect}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || timeouts.DNS <= 0 || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, netw, addr)
+	}
+
+	dnsCtx, cancel := context.WithTimeout(ctx, timeouts.DNS)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupHost(dnsCtx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, netw, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
 		}
-		// if we stay idle too long, close
-		idleConn := idletiming.Conn(monitorConn, rwTimeout, func() {
-			monitorConn.Close()
-		})
-		return idleConn, nil
+		lastErr = err
 	}
+	return nil, lastErr
 }
 
 // NewClient returns a new http client with custom connect and r/w timeouts.
 func NewClient(connectTimeout time.Duration, readWriteTimeout time.Duration) *http.Client {
+	return NewClientWithTimeouts(Timeouts{
+		Connect: connectTimeout,
+		Idle:    readWriteTimeout,
+	})
+}
+
+// NewClientWithTimeouts returns a new http client that enforces
+// separate limits on each phase of a request, see Timeouts.
+func NewClientWithTimeouts(timeouts Timeouts) *http.Client {
+	connTimeouts := timeouts
+	if timeouts.ResponseHeader > 0 && timeouts.Idle > 0 {
+		// waiting for headers looks idle to the connection, so only use
+		// the connection's idle timeout as a backstop, and enforce the
+		// real one on bodies.
+		connTimeouts.Idle = timeouts.Idle + timeouts.ResponseHeader
+	}
+
 	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		Dial:  timeoutDialer(connectTimeout, readWriteTimeout),
+		Proxy:                 proxyForRequest,
+		DialContext:           timeoutDialer(connTimeouts),
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
 	}
+
 	if IgnoreCertificateErrors {
 		transport.TLSClientConfig = &tls.Config{
 			InsecureSkipVerify: true,
@@ -106,6 +224,15 @@ func NewClient(connectTimeout time.Duration, readWriteTimeout time.Duration) *ht
 		log.Printf("Could not configure transport for http/2: %+v", err)
 	}
 
+	if timeouts.ResponseHeader > 0 && timeouts.Idle > 0 {
+		return &http.Client{
+			Transport: &idleTransport{
+				transport: transport,
+				idle:      timeouts.Idle,
+			},
+		}
+	}
+
 	return &http.Client{
 		Transport: transport,
 	}
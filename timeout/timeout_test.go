@@ -0,0 +1,113 @@
+package timeout_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/itchio/httpkit/neterr"
+	"github.com/itchio/httpkit/timeout"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Timeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-headers":
+			time.Sleep(500 * time.Millisecond)
+			w.WriteHeader(200)
+		case "/slow-body":
+			w.Header().Set("content-length", "8")
+			w.WriteHeader(200)
+			w.Write([]byte("aaaa"))
+			w.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte("bbbb"))
+		}
+	}))
+	defer server.Close()
+
+	get := func(timeouts timeout.Timeouts, path string) error {
+		c := timeout.NewClientWithTimeouts(timeouts)
+		res, err := c.Get(server.URL + path)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, err = ioutil.ReadAll(res.Body)
+		return err
+	}
+
+	// slow to respond, but then quick to finish
+	timeouts := timeout.DefaultTimeouts()
+	timeouts.Idle = 100 * time.Millisecond
+	timeouts.ResponseHeader = time.Second
+	assert.NoError(get(timeouts, "/slow-headers"), "waiting on headers isn't idle time")
+
+	timeouts.ResponseHeader = 100 * time.Millisecond
+	err := get(timeouts, "/slow-headers")
+	t.Logf("%v", err)
+	assert.Error(err)
+	assert.True(neterr.IsNetworkError(err))
+
+	// quick to respond, then stalls
+	timeouts = timeout.DefaultTimeouts()
+	timeouts.ResponseHeader = 100 * time.Millisecond
+	timeouts.Idle = time.Second
+	assert.NoError(get(timeouts, "/slow-body"))
+
+	timeouts.Idle = 100 * time.Millisecond
+	err = get(timeouts, "/slow-body")
+	t.Logf("%v", err)
+	assert.Error(err)
+	assert.True(neterr.IsNetworkError(err))
+
+	// zero means not limited
+	assert.NoError(get(timeout.Timeouts{}, "/slow-body"))
+	assert.NoError(get(timeout.Timeouts{Connect: time.Second}, "/slow-headers"))
+}
+
+func Test_WithProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("from proxy"))
+	}))
+	defer proxy.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from origin"))
+	}))
+	defer origin.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(err)
+
+	client := timeout.NewDefaultClient()
+	get := func(ctx context.Context) string {
+		req, err := http.NewRequest("GET", origin.URL+"/file", nil)
+		assert.NoError(err)
+		res, err := client.Do(req.WithContext(ctx))
+		assert.NoError(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		assert.NoError(err)
+		return string(body)
+	}
+
+	ctx := timeout.WithProxy(context.Background(), http.ProxyURL(proxyURL))
+	assert.EqualValues("from proxy", get(ctx))
+	assert.EqualValues([]string{origin.URL + "/file"}, proxied)
+
+	ctx = timeout.WithProxy(context.Background(), timeout.NoProxy)
+	assert.EqualValues("from origin", get(ctx))
+	assert.Len(proxied, 1)
+}
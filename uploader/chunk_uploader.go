@@ -31,9 +31,27 @@ type chunkUploader struct {
 	// internal
 	offset int64
 	total  int64
+	// bytes already committed by an earlier session, that
+	// we skip instead of sending again
+	skip int64
 }
 
 func (cu *chunkUploader) put(buf []byte, last bool) error {
+	if cu.skip > 0 {
+		skipped := cu.skip
+		if skipped > int64(len(buf)) {
+			skipped = int64(len(buf))
+		}
+		cu.offset += skipped
+		cu.skip -= skipped
+		buf = buf[skipped:]
+
+		if len(buf) == 0 {
+			cu.debugf("✓ Skipped %d bytes, already committed", skipped)
+			return nil
+		}
+	}
+
 	retryCtx := cu.newRetryContext()
 
 	for retryCtx.ShouldTry() {
@@ -217,6 +235,64 @@ func (cu *chunkUploader) tryQueryStatus() (*http.Response, error) {
 	return nil, errors.Errorf("while querying status, got HTTP %s (status %s)", res.Status, status)
 }
 
+// queryCommitted asks the server how much of the upload it has already
+// stored, so uploads can be resumed across process restarts.
+func (cu *chunkUploader) queryCommitted() (committed int64, complete bool, err error) {
+	retryCtx := cu.newRetryContext()
+	for retryCtx.ShouldTry() {
+		committed, complete, err = cu.tryQueryCommitted()
+		if err != nil {
+			if _, ok := err.(*netError); ok {
+				cu.debugf("while querying committed bytes: %s", err.Error())
+				retryCtx.Retry(err)
+				continue
+			}
+			return 0, false, err
+		}
+		return committed, complete, nil
+	}
+
+	return 0, false, errors.Errorf("gave up on trying to get committed bytes")
+}
+
+func (cu *chunkUploader) tryQueryCommitted() (int64, bool, error) {
+	req, err := http.NewRequest("PUT", cu.uploadURL, nil)
+	if err != nil {
+		return 0, false, errors.WithStack(err)
+	}
+	req.Header.Set("content-range", "bytes */*")
+
+	res, err := cu.httpClient.Do(req)
+	if err != nil {
+		return 0, false, &netError{err, gcsUnknown}
+	}
+	res.Body.Close()
+
+	switch status := interpretGcsStatusCode(res.StatusCode); status {
+	case gcsUploadComplete:
+		return 0, true, nil
+	case gcsResume:
+		rangeHeader := res.Header.Get("Range")
+		if rangeHeader == "" {
+			// nothing committed yet
+			return 0, false, nil
+		}
+
+		committedRange, err := parseRangeHeader(rangeHeader)
+		if err != nil {
+			return 0, false, errors.Wrap(err, "in chunkUploader.tryQueryCommitted, while parsing range header")
+		}
+		if committedRange.start != 0 {
+			return 0, false, errors.Errorf("beginning not committed somehow (committed range: %s)", committedRange)
+		}
+		return committedRange.end, false, nil
+	case gcsNeedQuery:
+		return 0, false, &netError{nil, status}
+	default:
+		return 0, false, errors.Errorf("while querying committed bytes, got HTTP %s (status %s)", res.Status, status)
+	}
+}
+
 func (cu *chunkUploader) debugf(msg string, args ...interface{}) {
 	if cu.consumer != nil {
 		fmsg := fmt.Sprintf(msg, args...)
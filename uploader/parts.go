@@ -0,0 +1,154 @@
+package uploader
+
+import (
+	"io"
+	"sync"
+
+	"github.com/itchio/httpkit/timeout"
+	"github.com/pkg/errors"
+)
+
+// UploadParts uploads size bytes from r over several connections at once.
+// The data is split into len(uploadURLs) consecutive parts, each uploaded
+// to its own resumable upload session, as for a composite upload: the
+// resulting objects are meant to be composed by the caller afterwards.
+//
+// Each part is retried on its own, and parts are resumed from wherever
+// their session left off, so calling UploadParts again with the same
+// sessions after a failure (or a process restart) only sends what's missing.
+func UploadParts(uploadURLs []string, r io.ReaderAt, size int64, opts ...Option) error {
+	s := defaultSettings()
+	for _, o := range opts {
+		o.Apply(s)
+	}
+
+	numParts := int64(len(uploadURLs))
+	if numParts == 0 {
+		return errors.Errorf("in UploadParts: no upload URLs")
+	}
+
+	// all parts but the last must be a multiple of the chunk size
+	numChunks := (size + gcsChunkSize - 1) / gcsChunkSize
+	partChunks := (numChunks + numParts - 1) / numParts
+	partSize := partChunks * gcsChunkSize
+	if partSize*(numParts-1) >= size {
+		return errors.Errorf("in UploadParts: %d bytes is too small to split into %d parts", size, numParts)
+	}
+
+	maxConns := s.MaxConns
+	if maxConns <= 0 || maxConns > len(uploadURLs) {
+		maxConns = len(uploadURLs)
+	}
+
+	pu := &partsUpload{
+		settings: s,
+		progress: make([]int64, numParts),
+	}
+
+	sem := make(chan struct{}, maxConns)
+	errs := make(chan error, numParts)
+	var wg sync.WaitGroup
+
+	for i, uploadURL := range uploadURLs {
+		start := int64(i) * partSize
+		end := start + partSize
+		if end > size {
+			end = size
+		}
+
+		wg.Add(1)
+		go func(i int, uploadURL string, start int64, end int64) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := pu.uploadPart(i, uploadURL, io.NewSectionReader(r, start, end-start))
+			if err != nil {
+				errs <- errors.Wrapf(err, "uploading part %d (bytes %d-%d)", i, start, end-1)
+			}
+		}(i, uploadURL, start, end)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// report the first error, other parts may have
+	// failed for the same reason.
+	for err := range errs {
+		return errors.Wrap(err, "in UploadParts")
+	}
+	return nil
+}
+
+type partsUpload struct {
+	settings *settings
+
+	progressMutex sync.Mutex
+	progress      []int64
+}
+
+func (pu *partsUpload) uploadPart(index int, uploadURL string, part *io.SectionReader) error {
+	cu := &chunkUploader{
+		uploadURL:  uploadURL,
+		httpClient: timeout.NewClient(resumableConnectTimeout, resumableIdleTimeout),
+		id:         index,
+		consumer:   pu.settings.Consumer,
+	}
+	cu.progressListener = func(count int64) {
+		pu.reportProgress(index, count)
+	}
+
+	committed, complete, err := cu.queryCommitted()
+	if err != nil {
+		return errors.Wrap(err, "while querying committed bytes")
+	}
+	if complete {
+		cu.debugf("✓ Part already uploaded")
+		pu.reportProgress(index, part.Size())
+		return nil
+	}
+	if committed > 0 {
+		cu.debugf("Resuming part, %d bytes already committed", committed)
+		cu.offset = committed
+		pu.reportProgress(index, committed)
+	}
+
+	groupSize := int64(pu.settings.MaxChunkGroup) * rblockSize
+	buf := make([]byte, groupSize)
+
+	for cu.offset < part.Size() {
+		n := part.Size() - cu.offset
+		if n > groupSize {
+			n = groupSize
+		}
+
+		_, err := part.ReadAt(buf[:n], cu.offset)
+		if err != nil && err != io.EOF {
+			return errors.WithStack(err)
+		}
+
+		last := cu.offset+n == part.Size()
+		err = cu.put(buf[:n], last)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (pu *partsUpload) reportProgress(index int, count int64) {
+	listener := pu.settings.ProgressListener
+	if listener == nil {
+		return
+	}
+
+	pu.progressMutex.Lock()
+	defer pu.progressMutex.Unlock()
+
+	pu.progress[index] = count
+	var total int64
+	for _, p := range pu.progress {
+		total += p
+	}
+	listener(total)
+}
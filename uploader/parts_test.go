@@ -0,0 +1,181 @@
+package uploader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSession struct {
+	data     []byte
+	complete bool
+	received int64
+}
+
+// fakeSessions serves any number of resumable upload sessions, one per path
+type fakeSessions struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	sessions map[string]*fakeSession
+}
+
+func (fs *fakeSessions) session(path string) *fakeSession {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	s, ok := fs.sessions[path]
+	if !ok {
+		s = &fakeSession{}
+		fs.sessions[path] = s
+	}
+	return s
+}
+
+func makeSessionsServer(t *testing.T) *fakeSessions {
+	fs := &fakeSessions{
+		sessions: make(map[string]*fakeSession),
+	}
+
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := fs.session(r.URL.Path)
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		contentRange := strings.TrimPrefix(r.Header.Get("content-range"), "bytes ")
+		slashTokens := strings.Split(contentRange, "/")
+
+		if slashTokens[0] != "*" {
+			if s.complete {
+				w.WriteHeader(400)
+				return
+			}
+
+			start, err := strconv.ParseInt(strings.Split(slashTokens[0], "-")[0], 10, 64)
+			tmust(t, err)
+			if start != int64(len(s.data)) {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "expected upload at %d, got %d", len(s.data), start)
+				return
+			}
+
+			buf, err := ioutil.ReadAll(r.Body)
+			tmust(t, err)
+			s.data = append(s.data, buf...)
+			s.received += int64(len(buf))
+			if slashTokens[1] != "*" {
+				s.complete = true
+			}
+		}
+
+		if s.complete {
+			w.WriteHeader(200)
+			return
+		}
+		if len(s.data) > 0 {
+			w.Header().Set("range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+		}
+		w.WriteHeader(308)
+	}))
+
+	return fs
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(0xf00d)).Read(data)
+	return data
+}
+
+func Test_UploadParts(t *testing.T) {
+	assert := assert.New(t)
+
+	server := makeSessionsServer(t)
+	defer server.Close()
+
+	data := randomData(2*1024*1024 + 1234)
+	var urls []string
+	for i := 0; i < 3; i++ {
+		urls = append(urls, fmt.Sprintf("%s/part-%d", server.URL, i))
+	}
+
+	var lastProgress int64
+	var progressMutex sync.Mutex
+	err := UploadParts(urls, bytes.NewReader(data), int64(len(data)),
+		WithMaxChunkGroup(2),
+		WithProgressListener(func(count int64) {
+			progressMutex.Lock()
+			lastProgress = count
+			progressMutex.Unlock()
+		}))
+	tmust(t, err)
+
+	var uploaded []byte
+	for i := 0; i < 3; i++ {
+		s := server.session(fmt.Sprintf("/part-%d", i))
+		assert.True(s.complete)
+		if i < 2 {
+			assert.EqualValues(0, len(s.data)%gcsChunkSize, "non-last parts are whole chunks")
+		}
+		uploaded = append(uploaded, s.data...)
+	}
+	assert.Equal(data, uploaded)
+	assert.EqualValues(len(data), lastProgress)
+
+	err = UploadParts(urls, bytes.NewReader(data[:1024]), 1024)
+	assert.Error(err, "can't split tiny uploads in many parts")
+}
+
+func Test_UploadPartsResume(t *testing.T) {
+	assert := assert.New(t)
+
+	server := makeSessionsServer(t)
+	defer server.Close()
+
+	data := randomData(2 * 1024 * 1024)
+	partSize := len(data) / 2
+	urls := []string{server.URL + "/part-0", server.URL + "/part-1"}
+
+	// an earlier process got part of the way there
+	first := server.session("/part-0")
+	first.data = append([]byte{}, data[:gcsChunkSize]...)
+	second := server.session("/part-1")
+	second.data = append([]byte{}, data[partSize:]...)
+	second.complete = true
+
+	tmust(t, UploadParts(urls, bytes.NewReader(data), int64(len(data))))
+
+	assert.Equal(data[:partSize], first.data)
+	assert.True(first.complete)
+	assert.EqualValues(partSize-gcsChunkSize, first.received, "only missing bytes are sent")
+	assert.EqualValues(0, second.received)
+}
+
+func Test_ResumableUploadResume(t *testing.T) {
+	assert := assert.New(t)
+
+	server := makeSessionsServer(t)
+	defer server.Close()
+
+	data := randomData(1024*1024 + 100)
+	s := server.session("/upload")
+	s.data = append([]byte{}, data[:2*gcsChunkSize]...)
+
+	ru := NewResumableUpload(server.URL+"/upload", WithResume())
+	_, err := ru.Write(data)
+	tmust(t, err)
+	tmust(t, ru.Close())
+
+	assert.True(s.complete)
+	assert.Equal(data, s.data)
+	assert.EqualValues(len(data)-2*gcsChunkSize, s.received, "only missing bytes are sent")
+}
@@ -14,6 +14,7 @@ import (
 
 type resumableUpload struct {
 	maxChunkGroup    int
+	resume           bool
 	consumer         *state.Consumer
 	progressListener ProgressListenerFunc
 
@@ -65,6 +66,7 @@ func NewResumableUpload(uploadURL string, opts ...Option) ResumableUpload {
 
 	ru := &resumableUpload{
 		maxChunkGroup: s.MaxChunkGroup,
+		resume:        s.Resume,
 
 		err:           nil,
 		pushedErr:     make(chan struct{}, 0),
@@ -75,6 +77,12 @@ func NewResumableUpload(uploadURL string, opts ...Option) ResumableUpload {
 		id:            id,
 	}
 	ru.splitBuf.Grow(rblockSize)
+	if s.Consumer != nil {
+		ru.SetConsumer(s.Consumer)
+	}
+	if s.ProgressListener != nil {
+		ru.SetProgressListener(s.ProgressListener)
+	}
 
 	go ru.work()
 
@@ -100,8 +108,10 @@ func (ru *resumableUpload) Write(buf []byte) (int, error) {
 		if availWrite == 0 {
 			// flush!
 			data := sb.Bytes()
-			ru.blocks <- &rblock{
-				data: append([]byte{}, data...),
+			select {
+			case ru.blocks <- &rblock{data: append([]byte{}, data...)}:
+			case <-ru.pushedErr:
+				return 0, ru.checkError()
 			}
 			sb.Reset()
 			availWrite = sb.Cap()
@@ -133,8 +143,10 @@ func (ru *resumableUpload) Close() error {
 
 	// flush!
 	data := ru.splitBuf.Bytes()
-	ru.blocks <- &rblock{
-		data: append([]byte{}, data...),
+	select {
+	case ru.blocks <- &rblock{data: append([]byte{}, data...)}:
+	case <-ru.pushedErr:
+		return ru.checkError()
 	}
 	close(ru.blocks)
 
@@ -164,6 +176,20 @@ func (ru *resumableUpload) SetProgressListener(progressListener ProgressListener
 func (ru *resumableUpload) work() {
 	defer close(ru.done)
 
+	if ru.resume {
+		committed, complete, err := ru.chunkUploader.queryCommitted()
+		if err != nil {
+			ru.pushError(errors.Wrap(err, "while resuming upload"))
+			return
+		}
+		if complete {
+			ru.pushError(errors.Errorf("cannot resume upload: it's already complete"))
+			return
+		}
+		ru.debugf("Resuming upload, %d bytes already committed", committed)
+		ru.chunkUploader.skip = committed
+	}
+
 	sendBuf := new(bytes.Buffer)
 	sendBuf.Grow(ru.maxChunkGroup * rblockSize)
 	var chunkGroupSize int
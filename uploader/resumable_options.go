@@ -1,7 +1,13 @@
 package uploader
 
+import "github.com/itchio/headway/state"
+
 type settings struct {
-	MaxChunkGroup int
+	MaxChunkGroup    int
+	Resume           bool
+	MaxConns         int
+	Consumer         *state.Consumer
+	ProgressListener ProgressListenerFunc
 }
 
 func defaultSettings() *settings {
@@ -35,3 +41,72 @@ func WithMaxChunkGroup(maxChunkGroup int) *maxChunkGroupOption {
 func (o *maxChunkGroupOption) Apply(s *settings) {
 	s.MaxChunkGroup = o.maxChunkGroup
 }
+
+// ---------
+
+type resumeOption struct{}
+
+// WithResume makes an upload first ask the server how much of it was
+// already stored (by an earlier process, using the same upload URL), and
+// skip over that much of what's written to it. Callers are expected to
+// write the same data from the start.
+func WithResume() *resumeOption {
+	return &resumeOption{}
+}
+
+func (o *resumeOption) Apply(s *settings) {
+	s.Resume = true
+}
+
+// ---------
+
+type maxConnsOption struct {
+	maxConns int
+}
+
+// WithMaxConns specifies how many parts UploadParts sends at the
+// same time. The default is to send all parts at once.
+func WithMaxConns(maxConns int) *maxConnsOption {
+	return &maxConnsOption{
+		maxConns: maxConns,
+	}
+}
+
+func (o *maxConnsOption) Apply(s *settings) {
+	s.MaxConns = o.maxConns
+}
+
+// ---------
+
+type consumerOption struct {
+	consumer *state.Consumer
+}
+
+// WithConsumer specifies where debug messages are sent
+func WithConsumer(consumer *state.Consumer) *consumerOption {
+	return &consumerOption{
+		consumer: consumer,
+	}
+}
+
+func (o *consumerOption) Apply(s *settings) {
+	s.Consumer = o.consumer
+}
+
+// ---------
+
+type progressListenerOption struct {
+	progressListener ProgressListenerFunc
+}
+
+// WithProgressListener specifies a function called with the total number
+// of bytes uploaded so far (across all parts, for UploadParts).
+func WithProgressListener(progressListener ProgressListenerFunc) *progressListenerOption {
+	return &progressListenerOption{
+		progressListener: progressListener,
+	}
+}
+
+func (o *progressListenerOption) Apply(s *settings) {
+	s.ProgressListener = o.progressListener
+}